@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SegmentAppender writes data chunks to a segment, writing the segment to a
+// Sink, and starting a new one, whenever it runs out of space. It is the
+// same "write, flush, and retry" loop a *Logger uses, for components (such
+// as Sink middleware, and tests) that manage their own segments.
+//
+// Unlike a *Logger, a SegmentAppender does not buffer segments that could
+// not be written: if the Sink fails to write a full segment, the error is
+// returned, and the segment is kept, to be written on the next call to
+// Append, or Flush.
+type SegmentAppender struct {
+	sink Sink
+	size uint64
+
+	mu  sync.Mutex
+	seg *Segment
+}
+
+// NewSegmentAppender returns a *SegmentAppender that writes segments of
+// size bytes to sink.
+func NewSegmentAppender(sink Sink, size uint64) (*SegmentAppender, error) {
+	if sink == nil {
+		return nil, errors.New("nil sink")
+	}
+	if size == 0 || size > MaxSegmentSize {
+		return nil, errors.Errorf("segment size must be between 1 and %d", MaxSegmentSize)
+	}
+	return &SegmentAppender{
+		sink: sink,
+		size: size,
+		seg:  NewSegmentSize(size),
+	}, nil
+}
+
+// Append writes p to the current segment as a new data chunk, and returns
+// its offset. If the current segment does not have enough space for p, it
+// is written to the Sink first, and p is written to a new segment.
+//
+// If p is larger than a segment, Append returns ErrTooBig.
+func (a *SegmentAppender) Append(p []byte) (Offset, error) {
+	if uint64(len(p)) > a.size {
+		return ZeroOffset, ErrTooBig
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	off, err := appendFlushing(func() *Segment { return a.seg }, p, nil, a.flush)
+	if err != nil {
+		return ZeroOffset, errors.Wrap(err, "append")
+	}
+	return off, nil
+}
+
+// Flush writes the current segment to the Sink, if it holds any data
+// chunks, and starts a new one.
+func (a *SegmentAppender) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.flush()
+}
+
+func (a *SegmentAppender) flush() error {
+	if a.seg.Chunks() == 0 {
+		return nil
+	}
+	if err := a.sink.WriteSegment(a.seg); err != nil {
+		return errors.Wrap(err, "write segment")
+	}
+	seg := NewSegmentSize(a.size)
+	seg.last = a.seg.last // Keep offsets increasing across segments.
+	a.seg = seg
+	return nil
+}
+
+// appendFlushing writes p, and the encoded chunk attributes hdr, to the
+// segment returned by seg, as a new data chunk. Whenever the segment does
+// not have enough space, flush is called (which is expected to start a new
+// segment), and the write is retried.
+//
+// The caller must ensure p, and hdr, fit in an empty segment.
+func appendFlushing[D chunkData](seg func() *Segment, p D, hdr []byte, flush func() error) (Offset, error) {
+	for {
+		off, err := writeSegmentHeader(seg(), p, hdr)
+		if err != ErrNotEnoughSpace {
+			return off, err
+		}
+		if err := flush(); err != nil {
+			return ZeroOffset, err
+		}
+	}
+}
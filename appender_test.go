@@ -0,0 +1,40 @@
+package wal
+
+import "testing"
+
+func TestSegmentAppender(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two chunks of 10 bytes each (see newChunkHeader).
+	a, err := NewSegmentAppender(sink, uint64(2*(chunkOffsetSize+1+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prev Offset
+	for i := 0; i < 5; i++ {
+		off, err := a.Append([]byte{'a' + byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !off.After(prev) {
+			t.Errorf("offset %v is not after previous offset %v", off, prev)
+		}
+		prev = off
+	}
+	if n := sink.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments written: want=2 got=%d", n)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, sink); n != 5 {
+		t.Errorf("wrong number of chunks: want=5 got=%d", n)
+	}
+
+	if _, err := a.Append(make([]byte, 64)); err != ErrTooBig {
+		t.Errorf("wrong error: want=%v got=%v", ErrTooBig, err)
+	}
+}
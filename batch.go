@@ -0,0 +1,273 @@
+package wal
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrSplitBatch is returned by a *Logger's Truncate, and TruncateAfter
+// methods when the offset to truncate at falls between the first, and last
+// records of a batch that has been written to a segment (see BatchRecords).
+// A batch is stored as a single data chunk, so it cannot be truncated in
+// part; truncate at the offset of a record outside of the batch, or of its
+// last record.
+var ErrSplitBatch = errors.New("wal: truncation offset splits a batch")
+
+// batchRecordLimit is the size records written to a *Logger must be
+// smaller than to be batched; see the BatchRecords option.
+const batchRecordLimit = 100
+
+// batchRecord is a record held in a *Logger's open batch, until the batch
+// is written to the active segment.
+type batchRecord struct {
+	off  Offset
+	data []byte
+}
+
+// A batch of records is written to a segment as a single data chunk, with
+// the "batch" attribute set to the number of records in it. The chunk's
+// offset is that of the last record in the batch, and its data holds each
+// record, in order, as:
+//
+//	gap (uvarint) | length (uvarint) | data
+//
+// where gap is the difference between the offset of the next record in the
+// batch, and that of the record itself; the gap of the last record is zero.
+// Each record's offset is after that of the data chunk before the batch, so
+// a batch covers the offsets between the two chunks.
+
+// encodeBatch encodes recs as the data of a batch chunk. size is the
+// encoded size of recs (see batchEntrySize).
+func encodeBatch(recs []batchRecord, size int) []byte {
+	p := make([]byte, 0, size)
+	for i, rec := range recs {
+		var gap uint64
+		if i+1 < len(recs) {
+			gap = uint64(recs[i+1].off - rec.off)
+		}
+		p = binary.AppendUvarint(p, gap)
+		p = binary.AppendUvarint(p, uint64(len(rec.data)))
+		p = append(p, rec.data...)
+	}
+	return p
+}
+
+// decodeBatch returns the n records held in p, the data of a batch chunk
+// at offset off. The records' data is not copied.
+func decodeBatch(off Offset, n int, p []byte) ([]Record, error) {
+	// Each record takes at least two bytes.
+	if n < 1 || n > len(p)/2 {
+		return nil, errors.Errorf("invalid batch size %d", n)
+	}
+	recs := make([]Record, n)
+	gaps := make([]uint64, n)
+	for i := range recs {
+		gap, k := binary.Uvarint(p)
+		if k <= 0 {
+			return nil, errors.Errorf("record %d: malformed gap", i)
+		}
+		p = p[k:]
+		size, k := binary.Uvarint(p)
+		if k <= 0 || size > uint64(len(p)-k) {
+			return nil, errors.Errorf("record %d: malformed length", i)
+		}
+		p = p[k:]
+		recs[i].Data, p = p[:size:size], p[size:]
+		if (gap == 0) != (i == n-1) {
+			return nil, errors.Errorf("record %d: offsets out of order", i)
+		}
+		gaps[i] = gap
+	}
+	if len(p) > 0 {
+		return nil, errors.Errorf("%d trailing bytes", len(p))
+	}
+
+	// Work back from the last record, whose offset is that of the chunk.
+	for i := n - 1; i >= 0; i-- {
+		recs[i].Offset = off
+		if i > 0 {
+			off -= Offset(gaps[i-1])
+		}
+	}
+	return recs, nil
+}
+
+// batchEntrySize returns the encoded size of a record of n bytes, with the
+// given gap, in a batch chunk.
+func batchEntrySize(gap uint64, n int) int {
+	return uvarintLen(gap) + uvarintLen(uint64(n)) + n
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// batchHeader returns the encoded attributes of a batch chunk of n
+// records, whose records were written with the attributes attrs.
+func batchHeader(attrs chunkAttrs, n int) []byte {
+	a := make(chunkAttrs, len(attrs)+1)
+	for k, v := range attrs {
+		a[k] = v
+	}
+	a[attrBatch] = strconv.Itoa(n)
+	return a.encode()
+}
+
+// batchFits reports whether a batch chunk of n records, written with the
+// attributes attrs, and whose records take size bytes, fits in space bytes.
+func (l *Logger) batchFits(n, size int, attrs chunkAttrs, space int64) bool {
+	hdr := batchHeader(attrs, n)
+	return int64(size+len(hdr)+l.sealer.overhead(hdr)) <= space
+}
+
+// appendBatch adds p, written with the data chunk attributes attrs, to the
+// *Logger's open batch, and returns its offset. The batch is written to the
+// active segment first if it is full, older than the batch window, or its
+// records were written with different attributes. It must be called while
+// holding l.mu.
+//
+// The open batch always fits in the active segment, so that it can be
+// written to it without flushing.
+func (l *Logger) appendBatch(p []byte, attrs chunkAttrs) (Offset, error) {
+	if n := len(l.batch); n > 0 {
+		if n >= l.batchMax || time.Since(l.batchStart) >= l.batchWindow ||
+			string(attrs.encode()) != string(l.batchAttrs.encode()) {
+			if err := l.closeBatch(); err != nil {
+				return ZeroOffset, err
+			}
+		}
+	}
+
+	off := l.seg.reserveOffset()
+	for {
+		n := len(l.batch)
+		if n == 0 {
+			l.batchAttrs, l.batchStart = attrs, time.Now()
+		}
+		size := l.batchSize + batchEntrySize(0, len(p))
+		if n > 0 {
+			size += uvarintLen(uint64(off-l.batch[n-1].off)) - 1
+		}
+		if l.batchFits(n+1, size, attrs, l.seg.Remaining()) {
+			l.batch = append(l.batch, batchRecord{off: off, data: p})
+			l.batchSize = size
+			return off, nil
+		}
+
+		// Write out the open batch, or if there is none, the active
+		// segment, to make room.
+		if n > 0 {
+			if err := l.closeBatch(); err != nil {
+				return ZeroOffset, err
+			}
+			continue
+		}
+		if err := l.writeFlush(); err != nil {
+			return ZeroOffset, err
+		}
+	}
+}
+
+// closeBatch writes the *Logger's open batch, if any, to the active segment,
+// as a single data chunk. It must be called while holding l.mu.
+func (l *Logger) closeBatch() error {
+	n := len(l.batch)
+	if n == 0 {
+		return nil
+	}
+	p := encodeBatch(l.batch, l.batchSize)
+	if err := writeSegmentAt(l.seg, l.batch[n-1].off, p, batchHeader(l.batchAttrs, n)); err != nil {
+		return errors.Wrap(err, "write batch")
+	}
+	l.batch, l.batchSize = nil, 0
+	return nil
+}
+
+// truncateBatch removes the records for which drop returns true from the
+// *Logger's open batch. It must be called while holding l.mu.
+func (l *Logger) truncateBatch(drop func(off Offset) bool) {
+	batch := l.batch[:0]
+	for _, rec := range l.batch {
+		if !drop(rec.off) {
+			batch = append(batch, rec)
+		}
+	}
+	for i := len(batch); i < len(l.batch); i++ {
+		l.batch[i] = batchRecord{}
+	}
+	l.batch = batch
+
+	l.batchSize = 0
+	for i, rec := range l.batch {
+		var gap uint64
+		if i+1 < len(l.batch) {
+			gap = uint64(l.batch[i+1].off - rec.off)
+		}
+		l.batchSize += batchEntrySize(gap, len(rec.data))
+	}
+}
+
+// checkSplit returns an error wrapping ErrSplitBatch if offset falls inside
+// a batch written to the *Logger's Sink, any segments waiting to be written
+// to it, or the active segment. It must be called while holding l.mu.
+//
+// Only the first data chunk after offset can hold records at, or before it,
+// so that is the only one checked.
+func (l *Logger) checkSplit(offset Offset) error {
+	seg, err := l.sink.LoadSegment(offset + 1)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "load segment")
+	}
+	segs := append([]*Segment{seg}, l.pending...)
+	for _, seg := range append(segs, l.seg) {
+		if seg == nil {
+			continue
+		}
+		for i := 0; i < seg.Chunks(); i++ {
+			if c := seg.chunkAt(i); c.Offset().After(offset) {
+				return l.checkBatchSplit(c, offset)
+			}
+		}
+	}
+	return nil
+}
+
+// checkBatchSplit returns an error wrapping ErrSplitBatch if c is a batch,
+// and offset falls before its last record, but not before its first. An
+// encrypted batch that the *Logger cannot decrypt is taken to be split.
+func (l *Logger) checkBatchSplit(c chunk, offset Offset) error {
+	attrs := c.attrs()
+	n, ok := attrs[attrBatch]
+	if !ok {
+		return nil
+	}
+	size, err := strconv.Atoi(n)
+	if err != nil {
+		return errors.Wrapf(err, "batch at offset %v: parse batch size", c.Offset())
+	}
+	p := c.Data()
+	if attrs[attrSealed] != "" {
+		if l.sealer == nil {
+			return errors.Wrapf(ErrSplitBatch, "encrypted batch ending at offset %v", c.Offset())
+		}
+		if p, err = l.sealer.open(c); err != nil {
+			return errors.Wrapf(err, "batch at offset %v", c.Offset())
+		}
+	}
+	recs, err := decodeBatch(c.Offset(), size, p)
+	if err != nil {
+		return errors.Wrapf(err, "batch at offset %v", c.Offset())
+	}
+	if first := recs[0].Offset; !first.After(offset) {
+		return errors.Wrapf(ErrSplitBatch, "batch at offsets %v-%v", first, c.Offset())
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestLoggerBatchRecords(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, BatchRecords(time.Hour, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 25 small records make three batches, and a large record is written
+	// on its own, closing the last batch.
+	var (
+		offsets []Offset
+		records []string
+	)
+	for i := 0; i < 26; i++ {
+		rec := fmt.Sprintf("record %d", i)
+		if i == 25 {
+			rec = string(bytes.Repeat([]byte("x"), batchRecordLimit))
+		}
+		off, err := logger.Append([]byte(rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		records = append(records, rec)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	seg, err := sink.LoadSegment(ZeroOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := seg.Chunks(); n != 4 {
+		t.Errorf("want 4 data chunks, got %d", n)
+	}
+
+	r := NewReader(sink)
+	for i := 0; r.Next(); i++ {
+		if i >= len(records) {
+			t.Fatalf("too many records: %d", i+1)
+		}
+		if got := r.Offset(); got != offsets[i] {
+			t.Errorf("record %d: want offset %v, got %v", i, offsets[i], got)
+		}
+		if got := string(r.Data()); got != records[i] {
+			t.Errorf("record %d: want %q, got %q", i, records[i], got)
+		}
+		if attrs := r.Attrs(); attrs != nil {
+			t.Errorf("record %d: unexpected attributes %v", i, attrs)
+		}
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader can start in the middle of a batch.
+	r = NewReaderOffset(sink, offsets[14])
+	if !r.Next() {
+		t.Fatal("no records", r.Error())
+	}
+	if got := r.Offset(); got != offsets[14] {
+		t.Errorf("want offset %v, got %v", offsets[14], got)
+	}
+	if n := countChunks(t, sink); n != len(records) {
+		t.Errorf("want %d records, got %d", len(records), n)
+	}
+}
+
+func TestLoggerBatchRecordsTruncate(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, BatchRecords(time.Hour, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []Offset
+	for i := 0; i < 6; i++ {
+		off, err := logger.Append([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+
+	// Records in the open batch are truncated individually.
+	if err := logger.Truncate(offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.TruncateAfter(offsets[4]); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(sink)
+	var got []byte
+	for r.Next() {
+		got = append(got, r.Data()...)
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{2, 3, 4}; !bytes.Equal(got, want) {
+		t.Errorf("want records %v, got %v", want, got)
+	}
+}
+
+func TestLoggerBatchRecordsTruncateSplit(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, BatchRecords(time.Hour, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []Offset
+	for i := 0; i < 8; i++ {
+		// The first batch is flushed to the sink, and the second is
+		// closed in the active segment, by a record that is not batched.
+		p := []byte{byte(i)}
+		if i == 7 {
+			p = bytes.Repeat([]byte{byte(i)}, batchRecordLimit)
+		}
+		off, err := logger.Append(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		if i == 3 {
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Truncating in the middle of a written batch fails, rather than
+	// removing acknowledged records, or keeping truncated ones.
+	for _, off := range []Offset{offsets[0], offsets[2], offsets[4], offsets[5]} {
+		if err := logger.TruncateAfter(off); !errors.Is(err, ErrSplitBatch) {
+			t.Errorf("truncate after %v: want %v, got %v", off, ErrSplitBatch, err)
+		}
+		if err := logger.Truncate(off); !errors.Is(err, ErrSplitBatch) {
+			t.Errorf("truncate %v: want %v, got %v", off, ErrSplitBatch, err)
+		}
+	}
+
+	// Truncating at the last record of a batch removes it as a whole.
+	if err := logger.Truncate(offsets[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.TruncateAfter(offsets[6]); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(sink)
+	var got []byte
+	for r.Next() {
+		got = append(got, r.Data()...)
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{4, 5, 6}; !bytes.Equal(got, want) {
+		t.Errorf("want records %v, got %v", want, got)
+	}
+}
+
+func TestLoggerBatchRecordsEncrypted(t *testing.T) {
+	aead := newTestAEAD(t)
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, BatchRecords(time.Hour, 10), EncryptRecords(aead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"a", "b", "c"} {
+		if _, err := logger.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the key, the batch is returned whole.
+	if n := countChunks(t, sink); n != 1 {
+		t.Errorf("want 1 encrypted data chunk, got %d", n)
+	}
+
+	r := NewReader(sink)
+	r.Decrypt(aead)
+	var got string
+	for r.Next() {
+		got += string(r.Data())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if got != "abc" {
+		t.Errorf("want records %q, got %q", "abc", got)
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	recs := []batchRecord{{off: 10, data: []byte("a")}, {off: 12, data: nil}, {off: 300, data: []byte("bc")}}
+	var size int
+	for i, rec := range recs {
+		var gap uint64
+		if i+1 < len(recs) {
+			gap = uint64(recs[i+1].off - rec.off)
+		}
+		size += batchEntrySize(gap, len(rec.data))
+	}
+	p := encodeBatch(recs, size)
+	if len(p) != size {
+		t.Errorf("want %d bytes, got %d", size, len(p))
+	}
+
+	got, err := decodeBatch(300, len(recs), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rec := range got {
+		if rec.Offset != recs[i].off || !bytes.Equal(rec.Data, recs[i].data) {
+			t.Errorf("record %d: want %v %q, got %v %q", i, recs[i].off, recs[i].data, rec.Offset, rec.Data)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		n    int
+		p    []byte
+	}{
+		{"wrong count", 2, p},
+		{"truncated", 3, p[:len(p)-1]},
+		{"trailing bytes", 3, append(p[:len(p):len(p)], 0)},
+		{"unordered", 2, []byte{0, 0, 0, 0}},
+	} {
+		if _, err := decodeBatch(300, tc.n, tc.p); err == nil {
+			t.Errorf("%s: want error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package wal
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// KeyFunc extracts a key, such as a transaction ID, from the data in a data
+// chunk. A nil return value means the data chunk has no key.
+//
+// A KeyFunc is passed a data chunk's data as it is stored, so keys cannot
+// be extracted from data chunks written by a *Logger created with the
+// EncryptRecords, CompressRecords, or BatchRecords options, whose stored
+// data is not the record that was written; a *DirectorySink that extracts
+// keys (see BloomFilter, and IndexKeys) refuses to store them.
+type KeyFunc func(data []byte) []byte
+
+// ErrNotKeyable is returned when a data chunk whose stored data is not the
+// record that was written (such as an encrypted, compressed, or batched
+// one) is written to a Sink that extracts keys from data chunks with a
+// KeyFunc.
+var ErrNotKeyable = errors.New("wal: cannot extract keys from encrypted, compressed, or batched data chunks")
+
+// keyable reports whether c's stored data is the record that was written,
+// so that its key can be extracted with a KeyFunc.
+func keyable(c chunk) bool {
+	attrs := c.attrs()
+	for _, k := range []string{attrSealed, attrDeflate, attrBatch} {
+		if _, ok := attrs[k]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkKeyable returns an error wrapping ErrNotKeyable if any data chunk in
+// seg is not keyable.
+func checkKeyable(seg *Segment) error {
+	for i := 0; i < seg.Chunks(); i++ {
+		if c := seg.chunkAt(i); !keyable(c) {
+			return errors.Wrapf(ErrNotKeyable, "data chunk at offset %v", c.Offset())
+		}
+	}
+	return nil
+}
+
+// checkKeyOptions returns an error wrapping ErrNotKeyable if l writes data
+// chunks that are not keyable, to a Sink that extracts keys from them.
+func (l *Logger) checkKeyOptions(sink Sink) error {
+	ds, ok := sink.(*DirectorySink)
+	if !ok || (ds.keyFn == nil && ds.indexFn == nil) {
+		return nil
+	}
+	if l.sealer != nil || l.compressMin > 0 || l.batchMax > 0 {
+		return errors.Wrap(ErrNotKeyable, "sink extracts keys")
+	}
+	return nil
+}
+
+// KeyFilter defines the interface of a Sink that can quickly rule out the
+// presence of a key (see KeyFunc) in its segments, without reading them.
+//
+// Implementing KeyFilter is optional; see the BloomFilter option of a
+// *DirectorySink.
+type KeyFilter interface {
+	// MayContainKey reports whether any segment may hold a data chunk
+	// with the given key. A false return value means no segment holds
+	// such a data chunk; a true return value may be a false positive.
+	MayContainKey(key []byte) bool
+}
+
+// bloomBitsPerKey is the number of filter bits allotted to each key. Ten
+// bits per key gives a false-positive rate of roughly 1%.
+const bloomBitsPerKey = 10
+
+// bloomFilter is a Bloom filter, using double hashing over a 64-bit FNV-1a
+// hash of each key.
+//
+// Encoded, a filter is a single byte holding the number of hash functions,
+// followed by the filter's bits.
+type bloomFilter []byte
+
+func newBloomFilter(keys int) bloomFilter {
+	nbits := keys * bloomBitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	f := make(bloomFilter, 1+(nbits+7)/8)
+	f[0] = 7 // ~ bloomBitsPerKey * ln(2)
+	return f
+}
+
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (f bloomFilter) add(key []byte) {
+	h1, h2 := bloomHash(key)
+	nbits := uint32(len(f)-1) * 8
+	for i := uint32(0); i < uint32(f[0]); i++ {
+		bit := (h1 + i*h2) % nbits
+		f[1+bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	nbits := uint32(len(f)-1) * 8
+	for i := uint32(0); i < uint32(f[0]); i++ {
+		bit := (h1 + i*h2) % nbits
+		if f[1+bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// segmentBloomFilter returns a Bloom filter over the keys of the data chunks
+// in seg.
+func segmentBloomFilter(seg *Segment, keyFn KeyFunc) bloomFilter {
+	keys := make([][]byte, 0, seg.Chunks())
+	for i := 0; i < seg.Chunks(); i++ {
+		c := seg.chunkAt(i)
+		if !keyable(c) {
+			continue
+		}
+		if key := keyFn(c.Data()); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	f := newBloomFilter(len(keys))
+	for _, key := range keys {
+		f.add(key)
+	}
+	return f
+}
+
+// writeBloomFilter writes a Bloom filter over the keys in seg to the file
+// accompanying the segment file name, and keeps it for MayContainKey.
+func (ds *DirectorySink) writeBloomFilter(name string, seg *Segment) error {
+	f := segmentBloomFilter(seg, ds.keyFn)
+	if err := ioutil.WriteFile(ds.metaPath(name+".BLOOM"), f, 0666); err != nil {
+		return errors.Wrap(err, "write bloom filter")
+	}
+	ds.setBloomFilter(name, f)
+	return nil
+}
+
+// loadBloomFilter loads the Bloom filter accompanying the segment file name,
+// if there is one.
+func (ds *DirectorySink) loadBloomFilter(name string) error {
+	p, err := ioutil.ReadFile(ds.metaPath(name + ".BLOOM"))
+	if err != nil && os.IsNotExist(err) {
+		return nil // Written before the sink had a KeyFunc.
+	} else if err != nil {
+		return errors.Wrap(err, "read bloom filter")
+	}
+	ds.setBloomFilter(name, bloomFilter(p))
+	return nil
+}
+
+func (ds *DirectorySink) setBloomFilter(name string, f bloomFilter) {
+	ds.bloomMu.Lock()
+	defer ds.bloomMu.Unlock()
+	if ds.blooms == nil {
+		ds.blooms = make(map[string]bloomFilter)
+	}
+	ds.blooms[name] = f
+}
+
+func (ds *DirectorySink) dropBloomFilter(name string) {
+	ds.bloomMu.Lock()
+	defer ds.bloomMu.Unlock()
+	delete(ds.blooms, name)
+}
+
+// MayContainKey implements the KeyFilter interface.
+//
+// Segments written before the sink was created with the BloomFilter option
+// have no filter, and may contain any key. If the sink was not created with
+// the BloomFilter option, MayContainKey always returns true.
+func (ds *DirectorySink) MayContainKey(key []byte) bool {
+	if ds.keyFn == nil {
+		return true
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	ds.bloomMu.Lock()
+	defer ds.bloomMu.Unlock()
+	for _, name := range ds.segPaths {
+		f, ok := ds.blooms[name]
+		if !ok || f.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"strings"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Bookmarker defines the interface of a Sink that can store named offsets
+// alongside the log, such as the progress of each of its consumers, so
+// that they are kept, and backed up, with the log itself.
+//
+// Implementing Bookmarker is optional; see SaveBookmark, and LoadBookmark.
+type Bookmarker interface {
+	// SaveBookmark stores offset under name, replacing any offset
+	// previously stored under it.
+	SaveBookmark(name string, offset Offset) error
+
+	// LoadBookmark returns the offset stored under name, or ZeroOffset
+	// if there is none.
+	LoadBookmark(name string) (Offset, error)
+}
+
+// SaveBookmark stores offset under name in sink, or returns ErrNotSupported
+// if sink does not implement Bookmarker. Bookmark names must not be empty,
+// begin with ".", or contain path separators.
+func SaveBookmark(sink Sink, name string, offset Offset) error {
+	b, ok := sink.(Bookmarker)
+	if !ok {
+		return ErrNotSupported
+	}
+	if !validBookmarkName(name) {
+		return errors.Errorf("invalid bookmark name %q", name)
+	}
+	return b.SaveBookmark(name, offset)
+}
+
+// LoadBookmark returns the offset stored under name in sink, or ZeroOffset
+// if there is none. If sink does not implement Bookmarker, LoadBookmark
+// returns ErrNotSupported.
+func LoadBookmark(sink Sink, name string) (Offset, error) {
+	b, ok := sink.(Bookmarker)
+	if !ok {
+		return ZeroOffset, ErrNotSupported
+	}
+	if !validBookmarkName(name) {
+		return ZeroOffset, errors.Errorf("invalid bookmark name %q", name)
+	}
+	return b.LoadBookmark(name)
+}
+
+// NewReaderBookmark returns a *Reader that starts reading data chunks from
+// sink after the offset stored under name (see SaveBookmark), or from the
+// start of the log, if there is none.
+func NewReaderBookmark(sink Sink, name string) (*Reader, error) {
+	offset, err := LoadBookmark(sink, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "load bookmark")
+	}
+	if offset.Equal(ZeroOffset) {
+		return NewReader(sink), nil
+	}
+	r := NewReaderOffset(sink, offset)
+	r.floor = offset + 1 // Skip the bookmarked data chunk.
+	return r, nil
+}
+
+// SaveBookmark stores the offset of the data chunk most recently read by
+// the *Reader under name, in its Sink, so that a *Reader returned by
+// NewReaderBookmark resumes after it.
+func (r *Reader) SaveBookmark(name string) error {
+	return SaveBookmark(r.sink, name, r.Offset())
+}
+
+// validBookmarkName reports whether name can be used as the name of a
+// bookmark.
+func validBookmarkName(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`)
+}
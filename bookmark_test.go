@@ -0,0 +1,91 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBookmarks(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-bookmarks"
+	defer os.RemoveAll(tempdir)
+
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sink := range []Sink{mem, dir} {
+		logger, err := New(sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"one", "two", "three"} {
+			if _, err := logger.WriteString(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A missing bookmark starts from the beginning.
+		r, err := NewReaderBookmark(sink, "consumer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Next() || string(r.Data()) != "one" {
+			t.Fatalf("%T: wrong first record: %q (%v)", sink, r.Data(), r.Error())
+		}
+		if err := r.SaveBookmark("consumer"); err != nil {
+			t.Fatal(err)
+		}
+
+		// The bookmarked record is not read again.
+		r, err = NewReaderBookmark(sink, "consumer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for r.Next() {
+			got = append(got, string(r.Data()))
+		}
+		if len(got) != 2 || got[0] != "two" || got[1] != "three" {
+			t.Errorf("%T: wrong records after bookmark: %q", sink, got)
+		}
+
+		if err := SaveBookmark(sink, "../escape", 1); err == nil {
+			t.Errorf("%T: expected an invalid bookmark name error", sink)
+		}
+	}
+
+	// Bookmarks are kept with the log, and included in snapshots.
+	dir, err = NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadBookmark(mem, "consumer")
+	if err != nil || want.Equal(ZeroOffset) {
+		t.Fatalf("load bookmark: %v, %v", want, err)
+	}
+	if off, err := LoadBookmark(dir, "consumer"); err != nil || off.Equal(ZeroOffset) {
+		t.Errorf("load bookmark after reopening: %v, %v", off, err)
+	}
+	snap := filepath.Join(tempdir, "snapshot")
+	if _, err := dir.SnapshotTo(snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(snap, "consumer.BOOKMARK")); err != nil {
+		t.Errorf("bookmark not in snapshot: %v", err)
+	}
+
+	if _, err := LoadBookmark(&failingSink{Sink: mem}, "consumer"); err != ErrNotSupported {
+		t.Errorf("want %v, got %v", ErrNotSupported, err)
+	}
+}
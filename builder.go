@@ -0,0 +1,142 @@
+package wal
+
+import (
+	"bytes"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SegmentBuilder constructs segments from records with offsets, and
+// attributes, chosen by its caller, rather than assigned by a *Logger; for
+// example, for a tool importing records from another system in bulk. The
+// segments it builds can be written to any Sink with its WriteSegment
+// method.
+//
+//	b := wal.NewSegmentBuilder(wal.DefaultSegmentSize)
+//	for _, rec := range imported {
+//		err := b.Append(wal.NewOffsetTime(rec.Time), rec.Data, nil)
+//		if errors.Is(err, wal.ErrNotEnoughSpace) {
+//			// Write out the full segment, and start another.
+//			seg, _, err := b.Finish()
+//			...
+//			err = sink.WriteSegment(seg)
+//			...
+//			err = b.Append(wal.NewOffsetTime(rec.Time), rec.Data, nil)
+//		}
+//		...
+//	}
+//
+// A SegmentBuilder is not safe for concurrent use.
+type SegmentBuilder struct {
+	size uint64
+	seg  *Segment
+}
+
+// reservedAttrs holds the keys of the data chunk attributes a *Logger sets
+// itself, which cannot be given to a SegmentBuilder.
+var reservedAttrs = []string{attrSealed, attrKey, attrBarrier, attrGenesis, attrMeta, attrBatch, attrDeflate}
+
+// NewSegmentBuilder returns a *SegmentBuilder that builds segments of up to
+// size bytes, as NewSegmentSize does.
+func NewSegmentBuilder(size uint64) *SegmentBuilder {
+	return &SegmentBuilder{
+		size: size,
+		seg:  NewSegmentSize(size),
+	}
+}
+
+// Append adds a data chunk holding a copy of data to the segment being
+// built, at offset off, and with the given attributes, which may be nil.
+// Offsets must be appended in increasing order.
+//
+// Attributes that a *Reader interprets, such as "ttl" (nanoseconds after
+// off that the record expires; see SkipExpired), and "producer" (see
+// FilterProducer), may be set; those set by a *Logger for its own records,
+// such as encrypted, compressed, or batched, data chunks, may not.
+//
+// If the data chunk does not fit in the segment, Append returns
+// ErrNotEnoughSpace; call Finish, and append it to the next segment.
+func (b *SegmentBuilder) Append(off Offset, data []byte, attrs map[string]string) error {
+	if off.Equal(ZeroOffset) {
+		return errors.New("zero offset")
+	}
+	if !off.After(b.seg.last) {
+		return errors.Errorf("offset %v is not after the last offset %v", off, b.seg.last)
+	}
+	for _, k := range reservedAttrs {
+		if _, ok := attrs[k]; ok {
+			return errors.Errorf("reserved attribute %q", k)
+		}
+	}
+	if err := writeSegmentAt(b.seg, off, data, chunkAttrs(attrs).encode()); err != nil {
+		return err
+	}
+	b.seg.last = off
+	return nil
+}
+
+// Chunks returns the number of data chunks in the segment being built.
+func (b *SegmentBuilder) Chunks() int {
+	return b.seg.Chunks()
+}
+
+// Finish returns the segment that has been built, along with its
+// description, as InspectSegment would return for it once encoded; its
+// Checksum is the checksum a DirectorySink records for it. The
+// *SegmentBuilder then starts building a new, empty, segment, whose offsets
+// must follow on from those of the one returned.
+func (b *SegmentBuilder) Finish() (*Segment, SegmentInfo, error) {
+	seg := b.seg
+	var buf bytes.Buffer
+	if _, err := seg.WriteTo(&buf); err != nil {
+		return nil, SegmentInfo{}, errors.Wrap(err, "encode segment")
+	}
+	info, _, err := InspectSegment(&buf)
+	if err != nil {
+		return nil, SegmentInfo{}, errors.Wrap(err, "inspect segment")
+	}
+
+	b.seg = NewSegmentSize(b.size)
+	b.seg.last = seg.last
+	return seg, info, nil
+}
+
+// ImportSegment writes seg, such as one built with a SegmentBuilder, to the
+// *Logger's Sink, after flushing the *Logger; the data chunks written to
+// the *Logger later are given offsets after seg's. seg's data chunks are
+// written as they are: they are not encrypted, validated, or batched, even
+// if the *Logger was created with options to do so, although the *Logger's
+// finalize func is called for seg (see OnSegmentFinalize).
+//
+// seg's offsets must all be newer than those already written to the
+// *Logger.
+func (l *Logger) ImportSegment(seg *Segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLoggerClosed
+	}
+	if seg.Chunks() == 0 {
+		return nil
+	}
+	if err := l.flush(); err != nil {
+		return errors.Wrap(err, "flush")
+	}
+
+	first, last := seg.Limits()
+	_, newest := l.sink.Offsets()
+	if l.seg.last.After(newest) {
+		newest = l.seg.last
+	}
+	if !first.After(newest) {
+		return errors.Errorf("segment offset %v is not after the newest offset %v", first, newest)
+	}
+	if err := l.writeSegment(seg, l.writeTimeout); err != nil {
+		return errors.Wrap(err, "write segment")
+	}
+	l.count(seg)
+	l.seg.mu.Lock()
+	l.seg.last = last
+	l.seg.mu.Unlock()
+	return l.finalize(seg)
+}
@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc64"
+	"testing"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestSegmentBuilder(t *testing.T) {
+	b := NewSegmentBuilder(64)
+	if err := b.Append(10, []byte("one"), map[string]string{"producer": "import"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append(20, []byte("two"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append(20, []byte("three"), nil); err == nil {
+		t.Error("appended an offset out of order")
+	}
+	if err := b.Append(30, []byte("three"), map[string]string{attrSealed: "1"}); err == nil {
+		t.Error("appended a reserved attribute")
+	}
+	if err := b.Append(30, bytes.Repeat([]byte("x"), 64), nil); !errors.Is(err, ErrNotEnoughSpace) {
+		t.Errorf("want %v, got %v", ErrNotEnoughSpace, err)
+	}
+
+	seg, info, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Records != 2 || info.First != 10 || info.Last != 20 {
+		t.Errorf("wrong segment info: %+v", info)
+	}
+	var buf bytes.Buffer
+	if _, err := seg.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := crc64.Checksum(buf.Bytes(), crc64.MakeTable(crc64.ISO)); info.Checksum != want {
+		t.Errorf("wrong checksum: want=%x got=%x", want, info.Checksum)
+	}
+
+	// The next segment follows on from the first.
+	if b.Chunks() != 0 {
+		t.Errorf("builder not reset: %d chunks", b.Chunks())
+	}
+	if err := b.Append(15, []byte("late"), nil); err == nil {
+		t.Error("appended an offset older than the finished segment's")
+	}
+	if err := b.Append(30, []byte("three"), nil); err != nil {
+		t.Fatal(err)
+	}
+	next, _, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Segment{seg, next} {
+		if err := sink.WriteSegment(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReader(sink)
+	r.FilterProducer("import", "")
+	var got []string
+	for r.Next() {
+		got = append(got, r.Offset().String()+"="+string(r.Data()))
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[10=one 20=two 30=three]"; fmt.Sprint(got) != want {
+		t.Errorf("wrong records: want=%s got=%s", want, fmt.Sprint(got))
+	}
+}
@@ -4,72 +4,186 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
+	"net/url"
+	"sort"
 	"strconv"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 )
 
 var (
-	chunkOffsetSize = 8
-	chunkSeparator  = byte(':')
+	chunkOffsetSize    = 8
+	chunkSeparator     = byte(':')
+	chunkAttrSeparator = byte(';')
 )
 
+// chunk holds a single record written to a segment.
+//
+// In memory, a chunk is laid out as:
+//
+//	offset (8 bytes, little-endian) | header length (uvarint) | header | data
+//
+// The header holds the chunk's optional attributes (see chunkAttrs), in the
+// same form they are written to persistent storage.
 type chunk []byte
 
-func newChunk(data []byte) *chunk {
-	return newChunkOffset(data, NewOffset())
+func newChunkOffset(data []byte, o Offset) *chunk {
+	return newChunkHeader(data, o, nil)
 }
 
-func newChunkOffset(data []byte, o Offset) *chunk {
-	// Create a chunk large enough to hold its offset + len(data).
-	c := make(chunk, chunkOffsetSize+len(data))
+// chunkData is the set of types a chunk's data can be copied from.
+type chunkData interface {
+	~[]byte | ~string
+}
+
+func newChunkHeader[D chunkData](data D, o Offset, hdr []byte) *chunk {
+	var n [binary.MaxVarintLen64]byte
+	hl := binary.PutUvarint(n[:], uint64(len(hdr)))
+
+	// Create a chunk large enough to hold its offset, header, and data.
+	c := make(chunk, chunkOffsetSize+hl+len(hdr)+len(data))
 	binary.LittleEndian.PutUint64(c[:chunkOffsetSize], uint64(o))
-	copy(c[chunkOffsetSize:], data)
+	copy(c[chunkOffsetSize:], n[:hl])
+	copy(c[chunkOffsetSize+hl:], hdr)
+	copy(c[chunkOffsetSize+hl+len(hdr):], data)
 	return &c
 }
 
 // MarshalText implements the encoding.TextMarshaler interface, and is
 // primarily used for encoding a data chunk before it is written to
 // persistent storage.
+//
+// A chunk is encoded as its offset, followed by its attributes (if any), a
+// separator ":", and its base64-encoded data:
+//
+//	<offset>[;<key>=<value>...]:<data>
+//
 func (c chunk) MarshalText() ([]byte, error) {
-	// Convert the chunk's offset to a string, then write it out as-is,
-	// followed by a separator ":".
-	offset := []byte(strconv.FormatInt(int64(c.Offset()), 10))
-	offset = append(offset, chunkSeparator)
+	return c.appendText(make([]byte, 0, c.textLen()), chunkSeparator), nil
+}
+
+// appendText appends the chunk, encoded as by MarshalText, to dst, and
+// returns the extended buffer. The chunk's data is separated from its
+// offset, and attributes, by sep, rather than ":".
+func (c chunk) appendText(dst []byte, sep byte) []byte {
+	// Write out the chunk's offset, followed by any attributes, and a
+	// separator.
+	dst = c.Offset().AppendText(dst)
+	if hdr := c.header(); len(hdr) > 0 {
+		dst = append(dst, chunkAttrSeparator)
+		dst = append(dst, hdr...)
+	}
+	dst = append(dst, sep)
 
-	// Encode the data.
+	// Encode the data, in place.
 	enc := base64.RawStdEncoding
-	data := make([]byte, enc.EncodedLen(len(c)-chunkOffsetSize))
-	enc.Encode(data, c[chunkOffsetSize:])
-	return append(offset, data...), nil
+	p := c.Data()
+	n := len(dst)
+	dst = append(dst, make([]byte, enc.EncodedLen(len(p)))...)
+	enc.Encode(dst[n:], p)
+	return dst
+}
+
+// textLen returns the length of the chunk, encoded as by MarshalText.
+func (c chunk) textLen() int {
+	n := c.Offset().textLen() + 1 + base64.RawStdEncoding.EncodedLen(len(c.Data()))
+	if hdr := c.header(); len(hdr) > 0 {
+		n += 1 + len(hdr)
+	}
+	return n
 }
 
 // UnmarshalText implements the encoding.TextUnmarshaler interface, and is
 // primarily used for decoding a data chunk that has been read in from
 // persistent storage.
 func (c *chunk) UnmarshalText(p []byte) error {
-	sep := bytes.Index(p, []byte{chunkSeparator})
+	off, hdr, data, err := parseChunkText(p, chunkSeparator)
+	if err != nil {
+		return err
+	}
+	*c = *newChunkHeader(data, off, hdr)
+	return nil
+}
+
+// parseChunkText splits a chunk encoded with appendText, using the
+// separator sepc, into its offset, encoded attributes, and decoded data.
+//
+// The base64 decoder skips newlines, so they are rejected explicitly; a
+// chunk holding one has been corrupted, or split across lines.
+func parseChunkText(p []byte, sepc byte) (off Offset, hdr, data []byte, err error) {
+	sep := bytes.IndexByte(p, sepc)
 	if sep == -1 {
-		return errors.New("no chunk separator")
+		return ZeroOffset, nil, nil, errors.New("no chunk separator")
+	}
+	if bytes.IndexAny(p, "\r\n") != -1 {
+		return ZeroOffset, nil, nil, errors.New("unexpected newline in chunk")
 	}
 
-	enc := base64.RawStdEncoding
-	size := chunkOffsetSize + enc.DecodedLen(len(p[sep+1:]))
-	*c = append([]byte{}, make([]byte, size)...)
+	// Split the attributes, if any, from the offset.
+	head := p[:sep]
+	if i := bytes.IndexByte(head, chunkAttrSeparator); i != -1 {
+		head, hdr = head[:i], head[i+1:]
+	}
 
 	// Unmarshal the offset.
-	off, err := strconv.ParseInt(string(p[:sep]), 10, 64)
+	off, err = ParseOffsetBytes(head)
 	if err != nil {
-		return errors.Wrap(err, "parse offset")
+		return ZeroOffset, nil, nil, err
 	}
-	binary.LittleEndian.PutUint64((*c)[:chunkOffsetSize], uint64(off))
 
 	// Decode the rest of the data.
-	if _, err = enc.Decode((*c)[chunkOffsetSize:], p[sep+1:]); err != nil {
-		return errors.Wrap(err, "unmarshal text")
+	enc := base64.RawStdEncoding
+	data = make([]byte, enc.DecodedLen(len(p[sep+1:])))
+	if _, err = enc.Decode(data, p[sep+1:]); err != nil {
+		return ZeroOffset, nil, nil, errors.Wrap(err, "unmarshal text")
+	}
+	return off, hdr, data, nil
+}
+
+// validSeparator reports whether c can separate a chunk's data from its
+// offset, and attributes, when it is encoded: it must be printable ASCII
+// punctuation that cannot appear in an offset, query-escaped attributes, or
+// base64-encoded data.
+func validSeparator(c byte) bool {
+	if c <= ' ' || c > '~' ||
+		'0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+		return false
 	}
+	return bytes.IndexByte([]byte("+/=;%#-_.~"), c) == -1
+}
 
-	return nil
+// textHeader returns the header line written at the start of a segment
+// file, describing how its chunks are encoded, when they are separated by
+// sep, rather than ":". The header holds chunk attributes:
+//
+//	#codec=text;sep=<separator>
+func textHeader(sep byte) []byte {
+	return append([]byte{'#'}, chunkAttrs{"codec": "text", "sep": string(sep)}.encode()...)
+}
+
+// parseTextHeader returns the separator described by a header written with
+// textHeader.
+func parseTextHeader(p []byte) (byte, error) {
+	attrs := parseChunkAttrs(bytes.TrimPrefix(p, []byte{'#'}))
+	if codec := attrs["codec"]; codec != "text" {
+		return 0, errors.Errorf("unsupported codec %q", codec)
+	}
+	sep := attrs["sep"]
+	if len(sep) != 1 || !validSeparator(sep[0]) {
+		return 0, errors.Errorf("invalid separator %q", sep)
+	}
+	return sep[0], nil
+}
+
+// paddingRecord returns a padding record of n bytes, including its trailing
+// newline, written after a segment's chunks to pad its segment file to a
+// block boundary; see AlignSegments. A padding record is a line starting
+// with "#", which, after the header, holds no chunk; a padding record of
+// one byte is an empty line.
+func paddingRecord(n int) []byte {
+	p := bytes.Repeat([]byte{'.'}, n)
+	p[0], p[n-1] = '#', '\n'
+	return p
 }
 
 func (c chunk) String() string {
@@ -85,6 +199,110 @@ func (c chunk) Offset() Offset {
 	return Offset(binary.LittleEndian.Uint64(c[:chunkOffsetSize]))
 }
 
+// header returns the chunk's encoded attributes.
+func (c chunk) header() []byte {
+	n, hl := binary.Uvarint(c[chunkOffsetSize:])
+	start := chunkOffsetSize + hl
+	return c[start : start+int(n)]
+}
+
 func (c chunk) Data() []byte {
-	return c[chunkOffsetSize:]
+	n, hl := binary.Uvarint(c[chunkOffsetSize:])
+	return c[chunkOffsetSize+hl+int(n):]
+}
+
+// attrs returns the chunk's attributes.
+func (c chunk) attrs() chunkAttrs {
+	return parseChunkAttrs(c.header())
+}
+
+// expiry returns the offset at which the chunk expires. ok is false if the
+// chunk does not expire.
+func (c chunk) expiry() (exp Offset, ok bool) {
+	s, ok := c.attrs()[attrTTL]
+	if !ok {
+		return ZeroOffset, false
+	}
+	ttl, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return ZeroOffset, false
+	}
+	return c.Offset() + Offset(ttl), true
+}
+
+// chunkAttrs holds optional key-value pairs that are stored alongside the
+// data in a chunk.
+type chunkAttrs map[string]string
+
+// Well-known chunk attribute keys.
+const (
+	attrSchema   = "schema"   // ID of the schema the data was encoded with.
+	attrTTL      = "ttl"      // Nanoseconds after the chunk's offset that it expires.
+	attrProducer = "producer" // ID of the producer that wrote the chunk.
+	attrSealed   = "sealed"   // Set if the chunk's data is encrypted; see EncryptRecords.
+	attrKey      = "key"      // ID of the key the chunk's data is encrypted with; see EncryptRecordsWith.
+	attrBarrier  = "barrier"  // ID of the flush group barrier the chunk marks; see FlushGroup.
+	attrGenesis  = "genesis"  // Format version of the bootstrap record; see Bootstrap.
+	attrMeta     = "meta"     // Application metadata in a bootstrap record.
+	attrBatch    = "batch"    // Number of records batched in the chunk; see BatchRecords.
+	attrDeflate  = "deflate"  // Set if the chunk's data is DEFLATE-compressed; see CompressRecords.
+)
+
+// control reports whether the attributes mark a chunk written by the
+// *Logger itself, rather than a record written by its caller, such as a
+// flush group barrier, or a bootstrap record.
+func (a chunkAttrs) control() bool {
+	_, barrier := a[attrBarrier]
+	_, genesis := a[attrGenesis]
+	return barrier || genesis
+}
+
+// encode returns the attributes in the form they are stored in a chunk's
+// header: "key=value" pairs, separated by ";", with keys and values
+// query-escaped. Keys are sorted, so the encoding is deterministic.
+func (a chunkAttrs) encode() []byte {
+	if len(a) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(chunkAttrSeparator)
+		}
+		buf.WriteString(url.QueryEscape(k))
+		buf.WriteByte('=')
+		buf.WriteString(url.QueryEscape(a[k]))
+	}
+	return buf.Bytes()
+}
+
+// parseChunkAttrs parses attributes encoded with chunkAttrs.encode.
+// Malformed pairs are ignored.
+func parseChunkAttrs(p []byte) chunkAttrs {
+	if len(p) == 0 {
+		return nil
+	}
+	a := make(chunkAttrs)
+	for _, pair := range bytes.Split(p, []byte{chunkAttrSeparator}) {
+		i := bytes.IndexByte(pair, '=')
+		if i == -1 {
+			continue
+		}
+		k, err := url.QueryUnescape(string(pair[:i]))
+		if err != nil {
+			continue
+		}
+		v, err := url.QueryUnescape(string(pair[i+1:]))
+		if err != nil {
+			continue
+		}
+		a[k] = v
+	}
+	return a
 }
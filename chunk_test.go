@@ -33,3 +33,25 @@ func TestChunkMarshalUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkAttrs(t *testing.T) {
+	attrs := chunkAttrs{"schema": "2", "odd key": "a;b:c=d"}
+	a := newChunkHeader([]byte("hello"), NewOffset(), attrs.encode())
+	txt, err := a.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := new(chunk)
+	if err := b.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b.Data()); got != "hello" {
+		t.Errorf("wrong data: want=%q got=%q", "hello", got)
+	}
+	for k, v := range attrs {
+		if got := b.attrs()[k]; got != v {
+			t.Errorf("wrong value for attribute %q: want=%q got=%q", k, v, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// CompressRecords causes a *Logger to DEFLATE-compress the data of each
+// data chunk of at least threshold bytes that it writes. Smaller data
+// chunks, whose data would barely shrink, if at all, are written as they
+// are, saving the CPU time it would take to compress them; so are data
+// chunks whose compressed data is no smaller than the original.
+//
+// Compressed data chunks are marked with a chunk attribute, and are
+// decompressed by a *Reader as they are read, so readers need not be
+// configured to read them. Data chunks are compressed before they are
+// encrypted (see EncryptRecords); batched records (see BatchRecords) are
+// not compressed.
+func CompressRecords(threshold int) Option {
+	return func(l *Logger) error {
+		if threshold <= 0 {
+			return errors.New("compression threshold must be positive")
+		}
+		l.compressMin = threshold
+		return nil
+	}
+}
+
+// deflateRecord returns p, compressed, and reports whether the compressed
+// data is smaller than p.
+func deflateRecord(p []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := zw.Write(p); err != nil {
+		return nil, false
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(p) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// inflateRecord decompresses p, which was compressed with deflateRecord.
+func inflateRecord(p []byte) ([]byte, error) {
+	zr := flate.NewReader(bytes.NewReader(p))
+	defer zr.Close()
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	return plain, nil
+}
@@ -0,0 +1,73 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressRecords(t *testing.T) {
+	random := make([]byte, 256)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	records := [][]byte{
+		[]byte("small"),
+		bytes.Repeat([]byte("compressible "), 64),
+		random,
+	}
+	compressed := []bool{false, true, false}
+
+	for _, encrypt := range []bool{false, true} {
+		aead := newTestAEAD(t)
+		sink, err := NewMemorySink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := []Option{CompressRecords(64)}
+		if encrypt {
+			opts = append(opts, EncryptRecords(aead))
+		}
+		logger, err := New(sink, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range records {
+			if _, err := logger.Append(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only records over the threshold, that shrink, are compressed.
+		seg, err := sink.LoadSegment(ZeroOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < seg.Chunks(); i++ {
+			_, ok := seg.chunkAt(i).attrs()[attrDeflate]
+			if ok != compressed[i] {
+				t.Errorf("encrypt=%v: record %d: want compressed=%v, got %v", encrypt, i, compressed[i], ok)
+			}
+		}
+
+		r := NewReader(sink)
+		if encrypt {
+			r.Decrypt(aead)
+		}
+		var i int
+		for ; r.Next(); i++ {
+			if !bytes.Equal(r.Data(), records[i]) {
+				t.Errorf("encrypt=%v: record %d: wrong data: %q", encrypt, i, r.Data())
+			}
+		}
+		if err := r.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if i != len(records) {
+			t.Errorf("encrypt=%v: want %d records, got %d", encrypt, len(records), i)
+		}
+	}
+}
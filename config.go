@@ -0,0 +1,77 @@
+package wal
+
+import (
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Config holds a *Logger's configuration, as an alternative to functional
+// options, for when it is loaded from a configuration file. Its fields are
+// tagged for use with encoding/json; the zero value of each field selects
+// the default behaviour.
+//
+// Options that cannot be represented in a file, such as OnClockSkew, can be
+// passed to NewWithConfig alongside a Config.
+type Config struct {
+	// SegmentSize is the size of a data segment, in bytes (see the
+	// SegmentSize option). The default is DefaultSegmentSize.
+	SegmentSize uint64 `json:"segment_size,omitempty"`
+
+	// FlushFailure is the policy followed when a segment cannot be
+	// written to the Sink (see the OnFlushFailure option). It is encoded
+	// as "fail-fast", or "buffer-and-retry". The default is FailFast.
+	FlushFailure FlushFailurePolicy `json:"flush_failure,omitempty"`
+
+	// MaxPending is the maximum number of segments held in memory when
+	// FlushFailure is BufferAndRetry. It must be set for BufferAndRetry,
+	// and must not be set for FailFast.
+	MaxPending int `json:"max_pending,omitempty"`
+
+	// Producer is stored alongside each data chunk written (see the
+	// Producer option).
+	Producer string `json:"producer,omitempty"`
+}
+
+// Validate reports whether c holds a valid configuration.
+func (c Config) Validate() error {
+	if c.SegmentSize > MaxSegmentSize {
+		return errors.Errorf("segment size must be at most %d", MaxSegmentSize)
+	}
+	if c.MaxPending < 0 {
+		return errors.New("max pending must not be negative")
+	}
+	switch c.FlushFailure {
+	case FailFast:
+		if c.MaxPending != 0 {
+			return errors.Errorf("max pending set, but flush failure policy is %s", c.FlushFailure)
+		}
+	case BufferAndRetry:
+		if c.MaxPending == 0 {
+			return errors.Errorf("max pending must be set for flush failure policy %s", c.FlushFailure)
+		}
+	default:
+		return errors.Errorf("unknown flush failure policy %d", c.FlushFailure)
+	}
+	return nil
+}
+
+// options returns the functional options equivalent to c.
+func (c Config) options() []Option {
+	var opts []Option
+	if c.SegmentSize != 0 {
+		opts = append(opts, SegmentSize(c.SegmentSize))
+	}
+	opts = append(opts, OnFlushFailure(c.FlushFailure, c.MaxPending))
+	if c.Producer != "" {
+		opts = append(opts, Producer(c.Producer))
+	}
+	return opts
+}
+
+// NewWithConfig is like New, but configures the *Logger with cfg, which is
+// validated first. Any options are applied after cfg.
+func NewWithConfig(sink Sink, cfg Config, options ...Option) (*Logger, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
+	return New(sink, append(cfg.options(), options...)...)
+}
@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"zero", Config{}, true},
+		{"buffer and retry", Config{FlushFailure: BufferAndRetry, MaxPending: 2}, true},
+		{"segment too big", Config{SegmentSize: MaxSegmentSize + 1}, false},
+		{"max pending without buffering", Config{MaxPending: 2}, false},
+		{"buffering without max pending", Config{FlushFailure: BufferAndRetry}, false},
+		{"negative max pending", Config{FlushFailure: BufferAndRetry, MaxPending: -1}, false},
+		{"unknown policy", Config{FlushFailure: 42}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result: %v", tt.name, err)
+		}
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	var cfg Config
+	p := []byte(`{"segment_size": 32, "flush_failure": "buffer-and-retry", "max_pending": 1, "producer": "a"}`)
+	if err := json.Unmarshal(p, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.FlushFailure != BufferAndRetry {
+		t.Errorf("wrong flush failure policy: want=%v got=%v", BufferAndRetry, cfg.FlushFailure)
+	}
+
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewWithConfig(sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Append(make([]byte, 32)); err != ErrTooBig {
+		t.Errorf("segment size not applied: err=%v", err)
+	}
+	if _, err := logger.Append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r := logger.NewReader()
+	if !r.Next() || r.Producer() != "a" {
+		t.Errorf("producer not applied: %q", r.Producer())
+	}
+
+	if _, err := NewWithConfig(sink, Config{MaxPending: 1}); err == nil {
+		t.Error("invalid config accepted")
+	}
+}
@@ -0,0 +1,278 @@
+package wal
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrRecordAuth is returned by a *Reader when an encrypted data chunk fails
+// authentication: its data, offset, or attributes have been modified since
+// it was written, or it was encrypted with a different key.
+var ErrRecordAuth = errors.New("wal: record failed authentication")
+
+// EncryptRecords causes a *Logger to encrypt the data of each data chunk
+// it writes with aead (such as AES-GCM, or ChaCha20-Poly1305). Use a
+// Reader's Decrypt method to read them.
+//
+// Each data chunk is encrypted with a random nonce, and the chunk's offset,
+// and attributes (its TTL, producer ID, etc.) are authenticated alongside
+// its data, so that moving a data chunk to another offset, or changing its
+// attributes, is detected when it is read.
+//
+// Encryption adds the size of aead's nonce, and its overhead, to each data
+// chunk.
+func EncryptRecords(aead cipher.AEAD) Option {
+	return func(l *Logger) error {
+		if aead == nil {
+			return errors.New("nil aead")
+		}
+		l.sealer = &recordSealer{aead: aead}
+		return nil
+	}
+}
+
+// ErrKeyRevoked should be returned, or wrapped, by a KeyProvider when the
+// requested key has been revoked. A *Reader skips data chunks encrypted
+// with a revoked key.
+var ErrKeyRevoked = errors.New("wal: encryption key revoked")
+
+// KeyProvider defines the interface of a type that supplies the keys data
+// chunks are encrypted with, so that different producers (for example, the
+// tenants of a multi-tenant system) can have their data chunks encrypted
+// with different keys. See EncryptRecordsWith.
+type KeyProvider interface {
+	// KeyID returns the ID of the key to encrypt a data chunk written by
+	// producer with (see the Producer option). The ID is stored alongside
+	// the data chunk, unencrypted.
+	KeyID(producer string) (string, error)
+
+	// Key returns the key identified by id, or an error wrapping
+	// ErrKeyRevoked if it has been revoked.
+	Key(id string) (cipher.AEAD, error)
+}
+
+// EncryptRecordsWith is like EncryptRecords, but encrypts each data chunk
+// with a key supplied by keys, chosen by the data chunk's producer ID.
+// Use a Reader's DecryptWith method to read them.
+//
+// Revoking a key, and destroying every copy of it, makes the data chunks
+// encrypted with it unreadable ("crypto-shredding"), without rewriting
+// the log. All of the keys supplied by keys must add the same overhead to
+// a data chunk; for example, by all being AES-GCM keys.
+func EncryptRecordsWith(keys KeyProvider) Option {
+	return func(l *Logger) error {
+		if keys == nil {
+			return errors.New("nil key provider")
+		}
+		l.sealer = &recordSealer{keys: keys}
+		return nil
+	}
+}
+
+// KeyCache is a KeyProvider that caches the key IDs, and keys, supplied by
+// another KeyProvider, for up to a TTL, so that a *Logger, or *Reader,
+// does not ask it for a key for every data chunk; for example, where keys
+// are fetched from a remote key management service.
+//
+// Keys are rotated by having the wrapped KeyProvider return a new key ID for
+// a producer; data chunks keep the ID of the key they were encrypted with,
+// so a log that spans several key generations can be read as long as the
+// wrapped KeyProvider can still supply the older keys. A rotation, or
+// revocation, takes effect once the cached key ID, or key, expires, or
+// immediately after calling Purge. Errors, including ErrKeyRevoked, are not
+// cached.
+type KeyCache struct {
+	keys KeyProvider
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ids   map[string]cachedKey // Key IDs, by producer.
+	aeads map[string]cachedKey // Keys, by key ID.
+}
+
+// cachedKey holds a cached key ID, or key, and when it expires.
+type cachedKey struct {
+	id      string
+	aead    cipher.AEAD
+	expires time.Time
+}
+
+// NewKeyCache returns a *KeyCache caching the key IDs, and keys, supplied
+// by keys, for up to ttl.
+func NewKeyCache(keys KeyProvider, ttl time.Duration) *KeyCache {
+	return &KeyCache{
+		keys:  keys,
+		ttl:   ttl,
+		ids:   make(map[string]cachedKey),
+		aeads: make(map[string]cachedKey),
+	}
+}
+
+// KeyID implements the KeyProvider interface.
+func (c *KeyCache) KeyID(producer string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.ids[producer]; ok && time.Now().Before(k.expires) {
+		return k.id, nil
+	}
+	id, err := c.keys.KeyID(producer)
+	if err != nil {
+		return "", err
+	}
+	c.ids[producer] = cachedKey{id: id, expires: time.Now().Add(c.ttl)}
+	return id, nil
+}
+
+// Key implements the KeyProvider interface.
+func (c *KeyCache) Key(id string) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.aeads[id]; ok && time.Now().Before(k.expires) {
+		return k.aead, nil
+	}
+	aead, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = cachedKey{id: id, aead: aead, expires: time.Now().Add(c.ttl)}
+	return aead, nil
+}
+
+// Purge removes every key ID, and key, from the cache; for example, once a
+// key has been rotated, or revoked.
+func (c *KeyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = make(map[string]cachedKey)
+	c.aeads = make(map[string]cachedKey)
+}
+
+// recordSealer encrypts, and decrypts, the data in data chunks, with
+// either a single key, or keys supplied by a KeyProvider.
+type recordSealer struct {
+	aead cipher.AEAD
+	keys KeyProvider
+}
+
+// keyID returns the ID of the key to encrypt a data chunk written by
+// producer with, or "" if the sealer has a single key.
+func (s *recordSealer) keyID(producer string) (string, error) {
+	if s.keys == nil {
+		return "", nil
+	}
+	id, err := s.keys.KeyID(producer)
+	if err != nil {
+		return "", errors.Wrap(err, "get encryption key id")
+	}
+	return id, nil
+}
+
+// key returns the key for a data chunk with the encoded chunk attributes
+// hdr.
+func (s *recordSealer) key(hdr []byte) (cipher.AEAD, error) {
+	if s.keys == nil {
+		return s.aead, nil
+	}
+	id, ok := parseChunkAttrs(hdr)[attrKey]
+	if !ok {
+		return nil, ErrRecordAuth
+	}
+	aead, err := s.keys.Key(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get encryption key %q", id)
+	}
+	return aead, nil
+}
+
+// overhead returns the number of bytes sealing adds to a data chunk with
+// the encoded chunk attributes hdr. It is safe to call on a nil
+// *recordSealer.
+func (s *recordSealer) overhead(hdr []byte) int {
+	if s == nil {
+		return 0
+	}
+	aead, err := s.key(hdr)
+	if err != nil {
+		// Sealing the data chunk will fail, too.
+		return 0
+	}
+	return aead.NonceSize() + aead.Overhead()
+}
+
+// seal encrypts p, and returns the nonce, followed by the ciphertext.
+func (s *recordSealer) seal(off Offset, hdr, p []byte) ([]byte, error) {
+	aead, err := s.key(hdr)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+aead.Overhead()+len(p))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	return aead.Seal(nonce, nonce, p, sealedData(off, hdr)), nil
+}
+
+// open decrypts the data of c, which was encrypted with seal. Data chunks
+// that were not encrypted fail authentication.
+func (s *recordSealer) open(c chunk) ([]byte, error) {
+	if c.attrs()[attrSealed] == "" {
+		return nil, ErrRecordAuth
+	}
+	aead, err := s.key(c.header())
+	if err != nil {
+		return nil, err
+	}
+	p := c.Data()
+	n := aead.NonceSize()
+	if len(p) < n {
+		return nil, ErrRecordAuth
+	}
+	plain, err := aead.Open(nil, p[:n], p[n:], sealedData(c.Offset(), c.header()))
+	if err != nil {
+		return nil, ErrRecordAuth
+	}
+	return plain, nil
+}
+
+// sealedData returns the additional data authenticated alongside a data
+// chunk's data: its offset (8 bytes, little-endian), followed by its
+// encoded attributes.
+func sealedData(off Offset, hdr []byte) []byte {
+	ad := make([]byte, chunkOffsetSize, chunkOffsetSize+len(hdr))
+	binary.LittleEndian.PutUint64(ad, uint64(off))
+	return append(ad, hdr...)
+}
+
+// Decrypt causes the *Reader to decrypt data chunks written by a *Logger
+// created with the EncryptRecords option, using aead.
+//
+// If a data chunk fails authentication, Next returns false, and Error
+// returns an error whose cause is ErrRecordAuth. Data chunks that were not
+// encrypted fail authentication, so that they cannot be forged, or have
+// their encryption stripped.
+func (r *Reader) Decrypt(aead cipher.AEAD) {
+	r.sealer = &recordSealer{aead: aead}
+}
+
+// DecryptWith is like Decrypt, but decrypts data chunks written by a
+// *Logger created with the EncryptRecordsWith option, using the keys
+// supplied by keys. Data chunks encrypted with a key that has been revoked
+// (see ErrKeyRevoked) are skipped.
+//
+// keys is asked for the key of each data chunk as it is read; wrap it in a
+// KeyCache to ask for each key only once.
+func (r *Reader) DecryptWith(keys KeyProvider) {
+	r.sealer = &recordSealer{keys: keys}
+}
+
+// KeyID returns the ID of the key the current data chunk was encrypted
+// with, by a *Logger created with the EncryptRecordsWith option, or "" if
+// it was not.
+func (r *Reader) KeyID() string {
+	return r.attrs()[attrKey]
+}
@@ -0,0 +1,299 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func newTestAEAD(t *testing.T) cipher.AEAD {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestEncryptRecords(t *testing.T) {
+	aead := newTestAEAD(t)
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, EncryptRecords(aead), Producer("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Append([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(sink)
+	if !r.Next() {
+		t.Fatal("no data chunks", r.Error())
+	}
+	if bytes.Contains(r.Data(), []byte("secret")) {
+		t.Error("data chunk was not encrypted")
+	}
+
+	r = NewReader(sink)
+	r.Decrypt(aead)
+	if !r.Next() {
+		t.Fatal("no data chunks", r.Error())
+	}
+	if got := string(r.Data()); got != "secret" {
+		t.Errorf("wrong data: want=%q got=%q", "secret", got)
+	}
+
+	// Relabel the data chunk, by moving it to another offset, and by
+	// changing its producer.
+	seg, err := sink.LoadSegment(ZeroOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := seg.chunkAt(0)
+	attrs := c.attrs()
+	attrs[attrProducer] = "b"
+	stripped := c.attrs()
+	delete(stripped, attrSealed)
+	for name, tampered := range map[string]*chunk{
+		"offset":   newChunkHeader(c.Data(), c.Offset()+1, c.header()),
+		"attrs":    newChunkHeader(c.Data(), c.Offset(), attrs.encode()),
+		"stripped": newChunkHeader(c.Data(), c.Offset(), stripped.encode()),
+		"forged":   newChunkOffset([]byte("forged"), c.Offset()),
+	} {
+		mem, err := NewMemorySink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg := NewSegment()
+		seg.addChunks(tampered)
+		if err := mem.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewReader(mem)
+		r.Decrypt(aead)
+		if r.Next() {
+			t.Errorf("%s: tampered data chunk was read", name)
+		}
+		if errors.Cause(r.Error()) != ErrRecordAuth {
+			t.Errorf("%s: wrong error: want=%v got=%v", name, ErrRecordAuth, r.Error())
+		}
+	}
+
+	// Relabeling a data chunk so that a *Reader would skip it, as a control
+	// record, as expired, or as written by another producer, must not drop
+	// it silently.
+	relabel := func(k, v string) *chunk {
+		attrs := c.attrs()
+		attrs[k] = v
+		return newChunkHeader(c.Data(), c.Offset(), attrs.encode())
+	}
+	for name, tampered := range map[string]*chunk{
+		"barrier":  relabel(attrBarrier, "x"),
+		"genesis":  relabel(attrGenesis, "1"),
+		"ttl":      relabel(attrTTL, "1"),
+		"producer": relabel(attrProducer, "b"),
+	} {
+		mem, err := NewMemorySink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg := NewSegment()
+		seg.addChunks(tampered)
+		if err := mem.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewReader(mem)
+		r.Decrypt(aead)
+		r.SkipExpired()
+		r.FilterProducer("a")
+		if r.Next() {
+			t.Errorf("%s: tampered data chunk was read", name)
+		}
+		if errors.Cause(r.Error()) != ErrRecordAuth {
+			t.Errorf("%s: wrong error: want=%v got=%v", name, ErrRecordAuth, r.Error())
+		}
+	}
+}
+
+// testKeys is a KeyProvider with a key for each producer, whose ID is the
+// producer's ID.
+type testKeys struct {
+	keys    map[string]cipher.AEAD
+	revoked map[string]bool
+}
+
+func (k *testKeys) KeyID(producer string) (string, error) {
+	return producer, nil
+}
+
+func (k *testKeys) Key(id string) (cipher.AEAD, error) {
+	if k.revoked[id] {
+		return nil, ErrKeyRevoked
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, errors.Errorf("unknown key %q", id)
+	}
+	return aead, nil
+}
+
+func TestEncryptRecordsWith(t *testing.T) {
+	keys := &testKeys{keys: make(map[string]cipher.AEAD), revoked: make(map[string]bool)}
+	for i, id := range []string{"a", "b"} {
+		block, err := aes.NewCipher(bytes.Repeat([]byte{byte(i)}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.keys[id], err = cipher.NewGCM(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "a"} {
+		logger, err := New(sink, EncryptRecordsWith(keys), Producer(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := logger.Write([]byte("hello from " + id)); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func() (got []string) {
+		r := NewReader(sink)
+		r.DecryptWith(keys)
+		for r.Next() {
+			got = append(got, string(r.Data()))
+		}
+		if err := r.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := read(); len(got) != 3 || got[1] != "hello from b" {
+		t.Fatalf("wrong data: %q", got)
+	}
+
+	// A different producer's key cannot decrypt the data chunks.
+	r := NewReader(sink)
+	r.Decrypt(keys.keys["b"])
+	if r.Next() {
+		t.Fatal("read data chunk with the wrong key")
+	}
+	if err := r.Error(); errors.Cause(err) != ErrRecordAuth {
+		t.Fatalf("want %v, got %v", ErrRecordAuth, err)
+	}
+
+	// Once a producer's key is revoked, its data chunks are skipped.
+	keys.revoked["b"] = true
+	if got := read(); len(got) != 2 || got[0] != "hello from a" || got[1] != "hello from a" {
+		t.Errorf("wrong data after revoking key: %q", got)
+	}
+}
+
+// rotatingKeys is a KeyProvider whose producers' keys are rotated to a new
+// generation, with an ID of "<producer>-<generation>"; it counts the keys it
+// is asked for.
+type rotatingKeys struct {
+	testKeys
+	gen   int
+	calls int
+}
+
+func (k *rotatingKeys) KeyID(producer string) (string, error) {
+	return producer + "-" + strconv.Itoa(k.gen), nil
+}
+
+func (k *rotatingKeys) Key(id string) (cipher.AEAD, error) {
+	k.calls++
+	return k.testKeys.Key(id)
+}
+
+func TestKeyCache(t *testing.T) {
+	keys := &rotatingKeys{
+		testKeys: testKeys{keys: make(map[string]cipher.AEAD), revoked: make(map[string]bool)},
+		gen:      1,
+	}
+	for i, id := range []string{"a-1", "a-2"} {
+		block, err := aes.NewCipher(bytes.Repeat([]byte{byte(i)}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.keys[id], err = cipher.NewGCM(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write a log spanning two key generations.
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewKeyCache(keys, time.Hour)
+	logger, err := New(sink, EncryptRecordsWith(cache), Producer("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for gen := 1; gen <= 2; gen++ {
+		keys.gen = gen
+		cache.Purge()
+		for i := 0; i < 5; i++ {
+			if _, err := logger.Write([]byte("gen " + strconv.Itoa(gen))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the log asks for each generation's key once.
+	read := func() (got []string) {
+		r := NewReader(sink)
+		r.DecryptWith(NewKeyCache(keys, time.Hour))
+		for r.Next() {
+			got = append(got, r.KeyID()+"="+string(r.Data()))
+		}
+		if err := r.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	keys.calls = 0
+	got := read()
+	if len(got) != 10 || got[0] != "a-1=gen 1" || got[9] != "a-2=gen 2" {
+		t.Errorf("wrong data: %q", got)
+	}
+	if keys.calls != 2 {
+		t.Errorf("want 2 keys fetched, got %d", keys.calls)
+	}
+
+	// A revoked key is not cached.
+	keys.revoked["a-1"] = true
+	if got := read(); len(got) != 5 || got[0] != "a-2=gen 2" {
+		t.Errorf("wrong data after revoking key: %q", got)
+	}
+}
@@ -0,0 +1,86 @@
+package wal
+
+import (
+	"strconv"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// FlushGroup flushes several *Loggers together, so that state spanning
+// their logs can be recovered consistently with RecoverGroup.
+//
+// A barrier record, holding an ID shared by the whole group, is appended to
+// each *Logger, before each of them is flushed. The barrier is complete
+// once it has been written to every *Logger's Sink; if FlushGroup fails
+// part-way through, the barrier is incomplete, and RecoverGroup discards
+// everything written after the last complete barrier.
+//
+// Barrier records are skipped by a *Reader, and are not passed to the
+// validators registered with the Validate option.
+func FlushGroup(loggers ...*Logger) error {
+	id := strconv.FormatInt(int64(NewOffset()), 10)
+	for i, l := range loggers {
+		if _, err := l.write([]byte(id), chunkAttrs{attrBarrier: id}); err != nil {
+			return errors.Wrapf(err, "write barrier to logger %d", i)
+		}
+	}
+	for i, l := range loggers {
+		if err := l.Flush(); err != nil {
+			return errors.Wrapf(err, "flush logger %d", i)
+		}
+	}
+	return nil
+}
+
+// RecoverGroup restores a group of *Loggers, flushed with FlushGroup, to a
+// consistent state after a restart, by removing every data chunk written
+// after the newest barrier found in all of their Sinks (see the *Logger's
+// TruncateAfter method). The *Loggers must be passed in the same order
+// they were passed to FlushGroup, and their Sinks must implement the
+// TailTruncater interface.
+//
+// If no barrier is found in all of the Sinks, nothing is removed.
+func RecoverGroup(loggers ...*Logger) error {
+	// The offset of each barrier in each log, by barrier ID.
+	barriers := make(map[int64][]Offset)
+	for i, l := range loggers {
+		r := NewReader(l.currentSink())
+		r.barriers = true
+		for r.Next() {
+			s, ok := r.attrs()[attrBarrier]
+			if !ok {
+				continue
+			}
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return errors.Wrapf(err, "logger %d: parse barrier id at offset %v", i, r.Offset())
+			}
+			offsets := barriers[id]
+			if len(offsets) == i {
+				barriers[id] = append(offsets, r.Offset())
+			}
+		}
+		if err := r.Error(); err != nil {
+			return errors.Wrapf(err, "logger %d: find barriers", i)
+		}
+	}
+
+	var (
+		newest  int64
+		offsets []Offset
+	)
+	for id, offs := range barriers {
+		if len(offs) == len(loggers) && id > newest {
+			newest, offsets = id, offs
+		}
+	}
+	if offsets == nil {
+		return nil
+	}
+	for i, l := range loggers {
+		if err := l.TruncateAfter(offsets[i]); err != nil {
+			return errors.Wrapf(err, "logger %d", i)
+		}
+	}
+	return nil
+}
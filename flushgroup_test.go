@@ -0,0 +1,62 @@
+package wal
+
+import "testing"
+
+func TestFlushGroup(t *testing.T) {
+	var (
+		sinks   [2]*MemorySink
+		loggers [2]*Logger
+	)
+	for i := range loggers {
+		var err error
+		if sinks[i], err = NewMemorySink(); err != nil {
+			t.Fatal(err)
+		}
+		if loggers[i], err = New(sinks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(l *Logger, s string) {
+		if _, err := l.Append([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(loggers[0], "a1")
+	write(loggers[1], "b1")
+	if err := FlushGroup(loggers[:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of the loggers is flushed, as if the process crashed
+	// part-way through the second group flush.
+	write(loggers[0], "a2")
+	write(loggers[1], "b2")
+	if err := loggers[0].Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted process recovers both logs to the first barrier.
+	for i := range loggers {
+		var err error
+		if loggers[i], err = New(sinks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecoverGroup(loggers[:]...); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"a1", "b1"} {
+		var got []string
+		r := NewReader(sinks[i])
+		for r.Next() {
+			got = append(got, string(r.Data()))
+		}
+		if err := r.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("log %d: want=[%s] got=%q", i, want, got)
+		}
+	}
+}
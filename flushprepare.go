@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"sync/atomic"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrInvalidFlushToken is returned by CommitFlush, and AbortFlush, when they
+// are passed a FlushToken that is not that of the *Logger's prepared flush.
+var ErrInvalidFlushToken = errors.New("wal: invalid flush token")
+
+// flushTokens generates the IDs of FlushTokens.
+var flushTokens atomic.Uint64
+
+// FlushToken identifies a flush started with a *Logger's PrepareFlush
+// method, which must be finished with CommitFlush, or AbortFlush.
+type FlushToken struct {
+	id uint64
+
+	// Last is the newest offset in the *Logger's Sink once the flush was
+	// prepared; for example, to store in an external index alongside the
+	// data it describes.
+	Last Offset
+}
+
+// PrepareFlush is the first step of a two-phase flush, for applications
+// that must write their data chunks to the *Logger's Sink, and commit a
+// change elsewhere (such as an update to an external index), atomically.
+//
+// PrepareFlush flushes the *Logger, as Flush does, and returns a FlushToken.
+// The application then commits its change, and finishes the flush by
+// passing the token to CommitFlush if it succeeded, or AbortFlush if it did
+// not; AbortFlush removes the data chunks written by the flush from the
+// Sink. If PrepareFlush returns an error, there is nothing to finish.
+//
+// The *Logger is locked until the flush is finished, so that nothing else is
+// written to its Sink in the meantime; calls to its other methods block.
+// The Sink must implement the TailTruncater interface, or PrepareFlush
+// returns ErrNotSupported.
+func (l *Logger) PrepareFlush() (FlushToken, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return FlushToken{}, ErrLoggerClosed
+	}
+	if _, ok := l.sink.(TailTruncater); !ok {
+		l.mu.Unlock()
+		return FlushToken{}, ErrNotSupported
+	}
+
+	_, prev := l.sink.Offsets()
+	if err := l.flush(); err != nil {
+		l.mu.Unlock()
+		return FlushToken{}, errors.Wrap(err, "flush")
+	}
+	l.prepared = prev
+	token := FlushToken{id: flushTokens.Add(1)}
+	_, token.Last = l.sink.Offsets()
+	l.preparedID.Store(token.id)
+	return token, nil
+}
+
+// CommitFlush finishes the flush identified by token, keeping the data
+// chunks it wrote, and unlocks the *Logger.
+func (l *Logger) CommitFlush(token FlushToken) error {
+	if token.id == 0 || !l.preparedID.CompareAndSwap(token.id, 0) {
+		return ErrInvalidFlushToken
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// AbortFlush finishes the flush identified by token, by removing the data
+// chunks it wrote from the *Logger's Sink, and unlocks the *Logger. The
+// data chunks are discarded, as though they had never been written; offsets
+// of data chunks written later continue to increase from theirs.
+//
+// If the data chunks cannot be removed, the error is returned, and the
+// *Logger is still unlocked.
+func (l *Logger) AbortFlush(token FlushToken) error {
+	if token.id == 0 || !l.preparedID.CompareAndSwap(token.id, 0) {
+		return ErrInvalidFlushToken
+	}
+	defer l.mu.Unlock()
+	if err := truncateAfter(l.sink, l.prepared); err != nil {
+		return errors.Wrap(err, "remove flushed data chunks")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package wal
+
+import (
+	"testing"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestLoggerPrepareFlush(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off, err := logger.Append([]byte("committed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := logger.PrepareFlush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Last != off {
+		t.Errorf("wrong last offset: want=%v got=%v", off, token.Last)
+	}
+	if err := logger.AbortFlush(FlushToken{}); err != ErrInvalidFlushToken {
+		t.Errorf("want ErrInvalidFlushToken, got %v", err)
+	}
+	if err := logger.CommitFlush(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.CommitFlush(token); err != ErrInvalidFlushToken {
+		t.Errorf("want ErrInvalidFlushToken for a finished flush, got %v", err)
+	}
+
+	// An aborted flush leaves nothing behind in the sink.
+	if _, err := logger.Append([]byte("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	if token, err = logger.PrepareFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.AbortFlush(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, last := sink.Offsets(); last != off {
+		t.Errorf("wrong newest offset after abort: want=%v got=%v", off, last)
+	}
+
+	// The *Logger is unlocked once the flush is finished.
+	next, err := logger.Append([]byte("next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !next.After(token.Last) {
+		t.Errorf("offset %v not after aborted offset %v", next, token.Last)
+	}
+	if n := countChunks(t, sink); n != 2 {
+		t.Errorf("want 2 data chunks, got %d", n)
+	}
+}
+
+func TestLoggerPrepareFlushNotSupported(t *testing.T) {
+	logger, err := New(newFailingSink(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.PrepareFlush(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("want ErrNotSupported, got %v", err)
+	}
+	// The *Logger is not left locked.
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// genesisVersion is the format version written in bootstrap records.
+const genesisVersion = 1
+
+var (
+	// ErrNotEmpty is returned by Bootstrap when the log already holds
+	// data chunks.
+	ErrNotEmpty = errors.New("wal: log is not empty")
+
+	// ErrNoGenesis is returned by Genesis when a log does not begin with
+	// a bootstrap record.
+	ErrNoGenesis = errors.New("wal: log has no bootstrap record")
+)
+
+// FormatVersionError is returned by New when the log in its Sink was
+// created, with Bootstrap, by a newer version of this package, whose format
+// this version may not write correctly; for example, when a deployment is
+// rolled back. The log can still be read with NewView.
+type FormatVersionError struct {
+	Version   int // The format version of the log.
+	Supported int // The newest format version this package supports.
+}
+
+func (e *FormatVersionError) Error() string {
+	return fmt.Sprintf("wal: log format version %d is newer than supported version %d", e.Version, e.Supported)
+}
+
+// checkVersion returns a *FormatVersionError if the log in sink was created
+// by a newer version of this package. Logs without a bootstrap record, such
+// as those created without one, or since truncated, are assumed to be
+// compatible.
+func checkVersion(sink Sink) error {
+	if sink.NumSegments() == 0 {
+		return nil
+	}
+	g, err := Genesis(sink)
+	if err == ErrNoGenesis {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "check log format version")
+	}
+	if g.Version > genesisVersion {
+		return &FormatVersionError{Version: g.Version, Supported: genesisVersion}
+	}
+	return nil
+}
+
+// GenesisRecord describes a log, as recorded by Bootstrap when the log was
+// created.
+type GenesisRecord struct {
+	Version int       // The format version of the record.
+	Offset  Offset    // The offset of the record.
+	Created time.Time // When the log was created.
+	Meta    []byte    // Application metadata passed to Bootstrap.
+}
+
+// Bootstrap writes a bootstrap record, holding meta, as the first data
+// chunk of a new, empty log, and flushes it to the *Logger's Sink, so that
+// tools can later identify the log, and check where it came from, with
+// Genesis. If the log already holds data chunks, ErrNotEmpty is returned.
+//
+// The bootstrap record is skipped by a *Reader, and is not passed to the
+// validators registered with the Validate option. meta is stored alongside
+// the record, rather than as its data, so it is not encrypted, even if the
+// *Logger encrypts records.
+func (l *Logger) Bootstrap(meta []byte) error {
+	attrs := chunkAttrs{
+		attrGenesis: strconv.Itoa(genesisVersion),
+		attrMeta:    string(meta),
+	}
+	if _, err := l.write(nil, attrs); err != nil {
+		return err
+	}
+	return l.Flush()
+}
+
+// empty reports whether nothing has been written to the *Logger, or its
+// Sink. It must be called while holding l.mu.
+func (l *Logger) empty() bool {
+	_, last := l.sink.Offsets()
+	return last.Equal(ZeroOffset) && len(l.pending) == 0 && l.seg.Chunks() == 0 && len(l.batch) == 0
+}
+
+// Genesis returns the bootstrap record written by Bootstrap when the log in
+// sink was created. If the log does not begin with a bootstrap record
+// (including when it has since been truncated), ErrNoGenesis is returned.
+func Genesis(sink Sink) (*GenesisRecord, error) {
+	seg, err := sink.LoadSegment(ZeroOffset)
+	if err == io.EOF {
+		return nil, ErrNoGenesis
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load first segment")
+	}
+	if seg.Chunks() == 0 {
+		return nil, ErrNoGenesis
+	}
+	c := seg.chunkAt(0)
+	attrs := c.attrs()
+	v, ok := attrs[attrGenesis]
+	if !ok {
+		return nil, ErrNoGenesis
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse bootstrap record version")
+	}
+	return &GenesisRecord{
+		Version: version,
+		Offset:  c.Offset(),
+		Created: time.Unix(0, int64(c.Offset())),
+		Meta:    []byte(attrs[attrMeta]),
+	}, nil
+}
@@ -0,0 +1,101 @@
+package wal
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestLoggerBootstrap(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Genesis(sink); err != ErrNoGenesis {
+		t.Errorf("want %v, got %v", ErrNoGenesis, err)
+	}
+
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := []byte("app=test;v=1\x00")
+	if err := logger.Bootstrap(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Bootstrap(meta); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("want %v, got %v", ErrNotEmpty, err)
+	}
+	if _, err := logger.Write([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Genesis(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Version != genesisVersion {
+		t.Errorf("wrong version: want=%d got=%d", genesisVersion, g.Version)
+	}
+	if !bytes.Equal(g.Meta, meta) {
+		t.Errorf("wrong meta: want=%q got=%q", meta, g.Meta)
+	}
+	if first, _ := sink.Offsets(); g.Offset != first || g.Created.UnixNano() != int64(first) {
+		t.Errorf("wrong offset: want=%v got=%v (created %v)", first, g.Offset, g.Created)
+	}
+
+	// The bootstrap record is not read as a record.
+	r := NewReader(sink)
+	var got []string
+	for r.Next() {
+		got = append(got, string(r.Data()))
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "one" {
+		t.Errorf("wrong records: %q", got)
+	}
+}
+
+func TestNewFormatVersion(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A log created by a newer version of the package.
+	seg := NewSegment()
+	attrs := chunkAttrs{attrGenesis: strconv.Itoa(genesisVersion + 1)}
+	if _, err := appendChunk(seg, []byte(nil), attrs.encode()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.Write([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(seg); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(sink)
+	var verr *FormatVersionError
+	if !errors.As(err, &verr) {
+		t.Fatalf("want *FormatVersionError, got %v", err)
+	}
+	if verr.Version != genesisVersion+1 || verr.Supported != genesisVersion {
+		t.Errorf("wrong versions: %+v", verr)
+	}
+
+	// It can still be read.
+	v := NewView(sink)
+	defer v.Close()
+	r := v.NewReader()
+	if !r.Next() || string(r.Data()) != "one" {
+		t.Errorf("wrong record read from view: %q (%v)", r.Data(), r.Error())
+	}
+}
@@ -0,0 +1,150 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Group owns an application's background goroutines, such as those
+// flushing, or monitoring, a *Logger (see walutil.FlushUntilClosed, and
+// walutil.Monitor), and the values that run goroutines of their own (such
+// as a *ShadowSink, or a *Logger), so that they can all be shut down, in
+// order, in one call, and their errors collected:
+//
+//	g := wal.NewGroup(ctx)
+//	g.Own(logger)
+//	g.Go("flush", func(ctx context.Context) error {
+//		return walutil.FlushUntilClosed(ctx, logger, walutil.FlushOptions{
+//			Interval: 10 * time.Second,
+//		})
+//	})
+//	...
+//	if err := g.Close(); err != nil {
+//		log.Println("wal shutdown:", err)
+//	}
+//
+// The goroutines share a context, which is cancelled when the Group is
+// closed, or when any of them fails, so that the rest stop too.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	closers []io.Closer
+	errs    []error
+	closed  bool
+}
+
+// GroupError is returned by a *Group's Wait, and Close methods, holding the
+// errors returned by its goroutines, and the values it owns, in the order
+// they were returned.
+type GroupError struct {
+	Errs []error
+}
+
+func (e *GroupError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return "wal: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors held by e, so that errors.Is, and errors.As,
+// match any of them.
+func (e *GroupError) Unwrap() []error {
+	return e.Errs
+}
+
+// NewGroup returns a *Group whose goroutines' context is derived from ctx.
+func NewGroup(ctx context.Context) *Group {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Group{ctx: ctx, cancel: cancel}
+}
+
+// Context returns the context shared by the group's goroutines.
+func (g *Group) Context() context.Context {
+	return g.ctx
+}
+
+// Go runs fn in a new goroutine, owned by the group, passing it the group's
+// context. If fn returns an error, the group's context is cancelled, and the
+// error, prefixed with name, is returned by Wait, and Close; an error
+// returned once the context is done, because it is done, is ignored.
+//
+// Go panics if it is called after Close.
+func (g *Group) Go(name string, fn func(ctx context.Context) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		panic("wal: Go called on a closed Group")
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := fn(g.ctx)
+		if err == nil || (g.ctx.Err() != nil && errors.Is(err, g.ctx.Err())) {
+			return
+		}
+		g.fail(errors.Wrap(err, name))
+		g.cancel()
+	}()
+}
+
+// Own adds c to the values closed by the group's Close method, once its
+// goroutines have returned; values are closed in the reverse order they
+// were added, so, for example, a *Logger should be added after its Sink.
+func (g *Group) Own(c io.Closer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closers = append(g.closers, c)
+}
+
+// fail records err, returned by one of the group's goroutines, or values.
+func (g *Group) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.errs = append(g.errs, err)
+}
+
+// Wait waits for the group's goroutines to return, without cancelling their
+// context, and returns a *GroupError holding their errors, if any.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	return g.err()
+}
+
+// err returns a *GroupError holding the errors recorded so far, if any.
+func (g *Group) err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.errs) == 0 {
+		return nil
+	}
+	return &GroupError{Errs: append([]error(nil), g.errs...)}
+}
+
+// Close cancels the group's context, waits for its goroutines to return,
+// then closes the values it owns, and returns a *GroupError holding the
+// errors returned by any of them. Calling Close more than once returns the
+// same errors, without closing anything again.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	closers := g.closers
+	g.closers, g.closed = nil, true
+	g.mu.Unlock()
+
+	g.cancel()
+	g.wg.Wait()
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			g.fail(errors.Wrap(err, "close"))
+		}
+	}
+	return g.err()
+}
@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"context"
+	"testing"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// closeFunc is an io.Closer calling a function.
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+func TestGroup(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewGroup(context.Background())
+	var closed []string
+	g.Own(closeFunc(func() error {
+		closed = append(closed, "sink")
+		return nil
+	}))
+	g.Own(closeFunc(func() error {
+		closed = append(closed, "logger")
+		return logger.Close()
+	}))
+
+	// A goroutine that runs until the group is closed, flushing the
+	// logger as it returns.
+	g.Go("flush", func(ctx context.Context) error {
+		<-ctx.Done()
+		if err := logger.Flush(); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	if _, err := logger.Append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if len(closed) != 2 || closed[0] != "logger" || closed[1] != "sink" {
+		t.Errorf("closed %v, want [logger sink]", closed)
+	}
+	if _, last := sink.Offsets(); last.Equal(ZeroOffset) {
+		t.Error("logger not flushed before it was closed")
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
+
+func TestGroupError(t *testing.T) {
+	errFailed := errors.New("failed")
+	errClose := errors.New("close failed")
+
+	g := NewGroup(context.Background())
+	g.Own(closeFunc(func() error { return errClose }))
+	g.Go("worker", func(ctx context.Context) error {
+		return errFailed
+	})
+	// The failure cancels the other goroutines.
+	g.Go("waiter", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := g.Wait(); !errors.Is(err, errFailed) {
+		t.Fatalf("wait: want %v, got %v", errFailed, err)
+	}
+
+	err := g.Close()
+	var gerr *GroupError
+	if !errors.As(err, &gerr) {
+		t.Fatalf("close: want a *GroupError, got %v", err)
+	}
+	if len(gerr.Errs) != 2 || !errors.Is(err, errFailed) || !errors.Is(err, errClose) {
+		t.Errorf("close: want %v, and %v, got %v", errFailed, errClose, err)
+	}
+}
@@ -0,0 +1,317 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// KeyIndexer defines the interface of a Sink that maintains an index of the
+// keys (see KeyFunc) of the data chunks in its segments.
+//
+// Implementing KeyIndexer is optional; see the IndexKeys option of a
+// *DirectorySink.
+type KeyIndexer interface {
+	// LookupKey returns the offsets of the data chunks with the given
+	// key, oldest first. The data chunk at each offset can be read with
+	// a *Reader created with NewReaderOffset.
+	LookupKey(key []byte) ([]Offset, error)
+}
+
+// segmentIndex maps the keys of the data chunks in a segment to where the
+// data chunks are.
+type segmentIndex map[string][]indexEntry
+
+// indexEntry locates a data chunk in its segment file.
+type indexEntry struct {
+	off Offset
+	pos int64 // Byte offset of the encoded data chunk in the segment file, or -1 if it is not known.
+	n   int   // Length of the encoded data chunk, in bytes.
+}
+
+// Attributes of an index entry.
+const (
+	indexPos = "pos" // Byte offset of the data chunk in the segment file.
+	indexLen = "n"   // Length of the encoded data chunk.
+)
+
+// writeIndex writes an index of the keys in seg to the file accompanying
+// the segment file name, and keeps it for LookupKey. If seg is the segment
+// as it was written to the segment file, withPos is true, and the index
+// records where each data chunk is in the file, for ReadChunkAt.
+//
+// An index file holds a line for each data chunk that has a key, in the
+// same form as the data chunk itself, but with the key in place of the
+// data, and where the data chunk is in the segment file in place of its
+// attributes:
+//
+//	<offset>[;n=<length>;pos=<byte offset>]:<base64-encoded key>
+func (ds *DirectorySink) writeIndex(name string, seg *Segment, withPos bool) error {
+	var (
+		idx = make(segmentIndex)
+		buf bytes.Buffer
+		ob  [20]byte // Holds each encoded offset.
+		enc = base64.RawStdEncoding
+		pos int64
+	)
+	if seg.sep != 0 {
+		pos = int64(len(textHeader(seg.sep)) + 1)
+	}
+	for i := 0; i < seg.Chunks(); i++ {
+		c := seg.chunkAt(i)
+		e := indexEntry{off: c.Offset(), pos: -1, n: c.textLen()}
+		if withPos {
+			e.pos = pos
+		}
+		pos += int64(e.n) + 1
+		if !keyable(c) {
+			continue
+		}
+		key := ds.indexFn(c.Data())
+		if key == nil {
+			continue
+		}
+		idx[string(key)] = append(idx[string(key)], e)
+
+		buf.Write(c.Offset().AppendText(ob[:0]))
+		if withPos {
+			buf.WriteByte(chunkAttrSeparator)
+			buf.Write(chunkAttrs{
+				indexLen: strconv.Itoa(e.n),
+				indexPos: strconv.FormatInt(e.pos, 10),
+			}.encode())
+		}
+		buf.WriteByte(chunkSeparator)
+		buf.WriteString(enc.EncodeToString(key))
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(ds.metaPath(name+".INDEX"), buf.Bytes(), 0666); err != nil {
+		return errors.Wrap(err, "write index")
+	}
+	ds.setIndex(name, idx)
+	return nil
+}
+
+// loadIndex loads the index accompanying the segment file name. If there is
+// no index file, for example because the segment was written before the sink
+// was created with the IndexKeys option, the index is rebuilt from the
+// segment, without where each data chunk is in the segment file.
+func (ds *DirectorySink) loadIndex(name string) error {
+	f, err := os.Open(ds.metaPath(name + ".INDEX"))
+	if err != nil && os.IsNotExist(err) {
+		seg, err := ds.loadSegment(name)
+		if err != nil {
+			return errors.Wrap(err, "rebuild index")
+		}
+		return ds.writeIndex(name, seg, false)
+	} else if err != nil {
+		return errors.Wrap(err, "open index")
+	}
+	defer f.Close()
+
+	idx := make(segmentIndex)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		off, hdr, key, err := parseChunkText(sc.Bytes(), chunkSeparator)
+		if err != nil {
+			return errors.Wrap(err, "parse index entry")
+		}
+		e := indexEntry{off: off, pos: -1}
+		if attrs := parseChunkAttrs(hdr); attrs != nil {
+			pos, perr := strconv.ParseInt(attrs[indexPos], 10, 64)
+			n, nerr := strconv.Atoi(attrs[indexLen])
+			if perr != nil || nerr != nil || pos < 0 || n <= 0 {
+				return errors.Errorf("malformed index entry at offset %v", off)
+			}
+			e.pos, e.n = pos, n
+		}
+		idx[string(key)] = append(idx[string(key)], e)
+	}
+	if err := sc.Err(); err != nil {
+		return errors.Wrap(err, "read index")
+	}
+	ds.setIndex(name, idx)
+	return nil
+}
+
+func (ds *DirectorySink) setIndex(name string, idx segmentIndex) {
+	ds.indexMu.Lock()
+	defer ds.indexMu.Unlock()
+	if ds.indexes == nil {
+		ds.indexes = make(map[string]segmentIndex)
+	}
+	ds.indexes[name] = idx
+}
+
+func (ds *DirectorySink) dropIndex(name string) {
+	ds.indexMu.Lock()
+	defer ds.indexMu.Unlock()
+	delete(ds.indexes, name)
+}
+
+// LookupKey implements the KeyIndexer interface.
+//
+// If the sink was not created with the IndexKeys option, LookupKey returns
+// ErrNotSupported.
+func (ds *DirectorySink) LookupKey(key []byte) ([]Offset, error) {
+	if ds.indexFn == nil {
+		return nil, ErrNotSupported
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	ds.indexMu.Lock()
+	defer ds.indexMu.Unlock()
+
+	var offsets []Offset
+	for i, name := range ds.segPaths {
+		for _, e := range ds.indexes[name][string(key)] {
+			// Skip data chunks that have been logically truncated.
+			if !e.off.Before(ds.segments[i][0]) {
+				offsets = append(offsets, e.off)
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// ReadChunkAt implements the ChunkReaderAt interface. If there is no segment
+// with the given ID, ReadChunkAt returns ErrSegmentNotFound.
+//
+// The data chunk is read with the segment file's ReadAt method, so the rest
+// of the segment file is not read, or decoded; nor is it checked against
+// the segment's checksum. Compressed segment files (see CompressBefore)
+// cannot be read from part-way through, and a data chunk cannot be checked
+// against its segment's signature without reading the whole segment file,
+// so for compressed segment files, and sinks created with the
+// VerifySegments option, ReadChunkAt returns an error whose cause is
+// ErrNotSupported.
+func (ds *DirectorySink) ReadChunkAt(segment SegmentID, byteOffset int64, n int) (Record, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	name, ok := ds.segmentName(segment)
+	if !ok {
+		return Record{}, ErrSegmentNotFound
+	}
+	return ds.readChunkAt(name, byteOffset, n)
+}
+
+// readChunkAt implements ReadChunkAt. It must be called while holding ds.mu.
+func (ds *DirectorySink) readChunkAt(name string, byteOffset int64, n int) (Record, error) {
+	if byteOffset < 0 || n <= 0 {
+		return Record{}, errors.New("invalid chunk position")
+	}
+	if ds.verifyKey != nil {
+		return Record{}, errors.Wrap(ErrNotSupported, "segments are verified")
+	}
+	ds.limits.acquireFile()
+	defer ds.limits.releaseFile()
+	f, err := os.Open(filepath.Join(ds.dir, name))
+	if err != nil {
+		return Record{}, errors.Wrap(err, "open segment file")
+	}
+	defer f.Close()
+
+	// Find out how the segment file is encoded from its first line, which
+	// is a header if the data chunks are separated by anything other than
+	// ":" (see TextSeparator).
+	var head [64]byte
+	hn, err := f.ReadAt(head[:], 0)
+	if err != nil && err != io.EOF {
+		return Record{}, errors.Wrap(err, "read segment file")
+	}
+	if bytes.HasPrefix(head[:hn], gzipMagic) {
+		return Record{}, errors.Wrap(ErrNotSupported, "segment file is compressed")
+	}
+	sep := chunkSeparator
+	if bytes.HasPrefix(head[:hn], []byte{'#'}) {
+		i := bytes.IndexByte(head[:hn], '\n')
+		if i == -1 {
+			return Record{}, errors.New("malformed segment file header")
+		}
+		if sep, err = parseTextHeader(head[:i]); err != nil {
+			return Record{}, errors.Wrap(err, "parse header")
+		}
+	}
+
+	p := make([]byte, n)
+	if _, err := f.ReadAt(p, byteOffset); err != nil {
+		return Record{}, errors.Wrap(err, "read data chunk")
+	}
+	off, _, data, err := parseChunkText(p, sep)
+	if err != nil {
+		return Record{}, errors.Wrap(err, "unmarshal data chunk")
+	}
+	return Record{Offset: off, Data: data}, nil
+}
+
+// LookupRecords is like LookupKey, but returns the data chunks with the given
+// key, rather than only their offsets. Where the key index records where
+// each data chunk is in its segment file, it is read on its own with
+// ReadChunkAt; otherwise (such as for a compressed segment file, or a sink
+// created with the VerifySegments option), the whole segment is loaded, and
+// verified.
+//
+// If the sink was not created with the IndexKeys option, LookupRecords
+// returns ErrNotSupported.
+func (ds *DirectorySink) LookupRecords(key []byte) ([]Record, error) {
+	if ds.indexFn == nil {
+		return nil, ErrNotSupported
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	var recs []Record
+	for i, name := range ds.segPaths {
+		ds.indexMu.Lock()
+		entries := ds.indexes[name][string(key)]
+		ds.indexMu.Unlock()
+
+		var seg *Segment // Loaded if a data chunk cannot be read on its own.
+		for _, e := range entries {
+			// Skip data chunks that have been logically truncated.
+			if e.off.Before(ds.segments[i][0]) {
+				continue
+			}
+			if e.pos >= 0 && seg == nil {
+				rec, err := ds.readChunkAt(name, e.pos, e.n)
+				if err == nil && rec.Offset == e.off {
+					recs = append(recs, rec)
+					continue
+				} else if err != nil && !errors.Is(err, ErrNotSupported) {
+					return nil, errors.Wrapf(err, "read data chunk at offset %v", e.off)
+				}
+			}
+			if seg == nil {
+				var err error
+				if seg, err = ds.loadSegment(name); err != nil {
+					return nil, errors.Wrapf(err, "load segment %s", name)
+				}
+			}
+			rec, ok := findRecord(seg, e.off)
+			if !ok {
+				return nil, errors.Errorf("no data chunk at indexed offset %v", e.off)
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// findRecord returns the data chunk at offset off in seg.
+func findRecord(seg *Segment, off Offset) (Record, bool) {
+	recs := seg.Records()
+	i := sort.Search(len(recs), func(i int) bool { return !recs[i].Offset.Before(off) })
+	if i == len(recs) || recs[i].Offset != off {
+		return Record{}, false
+	}
+	return recs[i], true
+}
@@ -0,0 +1,102 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SegmentInfo describes an encoded segment, as returned by InspectSegment.
+type SegmentInfo struct {
+	Records  int    // Number of records in the segment.
+	First    Offset // Offset of the first record.
+	Last     Offset // Offset of the last record.
+	Size     int64  // Size of the encoded segment, in bytes, once decompressed.
+	DataSize int64  // Total size of the records' data, once decoded.
+
+	// Checksum is the CRC-64 (ISO) checksum of the encoded segment; the
+	// same checksum a DirectorySink stores in a segment's ".CHECKSUM" file.
+	Checksum uint64
+}
+
+// RecordInfo describes a single record in an encoded segment, as returned by
+// InspectSegment.
+type RecordInfo struct {
+	Index       int               // Index of the record within the segment.
+	Offset      Offset            // The record's offset.
+	Position    int64             // Position of the record within the encoded segment, in bytes.
+	EncodedSize int               // Size of the encoded record, in bytes, excluding the trailing newline.
+	Size        int               // Size of the record's data, once decoded.
+	CRC         uint32            // CRC-32 (IEEE) checksum of the record's decoded data.
+	Attrs       map[string]string // The record's attributes (schema ID, TTL, etc.), if any.
+}
+
+// InspectSegment decodes an encoded segment, such as a segment file written
+// by a DirectorySink, into structured metadata, without loading it into a
+// Segment. It is intended for debugging tools. Segments compressed by a
+// DirectorySink (see its CompressBefore method) are decompressed first.
+//
+// If a record cannot be decoded, InspectSegment returns the information
+// gathered up to that point, along with an error identifying the record.
+func InspectSegment(r io.Reader) (SegmentInfo, []RecordInfo, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return SegmentInfo{}, nil, errors.Wrap(err, "read segment")
+	}
+	var (
+		info    SegmentInfo
+		records []RecordInfo
+		sum     = crc64.New(crc64.MakeTable(crc64.ISO))
+		br      = bufio.NewReader(io.TeeReader(r, sum))
+		sep     = chunkSeparator
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return info, records, errors.Wrap(err, "read segment")
+		}
+		pos := info.Size
+		info.Size += int64(len(line))
+
+		if row := bytes.TrimSuffix(line, []byte("\n")); pos == 0 && bytes.HasPrefix(row, []byte{'#'}) {
+			var herr error
+			if sep, herr = parseTextHeader(row); herr != nil {
+				return info, records, errors.Wrap(herr, "parse header")
+			}
+		} else if len(row) > 0 && row[0] != '#' {
+			off, hdr, data, perr := parseChunkText(row, sep)
+			if perr != nil {
+				return info, records, errors.Wrapf(perr, "record %d at byte %d", len(records), pos)
+			}
+			rec := RecordInfo{
+				Index:       len(records),
+				Offset:      off,
+				Position:    pos,
+				EncodedSize: len(row),
+				Size:        len(data),
+				CRC:         crc32.ChecksumIEEE(data),
+			}
+			if attrs := parseChunkAttrs(hdr); len(attrs) > 0 {
+				rec.Attrs = attrs
+			}
+			records = append(records, rec)
+
+			if info.Records == 0 {
+				info.First = off
+			}
+			info.Last = off
+			info.Records++
+			info.DataSize += int64(len(data))
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	info.Checksum = sum.Sum64()
+	return info, records, nil
+}
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"bytes"
+	"hash/crc32"
+	"hash/crc64"
+	"testing"
+)
+
+func TestInspectSegment(t *testing.T) {
+	seg := NewSegment()
+	seg.addChunks(
+		newChunkOffset([]byte("hello"), 10),
+		newChunkHeader([]byte("world"), 20, chunkAttrs{attrTTL: "5"}.encode()),
+	)
+	var buf bytes.Buffer
+	if _, err := seg.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	info, records, err := InspectSegment(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Records != 2 || info.First != 10 || info.Last != 20 {
+		t.Errorf("wrong segment info: %+v", info)
+	}
+	if info.Size != int64(len(encoded)) || info.DataSize != 10 {
+		t.Errorf("wrong sizes: size=%d data=%d", info.Size, info.DataSize)
+	}
+	if want := crc64.Checksum(encoded, crc64.MakeTable(crc64.ISO)); info.Checksum != want {
+		t.Errorf("wrong checksum: want=%x got=%x", want, info.Checksum)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("wrong number of records: want=2 got=%d", len(records))
+	}
+	rec := records[1]
+	if rec.Index != 1 || rec.Offset != 20 || rec.Size != 5 {
+		t.Errorf("wrong record info: %+v", rec)
+	}
+	if rec.Position != int64(records[0].EncodedSize+1) {
+		t.Errorf("wrong record position: %d", rec.Position)
+	}
+	if rec.CRC != crc32.ChecksumIEEE([]byte("world")) {
+		t.Errorf("wrong record crc: %x", rec.CRC)
+	}
+	if rec.Attrs[attrTTL] != "5" || records[0].Attrs != nil {
+		t.Errorf("wrong record attributes: %v, %v", records[0].Attrs, rec.Attrs)
+	}
+
+	// A corrupt record is reported, along with the records before it.
+	corrupt := append(append([]byte(nil), encoded...), "30:!!!\n"...)
+	_, records, err = InspectSegment(bytes.NewReader(corrupt))
+	if err == nil {
+		t.Error("expected error for corrupt record")
+	}
+	if len(records) != 2 {
+		t.Errorf("wrong number of records before corruption: want=2 got=%d", len(records))
+	}
+}
@@ -0,0 +1,29 @@
+// Package errors provides the error constructors, and wrapping functions,
+// used throughout yawal.
+//
+// By default, they are those of github.com/pkg/errors, whose errors record
+// a stack trace, printed with the "%+v" verb. When built with the
+// yawal_nodeps build tag, they are implemented with the standard library
+// alone, without stack traces, so that yawal has no third-party
+// dependencies:
+//
+//	go build -tags yawal_nodeps
+//
+// Either way, errors returned by Wrap, and Wrapf, implement both the
+// Cause, and Unwrap, methods, so that Cause, Is, and As all see through
+// them.
+package errors
+
+import stderrors "errors"
+
+// Is reports whether any error in err's chain matches target, as the
+// standard library's errors.Is does.
+func Is(err, target error) bool {
+	return stderrors.Is(err, target)
+}
+
+// As finds the first error in err's chain that matches target, as the
+// standard library's errors.As does.
+func As(err error, target any) bool {
+	return stderrors.As(err, target)
+}
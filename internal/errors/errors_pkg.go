@@ -0,0 +1,32 @@
+//go:build !yawal_nodeps
+
+package errors
+
+import "github.com/pkg/errors"
+
+// New returns an error with the given message.
+func New(message string) error {
+	return errors.New(message)
+}
+
+// Errorf returns an error with a message formatted from format, and args.
+func Errorf(format string, args ...any) error {
+	return errors.Errorf(format, args...)
+}
+
+// Wrap returns an error annotating err with message, or nil if err is nil.
+func Wrap(err error, message string) error {
+	return errors.Wrap(err, message)
+}
+
+// Wrapf returns an error annotating err with a message formatted from
+// format, and args, or nil if err is nil.
+func Wrapf(err error, format string, args ...any) error {
+	return errors.Wrapf(err, format, args...)
+}
+
+// Cause returns the underlying cause of err: the first error in its chain
+// that does not implement the Cause method.
+func Cause(err error) error {
+	return errors.Cause(err)
+}
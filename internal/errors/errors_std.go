@@ -0,0 +1,58 @@
+//go:build yawal_nodeps
+
+package errors
+
+import (
+	stderrors "errors"
+	"fmt"
+)
+
+// New returns an error with the given message.
+func New(message string) error {
+	return stderrors.New(message)
+}
+
+// Errorf returns an error with a message formatted from format, and args.
+func Errorf(format string, args ...any) error {
+	return fmt.Errorf(format, args...)
+}
+
+// Wrap returns an error annotating err with message, or nil if err is nil.
+func Wrap(err error, message string) error {
+	if err == nil {
+		return nil
+	}
+	return &wrapped{msg: message, err: err}
+}
+
+// Wrapf returns an error annotating err with a message formatted from
+// format, and args, or nil if err is nil.
+func Wrapf(err error, format string, args ...any) error {
+	if err == nil {
+		return nil
+	}
+	return &wrapped{msg: fmt.Sprintf(format, args...), err: err}
+}
+
+// Cause returns the underlying cause of err: the first error in its chain
+// that does not implement the Cause method.
+func Cause(err error) error {
+	for err != nil {
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return err
+}
+
+// wrapped is an error returned by Wrap, and Wrapf.
+type wrapped struct {
+	msg string
+	err error
+}
+
+func (w *wrapped) Error() string { return w.msg + ": " + w.err.Error() }
+func (w *wrapped) Cause() error  { return w.err }
+func (w *wrapped) Unwrap() error { return w.err }
@@ -0,0 +1,23 @@
+package errors
+
+import (
+	"io"
+	"testing"
+)
+
+// Run with, and without, the yawal_nodeps build tag.
+func TestWrap(t *testing.T) {
+	if err := Wrap(nil, "read"); err != nil {
+		t.Errorf("wrapped nil: %v", err)
+	}
+	err := Wrapf(Wrap(io.EOF, "read"), "segment %d", 1)
+	if got, want := err.Error(), "segment 1: read: EOF"; got != want {
+		t.Errorf("wrong message: want=%q got=%q", want, got)
+	}
+	if Cause(err) != io.EOF {
+		t.Errorf("wrong cause: %v", Cause(err))
+	}
+	if !Is(err, io.EOF) {
+		t.Error("wrapped error does not match its cause")
+	}
+}
@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"sync"
+)
+
+// ResourceLimits bounds the resources used, together, by all of the
+// *Loggers, and *DirectorySinks it is passed to (see the Limits, and
+// DirectoryLimits options), so that the package can be embedded in a
+// process with tight limits on open files, or memory. A zero field means
+// there is no limit.
+//
+// A *ResourceLimits is safe for concurrent use. It must not be copied, or
+// have its fields changed, once it has been passed to an option.
+type ResourceLimits struct {
+	// MaxOpenFiles is the number of segment files that may be open at
+	// once, for reading, or writing. Each open segment file counts as
+	// one, along with the files accompanying it; further reads, and
+	// writes, wait for one to finish.
+	MaxOpenFiles int
+
+	// MaxCachedSegments is the number of segments that may be cached at
+	// once (see the CacheSegments option). When the limit is reached, a
+	// *DirectorySink evicts one of its own cached segments to cache
+	// another, or does not cache it.
+	MaxCachedSegments int
+
+	// MaxPendingBytes is the size of the segments that may be waiting to
+	// be written to a Sink at once, in bytes (see the BufferAndRetry
+	// policy). When the limit is reached, a *Logger treats a failed
+	// flush as if its FlushFailurePolicy were FailFast.
+	MaxPendingBytes int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	files   int
+	cached  int
+	pending int64
+}
+
+// acquireFile waits until a segment file can be opened, without exceeding
+// MaxOpenFiles. It is safe to call on a nil *ResourceLimits.
+func (rl *ResourceLimits) acquireFile() {
+	if rl == nil || rl.MaxOpenFiles <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.cond == nil {
+		rl.cond = sync.NewCond(&rl.mu)
+	}
+	for rl.files >= rl.MaxOpenFiles {
+		rl.cond.Wait()
+	}
+	rl.files++
+}
+
+// releaseFile releases a segment file acquired with acquireFile.
+func (rl *ResourceLimits) releaseFile() {
+	if rl == nil || rl.MaxOpenFiles <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.files--
+	rl.cond.Signal()
+}
+
+// reserveCache reports whether another segment can be cached, without
+// exceeding MaxCachedSegments, and if so, counts it. It is safe to call on
+// a nil *ResourceLimits.
+func (rl *ResourceLimits) reserveCache() bool {
+	if rl == nil || rl.MaxCachedSegments <= 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.cached >= rl.MaxCachedSegments {
+		return false
+	}
+	rl.cached++
+	return true
+}
+
+// releaseCache releases n cached segments reserved with reserveCache.
+func (rl *ResourceLimits) releaseCache(n int) {
+	if rl == nil || rl.MaxCachedSegments <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cached -= n
+}
+
+// reservePending reports whether n more bytes of segments can wait to be
+// written, without exceeding MaxPendingBytes, and if so, counts them. It
+// is safe to call on a nil *ResourceLimits.
+func (rl *ResourceLimits) reservePending(n int64) bool {
+	if rl == nil || rl.MaxPendingBytes <= 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.pending+n > rl.MaxPendingBytes {
+		return false
+	}
+	rl.pending += n
+	return true
+}
+
+// releasePending releases n bytes reserved with reservePending.
+func (rl *ResourceLimits) releasePending(n int64) {
+	if rl == nil || rl.MaxPendingBytes <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.pending -= n
+}
@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestResourceLimitsPendingBytes(t *testing.T) {
+	// Leave room for one pending segment, of a single record.
+	probe := NewSegment()
+	if _, err := probe.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	rl := &ResourceLimits{MaxPendingBytes: probe.Size() * 3 / 2}
+	sinks := []*failingSink{newFailingSink(t), newFailingSink(t)}
+	var loggers []*Logger
+	for _, sink := range sinks {
+		sink.fail = true
+		logger, err := New(sink, SegmentSize(10), OnFlushFailure(BufferAndRetry, 4), Limits(rl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loggers = append(loggers, logger)
+	}
+
+	// The first logger's full segment is buffered; the second logger's
+	// would take the pending segments over the shared limit.
+	var ferr *FlushError
+	for i, logger := range loggers {
+		if _, err := logger.Append([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		_, err := logger.Append([]byte("0123456789"))
+		if i == 0 && err != nil {
+			t.Fatalf("logger 0: %v", err)
+		} else if i == 1 && !errors.As(err, &ferr) {
+			t.Fatalf("logger 1: want *FlushError, got %v", err)
+		}
+	}
+
+	// Once the first logger's pending segment is written, there is room
+	// for the second logger's.
+	sinks[0].fail = false
+	if err := loggers[0].Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loggers[1].Append([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if st := loggers[1].Stats(); st.Pending != 1 {
+		t.Errorf("want 1 pending segment, got %d", st.Pending)
+	}
+}
+
+func TestResourceLimitsCachedSegments(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-limits"
+	defer os.RemoveAll(tempdir)
+
+	rl := &ResourceLimits{MaxCachedSegments: 2, MaxOpenFiles: 1}
+	var sinks []*DirectorySink
+	for _, dir := range []string{tempdir + "/a", tempdir + "/b"} {
+		s, err := NewDirectorySink(dir, CacheSegments(5), DirectoryLimits(rl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sinks = append(sinks, s)
+	}
+
+	if _, err := sinks[0].Warmup(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sinks[1].Warmup(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sinks[0].cache); n != 2 {
+		t.Errorf("want 2 segments cached by the first sink, got %d", n)
+	}
+	if n := len(sinks[1].cache); n != 0 {
+		t.Errorf("want no segments cached by the second sink, got %d", n)
+	}
+
+	// Dropping the first sink's cache makes room for the second's.
+	if err := sinks[0].Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sinks[1].Warmup(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sinks[1].cache); n != 2 {
+		t.Errorf("want 2 segments cached by the second sink, got %d", n)
+	}
+}
+
+func TestResourceLimitsOpenFiles(t *testing.T) {
+	rl := &ResourceLimits{MaxOpenFiles: 1}
+	rl.acquireFile()
+
+	acquired := make(chan struct{})
+	go func() {
+		rl.acquireFile()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more files than the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	rl.releaseFile()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("file not acquired after release")
+	}
+	rl.releaseFile()
+}
@@ -1,16 +1,32 @@
 package wal
 
 import (
+	"context"
+	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 )
 
 // New creates a new write-ahead logger that will persist records to sink.
+//
+// Offsets assigned by the logger always follow on from the newest offset
+// already in sink, so a DirectorySink holding an existing log should be
+// analyzed before calling New.
+//
+// If the log in sink was created by a newer version of this package (see
+// Bootstrap), New returns a *FormatVersionError, rather than risk
+// corrupting it; it can be read, but not written, with NewView.
 func New(sink Sink, options ...Option) (*Logger, error) {
 	if sink == nil {
 		return nil, errors.New("nil sink")
 	}
+	if err := checkVersion(sink); err != nil {
+		return nil, err
+	}
 	logger := &Logger{
 		sink:    sink,
 		segSize: DefaultSegmentSize,
@@ -20,7 +36,17 @@ func New(sink Sink, options ...Option) (*Logger, error) {
 			return nil, errors.Wrap(err, "applying option")
 		}
 	}
+	if err := logger.checkKeyOptions(sink); err != nil {
+		return nil, err
+	}
 	logger.seg = NewSegmentSize(logger.segSize)
+	logger.seg.onBump = logger.checkSkew
+	logger.seg.sealer = logger.sealer
+	logger.seg.sep = logger.textSep
+
+	// Never assign offsets older than those already in the sink, in case
+	// the system clock has gone backwards since they were written.
+	_, logger.seg.last = sink.Offsets()
 	return logger, nil
 }
 
@@ -29,12 +55,55 @@ func New(sink Sink, options ...Option) (*Logger, error) {
 // A Logger always maintains an "active" segment that data will be written to.
 // For more details, see the Write method's documentation.
 type Logger struct {
-	sink    Sink
-	segSize uint64
+	sink          Sink
+	segSize       uint64
+	onFailure     FlushFailurePolicy
+	maxPending    int
+	skewThreshold time.Duration
+	onSkew        func(behind time.Duration)
+	producer      string               // Stored alongside each data chunk; see the Producer option.
+	writeTimeout  time.Duration        // How long to wait for the sink to write a segment, if non-zero.
+	maxLatency    time.Duration        // How long Write waits for a flush, if non-zero; see MaxWriteLatency.
+	textSep       byte                 // Separator used to encode segments, if non-zero; see TextSeparator.
+	limits        *ResourceLimits      // Shared resource limits, if non-nil; see the Limits option.
+	batchWindow   time.Duration        // How long small records are batched for, if non-zero; see BatchRecords.
+	batchMax      int                  // The most records in a batch.
+	sealer        *recordSealer        // Encrypts data chunks, if non-nil; see the EncryptRecords option.
+	compressMin   int                  // Size of the smallest data chunk compressed, if non-zero; see CompressRecords.
+	flushAt       int64                // Encoded size at which the active segment is flushed, if non-zero; see FlushAt.
+	validators    []func([]byte) error // Check records before they are written; see the Validate option.
+	onFinalize    func(*Segment) error // Called for each segment written; see OnSegmentFinalize.
+	finalizeBlock bool                 // Whether onFinalize's errors fail the flush.
+
+	mu       sync.RWMutex
+	seg      *Segment   // The currently-active segment that data will be written to.
+	pending  []*Segment // Segments that failed to be written to the sink.
+	reserved int64      // Bytes of pending segments reserved in limits.
+	closed   bool       // Indicates if the logger is "closed" for writing.
+
+	// The open batch of small records; see BatchRecords.
+	batch      []batchRecord
+	batchSize  int        // Encoded size of the records in batch.
+	batchAttrs chunkAttrs // Attributes the records in batch were written with.
+	batchStart time.Time  // When the first record in batch was written.
 
-	mu     sync.RWMutex
-	seg    *Segment // The currently-active segment that data will be written to.
-	closed bool     // Indicates if the logger is "closed" for writing.
+	inflight *inflightWrite // A timed-out write to the sink, if any.
+
+	unfinalized *Segment // A segment written to the sink whose blocking finalize func failed.
+
+	// The flush started with PrepareFlush, if any.
+	preparedID atomic.Uint64 // ID of the flush's FlushToken.
+	prepared   Offset        // Newest offset in the sink before the flush.
+
+	// Flush statistics; see Stats.
+	flushes      uint64
+	flushErrors  uint64
+	lastFlush    time.Time
+	lastErr      error
+	written      uint64 // Non-empty segments written to the Sink.
+	writtenBytes int64  // Bytes of data chunks written to the Sink.
+	finalizeErrs uint64
+	lastFinalize error
 }
 
 // lock runs the given function fn, while holding a write lock on a *Logger's
@@ -48,17 +117,178 @@ func (l *Logger) lock(fn func() error) error {
 	return nil
 }
 
+// currentSink returns the *Logger's Sink. The Sink may be replaced by
+// SwitchSink, so it must not be accessed directly without holding the
+// *Logger's lock.
+func (l *Logger) currentSink() Sink {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sink
+}
+
+// SwitchSink flushes the active segment (and any pending segments) to the
+// *Logger's current Sink, then redirects all future segments to sink. The
+// previous Sink is closed.
+//
+// If copyExisting is true, every segment held by the previous Sink is
+// written to sink before the switch takes place, so that sink holds the
+// complete log. Writes to the *Logger block until the switch is complete.
+//
+// Readers created before calling SwitchSink continue to read from the
+// previous Sink.
+func (l *Logger) SwitchSink(sink Sink, copyExisting bool) error {
+	if sink == nil {
+		return errors.New("nil sink")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLoggerClosed
+	}
+	if err := l.checkKeyOptions(sink); err != nil {
+		return err
+	}
+
+	if err := l.flush(); err != nil {
+		return errors.Wrap(err, "flush")
+	}
+	if copyExisting {
+		if err := copySegments(sink, l.sink); err != nil {
+			return errors.Wrap(err, "copy segments")
+		}
+	}
+
+	old := l.sink
+	l.sink = sink
+	if err := old.Close(); err != nil {
+		return errors.Wrap(err, "close previous sink")
+	}
+	return nil
+}
+
+// copySegments writes every segment held by src to dst, oldest first.
+func copySegments(dst SegmentWriter, src SegmentLoader) error {
+	seg, err := src.LoadSegment(ZeroOffset)
+	for err == nil {
+		if err := dst.WriteSegment(seg); err != nil {
+			return errors.Wrap(err, "write segment")
+		}
+		_, end := seg.Limits()
+		seg, err = src.LoadSegment(end + 1)
+	}
+	if err != io.EOF {
+		return errors.Wrap(err, "load segment")
+	}
+	return nil
+}
+
 // Latest returns the offsets of the first (oldest), and last (newest)
 // data chunks.
 func (l *Logger) Offsets() (first, last Offset) {
-	return l.sink.Offsets()
+	return l.currentSink().Offsets()
+}
+
+// Healthy reports whether the *Logger is able to persist data. It is
+// intended to be used from a service's readiness check.
+//
+// Healthy returns ErrLoggerClosed if the *Logger has been closed, and a
+// *FlushError if there are segments that could not be written to the Sink.
+// If the Sink implements the HealthChecker interface, its Ping method is
+// also called.
+func (l *Logger) Healthy(ctx context.Context) error {
+	l.mu.RLock()
+	closed, pending := l.closed, len(l.pending)
+	l.mu.RUnlock()
+	if closed {
+		return ErrLoggerClosed
+	}
+	if pending > 0 {
+		return &FlushError{
+			Err:     errors.New("segments waiting to be written"),
+			Pending: pending,
+		}
+	}
+
+	if hc, ok := l.currentSink().(HealthChecker); ok {
+		if err := hc.Ping(ctx); err != nil {
+			return errors.Wrap(err, "sink unhealthy")
+		}
+	}
+	return nil
 }
 
 var (
 	ErrTooBig       = errors.New("wal: data too large for segment")
 	ErrLoggerClosed = errors.New("wal: logger closed")
+
+	// ErrSlowSink is returned by Write when flushing the active segment
+	// takes longer than the latency set with the MaxWriteLatency option.
+	ErrSlowSink = errors.New("wal: sink too slow")
 )
 
+// FlushError is returned when a *Logger could not write a segment to its
+// Sink.
+//
+// The segment that could not be written is retained by the *Logger, and
+// will be written to the Sink on the next flush. Use errors.As to check for
+// a *FlushError.
+type FlushError struct {
+	Err     error // The error returned by the Sink.
+	Pending int   // The number of segments waiting to be written.
+}
+
+func (e *FlushError) Error() string {
+	return "wal: flush failed: " + e.Err.Error()
+}
+
+// Cause returns the error returned by the Sink.
+func (e *FlushError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the error returned by the Sink.
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// WriteTimeoutError is returned, as the cause of a *FlushError, when a Sink
+// does not finish writing a segment within the time set with the
+// SinkWriteTimeout option.
+type WriteTimeoutError struct {
+	After time.Duration // How long the *Logger waited for the Sink.
+}
+
+func (e *WriteTimeoutError) Error() string {
+	return "wal: sink write timed out after " + e.After.String()
+}
+
+// Timeout reports whether the error is a timeout; it always returns true.
+func (e *WriteTimeoutError) Timeout() bool {
+	return true
+}
+
+// RejectedError is returned when a record is rejected by one of the
+// validators registered with the Validate option. Use errors.As to check
+// for a *RejectedError.
+type RejectedError struct {
+	Err error // The error returned by the validator.
+}
+
+func (e *RejectedError) Error() string {
+	return "wal: record rejected: " + e.Err.Error()
+}
+
+// Cause returns the error returned by the validator.
+func (e *RejectedError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the error returned by the validator.
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
 // Write implements the io.Writer interface for a *Logger.
 //
 // When len(p) > the amount of space left in a segment, the current segment
@@ -67,43 +297,212 @@ var (
 // Should len(p) be larger than the size of a new, empty segment, this method
 // will return ErrTooBig.
 //
+// If the current segment cannot be written to the Sink, the behaviour
+// depends on the FlushFailurePolicy the *Logger was created with (see the
+// OnFlushFailure option). By default, p is not written, and a *FlushError is
+// returned; the full segment is retained, so it is safe to retry the Write.
+//
 // Any attempt to write to a *Logger, after its Close method has been called,
 // will yield ErrLoggerClosed.
 func (l *Logger) Write(p []byte) (int, error) {
-	if uint64(len(p)) > l.segSize {
-		return 0, ErrTooBig
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := l.write(p, nil); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
+
+// WriteString is like Write, but writes the contents of s, without first
+// converting it to a []byte; s is copied directly into the new data chunk.
+// It implements the io.StringWriter interface.
+func (l *Logger) WriteString(s string) (int, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if _, err := writeLogger(l, s, nil); err != nil {
+		return 0, err
+	}
+	return len(s), nil
+}
+
+// Append writes p to the *Logger, in the same way as Write, and returns the
+// offset of the new data chunk.
+func (l *Logger) Append(p []byte) (Offset, error) {
+	return l.write(p, nil)
+}
+
+// AppendTTL is like Append, but the data chunk expires ttl after it is
+// written. Expired chunks can be skipped by a Reader (see its SkipExpired
+// method), and removed with walutil.Reap.
+func (l *Logger) AppendTTL(p []byte, ttl time.Duration) (Offset, error) {
+	if ttl <= 0 {
+		return ZeroOffset, errors.New("ttl must be positive")
+	}
+	return l.write(p, chunkAttrs{attrTTL: strconv.FormatInt(int64(ttl), 10)})
+}
+
+// write writes p, and the chunk attributes attrs, to the active segment, as
+// described by Write, and returns the offset of the new data chunk.
+func (l *Logger) write(p []byte, attrs chunkAttrs) (Offset, error) {
+	return writeLogger(l, p, attrs)
+}
 
+// writeLogger implements the write method, for any type of chunk data.
+func writeLogger[D chunkData](l *Logger, p D, attrs chunkAttrs) (Offset, error) {
+	batched := l.batchWindow > 0 && attrs == nil && len(p) < batchRecordLimit
+	if len(l.validators) > 0 && !attrs.control() {
+		b := []byte(p)
+		for _, fn := range l.validators {
+			if err := fn(b); err != nil {
+				return ZeroOffset, &RejectedError{Err: err}
+			}
+		}
+	}
+	if l.compressMin > 0 && !batched && !attrs.control() && len(p) >= l.compressMin {
+		if z, ok := deflateRecord([]byte(p)); ok {
+			if attrs == nil {
+				attrs = make(chunkAttrs, 1)
+			}
+			attrs[attrDeflate] = "1"
+			p = D(z)
+		}
+	}
+	if l.producer != "" {
+		if attrs == nil {
+			attrs = make(chunkAttrs, 1)
+		}
+		attrs[attrProducer] = l.producer
+	}
+	if l.sealer != nil {
+		if attrs == nil {
+			attrs = make(chunkAttrs, 1)
+		}
+		attrs[attrSealed] = "1"
+		id, err := l.sealer.keyID(l.producer)
+		if err != nil {
+			return ZeroOffset, err
+		}
+		if id != "" {
+			attrs[attrKey] = id
+		}
+	}
+	hdr := attrs.encode()
+	if uint64(len(p)+len(hdr)+l.sealer.overhead(hdr)) > l.segSize {
+		return ZeroOffset, ErrTooBig
+	}
+	if batched {
+		batched = l.batchFits(1, batchEntrySize(0, len(p)), attrs, int64(l.segSize))
+	}
+
+	var off Offset
 	if err := l.lock(func() error {
 		if l.closed {
 			return ErrLoggerClosed
 		}
+		if _, genesis := attrs[attrGenesis]; genesis && !l.empty() {
+			return ErrNotEmpty
+		}
 
-	WriteData:
-		_, err := l.seg.Write(p)
-		if err != nil && err == ErrNotEnoughSpace {
-			if err := l.flush(); err != nil {
+		// A timed-out write to the Sink may still be writing the active
+		// segment, in which case it must not be modified; try writing it
+		// again first.
+		if w := l.inflight; w != nil && w.seg == l.seg {
+			if err := l.writeFlush(); err != nil {
 				return err
 			}
-			goto WriteData
 		}
-		return nil
+
+		if l.flushAt > 0 && l.seg.Stats().EncodedSize >= l.flushAt {
+			if err := l.writeFlush(); err != nil {
+				return err
+			}
+		}
+
+		if batched {
+			o, err := l.appendBatch(append([]byte(nil), p...), attrs)
+			off = o
+			return err
+		}
+		if err := l.closeBatch(); err != nil {
+			return err
+		}
+		o, err := appendFlushing(func() *Segment { return l.seg }, p, hdr, l.writeFlush)
+		off = o
+		return err
 	}); err != nil {
-		return 0, errors.Wrap(err, "write")
+		return ZeroOffset, errors.Wrap(err, "write")
 	}
-	return len(p), nil
+	return off, nil
+}
+
+// writeFlush flushes the *Logger for a write, waiting no longer than the
+// latency set with the MaxWriteLatency option, if any, and retains the
+// active segment if the flush fails (see retain). If the flush is too slow,
+// it is left running, and ErrSlowSink is returned.
+func (l *Logger) writeFlush() error {
+	wait := l.writeTimeout
+	if l.maxLatency > 0 && (wait <= 0 || l.maxLatency < wait) {
+		wait = l.maxLatency
+	}
+	err := l.flushWithin(wait)
+	var timeout *WriteTimeoutError
+	if l.maxLatency > 0 && errors.As(err, &timeout) && timeout.After == l.maxLatency {
+		return ErrSlowSink
+	}
+	// The active segment was written if only its finalize func failed.
+	if err != nil && (l.unfinalized != nil || !l.retain()) {
+		return err
+	}
+	return nil
+}
+
+// retain moves the active segment to the list of pending segments, and
+// starts a new, empty segment, if the *Logger's FlushFailurePolicy allows
+// it. It reports whether the active segment was retained.
+func (l *Logger) retain() bool {
+	if l.onFailure != BufferAndRetry {
+		return false
+	}
+	if len(l.pending) >= l.maxPending {
+		return false
+	}
+	size := l.seg.Size()
+	if !l.limits.reservePending(size) {
+		return false
+	}
+	l.reserved += size
+	l.pending = append(l.pending, l.seg)
+	l.seg = l.newSegment()
+	return true
+}
+
+// releasePending releases the bytes reserved in the *Logger's
+// ResourceLimits for pending segments that have since been written, or
+// truncated. It must be called while holding l.mu.
+func (l *Logger) releasePending() {
+	if l.limits == nil {
+		return
+	}
+	var size int64
+	for _, seg := range l.pending {
+		size += seg.Size()
+	}
+	l.limits.releasePending(l.reserved - size)
+	l.reserved = size
 }
 
 // NewReader returns a new *Reader that can sequentially read chunks of data
 // from the earliest-known offset.
 func (l *Logger) NewReader() *Reader {
-	return NewReader(l.sink)
+	return NewReader(l.currentSink())
 }
 
 // NewReaderOffset returns a new *Reader that can be used to sequentially read
 // chunks of data, starting at offset.
 func (l *Logger) NewReaderOffset(offset Offset) *Reader {
-	return NewReaderOffset(l.sink, offset)
+	return NewReaderOffset(l.currentSink(), offset)
 }
 
 // Close persists the current segment, by writing it to the *Logger's Sink,
@@ -145,27 +544,262 @@ func (l *Logger) Flush() error {
 	return nil
 }
 
-// flush dumps the currently-active data segment to the
-// *Logger's internal Sink, and replaces the segment with a new, empty
-// one.
+// flush dumps any pending segments, followed by the currently-active data
+// segment, to the *Logger's internal Sink, and replaces the active segment
+// with a new, empty one.
+//
+// Segments are written in the order they were filled. Should the Sink fail to
+// write a segment, flush stops, and returns a *FlushError.
 func (l *Logger) flush() error {
-	if err := l.sink.WriteSegment(l.seg); err != nil {
-		return errors.Wrap(err, "write segment")
+	return l.flushWithin(l.writeTimeout)
+}
+
+// flushWithin is like flush, but waits no longer than wait for the Sink to
+// write each segment, if wait is non-zero (see writeSegment).
+func (l *Logger) flushWithin(wait time.Duration) (err error) {
+	defer func() {
+		if err != nil {
+			l.flushErrors++
+			l.lastErr = err
+			return
+		}
+		l.flushes++
+		l.lastFlush = time.Now()
+	}()
+
+	if err := l.closeBatch(); err != nil {
+		return err
+	}
+
+	// Nothing more is written until a blocking finalize func succeeds for
+	// the last segment written.
+	if seg := l.unfinalized; seg != nil {
+		l.unfinalized = nil
+		if err := l.finalize(seg); err != nil {
+			return err
+		}
+	}
+
+	for len(l.pending) > 0 {
+		seg := l.pending[0]
+		if err := l.writeSegment(seg, wait); err != nil {
+			return &FlushError{Err: err, Pending: l.numPending()}
+		}
+		l.count(seg)
+		l.pending[0] = nil
+		l.pending = l.pending[1:]
+		l.releasePending()
+		if err := l.finalize(seg); err != nil {
+			return err
+		}
+	}
+	seg := l.seg
+	if err := l.writeSegment(seg, wait); err != nil {
+		return &FlushError{Err: err, Pending: l.numPending()}
+	}
+	l.count(seg)
+	l.seg = l.newSegment()
+	return l.finalize(seg)
+}
+
+// count adds seg, which has been written to the Sink, to the *Logger's
+// statistics, unless it is empty.
+func (l *Logger) count(seg *Segment) {
+	if seg.Chunks() > 0 {
+		l.written++
+		l.writtenBytes += seg.Size()
+	}
+}
+
+// finalize calls the *Logger's finalize func (see OnSegmentFinalize) for
+// seg, which has been written to the Sink, unless it is empty. If the func
+// is blocking, and fails, seg is kept to be finalized by the next flush,
+// and a *FlushError is returned.
+func (l *Logger) finalize(seg *Segment) error {
+	if l.onFinalize == nil || seg.Chunks() == 0 {
+		return nil
 	}
-	l.seg = NewSegmentSize(l.segSize)
+	err := l.onFinalize(seg)
+	if err == nil {
+		return nil
+	}
+	l.finalizeErrs++
+	l.lastFinalize = err
+	if !l.finalizeBlock {
+		return nil
+	}
+	l.unfinalized = seg
+	return &FlushError{Err: errors.Wrap(err, "finalize segment"), Pending: l.numPending()}
+}
+
+// numPending returns the number of segments waiting to be written to the
+// Sink, including the active segment, unless it is empty.
+func (l *Logger) numPending() int {
+	n := len(l.pending)
+	if l.seg.Chunks() > 0 {
+		n++
+	}
+	return n
+}
+
+// inflightWrite is a write to the Sink that timed out, but may not have
+// finished.
+type inflightWrite struct {
+	seg    *Segment
+	chunks int        // The number of chunks in seg when the write started.
+	done   chan error // Receives the result of the write.
+}
+
+// writeSegment writes seg to the *Logger's Sink, waiting no longer than
+// wait, if it is non-zero. A Sink implementing ContextWriter is asked to
+// give up after the timeout set with the SinkWriteTimeout option, if any.
+//
+// A write that times out is left running; before seg is written again,
+// writeSegment waits for it to finish, so that the Sink never writes the
+// same segment twice at once. If it finished successfully, and seg has not
+// changed since, seg is not written again.
+func (l *Logger) writeSegment(seg *Segment, wait time.Duration) error {
+	if wait <= 0 {
+		return l.sink.WriteSegment(seg)
+	}
+	timeout := &WriteTimeoutError{After: wait}
+
+	// Waiting for a timed-out write counts towards the timeout.
+	deadline := time.Now().Add(wait)
+	if w := l.inflight; w != nil {
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case err := <-w.done:
+			timer.Stop()
+			l.inflight = nil
+			if err == nil && w.seg == seg && w.chunks == seg.Chunks() {
+				return nil
+			}
+		case <-timer.C:
+			return timeout
+		}
+	}
+
+	// The Sink's deadline may be later than ours, in which case the write
+	// carries on after we stop waiting for it.
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if l.writeTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, l.writeTimeout)
+	}
+	w := &inflightWrite{seg: seg, chunks: seg.Chunks(), done: make(chan error, 1)}
+	go func(sink Sink) {
+		defer cancel()
+		if cw, ok := sink.(ContextWriter); ok {
+			w.done <- cw.WriteSegmentContext(ctx, seg)
+			return
+		}
+		w.done <- sink.WriteSegment(seg)
+	}(l.sink)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-w.done:
+		return err
+	case <-timer.C:
+		l.inflight = w
+		return timeout
+	}
+}
+
+// newSegment returns a new, empty segment whose chunk offsets will follow on
+// from those in the active segment.
+func (l *Logger) newSegment() *Segment {
+	seg := NewSegmentSize(l.segSize)
+	seg.last = l.seg.last // Keep offsets increasing across segments.
+	seg.onBump = l.checkSkew
+	seg.sealer = l.sealer
+	seg.sep = l.textSep
+	return seg
+}
+
+// checkSkew calls the *Logger's clock skew function (see OnClockSkew) if
+// the wall-clock offset wall is too far behind last.
+func (l *Logger) checkSkew(wall, last Offset) {
+	if l.onSkew == nil {
+		return
+	}
+	if behind := time.Duration(last - wall); behind > l.skewThreshold {
+		l.onSkew(behind)
+	}
+}
+
+// TruncateAfter removes all data chunks whose offsets are > offset, from the
+// *Logger's Sink, any segments waiting to be written to it, and the active
+// segment. It returns ErrNotSupported if the Sink does not implement the
+// TailTruncater interface.
+//
+// Offsets of data chunks written after calling TruncateAfter continue to
+// increase from the newest offset written before it.
+//
+// If offset falls inside a batch that has been written to a segment (see
+// BatchRecords), nothing is truncated, and an error wrapping ErrSplitBatch
+// is returned.
+func (l *Logger) TruncateAfter(offset Offset) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkSplit(offset); err != nil {
+		return errors.Wrap(err, "truncate wal")
+	}
+
+	if err := truncateAfter(l.sink, offset); err != nil {
+		return errors.Wrap(err, "truncate wal")
+	}
+
+	pending := l.pending[:0]
+	for _, seg := range l.pending {
+		seg.TruncateAfter(offset)
+		if seg.Chunks() > 0 {
+			pending = append(pending, seg)
+		}
+	}
+	for i := len(pending); i < len(l.pending); i++ {
+		l.pending[i] = nil
+	}
+	l.pending = pending
+	l.releasePending()
+	l.seg.TruncateAfter(offset)
+	l.truncateBatch(func(off Offset) bool { return off.After(offset) })
 	return nil
 }
 
 // Truncate removes all data chunks whose offsets are <= offset.
 //
 // This method attempts to call the underlying Sink's Truncate method, before
-// truncating the current segment.
+// truncating any segments waiting to be written to it, and the current
+// segment.
+//
+// If offset falls inside a batch that has been written to a segment (see
+// BatchRecords), nothing is truncated, and an error wrapping ErrSplitBatch
+// is returned.
 func (l *Logger) Truncate(offset Offset) error {
-	if err := l.sink.Truncate(offset); err != nil {
+	if err := l.lock(func() error { return l.checkSplit(offset) }); err != nil {
+		return errors.Wrap(err, "truncate wal")
+	}
+	if err := l.currentSink().Truncate(offset); err != nil {
 		return errors.Wrap(err, "truncate wal")
 	}
 	l.lock(func() error {
+		pending := l.pending[:0]
+		for _, seg := range l.pending {
+			seg.Truncate(offset)
+			if seg.Chunks() > 0 {
+				pending = append(pending, seg)
+			}
+		}
+		for i := len(pending); i < len(l.pending); i++ {
+			l.pending[i] = nil
+		}
+		l.pending = pending
+		l.releasePending()
 		l.seg.Truncate(offset)
+		l.truncateBatch(func(off Offset) bool { return !off.After(offset) })
 		return nil
 	})
 	return nil
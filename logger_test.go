@@ -0,0 +1,609 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// failingSink wraps a Sink, and fails calls to WriteSegment while fail is
+// true.
+type failingSink struct {
+	Sink
+	fail bool
+}
+
+func (s *failingSink) WriteSegment(seg *Segment) error {
+	if s.fail {
+		return errors.New("sink unavailable")
+	}
+	return s.Sink.WriteSegment(seg)
+}
+
+func newFailingSink(t *testing.T) *failingSink {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &failingSink{Sink: mem}
+}
+
+func TestLoggerFailFast(t *testing.T) {
+	sink := newFailingSink(t)
+	logger, err := New(sink, SegmentSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := logger.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The active segment is full, and cannot be flushed.
+	sink.fail = true
+	var ferr *FlushError
+	if _, err := logger.Write([]byte("abcdefghij")); !errors.As(err, &ferr) {
+		t.Fatalf("want *FlushError, got %v", err)
+	}
+
+	// Retrying once the sink recovers writes each record exactly once.
+	sink.fail = false
+	if _, err := logger.Write([]byte("abcdefghij")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sink.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments: want=%d got=%d", 2, n)
+	}
+}
+
+func TestLoggerBufferAndRetry(t *testing.T) {
+	sink := newFailingSink(t)
+	logger, err := New(sink, SegmentSize(10), OnFlushFailure(BufferAndRetry, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.fail = true
+	for i := 0; i < 3; i++ {
+		if _, err := logger.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	// Two segments are pending, and the active segment is full.
+	var ferr *FlushError
+	if _, err := logger.Write([]byte("0123456789")); !errors.As(err, &ferr) {
+		t.Fatalf("want *FlushError, got %v", err)
+	}
+
+	sink.fail = false
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sink.NumSegments(); n != 3 {
+		t.Errorf("wrong number of segments: want=%d got=%d", 3, n)
+	}
+
+	var prev Offset
+	r := NewReader(sink)
+	for r.Next() {
+		if !r.Offset().After(prev) {
+			t.Errorf("out-of-order offset %v after %v", r.Offset(), prev)
+		}
+		prev = r.Offset()
+	}
+}
+
+func TestLoggerTruncatePending(t *testing.T) {
+	sink := newFailingSink(t)
+	logger, err := New(sink, SegmentSize(10), OnFlushFailure(BufferAndRetry, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.fail = true
+	var offsets []Offset
+	for i := 0; i < 3; i++ {
+		off, err := logger.Append([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		offsets = append(offsets, off)
+	}
+	var ferr *FlushError
+	if err := logger.Flush(); !errors.As(err, &ferr) || ferr.Pending != 3 {
+		t.Fatalf("want *FlushError with 3 pending segments, got %v", err)
+	}
+
+	// Truncating drops the pending segments, so they are not written
+	// once the sink recovers.
+	if err := logger.Truncate(offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); !errors.As(err, &ferr) || ferr.Pending != 1 {
+		t.Fatalf("want *FlushError with 1 pending segment, got %v", err)
+	}
+	sink.fail = false
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, sink); n != 1 {
+		t.Errorf("wrong number of chunks: want=1 got=%d", n)
+	}
+}
+
+func TestLoggerHealthy(t *testing.T) {
+	sink := newFailingSink(t)
+	logger, err := New(sink, SegmentSize(10), OnFlushFailure(BufferAndRetry, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Healthy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.fail = true
+	for i := 0; i < 2; i++ {
+		if _, err := logger.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ferr *FlushError
+	if err := logger.Healthy(context.Background()); !errors.As(err, &ferr) {
+		t.Errorf("want *FlushError, got %v", err)
+	}
+
+	sink.fail = false
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Healthy(context.Background()); err != ErrLoggerClosed {
+		t.Errorf("want %v, got %v", ErrLoggerClosed, err)
+	}
+}
+
+func TestLoggerSwitchSink(t *testing.T) {
+	old, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(old, SegmentSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := logger.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.SwitchSink(sink, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := old.NumSegments(); n != 3 {
+		t.Errorf("wrong number of segments in old sink: want=%d got=%d", 3, n)
+	}
+	if n := sink.NumSegments(); n != 4 {
+		t.Errorf("wrong number of segments in new sink: want=%d got=%d", 4, n)
+	}
+}
+
+func TestLoggerTruncateAfter(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offsets []Offset
+	for i := 0; i < 4; i++ {
+		off, err := logger.Append([]byte("record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		if i == 1 {
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Roll back to the first record; this spans the sink, and the active
+	// segment.
+	if err := logger.TruncateAfter(offsets[0]); err != nil {
+		t.Fatal(err)
+	}
+	next, err := logger.Append([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.After(offsets[3]) {
+		t.Errorf("offset did not increase after rollback: %v <= %v", next, offsets[3])
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Offset
+	r := logger.NewReader()
+	for r.Next() {
+		got = append(got, r.Offset())
+	}
+	if len(got) != 2 || got[0] != offsets[0] || got[1] != next {
+		t.Errorf("wrong offsets after rollback: want=[%v %v] got=%v", offsets[0], next, got)
+	}
+}
+
+func TestLoggerClockSkew(t *testing.T) {
+	// A log written while the clock was an hour ahead.
+	future := NewOffsetTime(time.Now().Add(time.Hour))
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(newSegmentOffsets(future)); err != nil {
+		t.Fatal(err)
+	}
+
+	var behind time.Duration
+	logger, err := New(sink, OnClockSkew(time.Minute, func(d time.Duration) {
+		behind = d
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off, err := logger.Append([]byte("after restart"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != future+1 {
+		t.Errorf("wrong offset: want=%v got=%v", future+1, off)
+	}
+	if behind < 59*time.Minute {
+		t.Errorf("clock skew not reported: behind=%v", behind)
+	}
+}
+
+func TestLoggerWriteString(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var _ io.StringWriter = logger
+	if n, err := logger.WriteString("hello, wal"); err != nil {
+		t.Fatal(err)
+	} else if n != len("hello, wal") {
+		t.Errorf("wrong number of bytes written: want=%d got=%d", len("hello, wal"), n)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := logger.NewReader()
+	if !r.Next() {
+		t.Fatal("no data chunks", r.Error())
+	}
+	if got := string(r.Data()); got != "hello, wal" {
+		t.Errorf("wrong data: want=%q got=%q", "hello, wal", got)
+	}
+}
+
+// hangingSink wraps a Sink, and blocks calls to WriteSegment until release
+// is closed.
+type hangingSink struct {
+	Sink
+	release chan struct{}
+}
+
+func (s *hangingSink) WriteSegment(seg *Segment) error {
+	<-s.release
+	return s.Sink.WriteSegment(seg)
+}
+
+func TestLoggerSinkWriteTimeout(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &hangingSink{Sink: mem, release: make(chan struct{})}
+	logger, err := New(sink, SinkWriteTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := logger.Append([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	err = logger.Flush()
+	var timeout *WriteTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("expected a *WriteTimeoutError, got %v", err)
+	}
+
+	// With the FailFast policy, the segment is kept as the active segment,
+	// so writes fail while the sink is stuck.
+	start := time.Now()
+	_, err = logger.Append([]byte("two"))
+	if !errors.As(err, &timeout) {
+		t.Fatalf("expected a *WriteTimeoutError, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("write took %v, with a timeout of 10ms", d)
+	}
+	if st := logger.Stats(); st.Pending != 0 || st.ActiveChunks != 1 {
+		t.Errorf("wrong state: want pending=0 active=1, got pending=%d active=%d", st.Pending, st.ActiveChunks)
+	}
+
+	// Once the sink recovers, the timed-out write completes, and is not
+	// repeated.
+	close(sink.release)
+	if _, err := logger.Append([]byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments: want=2 got=%d", n)
+	}
+	if n := countChunks(t, mem); n != 2 {
+		t.Errorf("wrong number of chunks: want=2 got=%d", n)
+	}
+}
+
+func TestLoggerSinkWriteTimeoutBufferAndRetry(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &hangingSink{Sink: mem, release: make(chan struct{})}
+	logger, err := New(sink, SegmentSize(10), OnFlushFailure(BufferAndRetry, 1), SinkWriteTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second write fills the segment; the timed-out flush queues it,
+	// rather than failing the write.
+	for i := 0; i < 2; i++ {
+		if _, err := logger.Append([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := logger.Stats(); st.Pending != 1 || st.ActiveChunks != 1 {
+		t.Errorf("wrong state: want pending=1 active=1, got pending=%d active=%d", st.Pending, st.ActiveChunks)
+	}
+
+	// No more than one segment is held in memory.
+	_, err = logger.Append([]byte("a"))
+	var timeout *WriteTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("expected a *WriteTimeoutError, got %v", err)
+	}
+	if st := logger.Stats(); st.Pending != 1 || st.ActiveChunks != 1 {
+		t.Errorf("wrong state: want pending=1 active=1, got pending=%d active=%d", st.Pending, st.ActiveChunks)
+	}
+
+	close(sink.release)
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, mem); n != 2 {
+		t.Errorf("wrong number of chunks: want=2 got=%d", n)
+	}
+}
+
+func TestLoggerMaxWriteLatency(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &hangingSink{Sink: mem, release: make(chan struct{})}
+	logger, err := New(sink, SegmentSize(10), OnFlushFailure(BufferAndRetry, 1), MaxWriteLatency(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second write needs the full segment to be flushed, which is too
+	// slow; it is not buffered, despite the policy.
+	if _, err := logger.Append([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := logger.Append([]byte("a")); !errors.Is(err, ErrSlowSink) {
+		t.Fatalf("want %v, got %v", ErrSlowSink, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("write took %v, with a max latency of 10ms", d)
+	}
+	if st := logger.Stats(); st.Pending != 0 || st.ActiveChunks != 1 {
+		t.Errorf("wrong state: want pending=0 active=1, got pending=%d active=%d", st.Pending, st.ActiveChunks)
+	}
+
+	// Once the background flush finishes, writes succeed, and the full
+	// segment is not written again.
+	close(sink.release)
+	if _, err := logger.Append([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments: want=2 got=%d", n)
+	}
+	if n := countChunks(t, mem); n != 2 {
+		t.Errorf("wrong number of chunks: want=2 got=%d", n)
+	}
+}
+
+func TestLoggerValidate(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errDenied := errors.New("denied")
+	logger, err := New(sink,
+		Validate(func(p []byte) error {
+			if len(p) > 5 {
+				return errors.New("too long")
+			}
+			return nil
+		}),
+		Validate(func(p []byte) error {
+			if string(p) == "nope" {
+				return errDenied
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := logger.Append([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	var rejected *RejectedError
+	if _, err := logger.WriteString("too long"); !errors.As(err, &rejected) {
+		t.Errorf("want *RejectedError, got %v", err)
+	}
+	if _, err := logger.Append([]byte("nope")); errors.Cause(err) != errDenied {
+		t.Errorf("want %v, got %v", errDenied, err)
+	}
+	if n := logger.Stats().ActiveChunks; n != 1 {
+		t.Errorf("wrong number of chunks written: want=1 got=%d", n)
+	}
+}
+
+func TestLoggerFlushAt(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, FlushAt(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := logger.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each segment is flushed once it reaches the threshold, so holds no
+	// more than one record past it.
+	if n := sink.NumSegments(); n < 10 {
+		t.Errorf("want at least 10 segments, got %d", n)
+	}
+	segs, err := LoadSegments(sink, ZeroOffset, maxOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, seg := range segs {
+		if n, _ := seg.EncodedSize(); n >= 256+64 {
+			t.Errorf("segment %d is %d bytes, encoded", i, n)
+		}
+	}
+}
+
+func TestLoggerSegmentFinalize(t *testing.T) {
+	errIndex := errors.New("index failed")
+	for _, blocking := range []bool{false, true} {
+		t.Run(fmt.Sprintf("blocking=%v", blocking), func(t *testing.T) {
+			sink, err := NewMemorySink()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				fail      bool
+				finalized []int // Chunks in each segment finalized.
+			)
+			logger, err := New(sink, OnSegmentFinalize(func(seg *Segment) error {
+				if fail {
+					return errIndex
+				}
+				finalized = append(finalized, seg.Chunks())
+				return nil
+			}, blocking))
+			if err != nil {
+				t.Fatal(err)
+			}
+			write := func(s string) {
+				if _, err := logger.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Empty segments are not finalized.
+			write("a")
+			write("b")
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			fail = true
+			write("c")
+			err = logger.Flush()
+			if blocking && !errors.Is(err, errIndex) {
+				t.Fatalf("flush: want %v, got %v", errIndex, err)
+			} else if !blocking && err != nil {
+				t.Fatal(err)
+			}
+			if _, last := sink.Offsets(); last.Equal(ZeroOffset) || sink.NumSegments() != 2 {
+				t.Fatalf("segment not written to the sink before it was finalized")
+			}
+
+			// A blocking finalize func is retried before anything else
+			// is written.
+			fail = false
+			write("d")
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			want := []int{2, 1}
+			if blocking {
+				want = []int{2, 1, 1}
+			}
+			if fmt.Sprint(finalized) != fmt.Sprint(want) {
+				t.Errorf("finalized segments with %v chunks, want %v", finalized, want)
+			}
+			if st := logger.Stats(); st.FinalizeErrors != 1 || !errors.Is(st.LastFinalizeError, errIndex) {
+				t.Errorf("stats: %d finalize errors, last %v", st.FinalizeErrors, st.LastFinalizeError)
+			}
+		})
+	}
+}
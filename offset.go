@@ -1,10 +1,11 @@
 package wal
 
 import (
+	"math"
 	"strconv"
 	"time"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 )
 
 // Offset represents the offset of a data chunk within a write-ahead logger.
@@ -14,6 +15,9 @@ type Offset int64
 // write-ahead logger.
 var ZeroOffset = Offset(0)
 
+// maxOffset is the newest-possible offset.
+const maxOffset = Offset(math.MaxInt64)
+
 // NewOffset returns a new Offset for the current time.
 // This is a shorthand for:
 //
@@ -37,6 +41,36 @@ func ParseOffset(s string) (Offset, error) {
 	return Offset(n), nil
 }
 
+// ParseOffsetBytes is like ParseOffset, but parses the offset from p,
+// without first converting it to a string. It does not allocate, unless p
+// is not a valid offset.
+func ParseOffsetBytes(p []byte) (Offset, error) {
+	s, neg := p, false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		s, neg = s[1:], s[0] == '-'
+	}
+	limit := uint64(math.MaxInt64)
+	if neg {
+		limit++
+	}
+	var n uint64
+	for _, b := range s {
+		d := uint64(b - '0')
+		if b < '0' || b > '9' || n > (limit-d)/10 {
+			// Let strconv describe the problem.
+			return ParseOffset(string(p))
+		}
+		n = n*10 + d
+	}
+	if len(s) == 0 {
+		return ParseOffset(string(p))
+	}
+	if neg {
+		return Offset(-int64(n-1) - 1), nil
+	}
+	return Offset(n), nil
+}
+
 // Before reports whether the offset o is older than b.
 func (o Offset) Before(b Offset) bool {
 	return time.Unix(0, int64(o)).Before(time.Unix(0, int64(b)))
@@ -44,7 +78,7 @@ func (o Offset) Before(b Offset) bool {
 
 // After reports whether the offset o is newer than b.
 func (o Offset) After(b Offset) bool {
-	return time.Unix(0, int64(o)).Before(time.Unix(0, int64(b)))
+	return time.Unix(0, int64(o)).After(time.Unix(0, int64(b)))
 }
 
 // Equal reports whether the offset o is the same as b.
@@ -63,3 +97,18 @@ func (o Offset) Within(a, b Offset) bool {
 func (o Offset) String() string {
 	return strconv.FormatInt(int64(o), 10)
 }
+
+// AppendText appends the offset, as returned by String, to dst, and
+// returns the extended buffer.
+//
+// It does not implement the encoding.TextAppender interface, so that
+// offsets are still encoded as numbers by encoding/json.
+func (o Offset) AppendText(dst []byte) []byte {
+	return strconv.AppendInt(dst, int64(o), 10)
+}
+
+// textLen returns the length of the offset, as returned by String.
+func (o Offset) textLen() int {
+	var buf [20]byte
+	return len(strconv.AppendInt(buf[:0], int64(o), 10))
+}
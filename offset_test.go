@@ -0,0 +1,55 @@
+package wal
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestParseOffsetBytes(t *testing.T) {
+	valid := []int64{0, 1, -1, 1234567890, math.MaxInt64, math.MinInt64}
+	for _, n := range valid {
+		s := strconv.FormatInt(n, 10)
+		got, err := ParseOffsetBytes([]byte(s))
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if got != Offset(n) {
+			t.Errorf("%s: want=%d got=%d", s, n, got)
+		}
+	}
+	if got, err := ParseOffsetBytes([]byte("+42")); err != nil || got != 42 {
+		t.Errorf("+42: got %v, %v", got, err)
+	}
+
+	invalid := []string{"", "-", "+", "12a", " 1", "9223372036854775808", "-9223372036854775809", "1_000"}
+	for _, s := range invalid {
+		_, want := ParseOffset(s)
+		if _, err := ParseOffsetBytes([]byte(s)); err == nil {
+			t.Errorf("%q: expected an error", s)
+		} else if err.Error() != want.Error() {
+			t.Errorf("%q: want error %q, got %q", s, want, err)
+		}
+	}
+}
+
+func TestOffsetAppendText(t *testing.T) {
+	o := NewOffset()
+	p := o.AppendText([]byte("x"))
+	if want := "x" + o.String(); string(p) != want {
+		t.Errorf("want=%q got=%q", want, p)
+	}
+	if o.textLen() != len(o.String()) {
+		t.Errorf("wrong text length: want=%d got=%d", len(o.String()), o.textLen())
+	}
+
+	buf := make([]byte, 0, 32)
+	text := []byte(o.String())
+	if n := testing.AllocsPerRun(100, func() {
+		buf = o.AppendText(buf[:0])
+		if _, err := ParseOffsetBytes(text); err != nil {
+			t.Fatal(err)
+		}
+	}); n != 0 {
+		t.Errorf("want no allocations, got %v", n)
+	}
+}
@@ -1,5 +1,11 @@
 package wal
 
+import (
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
 // Option is a functional configuration type that can be used to configure
 // the behaviour of a *Logger.
 type Option func(*Logger) error
@@ -9,9 +15,300 @@ type Option func(*Logger) error
 // Depending on the Sink provided to the *Logger, setting n too low may cause
 // excessive amounts of I/O, thus slowing everything down. Another potential
 // problem is attempting to write data, where len(data) > n.
+//
+// n must be between 1, and MaxSegmentSize.
 func SegmentSize(n uint64) Option {
 	return func(l *Logger) error {
+		if n == 0 || n > MaxSegmentSize {
+			return errors.Errorf("segment size must be between 1 and %d", MaxSegmentSize)
+		}
 		l.segSize = n
 		return nil
 	}
 }
+
+// FlushFailurePolicy determines what a *Logger does when a full segment
+// cannot be written to its Sink during a call to Write.
+type FlushFailurePolicy int
+
+const (
+	// FailFast causes Write to return a *FlushError, without writing the
+	// data. The full segment is kept as the active segment, and will be
+	// written to the Sink on the next Write, or Flush.
+	FailFast FlushFailurePolicy = iota
+
+	// BufferAndRetry causes the full segment to be held in memory as a
+	// "pending" segment, and the data to be written to a new segment.
+	// Pending segments are written to the Sink, in order, on the next
+	// flush. Once the maximum number of pending segments is reached, Write
+	// behaves as it would with FailFast.
+	BufferAndRetry
+)
+
+func (p FlushFailurePolicy) String() string {
+	switch p {
+	case FailFast:
+		return "fail-fast"
+	case BufferAndRetry:
+		return "buffer-and-retry"
+	}
+	return "unknown"
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so that a
+// FlushFailurePolicy can be stored in a configuration file (see Config).
+func (p FlushFailurePolicy) MarshalText() ([]byte, error) {
+	switch p {
+	case FailFast, BufferAndRetry:
+		return []byte(p.String()), nil
+	}
+	return nil, errors.Errorf("unknown flush failure policy %d", p)
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface. It
+// accepts "fail-fast", and "buffer-and-retry".
+func (p *FlushFailurePolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "fail-fast":
+		*p = FailFast
+	case "buffer-and-retry":
+		*p = BufferAndRetry
+	default:
+		return errors.Errorf("unknown flush failure policy %q", text)
+	}
+	return nil
+}
+
+// OnFlushFailure sets the policy a *Logger follows when a segment cannot be
+// written to its Sink during a call to Write. The default policy is
+// FailFast.
+//
+// maxPending is the maximum number of segments that will be held in memory
+// when policy is BufferAndRetry; it is ignored for FailFast.
+func OnFlushFailure(policy FlushFailurePolicy, maxPending int) Option {
+	return func(l *Logger) error {
+		switch policy {
+		case FailFast:
+		case BufferAndRetry:
+			if maxPending < 1 {
+				return errors.New("maxPending must be at least 1")
+			}
+			l.maxPending = maxPending
+		default:
+			return errors.Errorf("unknown flush failure policy %d", policy)
+		}
+		l.onFailure = policy
+		return nil
+	}
+}
+
+// OnClockSkew sets a function that is called when the system clock is found
+// to be more than threshold behind the offset of the last data chunk
+// written, such as after the clock has been stepped backwards by NTP.
+//
+// A *Logger never assigns an offset at, or before, that of the last data
+// chunk written (including those already in its Sink when it was created),
+// so while the clock is behind, offsets continue to increase by one
+// nanosecond per data chunk. fn is passed how far behind the clock is. It
+// is called while the *Logger is locked, so it must not call the *Logger's
+// methods.
+func OnClockSkew(threshold time.Duration, fn func(behind time.Duration)) Option {
+	return func(l *Logger) error {
+		if threshold < 0 {
+			return errors.New("negative clock skew threshold")
+		}
+		if fn == nil {
+			return errors.New("nil clock skew func")
+		}
+		l.skewThreshold = threshold
+		l.onSkew = fn
+		return nil
+	}
+}
+
+// OnSegmentFinalize sets a function that is called once for each segment
+// holding data chunks, after it has been written to the *Logger's Sink, so
+// that an application can build artifacts derived from it, such as an
+// index, or a copy held elsewhere. fn is called while the *Logger is
+// locked, so it must not call the *Logger's methods, and it must not modify
+// seg.
+//
+// If blocking is true, and fn returns an error, the flush that wrote seg
+// fails with a *FlushError, although seg stays in the Sink; each later
+// flush calls fn for seg again, before writing anything else, until it
+// succeeds. Otherwise, the error is only counted (see Stats), and fn is not
+// called for seg again.
+func OnSegmentFinalize(fn func(seg *Segment) error, blocking bool) Option {
+	return func(l *Logger) error {
+		if fn == nil {
+			return errors.New("nil segment finalize func")
+		}
+		l.onFinalize = fn
+		l.finalizeBlock = blocking
+		return nil
+	}
+}
+
+// Producer sets an ID that is stored alongside each data chunk written by
+// the *Logger, identifying where it came from. When several producers write
+// to the same Sink, or their logs are merged, a Reader can replay the data
+// chunks written by each of them separately (see the Reader's
+// FilterProducer method).
+func Producer(id string) Option {
+	return func(l *Logger) error {
+		if id == "" {
+			return errors.New("empty producer id")
+		}
+		l.producer = id
+		return nil
+	}
+}
+
+// SinkWriteTimeout sets how long a *Logger waits for its Sink to write a
+// segment, so that a Sink that hangs (such as one on an unresponsive
+// network filesystem) cannot block Write, or Flush, forever.
+//
+// If the Sink implements the ContextWriter interface, it is asked to give
+// up once d has passed. Either way, when a write times out, the *Logger
+// returns a *FlushError whose cause is a *WriteTimeoutError, and follows
+// its FlushFailurePolicy, as it would for any other failed write.
+//
+// The Sink may still finish the timed-out write in the background, so the
+// segment is not modified until it does: with FailFast, Write returns a
+// *FlushError until the segment has been written. Before trying again, the
+// *Logger waits for the timed-out write to finish, rather than writing the
+// same segment twice; the wait counts towards d.
+func SinkWriteTimeout(d time.Duration) Option {
+	return func(l *Logger) error {
+		if d <= 0 {
+			return errors.New("sink write timeout must be positive")
+		}
+		l.writeTimeout = d
+		return nil
+	}
+}
+
+// TextSeparator sets the byte that separates each data chunk's data from
+// its offset, and attributes, when the *Logger's segments are encoded, in
+// place of ":". sep must be printable ASCII punctuation that cannot appear
+// in an encoded offset, attribute, or data chunk; it cannot be one of
+// "+/=;%#-_.~".
+//
+// Segments encoded with a separator other than ":" begin with a header
+// line recording it, so that they can be decoded without knowing how the
+// *Logger was configured:
+//
+//	#codec=text;sep=<separator>
+func TextSeparator(sep byte) Option {
+	return func(l *Logger) error {
+		if !validSeparator(sep) {
+			return errors.Errorf("invalid text separator %q", sep)
+		}
+		if sep != chunkSeparator {
+			l.textSep = sep
+		}
+		return nil
+	}
+}
+
+// Limits causes a *Logger to share the resource limits rl with the other
+// *Loggers, and *DirectorySinks, it is passed to. A *Logger is bound by
+// rl's MaxPendingBytes.
+func Limits(rl *ResourceLimits) Option {
+	return func(l *Logger) error {
+		if rl == nil {
+			return errors.New("nil resource limits")
+		}
+		l.limits = rl
+		return nil
+	}
+}
+
+// MaxWriteLatency sets how long Write (and Append, etc.) waits for the
+// *Logger to flush a full segment to its Sink, so that latency-sensitive
+// callers can degrade gracefully, rather than stall, when the Sink is slow.
+//
+// When a flush takes longer than d, the write returns ErrSlowSink, and the
+// flush carries on in the background; the record is not written, whatever
+// the *Logger's FlushFailurePolicy, and the full segment is not modified
+// until the flush finishes. A later write waits up to d for it again, and
+// succeeds once it has finished. Flush, and Close, are not affected.
+//
+// If a timeout is also set with the SinkWriteTimeout option, the shorter of
+// the two applies to writes, and a Sink that implements ContextWriter is
+// only asked to give up after the SinkWriteTimeout.
+func MaxWriteLatency(d time.Duration) Option {
+	return func(l *Logger) error {
+		if d <= 0 {
+			return errors.New("max write latency must be positive")
+		}
+		l.maxLatency = d
+		return nil
+	}
+}
+
+// FlushAt causes a *Logger to flush its active segment to its Sink once the
+// segment's encoded size reaches n bytes, rather than waiting for it to
+// fill; for example, so that a DirectorySink's segment files are all
+// roughly n bytes, without limiting the size of the records that can be
+// written (see SegmentSize). The segment is flushed by the first write
+// after it reaches n bytes, in the same way as a full segment is.
+func FlushAt(n int64) Option {
+	return func(l *Logger) error {
+		if n <= 0 {
+			return errors.New("flush threshold must be positive")
+		}
+		l.flushAt = n
+		return nil
+	}
+}
+
+// Validate registers functions that check each record before it is written
+// to the *Logger's active segment; for example, to enforce size limits, or
+// schemas. If any of them returns an error, the record is not written, and
+// the write returns a *RejectedError wrapping it. Validators are called in
+// the order they were registered, with the record's data, before it is
+// encrypted.
+func Validate(fns ...func(p []byte) error) Option {
+	return func(l *Logger) error {
+		for _, fn := range fns {
+			if fn == nil {
+				return errors.New("nil validator")
+			}
+		}
+		l.validators = append(l.validators, fns...)
+		return nil
+	}
+}
+
+// BatchRecords causes a *Logger to coalesce small records (those shorter
+// than 100 bytes), written within window of each other, into batches of up
+// to maxRecords, each stored as a single data chunk. This saves the
+// per-chunk overhead of an offset, and a line, in the Sink for each record,
+// which can outweigh the records themselves.
+//
+// Each batched record is still given its own offset, and a *Reader returns
+// the records in a batch one at a time, as though they had been written
+// separately. A batch is written to the active segment when it is full, when
+// a record arrives more than window after the first in the batch, or a
+// record that cannot be batched (such as one written with AppendTTL) is
+// written, and whenever the *Logger is flushed.
+//
+// Records in the open batch are truncated individually, but once a batch
+// has been written to a segment, it is stored as a single data chunk, and
+// the *Logger's Truncate, and TruncateAfter methods return ErrSplitBatch,
+// rather than truncate it in part, or as a whole, for an offset between its
+// first, and last records.
+func BatchRecords(window time.Duration, maxRecords int) Option {
+	return func(l *Logger) error {
+		if window <= 0 {
+			return errors.New("batch window must be positive")
+		}
+		if maxRecords < 2 {
+			return errors.New("maxRecords must be at least 2")
+		}
+		l.batchWindow = window
+		l.batchMax = maxRecords
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrPinned is returned when truncating data chunks that have been pinned
+// (see the Pinner interface) from the newest end of a log.
+var ErrPinned = errors.New("wal: data chunks are pinned")
+
+// Pinner defines the interface of a Sink that can protect ranges of data
+// chunks from being truncated, such as while they are being read.
+//
+// While a range is pinned, calls to the Sink's Truncate method only remove
+// data chunks older than the range; the rest of the truncation is carried
+// out as ranges are unpinned. Calls to TruncateAfter that would
+// remove pinned data chunks return ErrPinned.
+//
+// Implementing Pinner is optional; see the Logger's Snapshot method.
+type Pinner interface {
+	// Pin protects the data chunks with offsets between first and last,
+	// inclusive. Ranges may be pinned more than once, and overlap.
+	Pin(first, last Offset)
+
+	// Unpin releases a range previously passed to Pin, and carries out
+	// any truncation that was held back by it.
+	Unpin(first, last Offset) error
+}
+
+// pinSet holds the ranges pinned in a Sink, and any truncation that has
+// been deferred because of them. The zero value is ready to use.
+type pinSet struct {
+	mu       sync.Mutex
+	pins     map[[2]Offset]int // Pinned ranges, and how many times each is pinned.
+	deferred Offset            // Offset to truncate at, once nothing is pinned.
+	pending  bool              // Whether there is a deferred truncation.
+}
+
+func (p *pinSet) pin(first, last Offset) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pins == nil {
+		p.pins = make(map[[2]Offset]int)
+	}
+	p.pins[[2]Offset{first, last}]++
+}
+
+// unpin releases a pinned range. If a truncation was deferred, it returns
+// the offset to truncate at, and true; the truncation is deferred again by
+// limit, as far as any remaining pins require.
+func (p *pinSet) unpin(first, last Offset) (Offset, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := [2]Offset{first, last}
+	if p.pins[r]--; p.pins[r] <= 0 {
+		delete(p.pins, r)
+	}
+	if !p.pending {
+		return ZeroOffset, false
+	}
+	off := p.deferred
+	p.deferred, p.pending = ZeroOffset, false
+	return off, true
+}
+
+// limit returns the offset a truncation at offset may proceed to, without
+// removing pinned data chunks. If that is short of offset, the truncation
+// is deferred until a range is unpinned.
+func (p *pinSet) limit(offset Offset) Offset {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limit := offset
+	for r := range p.pins {
+		if !r[0].After(limit) {
+			limit = r[0] - 1
+		}
+	}
+	if limit != offset && (!p.pending || offset.After(p.deferred)) {
+		p.deferred, p.pending = offset, true
+	}
+	return limit
+}
+
+// pinnedAfter reports whether any pinned data chunks are newer than offset.
+func (p *pinSet) pinnedAfter(offset Offset) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for r := range p.pins {
+		if r[1].After(offset) {
+			return true
+		}
+	}
+	return false
+}
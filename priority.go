@@ -0,0 +1,57 @@
+package wal
+
+import "go.nesv.ca/yawal/internal/errors"
+
+// Priority is the lane a record is appended in, with AppendPriority.
+type Priority int
+
+const (
+	// PriorityNormal records are appended as they are by Append: they
+	// may be batched (see BatchRecords), and are written to the Sink when
+	// the active segment is next flushed.
+	PriorityNormal Priority = iota
+
+	// PriorityHigh records, such as commit markers, are written to the
+	// Sink before AppendPriority returns, along with the normal records
+	// appended before them.
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+// AppendPriority is like Append, but appends p in the given priority lane,
+// so that a log mixing critical records with bulk ones can flush for the
+// critical ones alone, rather than for every record, or on an interval.
+//
+// If a PriorityHigh record is appended, but the flush fails, its offset is
+// returned along with the flush's error; the record stays in the active
+// segment, and is written to the Sink by the next successful flush, as are
+// normal records.
+func (l *Logger) AppendPriority(p []byte, prio Priority) (Offset, error) {
+	switch prio {
+	case PriorityNormal:
+		return l.write(p, nil)
+	case PriorityHigh:
+	default:
+		return ZeroOffset, errors.Errorf("unknown priority %d", prio)
+	}
+
+	off, err := l.write(p, nil)
+	if err != nil {
+		return ZeroOffset, err
+	}
+	// The *Logger may have been closed since p was written, in which case
+	// Close has already flushed it.
+	if err := l.Flush(); err != nil && err != ErrLoggerClosed {
+		return off, err
+	}
+	return off, nil
+}
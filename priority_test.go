@@ -0,0 +1,42 @@
+package wal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppendPriority(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink, BatchRecords(time.Hour, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := logger.AppendPriority([]byte("telemetry"), PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sink.NumSegments(); n != 0 {
+		t.Fatalf("normal records flushed: %d segments", n)
+	}
+
+	off, err := logger.AppendPriority([]byte("commit"), PriorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, last := sink.Offsets(); last != off {
+		t.Errorf("high-priority record not flushed: want last offset %v, got %v", off, last)
+	}
+	if n := countChunks(t, sink); n != 4 {
+		t.Errorf("wrong number of records flushed: want=4 got=%d", n)
+	}
+
+	if _, err := logger.AppendPriority([]byte("x"), Priority(7)); err == nil {
+		t.Error("unknown priority accepted")
+	}
+}
@@ -1,17 +1,39 @@
 package wal
 
 import (
+	"context"
 	"io"
+	"strconv"
+	"sync"
+	"time"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 )
 
+// ErrEndOfLog is returned by a *Reader's Err method when Next returned
+// false because there were no more data chunks to read. More data chunks
+// may be written to the Sink later.
+var ErrEndOfLog = errors.New("wal: end of log")
+
 // Reader loads data segments from a Sink, and progresses through a
 // data segment until there are no more chunks to be read. When the end of a
 // current segment is reached, a Reader will attempt to increment the
 // last-known chunk offset by one, and load the next-available data segment.
 //
-// It is not safe to call a Reader from multiple goroutines.
+// Chunks within a newly-loaded segment that are older than the last-read
+// offset are skipped, so a Reader never yields the same chunk twice. Chunks
+// that share the last-read offset, but live in a segment that begins with
+// it, are distinct records (older logs may contain such duplicates), and are
+// returned. A segment that begins before the last-read offset overlaps the
+// chunks already read (such as a copy of the segment merged with its
+// neighbours, loaded part-way through the log), so its chunks at the
+// last-read offset are skipped, too.
+//
+// It is not safe to call a Reader from multiple goroutines; wrap it with
+// NewConcurrentReader instead.
+//
+// By default, a concurrent call to the Sink's Truncate method may remove
+// the segment a Reader is part-way through; see the PinSegments method.
 //
 // Example:
 //
@@ -25,10 +47,27 @@ import (
 //		log.Println("error:", err)
 //	}
 type Reader struct {
-	sink Sink
-	off  Offset   // The last-known offset.
-	seg  *Segment // Current segment being read.
-	err  error
+	sink  Sink
+	off   Offset   // The last-known offset.
+	floor Offset   // Chunks older than this offset are skipped.
+	seg   *Segment // Current segment being read.
+	idx   int      // Index of the current chunk in seg.
+	batch []Record // Records in the current chunk, if it is a batch; see BatchRecords.
+	bidx  int      // Index of the current record in batch.
+	err   error
+
+	skipExpired bool                // Skip chunks whose TTL has passed.
+	producers   map[string]struct{} // Only yield chunks from these producers, if non-nil.
+	sealer      *recordSealer       // Decrypts encrypted chunks, if non-nil.
+	plain       []byte              // The current chunk's decrypted, or transformed, data, if any.
+	pin         bool                // Pin the current segment in the sink.
+	pinned      *[2]Offset          // The range currently pinned, if any.
+	end         bool                // Next returned false at the end of the log.
+	transforms  []transform         // Rewrite chunks' data as they are read; see Transform.
+	barriers    bool                // Yield control records, such as flush group barriers; see FlushGroup.
+
+	followCtx      context.Context // Wait for more data chunks until done, if non-nil; see Follow.
+	followInterval time.Duration   // How often to check for more data chunks.
 }
 
 // NewReader returns a *Reader that reads data chunks from sink, starting
@@ -41,8 +80,9 @@ func NewReader(sink Sink) *Reader {
 // sink, at the specified offset.
 func NewReaderOffset(sink Sink, offset Offset) *Reader {
 	return &Reader{
-		sink: sink,
-		off:  offset,
+		sink:  sink,
+		off:   offset,
+		floor: offset,
 	}
 }
 
@@ -50,34 +90,242 @@ func NewReaderOffset(sink Sink, offset Offset) *Reader {
 // using the Data method.
 //
 // A false return value means there are no more data chunks that can be
-// read from the current segment, and no more segments can be loaded.
+// read from the current segment, and no more segments can be loaded, or
+// that an error occurred; the Err method tells the two apart. If Follow
+// was called, Next waits for more data chunks, rather than returning false
+// at the end of the log.
 func (r *Reader) Next() bool {
-	if r.seg == nil {
-		if seg, err := r.loadSegment(r.off); err != nil {
-			r.err = err
+	for {
+		if r.next() {
+			r.end = false
+			return true
+		}
+		if r.err != nil {
+			return false
+		}
+		r.end = true
+		if r.followCtx == nil {
+			return false
+		}
+
+		t := time.NewTimer(r.followInterval)
+		select {
+		case <-r.followCtx.Done():
+			t.Stop()
+			r.err = r.followCtx.Err()
 			return false
-		} else {
-			r.seg = seg
+		case <-t.C:
 		}
 	}
+}
 
-NextDataChunk:
-	// Is there more that can be read in the current segment?
-	if r.seg.Next() {
-		r.off = r.seg.CurrentReadOffset()
-		return true
+// next implements Next, without waiting for more data chunks.
+func (r *Reader) next() bool {
+	if r.seg == nil && !r.advance(r.off) {
+		return false
 	}
 
-	// Attempt to load the next segment.
-	if seg, err := r.loadSegment(r.off + 1); err != nil {
+	for {
+		// Is there more that can be read in the current batch?
+		if r.nextBatched() {
+			return true
+		} else if r.err != nil {
+			return false
+		}
+
+		// Is there more that can be read in the current segment?
+		//
+		// Segments may be shared between readers (a MemorySink returns
+		// the same *Segment to each caller), so the reader keeps its own
+		// position, rather than using the segment's Next method.
+		for r.idx+1 < r.seg.Chunks() {
+			r.idx++
+			c := r.seg.chunkAt(r.idx)
+			off := c.Offset()
+			if off.Before(r.floor) {
+				continue
+			}
+			// An encrypted data chunk's attributes are authenticated
+			// along with its data, so it is opened before they are
+			// trusted to skip it; otherwise, relabeling it (as a
+			// control record, or with a different TTL, or producer)
+			// would drop it silently, rather than fail.
+			r.plain = nil
+			if r.sealer != nil {
+				p, err := r.sealer.open(c)
+				if errors.Is(err, ErrKeyRevoked) {
+					r.off = off
+					continue
+				} else if err != nil {
+					r.off = off
+					r.err = errors.Wrapf(err, "data chunk at offset %v", off)
+					return false
+				}
+				r.plain = p
+			}
+			if hdr := c.header(); len(hdr) > 0 && !r.barriers {
+				if parseChunkAttrs(hdr).control() {
+					r.off = off
+					continue
+				}
+			}
+			if r.skipExpired {
+				if exp, ok := c.expiry(); ok && !exp.After(NewOffset()) {
+					r.off = off
+					continue
+				}
+			}
+			if r.producers != nil {
+				if _, ok := r.producers[c.attrs()[attrProducer]]; !ok {
+					r.off = off
+					continue
+				}
+			}
+			r.off = off
+			// Like a batch, a compressed data chunk that was encrypted
+			// cannot be decompressed without decrypting it.
+			if c.attrs()[attrDeflate] != "" && (r.sealer != nil || c.attrs()[attrSealed] == "") {
+				p, err := inflateRecord(r.Data())
+				if err != nil {
+					r.err = errors.Wrapf(err, "data chunk at offset %v", off)
+					return false
+				}
+				r.plain = p
+			}
+			// An encrypted batch cannot be split without decrypting it,
+			// so it is returned whole, as any encrypted data chunk is.
+			if n, ok := c.attrs()[attrBatch]; ok && (r.sealer != nil || c.attrs()[attrSealed] == "") {
+				if err := r.openBatch(c, n); err != nil {
+					r.err = errors.Wrapf(err, "batch at offset %v", off)
+					return false
+				}
+				if r.nextBatched() {
+					return true
+				} else if r.err != nil {
+					return false
+				}
+				continue
+			}
+			if len(r.transforms) > 0 {
+				if err := r.transform(); err != nil {
+					r.err = errors.Wrapf(err, "transform data chunk at offset %v", off)
+					return false
+				}
+			}
+			return true
+		}
+
+		// Attempt to load the next segment.
+		prev := r.off
+		r.floor = r.off
+		if !r.advance(r.off + 1) {
+			return false
+		}
+
+		// The sink should have returned a segment holding data chunks
+		// newer than the last one read. If it did not (it returned the
+		// same segment again, or an empty one), stop, rather than load
+		// it over, and over again.
+		first, last := r.seg.Limits()
+		if !last.After(prev) {
+			r.idx = r.seg.Chunks() - 1
+			return false
+		}
+		if first.Before(prev) {
+			r.floor = prev + 1
+		}
+	}
+}
+
+// advance loads the segment containing off, and makes it the current
+// segment. It reports whether a segment was loaded.
+func (r *Reader) advance(off Offset) bool {
+	// Pin everything from off onwards while the segment is loaded, so it
+	// cannot be truncated before it is pinned on its own.
+	pinner, pin := r.sink.(Pinner)
+	if pin = pin && r.pin; pin {
+		pinner.Pin(off, maxOffset)
+		defer r.unpin(pinner, [2]Offset{off, maxOffset})
+	}
+
+	seg, err := r.loadSegment(off)
+	if err != nil {
 		r.err = err
+		r.release()
 		return false
 	} else if seg == nil {
+		r.release()
 		return false
-	} else {
-		r.seg = seg
 	}
-	goto NextDataChunk
+
+	r.release()
+	if pin {
+		first, last := seg.Limits()
+		pinner.Pin(first, last)
+		r.pinned = &[2]Offset{first, last}
+	}
+	r.seg = seg
+	r.idx = -1
+	r.batch = nil
+	return true
+}
+
+// openBatch makes the records in c, a batch of n records, the current
+// batch. If c was encrypted, its decrypted data must be in r.plain.
+func (r *Reader) openBatch(c chunk, n string) error {
+	size, err := strconv.Atoi(n)
+	if err != nil {
+		return errors.Wrap(err, "parse batch size")
+	}
+	p := r.plain
+	if p == nil {
+		p = c.Data()
+	}
+	batch, err := decodeBatch(c.Offset(), size, p)
+	if err != nil {
+		return err
+	}
+	r.batch, r.bidx = batch, -1
+	return nil
+}
+
+// nextBatched moves on to the next record in the current batch, if there is
+// one, skipping those older than r.floor.
+func (r *Reader) nextBatched() bool {
+	for r.bidx+1 < len(r.batch) {
+		r.bidx++
+		rec := r.batch[r.bidx]
+		if rec.Offset.Before(r.floor) {
+			continue
+		}
+		r.off = rec.Offset
+		r.plain = rec.Data
+		if len(r.transforms) > 0 {
+			if err := r.transform(); err != nil {
+				r.err = errors.Wrapf(err, "transform data chunk at offset %v", rec.Offset)
+				return false
+			}
+		}
+		return true
+	}
+	r.batch = nil
+	return false
+}
+
+// release unpins the current segment, if it is pinned.
+func (r *Reader) release() {
+	if r.pinned == nil {
+		return
+	}
+	rng := *r.pinned
+	r.pinned = nil
+	r.unpin(r.sink.(Pinner), rng)
+}
+
+func (r *Reader) unpin(pinner Pinner, rng [2]Offset) {
+	if err := pinner.Unpin(rng[0], rng[1]); err != nil && r.err == nil {
+		r.err = errors.Wrap(err, "unpin segment")
+	}
 }
 
 func (r *Reader) loadSegment(off Offset) (*Segment, error) {
@@ -92,8 +340,87 @@ func (r *Reader) loadSegment(off Offset) (*Segment, error) {
 
 // Data returns the []byte of the current data chunk. Successive calls to
 // Data, without calling Next, will return the same []byte.
+//
+// If the data chunk was encrypted, and Decrypt was called, Data returns the
+// decrypted data. If the data chunk was rewritten by a transform (see
+// Transform), Data returns the rewritten data.
 func (r *Reader) Data() []byte {
-	return r.seg.Chunk().Data()
+	if r.plain != nil {
+		return r.plain
+	}
+	return r.seg.chunkAt(r.idx).Data()
+}
+
+// PinSegments causes the *Reader to pin each segment it reads from, if its
+// Sink implements the Pinner interface, so that the segment cannot be
+// removed by a concurrent call to the Sink's Truncate method. A segment is
+// unpinned when the *Reader moves on to the next segment, reaches the end
+// of the log, or is closed.
+//
+// A *Reader that pins segments must be closed.
+func (r *Reader) PinSegments() {
+	r.pin = true
+}
+
+// Close releases the segment pinned by the *Reader, if any (see
+// PinSegments). The *Reader must not be used after it is closed.
+func (r *Reader) Close() error {
+	if r.pinned == nil {
+		return nil
+	}
+	rng := *r.pinned
+	r.pinned = nil
+	if err := r.sink.(Pinner).Unpin(rng[0], rng[1]); err != nil {
+		return errors.Wrap(err, "unpin segment")
+	}
+	return nil
+}
+
+// SkipExpired causes the *Reader to skip data chunks that were written with
+// a TTL (see the Logger's AppendTTL method), that has since passed.
+func (r *Reader) SkipExpired() {
+	r.skipExpired = true
+}
+
+// FilterProducer causes the *Reader to skip data chunks that were not
+// written by one of the given producers (see the Producer option). Data
+// chunks written without a producer ID can be included by passing "".
+func (r *Reader) FilterProducer(ids ...string) {
+	r.producers = make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		r.producers[id] = struct{}{}
+	}
+}
+
+// Producer returns the ID of the producer that wrote the current data
+// chunk, or "" if it was written without one.
+func (r *Reader) Producer() string {
+	return r.attrs()[attrProducer]
+}
+
+// Expiry returns the offset at which the current data chunk expires. ok is
+// false if the chunk was written without a TTL.
+func (r *Reader) Expiry() (exp Offset, ok bool) {
+	return r.seg.chunkAt(r.idx).expiry()
+}
+
+// attrs returns the attributes of the current data chunk. A batched
+// record has those of its batch, other than the batch size.
+func (r *Reader) attrs() chunkAttrs {
+	a := r.seg.chunkAt(r.idx).attrs()
+	if r.batch != nil {
+		if delete(a, attrBatch); len(a) == 0 {
+			return nil
+		}
+	}
+	return a
+}
+
+// Attrs returns the attributes stored alongside the current data chunk, such
+// as its TTL, or the ID of the schema it was encoded with. Attrs returns nil
+// if the chunk has no attributes.
+func (r *Reader) Attrs() map[string]string {
+	return r.attrs()
 }
 
 // Offset returns the offset of the current data chunk. Multiple calls to
@@ -109,3 +436,119 @@ func (r *Reader) Error() error {
 	}
 	return nil
 }
+
+// Err is like Error, but returns ErrEndOfLog if Next returned false because
+// there were no more data chunks to read, rather than nil. It returns nil
+// if Next has not returned false.
+//
+// If the *Reader is following the log (see Follow), and its context is
+// done, Err returns an error whose cause is the context's error.
+func (r *Reader) Err() error {
+	if err := r.Error(); err != nil {
+		return err
+	}
+	if r.end {
+		return ErrEndOfLog
+	}
+	return nil
+}
+
+// Follow causes the *Reader's Next method to wait for more data chunks to
+// be written to the Sink, checking every interval, rather than returning
+// false at the end of the log, until ctx is done.
+//
+// Only segments written to the Sink are read; a *Logger's active segment is
+// read once it is flushed. Segments written to a DirectorySink by another
+// process are only seen after the sink's Analyze method is called.
+func (r *Reader) Follow(ctx context.Context, interval time.Duration) {
+	r.followCtx = ctx
+	r.followInterval = interval
+}
+
+// transform is a function registered with a *Reader's Transform method.
+type transform struct {
+	match func(attrs map[string]string) bool
+	fn    func(p []byte) ([]byte, error)
+}
+
+// Transform causes the *Reader to rewrite the data of each data chunk whose
+// attributes (see Attrs) are matched by match, with fn, as it is read; for
+// example, to upgrade records written in an old format, without migrating
+// the log itself. The rewritten data is returned by Data.
+//
+// Transforms are applied in the order they were registered, after a data
+// chunk is decrypted (see Decrypt); each one is passed the data returned by
+// the one before. If fn returns an error, Next returns false, and Error
+// returns it.
+func (r *Reader) Transform(match func(attrs map[string]string) bool, fn func(p []byte) ([]byte, error)) {
+	r.transforms = append(r.transforms, transform{match: match, fn: fn})
+}
+
+// UpgradeSchema is like Transform, but rewrites data chunks written with
+// the schema identified by id (see NewTypedSchema). An id of 0 matches data
+// chunks written without a schema ID.
+func (r *Reader) UpgradeSchema(id uint32, fn func(p []byte) ([]byte, error)) {
+	want := strconv.FormatUint(uint64(id), 10)
+	r.Transform(func(attrs map[string]string) bool {
+		got, ok := attrs[attrSchema]
+		if !ok {
+			got = "0"
+		}
+		return got == want
+	}, fn)
+}
+
+// transform applies the *Reader's transforms to the current data chunk.
+func (r *Reader) transform() error {
+	attrs := r.attrs()
+	p := r.Data()
+	for _, t := range r.transforms {
+		if !t.match(attrs) {
+			continue
+		}
+		var err error
+		if p, err = t.fn(p); err != nil {
+			return err
+		}
+	}
+	if p == nil {
+		p = []byte{}
+	}
+	r.plain = p
+	return nil
+}
+
+// ConcurrentReader wraps a *Reader, so that it can be shared by multiple
+// goroutines. Each data chunk is returned to exactly one caller of Read.
+type ConcurrentReader struct {
+	mu sync.Mutex
+	r  *Reader
+}
+
+// NewConcurrentReader returns a *ConcurrentReader that reads data chunks
+// from r. r must not be used directly once it has been wrapped.
+func NewConcurrentReader(r *Reader) *ConcurrentReader {
+	return &ConcurrentReader{r: r}
+}
+
+// Read returns the offset, and a copy of the data, of the next data chunk.
+// When there are no more data chunks to be read, Read returns io.EOF; as
+// with a *Reader, more data chunks may become available later.
+func (cr *ConcurrentReader) Read() (Offset, []byte, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.r.Next() {
+		if err := cr.r.Error(); err != nil {
+			return ZeroOffset, nil, err
+		}
+		return ZeroOffset, nil, io.EOF
+	}
+	return cr.r.Offset(), append([]byte(nil), cr.r.Data()...), nil
+}
+
+// Close closes the underlying *Reader.
+func (cr *ConcurrentReader) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.r.Close()
+}
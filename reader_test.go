@@ -0,0 +1,413 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// newSegmentOffsets returns a segment holding one chunk for each of the
+// given offsets.
+func newSegmentOffsets(offsets ...Offset) *Segment {
+	seg := NewSegment()
+	for _, o := range offsets {
+		seg.addChunks(newChunkOffset([]byte(o.String()), o))
+	}
+	return seg
+}
+
+func TestReaderDuplicateOffsets(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second segment starts with the same offset the first segment
+	// ends with.
+	segments := []*Segment{
+		newSegmentOffsets(1, 2, 3),
+		newSegmentOffsets(3, 4),
+		newSegmentOffsets(10),
+	}
+	for _, seg := range segments {
+		if err := sink.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []Offset{1, 2, 3, 3, 4, 10}
+	var got []Offset
+	r := NewReader(sink)
+	for r.Next() {
+		got = append(got, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of chunks: want=%v got=%v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("chunk %d: want=%v got=%v", i, want[i], got[i])
+		}
+	}
+}
+
+// staleSink is a Sink that returns its first segment, regardless of the
+// offset requested.
+type staleSink struct {
+	*MemorySink
+	loads int
+}
+
+func (s *staleSink) LoadSegment(Offset) (*Segment, error) {
+	if s.loads++; s.loads > 100 {
+		return nil, io.EOF
+	}
+	return s.MemorySink.LoadSegment(ZeroOffset)
+}
+
+func TestReaderStaleSegment(t *testing.T) {
+	for name, seg := range map[string]*Segment{
+		"stale": newSegmentOffsets(1, 2, 3),
+		"empty": NewSegment(),
+	} {
+		mem, err := NewMemorySink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mem.segments = append(mem.segments, seg)
+		sink := &staleSink{MemorySink: mem}
+
+		r := NewReader(sink)
+		var n int
+		for r.Next() {
+			n++
+		}
+		if err := r.Error(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := seg.Chunks(); n != want {
+			t.Errorf("%s: wrong number of chunks: want=%d got=%d", name, want, n)
+		}
+		if sink.loads > 3 {
+			t.Errorf("%s: segment loaded %d times", name, sink.loads)
+		}
+	}
+}
+
+func TestReaderOffset(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(newSegmentOffsets(1, 2, 3, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReaderOffset(sink, 3)
+	var n int
+	for r.Next() {
+		if r.Offset().Before(3) {
+			t.Errorf("read chunk at offset %v, before starting offset", r.Offset())
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("wrong number of chunks: want=%d got=%d", 2, n)
+	}
+}
+
+func TestReaderFilterProducer(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, producer := range []string{"a", "b", "a"} {
+		logger, err := New(sink, Producer(producer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := logger.Append([]byte(producer)); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(sink)
+	r.FilterProducer("a")
+	var n int
+	for r.Next() {
+		if got := r.Producer(); got != "a" {
+			t.Errorf("read chunk from wrong producer: want=a got=%q", got)
+		}
+		n++
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("wrong number of chunks: want=%d got=%d", 2, n)
+	}
+}
+
+func TestReaderPinSegments(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range []*Segment{
+		newSegmentOffsets(1, 2),
+		newSegmentOffsets(3, 4),
+	} {
+		if err := sink.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(sink)
+	r.PinSegments()
+	if !r.Next() || r.Offset() != 1 {
+		t.Fatalf("wrong first offset: %v", r.Offset())
+	}
+
+	// The segment being read survives truncation, while the reader is
+	// part-way through it.
+	if err := sink.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := sink.Offsets(); first != 1 {
+		t.Errorf("pinned segment was truncated: first offset=%v", first)
+	}
+
+	// Moving on to the next segment releases the first one.
+	if !r.Next() || !r.Next() || r.Offset() != 3 {
+		t.Fatalf("wrong offset: %v", r.Offset())
+	}
+	if first, _ := sink.Offsets(); first != 3 {
+		t.Errorf("wrong first offset after moving on: want=3 got=%v", first)
+	}
+
+	// Closing the reader carries out the rest of the truncation.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sink.NumSegments(); n != 0 {
+		t.Errorf("wrong number of segments after closing reader: want=0 got=%d", n)
+	}
+}
+
+func TestConcurrentReader(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 100
+	for i := 0; i < n; i += 10 {
+		var offsets []Offset
+		for j := i; j < i+10; j++ {
+			offsets = append(offsets, Offset(j+1))
+		}
+		if err := sink.WriteSegment(newSegmentOffsets(offsets...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cr := NewConcurrentReader(NewReader(sink))
+	var (
+		mu   sync.Mutex
+		seen = make(map[Offset]bool)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				off, data, err := cr.Read()
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(data) != off.String() {
+					t.Errorf("wrong data for offset %v: %q", off, data)
+				}
+				mu.Lock()
+				if seen[off] {
+					t.Errorf("offset %v read twice", off)
+				}
+				seen[off] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != n {
+		t.Errorf("wrong number of chunks read: want=%d got=%d", n, len(seen))
+	}
+}
+
+func TestReaderFollow(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(newSegmentOffsets(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(sink)
+	if err := r.Err(); err != nil {
+		t.Errorf("unexpected error before reading: %v", err)
+	}
+	for r.Next() {
+	}
+	if err := r.Err(); err != ErrEndOfLog {
+		t.Fatalf("want %v, got %v", ErrEndOfLog, err)
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// While following the log, Next waits for the next segment.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.Follow(ctx, time.Millisecond)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sink.WriteSegment(newSegmentOffsets(3))
+	}()
+	if !r.Next() {
+		t.Fatal(r.Err())
+	}
+	if got := r.Offset(); got != 3 {
+		t.Errorf("wrong offset: want=%v got=%v", Offset(3), got)
+	}
+	if err := r.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Once the context is done, Next returns false.
+	cancel()
+	if r.Next() {
+		t.Fatalf("unexpected data chunk at offset %v", r.Offset())
+	}
+	if err := r.Err(); errors.Cause(err) != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestReaderUpgradeSchema(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []struct {
+		schema string
+		data   string
+	}{{"", "zero"}, {"1", "one"}, {"2", "two"}} {
+		var attrs chunkAttrs
+		if rec.schema != "" {
+			attrs = chunkAttrs{attrSchema: rec.schema}
+		}
+		if _, err := logger.write([]byte(rec.data), attrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(sink)
+	r.UpgradeSchema(0, func(p []byte) ([]byte, error) {
+		return append([]byte("v0:"), p...), nil
+	})
+	r.UpgradeSchema(1, func(p []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(p))), nil
+	})
+	var got []string
+	for r.Next() {
+		got = append(got, string(r.Data()))
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"v0:zero", "ONE", "two"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("wrong data: want=%q got=%q", want, got)
+	}
+
+	// An error from a transform stops the reader.
+	errBad := errors.New("bad record")
+	r = NewReader(sink)
+	r.UpgradeSchema(2, func([]byte) ([]byte, error) { return nil, errBad })
+	for r.Next() {
+	}
+	if err := r.Error(); errors.Cause(err) != errBad {
+		t.Errorf("want %v, got %v", errBad, err)
+	}
+}
+
+// windowSink is a Sink that returns a segment holding the data chunks either
+// side of the offset requested, so that each segment it returns overlaps
+// the one before it.
+type windowSink struct {
+	*MemorySink
+	offsets []Offset
+}
+
+func (s *windowSink) LoadSegment(off Offset) (*Segment, error) {
+	i := 0
+	for i < len(s.offsets) && s.offsets[i].Before(off) {
+		i++
+	}
+	if i == len(s.offsets) {
+		return nil, io.EOF
+	}
+	lo, hi := i-2, i+2
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(s.offsets) {
+		hi = len(s.offsets)
+	}
+	return newSegmentOffsets(s.offsets[lo:hi]...), nil
+}
+
+func TestReaderOverlappingSegments(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &windowSink{MemorySink: mem}
+	for off := Offset(1); off <= 10; off++ {
+		sink.offsets = append(sink.offsets, off)
+	}
+
+	var got []Offset
+	r := NewReader(sink)
+	for r.Next() {
+		got = append(got, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(sink.offsets) {
+		t.Errorf("wrong chunks read: want=%v got=%v", sink.offsets, got)
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"io/ioutil"
 	"sync"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 )
 
 const (
 	// DefaultSegmentSize is the default size of a data segment (16MB).
 	DefaultSegmentSize uint64 = 16777216
+
+	// MaxSegmentSize is the largest size a *Logger's data segments can be
+	// configured with (1GB). Segments are held in memory while they are
+	// written to, and loaded into memory in full when they are read.
+	MaxSegmentSize uint64 = 1 << 30
 )
 
 func NewSegment() *Segment {
@@ -34,7 +39,25 @@ type Segment struct {
 	size     uint64 // Maximum size of the segment, in bytes.
 	mu       sync.Mutex
 	chunks   []*chunk
-	chunkIdx int // Index of chunk that will be returned by Data().
+	chunkIdx int    // Index of chunk that will be returned by Data().
+	last     Offset // Offset of the most-recently written chunk.
+
+	// The sizes of the chunks, kept up to date as chunks are added, and
+	// removed, so that they can be checked on every write; see Stats.
+	used    int64 // Bytes used by the chunks, as returned by Size.
+	encoded int64 // Bytes taken by the encoded chunks, and their newlines.
+
+	// onBump, if non-nil, is called by nextOffset when the system clock
+	// has not moved past the last-written offset.
+	onBump func(wall, last Offset)
+
+	// sealer, if non-nil, encrypts data chunks as they are written; see
+	// the EncryptRecords option.
+	sealer *recordSealer
+
+	// sep separates each chunk's data from its offset when the segment
+	// is encoded, if it is not zero; see the TextSeparator option.
+	sep byte
 }
 
 var (
@@ -47,6 +70,17 @@ var (
 // If the length of p is greater than the remaining capacity of the
 // segment, this method will return ErrNotEnoughSpace.
 func (s *Segment) Write(p []byte) (int, error) {
+	return writeSegment(s, p)
+}
+
+// WriteString is like Write, but writes the contents of str, without first
+// converting it to a []byte. It implements the io.StringWriter interface.
+func (s *Segment) WriteString(str string) (int, error) {
+	return writeSegment(s, str)
+}
+
+// writeSegment implements the Write, and WriteString methods.
+func writeSegment[D chunkData](s *Segment, p D) (int, error) {
 	// If p is nil, or has a length of zero, return early.
 	if len(p) == 0 {
 		return 0, nil
@@ -57,12 +91,99 @@ func (s *Segment) Write(p []byte) (int, error) {
 	if int64(len(p)) > s.remaining() {
 		return 0, ErrNotEnoughSpace
 	}
-	return s.write(p)
+	if _, err := appendChunk(s, p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func (s *Segment) write(p []byte) (int, error) {
-	s.chunks = append(s.chunks, newChunk(p))
-	return len(p), nil
+// appendChunk appends p to s as a new data chunk, with the encoded chunk
+// attributes hdr, and returns the chunk's offset. If the segment has a
+// sealer, p is encrypted first. It must be called while holding s.mu.
+func appendChunk[D chunkData](s *Segment, p D, hdr []byte) (Offset, error) {
+	return appendChunkAt(s, s.nextOffset(), p, hdr)
+}
+
+// appendChunkAt is like appendChunk, but the new data chunk is given the
+// offset off, which must come after that of the last chunk in s.
+func appendChunkAt[D chunkData](s *Segment, off Offset, p D, hdr []byte) (Offset, error) {
+	if s.sealer == nil {
+		s.addChunks(newChunkHeader(p, off, hdr))
+		return off, nil
+	}
+	sealed, err := s.sealer.seal(off, hdr, []byte(p))
+	if err != nil {
+		return ZeroOffset, err
+	}
+	s.addChunks(newChunkHeader(sealed, off, hdr))
+	return off, nil
+}
+
+// addChunks appends cs to the segment's chunks, and counts their sizes. It
+// must be called while holding s.mu.
+func (s *Segment) addChunks(cs ...*chunk) {
+	s.chunks = append(s.chunks, cs...)
+	s.count(cs, 1)
+}
+
+// count adds the sizes of cs to those of the segment, or subtracts them if
+// sign is -1, as they are added to, or removed from, the segment. It must
+// be called while holding s.mu.
+func (s *Segment) count(cs []*chunk, sign int64) {
+	for _, c := range cs {
+		s.used += sign * int64(len(*c))
+		s.encoded += sign * (int64(c.textLen()) + 1) // Add 1 for the newline character.
+	}
+}
+
+// writeSegmentHeader is like Write, but stores the encoded chunk attributes
+// hdr alongside p, and returns the offset of the new data chunk.
+func writeSegmentHeader[D chunkData](s *Segment, p D, hdr []byte) (Offset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(p)+len(hdr)+s.sealer.overhead(hdr)) > s.remaining() {
+		return ZeroOffset, ErrNotEnoughSpace
+	}
+	return appendChunk(s, p, hdr)
+}
+
+// writeSegmentAt is like writeSegmentHeader, but the new data chunk is given
+// the offset off; see appendChunkAt.
+func writeSegmentAt(s *Segment, off Offset, p, hdr []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(p)+len(hdr)+s.sealer.overhead(hdr)) > s.remaining() {
+		return ErrNotEnoughSpace
+	}
+	_, err := appendChunkAt(s, off, p, hdr)
+	return err
+}
+
+// reserveOffset returns the offset for a new chunk, as nextOffset does, for
+// a data chunk that will be written later; see the BatchRecords option.
+func (s *Segment) reserveOffset() Offset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextOffset()
+}
+
+// nextOffset returns the offset for a new chunk.
+//
+// Offsets are timestamps, so two chunks written within the same nanosecond
+// (or while the system clock is stepped backwards) would otherwise share an
+// offset. To keep offsets unique, and strictly increasing, the new offset is
+// bumped to one past the last-written offset whenever the clock has not
+// moved forward.
+func (s *Segment) nextOffset() Offset {
+	o := NewOffset()
+	if !o.After(s.last) {
+		if s.onBump != nil {
+			s.onBump(o, s.last)
+		}
+		o = s.last + 1
+	}
+	s.last = o
+	return o
 }
 
 // Data returns the current chunk.
@@ -75,6 +196,37 @@ func (s *Segment) Chunk() chunk {
 	return *c
 }
 
+// chunkAt returns the chunk at index i.
+func (s *Segment) chunkAt(i int) chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.chunks[i]
+}
+
+// Record is a read-only view of a data chunk in a segment.
+type Record struct {
+	Offset Offset // The data chunk's offset.
+	Data   []byte // The data chunk's data; it must not be modified.
+}
+
+// Records returns a view of each data chunk in the segment, in the order
+// they were written. Unlike the Next, and Chunk methods, Records does not
+// move the segment's internal read pointer, so a segment shared between
+// several readers can be safely iterated by each of them.
+//
+// The data in the returned records is not copied; data chunks are never
+// modified once written, so it remains valid even if the segment is later
+// truncated.
+func (s *Segment) Records() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recs := make([]Record, len(s.chunks))
+	for i, c := range s.chunks {
+		recs[i] = Record{Offset: c.Offset(), Data: c.Data()}
+	}
+	return recs
+}
+
 // Next reports whether or not there is another chunk that can be read with
 // the Chunk() method.
 //
@@ -123,16 +275,27 @@ func (s *Segment) ReadFrom(r io.Reader) (int64, error) {
 	}
 	rows := bytes.Split(p, []byte("\n"))
 	s.chunks = []*chunk{}
+	s.used, s.encoded = 0, 0
+	sep := chunkSeparator
+	if len(rows) > 0 && bytes.HasPrefix(rows[0], []byte{'#'}) {
+		if sep, err = parseTextHeader(rows[0]); err != nil {
+			return 0, errors.Wrap(err, "parse header")
+		}
+		rows[0], s.sep = nil, sep
+	}
 	for i, row := range rows {
-		// Skip empty rows.
-		if len(row) == 0 {
+		// Skip empty rows, and padding records.
+		if len(row) == 0 || row[0] == '#' {
 			continue
 		}
-		c := new(chunk)
-		if err := c.UnmarshalText(row); err != nil {
+		off, hdr, data, err := parseChunkText(row, sep)
+		if err != nil {
 			return 0, errors.Wrapf(err, "unmarshal chunk %d", i)
 		}
-		s.chunks = append(s.chunks, c)
+		s.addChunks(newChunkHeader(data, off, hdr))
+	}
+	if n := len(s.chunks); n > 0 {
+		s.last = s.chunks[n-1].Offset()
 	}
 
 	return int64(len(p)), nil
@@ -151,14 +314,21 @@ func (s *Segment) WriteTo(w io.Writer) (int64, error) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	var n int64
-	for i := range s.chunks {
-		p, err := s.chunks[i].MarshalText()
+	var (
+		n int64
+		p []byte // Reused for each chunk.
+	)
+	if s.sep != 0 {
+		b, err := w.Write(append(textHeader(s.sep), '\n'))
+		n += int64(b)
 		if err != nil {
-			return n, errors.Wrapf(err, "marshal chunk %d", i)
+			return n, errors.Wrap(err, "write header")
 		}
-
-		b, err := w.Write(append(p, '\n'))
+	}
+	sep := s.separator()
+	for i := range s.chunks {
+		p = append(s.chunks[i].appendText(p[:0], sep), '\n')
+		b, err := w.Write(p)
 		if err != nil {
 			return n, errors.Wrap(err, "write chunk")
 		} else if b < len(p) {
@@ -180,31 +350,55 @@ func (s *Segment) Chunks() int {
 func (s *Segment) Size() int64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	var n int64 = 0
-	for i := range s.chunks {
-		c := s.chunks[i]
-		n += int64(len(*c))
-	}
-	return n
+	return s.used
 }
 
 // EncodedSize returns the encoded size of the segment, in bytes. This is the
 // number of bytes that should be returned by WriteTo, assuming no more chunks
 // are added to the segment.
+//
+// The encoded size is kept up to date as chunks are written to, and
+// truncated from, the segment, so EncodedSize does not encode them.
 func (s *Segment) EncodedSize() (int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.encodedSize(), nil
+}
 
-	var n int64 = 0
-	for i := range s.chunks {
-		p, err := s.chunks[i].MarshalText()
-		if err != nil {
-			return 0, errors.Wrapf(err, "marshal chunk %d", i)
-		}
-		n += int64(len(p)) + 1 // Add 1 for the newline character
+// encodedSize implements EncodedSize. It must be called while holding s.mu.
+func (s *Segment) encodedSize() int64 {
+	if len(s.chunks) == 0 {
+		return 0
+	}
+	n := s.encoded
+	if s.sep != 0 {
+		n += int64(len(textHeader(s.sep))) + 1
+	}
+	return n
+}
+
+// SegmentUsage describes how full a segment is, as returned by its Stats
+// method.
+type SegmentUsage struct {
+	Chunks      int   // Number of data chunks in the segment.
+	Size        int64 // Bytes used by the data chunks; see Size.
+	EncodedSize int64 // Bytes the segment takes, once encoded; see EncodedSize.
+	Remaining   int64 // Bytes left before the segment is full; see Remaining.
+}
+
+// Stats returns the segment's current size, in each of the ways it is
+// measured. The sizes are kept up to date as chunks are written to, and
+// truncated from, the segment, so Stats is cheap enough to call on every
+// write.
+func (s *Segment) Stats() SegmentUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SegmentUsage{
+		Chunks:      len(s.chunks),
+		Size:        s.used,
+		EncodedSize: s.encodedSize(),
+		Remaining:   s.remaining(),
 	}
-	return n, nil
 }
 
 // Remaining returns the number of bytes left before the segment is
@@ -216,11 +410,7 @@ func (s *Segment) Remaining() int64 {
 }
 
 func (s *Segment) remaining() int64 {
-	var n uint64
-	for i := range s.chunks {
-		n += uint64(len(*s.chunks[i]))
-	}
-	return int64(s.size - n)
+	return int64(s.size - uint64(s.used))
 }
 
 // Limits returns the oldest and newest offsets of the data chunks
@@ -257,14 +447,83 @@ func (s *Segment) Truncate(offset Offset) {
 	for i, c := range s.chunks {
 		if c.Offset().After(offset) {
 			// Shrink the current chunk slice.
+			s.count(s.chunks[:i], -1)
 			s.chunks = s.chunks[i:]
 
 			// Adjust the internal read pointer.
-			if s.chunkIdx > 0 {
-				s.chunkIdx -= i + 1
+			if s.chunkIdx -= i; s.chunkIdx < -1 {
+				s.chunkIdx = -1
 			}
 
-			break
+			return
 		}
 	}
+
+	// Every chunk in the segment is <= offset.
+	s.chunks = s.chunks[:0]
+	s.used, s.encoded = 0, 0
+	s.chunkIdx = -1
+}
+
+// TruncateAfter removes all chunks from the segment, whose offsets are
+// > offset.
+//
+// If the current segment is being read, and the chunk being read is
+// removed, the internal pointer is moved to the last remaining chunk.
+func (s *Segment) TruncateAfter(offset Offset) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.chunks {
+		if c.Offset().After(offset) {
+			s.count(s.chunks[i:], -1)
+			s.chunks = s.chunks[:i]
+			if s.chunkIdx >= i {
+				s.chunkIdx = i - 1
+			}
+			return
+		}
+	}
+}
+
+// clone returns a copy of the segment. The chunks themselves are not
+// copied, as they are never modified once written.
+func (s *Segment) clone() *Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &Segment{
+		size:     s.size,
+		chunks:   append([]*chunk(nil), s.chunks...),
+		chunkIdx: -1,
+		last:     s.last,
+		used:     s.used,
+		encoded:  s.encoded,
+		sep:      s.sep,
+	}
+}
+
+// prepend adds the chunks of o, which must all be older than those of s,
+// to the start of s.
+func (s *Segment) prepend(o *Segment) {
+	o.mu.Lock()
+	cs := append([]*chunk(nil), o.chunks...)
+	o.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks = append(cs, s.chunks...)
+	s.count(cs, 1)
+	if s.chunkIdx >= 0 {
+		s.chunkIdx += len(cs)
+	}
+}
+
+// separator returns the separator between each chunk's data, and its
+// offset, when the segment is encoded. It must be called while holding
+// s.mu.
+func (s *Segment) separator() byte {
+	if s.sep == 0 {
+		return chunkSeparator
+	}
+	return s.sep
 }
@@ -37,3 +37,152 @@ func TestSegmentWriteAndLoad(t *testing.T) {
 		t.Errorf("mismatched number of bytes: wanted=%v got=%v", nwritten, nread)
 	}
 }
+
+func TestSegmentOffsetsIncrease(t *testing.T) {
+	s := NewSegment()
+	for i := 0; i < 10000; i++ {
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var prev Offset
+	for s.Next() {
+		off := s.CurrentReadOffset()
+		if !off.After(prev) {
+			t.Fatalf("offset %v is not after previous offset %v", off, prev)
+		}
+		prev = off
+	}
+}
+
+func TestSegmentRecords(t *testing.T) {
+	s := newSegmentOffsets(1, 2, 3)
+	recs := s.Records()
+	if len(recs) != 3 {
+		t.Fatalf("wrong number of records: want=3 got=%d", len(recs))
+	}
+	for i, rec := range recs {
+		want := Offset(i + 1)
+		if rec.Offset != want || string(rec.Data) != want.String() {
+			t.Errorf("wrong record %d: want=%v:%v got=%v:%s", i, want, want, rec.Offset, rec.Data)
+		}
+	}
+
+	// The segment's read pointer is left alone.
+	if !s.Next() || s.CurrentReadOffset() != 1 {
+		t.Error("Records moved the segment's read pointer")
+	}
+}
+
+func TestSegmentTextSeparator(t *testing.T) {
+	for _, sep := range []byte{'+', '=', '#', 'a', '5', '\n', ' '} {
+		if _, err := New(&MemorySink{}, TextSeparator(sep)); err == nil {
+			t.Errorf("%q: expected an invalid separator error", sep)
+		}
+	}
+
+	s := NewSegment()
+	s.sep = '|'
+	for _, p := range []string{"one", "two:three", "four|five"} {
+		if _, err := s.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := s.EncodedSize(); err != nil || n != want {
+		t.Errorf("wrong encoded size: want=%d got=%d (%v)", n, want, err)
+	}
+	if want := "#codec=text;sep=%7C\n"; !bytes.HasPrefix(buf.Bytes(), []byte(want)) {
+		t.Errorf("missing header %q in %q", want, buf.Bytes())
+	}
+
+	// The separator is read from the header.
+	loaded := new(Segment)
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.sep != '|' || loaded.Chunks() != 3 {
+		t.Errorf("wrong segment: sep=%q chunks=%d", loaded.sep, loaded.Chunks())
+	}
+	if got := string(loaded.chunkAt(1).Data()); got != "two:three" {
+		t.Errorf("wrong data: want=%q got=%q", "two:three", got)
+	}
+	if _, records, err := InspectSegment(bytes.NewReader(buf.Bytes())); err != nil || len(records) != 3 {
+		t.Errorf("inspect: %d records, %v", len(records), err)
+	}
+
+	// Corruption cannot be mistaken for framing.
+	corrupt := [][]byte{
+		bytes.Replace(buf.Bytes(), []byte("|"), []byte(":"), 1),
+		bytes.Replace(buf.Bytes(), []byte("|"), []byte("|\r"), 1),
+		bytes.Replace(buf.Bytes(), []byte("sep=%7C"), []byte("sep=%2B"), 1),
+		bytes.Replace(buf.Bytes(), []byte("codec=text"), []byte("codec=json"), 1),
+	}
+	for i, p := range corrupt {
+		if _, err := new(Segment).ReadFrom(bytes.NewReader(p)); err == nil {
+			t.Errorf("corruption %d: expected an error", i)
+		}
+	}
+}
+
+func TestSegmentStats(t *testing.T) {
+	// check compares the segment's counted sizes to those it has, once
+	// encoded.
+	check := func(name string, s *Segment) {
+		t.Helper()
+		var buf bytes.Buffer
+		if _, err := s.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var size int64
+		for _, c := range s.chunks {
+			size += int64(len(*c))
+		}
+		want := SegmentUsage{
+			Chunks:      len(s.chunks),
+			Size:        size,
+			EncodedSize: int64(buf.Len()),
+			Remaining:   int64(s.size) - size,
+		}
+		if got := s.Stats(); got != want {
+			t.Errorf("%s: wrong stats: want=%+v got=%+v", name, want, got)
+		}
+	}
+
+	s := NewSegmentSize(4096)
+	s.sep = '|'
+	check("empty", s)
+	for i := 0; i < 10; i++ {
+		if _, err := writeSegmentHeader(s, strconv.Itoa(i*1000), chunkAttrs{attrTTL: "5"}.encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("written", s)
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewSegmentSize(4096)
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	check("loaded", loaded)
+
+	s.Truncate(s.chunks[2].Offset())
+	check("truncated", s)
+	s.TruncateAfter(s.chunks[4].Offset())
+	check("truncated after", s)
+
+	clone := s.clone()
+	clone.prepend(loaded)
+	check("prepended", clone)
+
+	s.Truncate(maxOffset)
+	check("emptied", s)
+}
@@ -1,6 +1,11 @@
 package wal
 
-import "io"
+import (
+	"context"
+	"io"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
 
 // Sink defines the interface of a type that can persist, and subsequently
 // load, write-ahead logging segments.
@@ -37,9 +42,12 @@ type SegmentLoader interface {
 	// If ZeroOffset is specified, then the segment with the lowest
 	// offset will be returned.
 	//
+	// If the given offset falls between two segments, the newer of the
+	// two segments will be returned.
+	//
 	// Should the given offset be greater than one contained in any
-	// available segments, no segment will be returned, and err will be
-	// io.EOF.
+	// available segments, or the Sink holds no segments, no segment will
+	// be returned, and err will be io.EOF.
 	LoadSegment(Offset) (*Segment, error)
 }
 
@@ -48,3 +56,129 @@ type SegmentLoader interface {
 type SegmentWriter interface {
 	WriteSegment(*Segment) error
 }
+
+// HealthChecker defines the interface of a Sink that can report whether it
+// is currently able to store, and retrieve, segments.
+//
+// Implementing HealthChecker is optional; see the Logger's Healthy method.
+type HealthChecker interface {
+	// Ping returns a non-nil error if the Sink is not able to store
+	// segments.
+	Ping(ctx context.Context) error
+}
+
+// ErrNotSupported is returned when a Sink does not support an optional
+// operation.
+var ErrNotSupported = errors.New("wal: operation not supported by sink")
+
+// TailTruncater defines the interface of a Sink that can discard its newest
+// data chunks, such as a replication follower rolling back a divergent
+// tail, or a point-in-time restore.
+//
+// Implementing TailTruncater is optional; see the Logger's TruncateAfter
+// method.
+type TailTruncater interface {
+	// TruncateAfter removes all data chunks whose offsets are > offset.
+	TruncateAfter(offset Offset) error
+}
+
+// ContextWriter defines the interface of a Sink that can abandon writing a
+// segment when a context is done.
+//
+// Implementing ContextWriter is optional; see the SinkWriteTimeout option.
+type ContextWriter interface {
+	// WriteSegmentContext is like WriteSegment, but gives up once ctx is
+	// done, returning ctx's error.
+	WriteSegmentContext(ctx context.Context, seg *Segment) error
+}
+
+// Compressor defines the interface of a Sink that can compress the segments
+// it holds, such as old segments that are rarely read (see
+// walutil.CompressOlderThan).
+type Compressor interface {
+	// CompressBefore compresses the segments whose data chunks are all
+	// older than offset, and returns the number of segments compressed.
+	CompressBefore(offset Offset) (int, error)
+}
+
+// Warmer defines the interface of a Sink that can load its newest segments
+// ahead of time, such as into a cache, so that they can be read quickly
+// once they are needed.
+//
+// Implementing Warmer is optional; see DirectorySink's CacheSegments
+// option.
+type Warmer interface {
+	// Warmup loads the newest n segments, and returns the number of
+	// segments loaded.
+	Warmup(n int) (int, error)
+}
+
+// SegmentLister defines the interface of a Sink that records statistics
+// about each segment as it is written, such as how many data chunks it
+// holds, so that they can be listed without loading the segments (see
+// walutil.Lag).
+type SegmentLister interface {
+	// ListSegments returns the statistics of each segment, oldest first.
+	ListSegments() ([]SegmentStats, error)
+}
+
+// ChunkReaderAt defines the interface of a Sink that can read a single data
+// chunk from part-way through a segment, without reading, or decoding, the
+// data chunks before it; for example, at a position recorded in an index.
+//
+// Implementing ChunkReaderAt is optional; see DirectorySink's IndexKeys
+// option.
+type ChunkReaderAt interface {
+	// ReadChunkAt reads the n-byte encoded data chunk that begins
+	// byteOffset bytes into the segment with the given ID.
+	ReadChunkAt(segment SegmentID, byteOffset int64, n int) (Record, error)
+}
+
+// RangeLoader defines the interface of a Sink that can load every segment
+// holding data chunks in a range of offsets in one call, rather than one
+// call to LoadSegment per segment; for example, to fetch them in a single
+// request to remote storage.
+//
+// Implementing RangeLoader is optional; see LoadSegments.
+type RangeLoader interface {
+	// LoadSegments returns the segments holding data chunks with
+	// offsets from from, to to, inclusive, oldest first.
+	LoadSegments(from, to Offset) ([]*Segment, error)
+}
+
+// LoadSegments returns the segments in sink holding data chunks with offsets
+// from from, to to, inclusive, oldest first; for example, for a replica
+// catching up, or exporting part of a log. If sink implements RangeLoader,
+// its LoadSegments method is used; otherwise, the segments are loaded one
+// at a time, with LoadSegment.
+func LoadSegments(sink Sink, from, to Offset) ([]*Segment, error) {
+	if rl, ok := sink.(RangeLoader); ok {
+		return rl.LoadSegments(from, to)
+	}
+	var segs []*Segment
+	for off := from; !off.After(to); {
+		seg, err := sink.LoadSegment(off)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "load segment at offset %v", off)
+		}
+		first, last := seg.Limits()
+		if first.After(to) {
+			break
+		}
+		segs = append(segs, seg)
+		off = last + 1
+	}
+	return segs, nil
+}
+
+// truncateAfter calls sink's TruncateAfter method, or returns
+// ErrNotSupported if sink does not implement TailTruncater.
+func truncateAfter(sink Sink, offset Offset) error {
+	tt, ok := sink.(TailTruncater)
+	if !ok {
+		return ErrNotSupported
+	}
+	return tt.TruncateAfter(offset)
+}
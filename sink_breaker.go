@@ -0,0 +1,277 @@
+package wal
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// BreakerState is the state of a *BreakerSink's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed means segments are written to the primary Sink.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen means the primary Sink has failed too many times in a
+	// row, and segments are written to the fallback Sink.
+	BreakerOpen
+
+	// BreakerHalfOpen means the primary Sink is being probed, to see if
+	// it has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrBreakerOpen is returned by a *BreakerSink's WriteSegment method when
+// its circuit breaker is open, and it has no fallback Sink.
+var ErrBreakerOpen = errors.New("wal: circuit breaker open")
+
+// BreakerSink wraps a Sink with a circuit breaker.
+//
+// After a number of consecutive WriteSegment failures, the breaker "opens",
+// and segments are written to a fallback Sink (for example, a
+// DirectorySink on a local, emergency directory) instead, so that slow,
+// or failing, network sinks do not hold up a Logger. While the breaker is
+// open, the primary Sink is periodically probed with the next segment to be
+// written; once a write succeeds, the breaker closes again.
+//
+// Segments are loaded from whichever of the two Sinks holds the oldest
+// segment containing, or following, the requested offset, so Readers see
+// the segments from both Sinks.
+type BreakerSink struct {
+	primary       Sink
+	fallback      Sink
+	threshold     int
+	probeInterval time.Duration
+	onStateChange func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int       // Consecutive failures writing to the primary Sink.
+	openedAt time.Time // When the breaker last opened.
+}
+
+// NewBreakerSink returns a *BreakerSink that writes to primary until
+// threshold consecutive writes have failed, then writes to fallback,
+// probing primary every probeInterval.
+//
+// fallback may be nil, in which case writes fail with ErrBreakerOpen while
+// the breaker is open. onStateChange, if non-nil, is called whenever the
+// breaker changes state.
+func NewBreakerSink(primary, fallback Sink, threshold int, probeInterval time.Duration, onStateChange func(from, to BreakerState)) (*BreakerSink, error) {
+	if primary == nil {
+		return nil, errors.New("nil sink")
+	}
+	if threshold < 1 {
+		return nil, errors.New("threshold must be at least 1")
+	}
+	if onStateChange == nil {
+		onStateChange = func(from, to BreakerState) {}
+	}
+	return &BreakerSink{
+		primary:       primary,
+		fallback:      fallback,
+		threshold:     threshold,
+		probeInterval: probeInterval,
+		onStateChange: onStateChange,
+	}, nil
+}
+
+// State returns the current state of the circuit breaker.
+func (s *BreakerSink) State() BreakerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Failures returns the number of consecutive failed writes to the primary
+// Sink.
+func (s *BreakerSink) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+// setState must be called while holding s.mu.
+func (s *BreakerSink) setState(state BreakerState) {
+	if s.state == state {
+		return
+	}
+	from := s.state
+	s.state = state
+	if state == BreakerOpen {
+		s.openedAt = time.Now()
+	}
+	s.onStateChange(from, state)
+}
+
+// WriteSegment implements the SegmentWriter interface.
+//
+// The breaker's lock is not held while writing to either Sink, so a slow
+// write does not hold up State, Failures, or other writes. While the
+// breaker is half-open, only one write at a time probes the primary Sink;
+// the others are written to the fallback Sink.
+func (s *BreakerSink) WriteSegment(seg *Segment) error {
+	s.mu.Lock()
+	var probe bool
+	if s.state == BreakerOpen && time.Since(s.openedAt) >= s.probeInterval {
+		s.setState(BreakerHalfOpen)
+		probe = true
+	}
+	usePrimary := s.state == BreakerClosed || probe
+	s.mu.Unlock()
+
+	if usePrimary {
+		err := s.primary.WriteSegment(seg)
+
+		s.mu.Lock()
+		if err == nil {
+			s.failures = 0
+			s.setState(BreakerClosed)
+			s.mu.Unlock()
+			return nil
+		}
+		s.failures++
+		if s.state == BreakerClosed && s.failures < s.threshold {
+			s.mu.Unlock()
+			return err
+		}
+		// Either the threshold has been reached, or the probe failed.
+		s.setState(BreakerOpen)
+		s.mu.Unlock()
+		if s.fallback == nil {
+			return err
+		}
+	}
+
+	if s.fallback == nil {
+		return ErrBreakerOpen
+	}
+	if err := s.fallback.WriteSegment(seg); err != nil {
+		return errors.Wrap(err, "write segment to fallback sink")
+	}
+	return nil
+}
+
+// sinks returns the Sinks segments may be held in.
+func (s *BreakerSink) sinks() []Sink {
+	if s.fallback == nil {
+		return []Sink{s.primary}
+	}
+	return []Sink{s.primary, s.fallback}
+}
+
+// Analyze implements the Analyzer interface, by analyzing both Sinks.
+func (s *BreakerSink) Analyze() error {
+	for _, sink := range s.sinks() {
+		if err := sink.Analyze(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSegment implements the SegmentLoader interface, by returning the
+// oldest segment containing, or following, offset from either Sink.
+func (s *BreakerSink) LoadSegment(offset Offset) (*Segment, error) {
+	var found *Segment
+	for _, sink := range s.sinks() {
+		seg, err := sink.LoadSegment(offset)
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			found = seg
+			continue
+		}
+		if a, _ := seg.Limits(); a.Before(firstOffset(found)) {
+			found = seg
+		}
+	}
+	if found == nil {
+		return nil, io.EOF
+	}
+	return found, nil
+}
+
+func firstOffset(seg *Segment) Offset {
+	first, _ := seg.Limits()
+	return first
+}
+
+// Offsets implements the Sink interface, by returning the oldest, and
+// newest, offsets in either Sink.
+func (s *BreakerSink) Offsets() (first, last Offset) {
+	for _, sink := range s.sinks() {
+		if sink.NumSegments() == 0 {
+			continue
+		}
+		a, b := sink.Offsets()
+		if first == ZeroOffset || a.Before(first) {
+			first = a
+		}
+		if b.After(last) {
+			last = b
+		}
+	}
+	return first, last
+}
+
+// NumSegments implements the Sink interface, by returning the total number
+// of segments in both Sinks.
+func (s *BreakerSink) NumSegments() int {
+	var n int
+	for _, sink := range s.sinks() {
+		n += sink.NumSegments()
+	}
+	return n
+}
+
+// Truncate implements the Sink interface, by truncating both Sinks.
+func (s *BreakerSink) Truncate(offset Offset) error {
+	for _, sink := range s.sinks() {
+		if err := sink.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateAfter implements the TailTruncater interface, by truncating both
+// Sinks. It returns ErrNotSupported if either Sink does not implement
+// TailTruncater.
+func (s *BreakerSink) TruncateAfter(offset Offset) error {
+	for _, sink := range s.sinks() {
+		if err := truncateAfter(sink, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements the io.Closer interface, by closing both Sinks.
+func (s *BreakerSink) Close() error {
+	var first error
+	for _, sink := range s.sinks() {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerSink(t *testing.T) {
+	primary := newFailingSink(t)
+	fallback, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var transitions []BreakerState
+	sink, err := NewBreakerSink(primary, fallback, 2, 10*time.Millisecond, func(from, to BreakerState) {
+		transitions = append(transitions, to)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(offsets ...Offset) error {
+		return sink.WriteSegment(newSegmentOffsets(offsets...))
+	}
+
+	primary.fail = true
+	if err := write(1); err == nil {
+		t.Fatal("expected first failure to be returned")
+	}
+	if err := write(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.State(); got != BreakerOpen {
+		t.Fatalf("wrong state: want=%v got=%v", BreakerOpen, got)
+	}
+	if err := write(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the probe interval has passed, the next write probes the
+	// primary sink.
+	primary.fail = false
+	time.Sleep(20 * time.Millisecond)
+	if err := write(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.State(); got != BreakerClosed {
+		t.Fatalf("wrong state: want=%v got=%v", BreakerClosed, got)
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(transitions) != len(want) {
+		t.Fatalf("wrong transitions: want=%v got=%v", want, transitions)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("wrong transition %d: want=%v got=%v", i, want[i], transitions[i])
+		}
+	}
+
+	// Segments from both sinks are read back in order.
+	var got []Offset
+	r := NewReader(sink)
+	for r.Next() {
+		got = append(got, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != 2 || got[1] != 3 || got[2] != 4 {
+		t.Errorf("wrong offsets read: want=[2 3 4] got=%v", got)
+	}
+}
+
+func TestBreakerSinkSlowPrimary(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &hangingSink{Sink: mem, release: make(chan struct{})}
+	sink, err := NewBreakerSink(primary, nil, 1, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sink.WriteSegment(newSegmentOffsets(1)) }()
+
+	// The breaker's state can be read while the primary sink is blocked.
+	state := make(chan BreakerState, 1)
+	go func() { state <- sink.State() }()
+	select {
+	case got := <-state:
+		if got != BreakerClosed {
+			t.Errorf("wrong state: want=%v got=%v", BreakerClosed, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("State blocked on a write to the primary sink")
+	}
+
+	close(primary.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,222 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// CoalescingSink is a Sink that buffers small segments in memory, and
+// writes them to another Sink as one combined segment, once the combined
+// segment holds at least a minimum number of bytes.
+//
+// It is intended for workloads where a *Logger's segments are flushed long
+// before they are full (such as with a short flush interval), which would
+// otherwise leave the underlying Sink holding many near-empty segments.
+//
+// Buffered segments are readable through the CoalescingSink, but they are
+// not durable until they have been written to the underlying Sink; call
+// Flush to write them early. Closing a CoalescingSink flushes it.
+type CoalescingSink struct {
+	sink    Sink
+	minSize int64
+
+	mu     sync.Mutex
+	buf    *Segment // Buffered segments, combined; nil if there are none.
+	closed bool
+}
+
+// NewCoalescingSink returns a *CoalescingSink that writes segments to sink,
+// once the segments buffered hold at least minSize bytes of data chunks.
+func NewCoalescingSink(sink Sink, minSize uint64) (*CoalescingSink, error) {
+	if sink == nil {
+		return nil, errors.New("nil sink")
+	}
+	if minSize == 0 {
+		return nil, errors.New("minSize must be at least 1")
+	}
+	return &CoalescingSink{
+		sink:    sink,
+		minSize: int64(minSize),
+	}, nil
+}
+
+// Analyze implements the Analyzer interface, by analyzing the underlying
+// Sink.
+func (s *CoalescingSink) Analyze() error {
+	return s.sink.Analyze()
+}
+
+// LoadSegment implements the SegmentLoader interface. Segments are loaded
+// from the underlying Sink, and then from the buffered segments.
+func (s *CoalescingSink) LoadSegment(offset Offset) (*Segment, error) {
+	seg, err := s.sink.LoadSegment(offset)
+	if err != io.EOF {
+		return seg, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf == nil {
+		return nil, io.EOF
+	}
+	if _, last := s.buf.Limits(); offset.After(last) {
+		return nil, io.EOF
+	}
+	return s.buf.clone(), nil
+}
+
+// WriteSegment implements the SegmentWriter interface.
+//
+// seg is combined with any buffered segments. If the combined segment holds
+// at least the minimum number of bytes the *CoalescingSink was created
+// with, it is written to the underlying Sink; otherwise, it is buffered.
+// If the combined segment cannot be written, seg is not buffered, so it is
+// safe to retry the write.
+//
+// Empty segments, such as those written by a *Logger flushing an idle
+// segment, are ignored.
+func (s *CoalescingSink) WriteSegment(seg *Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("write segment: sink closed")
+	}
+	if seg.Chunks() == 0 {
+		return nil
+	}
+
+	// Do not merge segments whose offsets would overlap; write out the
+	// buffered segments first, instead.
+	if s.buf != nil {
+		first, _ := seg.Limits()
+		if _, last := s.buf.Limits(); !first.After(last) {
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	combined := seg.clone()
+	if s.buf != nil {
+		combined.prepend(s.buf)
+	}
+	if combined.Size() < s.minSize {
+		s.buf = combined
+		return nil
+	}
+	if err := s.sink.WriteSegment(combined); err != nil {
+		return err
+	}
+	s.buf = nil
+	return nil
+}
+
+// Flush writes any buffered segments to the underlying Sink, as one
+// combined segment.
+func (s *CoalescingSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+func (s *CoalescingSink) flush() error {
+	if s.buf == nil {
+		return nil
+	}
+	if err := s.sink.WriteSegment(s.buf); err != nil {
+		return errors.Wrap(err, "flush buffered segments")
+	}
+	s.buf = nil
+	return nil
+}
+
+// Offsets implements the Sink interface. The offsets cover both the
+// underlying Sink, and the buffered segments.
+func (s *CoalescingSink) Offsets() (first, last Offset) {
+	first, last = s.sink.Offsets()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf == nil {
+		return first, last
+	}
+	bufFirst, bufLast := s.buf.Limits()
+	if s.sink.NumSegments() == 0 {
+		first = bufFirst
+	}
+	return first, bufLast
+}
+
+// NumSegments implements the Sink interface. The buffered segments count
+// as a single segment.
+func (s *CoalescingSink) NumSegments() int {
+	n := s.sink.NumSegments()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf != nil {
+		n++
+	}
+	return n
+}
+
+// Truncate implements the Sink interface, by truncating the underlying
+// Sink, and the buffered segments.
+func (s *CoalescingSink) Truncate(offset Offset) error {
+	if err := s.sink.Truncate(offset); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf != nil {
+		if s.buf.Truncate(offset); s.buf.Chunks() == 0 {
+			s.buf = nil
+		}
+	}
+	return nil
+}
+
+// TruncateAfter implements the TailTruncater interface, by truncating the
+// underlying Sink, and the buffered segments. It returns ErrNotSupported if
+// the underlying Sink does not implement TailTruncater.
+func (s *CoalescingSink) TruncateAfter(offset Offset) error {
+	if err := truncateAfter(s.sink, offset); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf != nil {
+		if s.buf.TruncateAfter(offset); s.buf.Chunks() == 0 {
+			s.buf = nil
+		}
+	}
+	return nil
+}
+
+// Ping implements the HealthChecker interface, by checking the underlying
+// Sink, if it implements HealthChecker.
+func (s *CoalescingSink) Ping(ctx context.Context) error {
+	if hc, ok := s.sink.(HealthChecker); ok {
+		return hc.Ping(ctx)
+	}
+	return ctx.Err()
+}
+
+// Close writes any buffered segments to the underlying Sink, and closes it.
+func (s *CoalescingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.closed = true
+	return s.sink.Close()
+}
@@ -0,0 +1,70 @@
+package wal
+
+import "testing"
+
+func TestCoalescingSink(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each chunk below takes up 10 bytes (its offset, header length, and a
+	// single byte of data), so three of them fill a combined segment.
+	sink, err := NewCoalescingSink(mem, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := sink.WriteSegment(newSegmentOffsets(Offset(i + 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An empty segment, as written by a Logger flushing while idle, does
+	// not force the buffered segments out.
+	if err := sink.WriteSegment(NewSegment()); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.NumSegments(); n != 0 {
+		t.Errorf("segments written before minimum size reached: %d", n)
+	}
+	if first, last := sink.Offsets(); sink.NumSegments() != 1 || first != 1 || last != 2 {
+		t.Errorf("wrong buffered segments: want=1 (1,2) got=%d (%v,%v)", sink.NumSegments(), first, last)
+	}
+	if n := countChunks(t, sink); n != 2 {
+		t.Errorf("wrong number of buffered chunks read: want=2 got=%d", n)
+	}
+
+	if err := sink.WriteSegment(newSegmentOffsets(3)); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.NumSegments(); n != 1 {
+		t.Fatalf("wrong number of segments written: want=1 got=%d", n)
+	}
+	if first, last := mem.Offsets(); first != 1 || last != 3 {
+		t.Errorf("wrong combined segment: want=1,3 got=%v,%v", first, last)
+	}
+
+	// Closing the sink writes out whatever is left.
+	if err := sink.WriteSegment(newSegmentOffsets(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments after close: want=2 got=%d", n)
+	}
+}
+
+func countChunks(t *testing.T, sink Sink) int {
+	t.Helper()
+	r := NewReader(sink)
+	var n int
+	for r.Next() {
+		n++
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,173 @@
+package wal
+
+import (
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Sink types that can be constructed by SinkFromConfig.
+const (
+	SinkTypeDirectory  = "directory"  // A *DirectorySink.
+	SinkTypeMemory     = "memory"     // A *MemorySink.
+	SinkTypeShadow     = "shadow"     // A *ShadowSink.
+	SinkTypeBreaker    = "breaker"    // A *BreakerSink.
+	SinkTypeCoalescing = "coalescing" // A *CoalescingSink.
+	SinkTypeStrict     = "strict"     // A *StrictSink.
+)
+
+// SinkConfig declares a Sink, so that it can be loaded from a configuration
+// file, and constructed with SinkFromConfig. Its fields are tagged for use
+// with encoding/json, and with YAML packages that read "yaml" struct tags
+// (such as gopkg.in/yaml.v3). This package does not depend on a YAML
+// package; decoding a YAML file is left to the caller.
+//
+// Sinks that wrap other Sinks declare them with the Primary, and Secondary
+// fields. For example, a DirectorySink that falls back to a MemorySink when
+// writes to the directory fail:
+//
+//	{
+//		"type": "breaker",
+//		"threshold": 3,
+//		"probe_interval": "30s",
+//		"primary": {"type": "directory", "dir": "/var/lib/app/wal"},
+//		"secondary": {"type": "memory"}
+//	}
+type SinkConfig struct {
+	// Type is the type of Sink; one of the SinkType constants.
+	Type string `json:"type" yaml:"type"`
+
+	// Dir is the directory a "directory" Sink stores segments in.
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// MinFreeSpace, AppendOnly, LogicalTruncation, ImmutableSegments, and
+	// CacheSegments set the options of the same name on a "directory"
+	// Sink.
+	MinFreeSpace      uint64 `json:"min_free_space,omitempty" yaml:"min_free_space,omitempty"`
+	AppendOnly        bool   `json:"append_only,omitempty" yaml:"append_only,omitempty"`
+	LogicalTruncation bool   `json:"logical_truncation,omitempty" yaml:"logical_truncation,omitempty"`
+	ImmutableSegments bool   `json:"immutable_segments,omitempty" yaml:"immutable_segments,omitempty"`
+	CacheSegments     int    `json:"cache_segments,omitempty" yaml:"cache_segments,omitempty"`
+
+	// Primary is the Sink wrapped by a "shadow", "breaker", "coalescing",
+	// or "strict" Sink.
+	Primary *SinkConfig `json:"primary,omitempty" yaml:"primary,omitempty"`
+
+	// Secondary is the shadow Sink of a "shadow" Sink, or the (optional)
+	// fallback Sink of a "breaker" Sink.
+	Secondary *SinkConfig `json:"secondary,omitempty" yaml:"secondary,omitempty"`
+
+	// Threshold is the number of consecutive failed writes after which a
+	// "breaker" Sink opens, and ProbeInterval is how often it then probes
+	// its primary Sink, as parsed by time.ParseDuration.
+	Threshold     int    `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	ProbeInterval string `json:"probe_interval,omitempty" yaml:"probe_interval,omitempty"`
+
+	// MinSize is the number of bytes a "coalescing" Sink buffers before
+	// writing to its primary Sink.
+	MinSize uint64 `json:"min_size,omitempty" yaml:"min_size,omitempty"`
+}
+
+// SinkFromConfig constructs the Sink declared by cfg, along with any Sinks
+// it wraps.
+//
+// As with NewDirectorySink, the returned Sink has not been analyzed; call
+// its Analyze method before using it with an existing log.
+func SinkFromConfig(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case SinkTypeDirectory:
+		return directorySinkFromConfig(cfg)
+
+	case SinkTypeMemory:
+		return NewMemorySink()
+
+	case SinkTypeShadow:
+		return wrapSinks(cfg, true, func(primary, secondary Sink) (Sink, error) {
+			return NewShadowSink(primary, secondary, nil)
+		})
+
+	case SinkTypeBreaker:
+		var interval time.Duration
+		if cfg.ProbeInterval != "" {
+			d, err := time.ParseDuration(cfg.ProbeInterval)
+			if err != nil {
+				return nil, errors.Wrap(err, "breaker sink: parse probe interval")
+			}
+			interval = d
+		}
+		return wrapSinks(cfg, false, func(primary, secondary Sink) (Sink, error) {
+			return NewBreakerSink(primary, secondary, cfg.Threshold, interval, nil)
+		})
+
+	case SinkTypeCoalescing:
+		return wrapSinks(cfg, false, func(primary, _ Sink) (Sink, error) {
+			return NewCoalescingSink(primary, cfg.MinSize)
+		})
+
+	case SinkTypeStrict:
+		return wrapSinks(cfg, false, func(primary, _ Sink) (Sink, error) {
+			return NewStrictSink(primary)
+		})
+
+	case "":
+		return nil, errors.New("no sink type")
+	}
+	return nil, errors.Errorf("unknown sink type %q", cfg.Type)
+}
+
+func directorySinkFromConfig(cfg SinkConfig) (Sink, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("directory sink: no dir")
+	}
+	var opts []DirectoryOption
+	if cfg.MinFreeSpace > 0 {
+		opts = append(opts, MinFreeSpace(cfg.MinFreeSpace, nil))
+	}
+	if cfg.AppendOnly {
+		opts = append(opts, AppendOnly())
+	}
+	if cfg.LogicalTruncation {
+		opts = append(opts, LogicalTruncation())
+	}
+	if cfg.ImmutableSegments {
+		opts = append(opts, ImmutableSegments())
+	}
+	if cfg.CacheSegments > 0 {
+		opts = append(opts, CacheSegments(cfg.CacheSegments))
+	}
+	return NewDirectorySink(cfg.Dir, opts...)
+}
+
+// wrapSinks constructs the primary, and secondary (if any) Sinks declared by
+// cfg, and passes them to wrap. The secondary Sink is optional, unless
+// needSecondary is true. The wrapped Sinks are closed if wrap fails.
+func wrapSinks(cfg SinkConfig, needSecondary bool, wrap func(primary, secondary Sink) (Sink, error)) (Sink, error) {
+	if cfg.Primary == nil {
+		return nil, errors.Errorf("%s sink: no primary sink", cfg.Type)
+	}
+	primary, err := SinkFromConfig(*cfg.Primary)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s sink: primary", cfg.Type)
+	}
+
+	var second Sink
+	if cfg.Secondary != nil {
+		if second, err = SinkFromConfig(*cfg.Secondary); err != nil {
+			primary.Close()
+			return nil, errors.Wrapf(err, "%s sink: secondary", cfg.Type)
+		}
+	} else if needSecondary {
+		primary.Close()
+		return nil, errors.Errorf("%s sink: no secondary sink", cfg.Type)
+	}
+
+	sink, err := wrap(primary, second)
+	if err != nil {
+		primary.Close()
+		if second != nil {
+			second.Close()
+		}
+		return nil, errors.Wrapf(err, "%s sink", cfg.Type)
+	}
+	return sink, nil
+}
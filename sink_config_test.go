@@ -0,0 +1,68 @@
+package wal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSinkFromConfig(t *testing.T) {
+	p := []byte(`{
+		"type": "breaker",
+		"threshold": 3,
+		"probe_interval": "30s",
+		"primary": {
+			"type": "coalescing",
+			"min_size": 1024,
+			"primary": {"type": "directory", "dir": "` + t.TempDir() + `", "logical_truncation": true}
+		},
+		"secondary": {"type": "memory"}
+	}`)
+	var cfg SinkConfig
+	if err := json.Unmarshal(p, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := SinkFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	bs, ok := sink.(*BreakerSink)
+	if !ok {
+		t.Fatalf("wrong sink type: %T", sink)
+	}
+	if cs, ok := bs.primary.(*CoalescingSink); !ok {
+		t.Errorf("wrong primary sink type: %T", bs.primary)
+	} else if ds, ok := cs.sink.(*DirectorySink); !ok || !ds.logical {
+		t.Errorf("wrong coalesced sink: %T", cs.sink)
+	}
+	if _, ok := bs.fallback.(*MemorySink); !ok {
+		t.Errorf("wrong fallback sink type: %T", bs.fallback)
+	}
+
+	for _, cfg := range []SinkConfig{
+		{},
+		{Type: "s3"},
+		{Type: SinkTypeDirectory},
+		{Type: SinkTypeShadow, Primary: &SinkConfig{Type: SinkTypeMemory}},
+		{Type: SinkTypeBreaker, Primary: &SinkConfig{Type: SinkTypeMemory}, ProbeInterval: "soon"},
+		{Type: SinkTypeStrict},
+	} {
+		if _, err := SinkFromConfig(cfg); err == nil {
+			t.Errorf("invalid config accepted: %+v", cfg)
+		}
+	}
+}
+
+func TestSinkConfigTags(t *testing.T) {
+	// There is no YAML package to decode with; make sure that each field
+	// has the same key in YAML, as in JSON.
+	typ := reflect.TypeOf(SinkConfig{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if j, y := f.Tag.Get("json"), f.Tag.Get("yaml"); j != y {
+			t.Errorf("field %s: json tag %q does not match yaml tag %q", f.Name, j, y)
+		}
+	}
+}
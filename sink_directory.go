@@ -2,6 +2,9 @@ package wal
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
 	"encoding/hex"
 	"hash"
 	"hash/crc64"
@@ -12,7 +15,7 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 )
 
 // DirectorySink implements a Sink that can persist WAL segments to,
@@ -35,12 +38,97 @@ import (
 //
 //	1483228800000000000-1483232400000000000.CHECKSUM
 //
+// When created with the SignSegments option, each segment file is also
+// accompanied by a file holding an Ed25519 signature of the segment's
+// contents, and its link in the hash chain, if it has one:
+//
+//	1483228800000000000-1483232400000000000.SIGNATURE
+//
+// When created with the AppendOnly option, each segment file is accompanied
+// by a file holding a link in a hash chain, covering the segment and every
+// segment written before it (see VerifyChain):
+//
+//	1483228800000000000-1483232400000000000.CHAIN
+//
+// When created with the LogicalTruncation option, a segment that has been
+// partially truncated is accompanied by a "tombstone" file, holding the
+// offset it was truncated at:
+//
+//	1483228800000000000-1483232400000000000.TOMBSTONE
+//
+// When created with the BloomFilter option, each segment file is also
+// accompanied by a Bloom filter over the keys of its data chunks:
+//
+//	1483228800000000000-1483232400000000000.BLOOM
+//
+// When created with the IndexKeys option, each segment file is also
+// accompanied by an index of the keys of its data chunks:
+//
+//	1483228800000000000-1483232400000000000.INDEX
+//
+// While a segment is being rewritten (such as when it is truncated), the
+// original segment file is accompanied by a file holding the name of the
+// rewritten segment file, which is removed along with the original:
+//
+//	1483228800000000000-1483232400000000000.REWRITE
+//
+// Each segment file is accompanied by a file holding its SegmentID, which is
+// kept when the segment is rewritten under a new name:
+//
+//	1483228800000000000-1483232400000000000.ID
+//
+// Segment files may be gzip-compressed, in place, with the CompressBefore
+// method; they keep the same name, and accompanying files.
+//
+// When created with the AlignSegments option, each segment file is padded
+// to a multiple of a block size, with a padding record: a line, following
+// the data chunks, starting with "#".
+//
 type DirectorySink struct {
-	dir string
+	dir     string
+	metaDir string // Directory holding the files accompanying segment files; see MetadataDir.
+
+	minFree    uint64                  // Free space to keep on the filesystem, in bytes.
+	onLowDisk  func(free uint64) error // Called when free space is below minFree.
+	signKey    ed25519.PrivateKey      // Key used to sign written segments.
+	verifyKey  ed25519.PublicKey       // Key used to verify loaded segments.
+	appendOnly bool                    // Disallow truncation, and chain segments.
+	throttle   *truncThrottle          // Truncate in the background, if non-nil.
+	logical    bool                    // Truncate segments with tombstones, rather than rewriting them.
+	immutable  bool                    // Never rewrite segment files.
+	keyFn      KeyFunc                 // Extracts keys for segments' Bloom filters.
+	indexFn    KeyFunc                 // Extracts keys for segments' key indexes.
+	limits     *ResourceLimits         // Shared resource limits, if non-nil; see DirectoryLimits.
+	align      int64                   // Pad segment files to a multiple of this many bytes, if non-zero.
+
+	// Called before truncating, if non-nil; see OnBeforeTruncate.
+	beforeTrunc func([]SegmentStats) error
+
+	chainMu sync.Mutex
+	chain   []byte // The most-recent link in the segment hash chain.
+
+	listMu  sync.Mutex // Serializes calls to PublishSegmentList.
+	listGen uint64     // Generation of the segment list last published.
 
-	mu       sync.RWMutex
-	segments [][2]Offset
-	segPaths []string // holds the basename of each segment file
+	bloomMu sync.Mutex
+	blooms  map[string]bloomFilter // Bloom filters over segments' keys, by basename.
+
+	indexMu sync.Mutex
+	indexes map[string]segmentIndex // Segments' key indexes, by basename.
+
+	cacheSize int // Number of loaded segments to keep; see CacheSegments.
+
+	cacheMu    sync.Mutex
+	cache      map[SegmentID]*Segment // Recently-loaded segments, by ID, before tombstones are applied.
+	cacheOrder []SegmentID            // IDs of cached segments, least-recently used first.
+
+	mu         sync.RWMutex
+	segments   [][2]Offset
+	segPaths   []string             // holds the basename of each segment file
+	tombstones map[string]Offset    // Offsets segments have been logically truncated at, by basename.
+	ids        map[string]SegmentID // Segments' stable IDs, by basename.
+
+	pins pinSet
 }
 
 // NewDirectorySink returns a *DirectorySink that can read and write
@@ -49,7 +137,7 @@ type DirectorySink struct {
 // The permissions of dir will be checked to ensure the *DirectorySink
 // can read and write to dir. If the directory does not exist, it will be
 // created with mode 0777 (before umask).
-func NewDirectorySink(dir string) (*DirectorySink, error) {
+func NewDirectorySink(dir string, options ...DirectoryOption) (*DirectorySink, error) {
 	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, errors.Wrap(err, "new directory sink")
@@ -64,7 +152,18 @@ func NewDirectorySink(dir string) (*DirectorySink, error) {
 	}
 
 	ds := &DirectorySink{
-		dir: dir,
+		dir:     dir,
+		metaDir: dir,
+	}
+	for _, option := range options {
+		if err := option(ds); err != nil {
+			return nil, errors.Wrap(err, "applying option")
+		}
+	}
+	if ds.metaDir != dir {
+		if err := os.MkdirAll(ds.metaDir, 0777); err != nil {
+			return nil, errors.Wrap(err, "mkdir all")
+		}
 	}
 	return ds, nil
 }
@@ -76,6 +175,25 @@ func NewDirectorySink(dir string) (*DirectorySink, error) {
 // checksum of the segment file, and comparing it to the checksum in the
 // segment's checksum file.
 func (ds *DirectorySink) Analyze() error {
+	return ds.AnalyzeContext(context.Background(), nil)
+}
+
+// AnalyzeProgress reports the progress of a call to AnalyzeContext.
+type AnalyzeProgress struct {
+	Scanned int    // Segment files scanned so far.
+	Total   int    // Segment files to scan.
+	File    string // Name of the segment file about to be scanned.
+}
+
+// AnalyzeContext is like Analyze, but stops scanning segment files once ctx
+// is done, returning ctx's error, and leaving the sink without any
+// segments. If progress is non-nil, it is called before each segment file
+// is scanned.
+//
+// Analyzing a directory holding many segment files can take some time, as
+// each one is checksummed; AnalyzeContext allows it to be observed, and
+// cancelled.
+func (ds *DirectorySink) AnalyzeContext(ctx context.Context, progress func(AnalyzeProgress)) error {
 	// "Reset" the slices containing the currently-known segment offsets,
 	// and the paths to them.
 	//
@@ -99,6 +217,24 @@ func (ds *DirectorySink) Analyze() error {
 		return errors.Wrap(err, "find files")
 	}
 	for i, name := range files {
+		if err := ctx.Err(); err != nil {
+			ds.reset()
+			return errors.Wrap(err, "analyze")
+		}
+		if progress != nil {
+			progress(AnalyzeProgress{Scanned: i, Total: len(files), File: name})
+		}
+
+		// The newest segment file may not have been completely
+		// written, if the metadata directory is separate, and the sink
+		// was interrupted before writing its checksum file.
+		if chksums[i] == "" {
+			if ds.metaDir != ds.dir && i == len(files)-1 {
+				continue
+			}
+			return errors.Errorf("segment %s has no checksum file", name)
+		}
+
 		// Verify the segment file by checksumming its contents, and
 		// comparing it to the accompanying ".CHECKSUM" file.
 		if err := ds.verifySegment(name, chksums[i]); err != nil {
@@ -109,25 +245,72 @@ func (ds *DirectorySink) Analyze() error {
 		if err != nil {
 			return errors.Wrap(err, "analyze")
 		}
+		if ds.throttle != nil && !end.After(ds.throttle.truncated()) {
+			// Waiting to be deleted by a throttled truncation.
+			continue
+		}
+		if tomb, ok, err := ds.readTombstone(name); err != nil {
+			return errors.Wrapf(err, "segment %s", name)
+		} else if ok {
+			if !end.After(tomb) {
+				continue // Every data chunk has been truncated.
+			}
+			ds.setTombstone(name, tomb)
+			start = tomb + 1
+		}
+		id, err := ds.loadSegmentID(name)
+		if err != nil {
+			return errors.Wrapf(err, "segment %s", name)
+		}
+		ds.setSegmentID(name, id)
+		if ds.keyFn != nil {
+			if err := ds.loadBloomFilter(name); err != nil {
+				return errors.Wrapf(err, "segment %s", name)
+			}
+		}
+		if ds.indexFn != nil {
+			if err := ds.loadIndex(name); err != nil {
+				return errors.Wrapf(err, "segment %s", name)
+			}
+		}
 		ds.segments = append(ds.segments, [2]Offset{start, end})
 		ds.segPaths = append(ds.segPaths, name)
 	}
+
+	// Pick up the hash chain from the most-recent segment, so that new
+	// segments are chained to it.
+	if ds.appendOnly && len(ds.segPaths) > 0 {
+		link, err := ds.loadChecksum(ds.metaPath(ds.segPaths[len(ds.segPaths)-1] + ".CHAIN"))
+		if err != nil {
+			return errors.Wrap(err, "load hash chain")
+		}
+		ds.chainMu.Lock()
+		ds.chain = link
+		ds.chainMu.Unlock()
+	}
 	return nil
 }
 
 func (ds *DirectorySink) verifySegment(segmentPath, chksumPath string) error {
-	chksum, err := ds.loadChecksum(filepath.Join(ds.dir, chksumPath))
+	chksum, err := ds.loadChecksum(ds.metaPath(chksumPath))
 	if err != nil {
 		return errors.Wrap(err, "load checksum")
 	}
 
 	calc := ds.newChecksum()
+	digest := sha512.New()
+	ds.limits.acquireFile()
+	defer ds.limits.releaseFile()
 	f, err := os.Open(filepath.Join(ds.dir, segmentPath))
 	if err != nil {
 		return errors.Wrap(err, "open segment file")
 	}
 	defer f.Close()
-	if _, err := io.Copy(calc, f); err != nil {
+	r, err := decompress(f)
+	if err != nil {
+		return errors.Wrap(err, "open segment file")
+	}
+	if _, err := io.Copy(io.MultiWriter(calc, digest), r); err != nil {
 		return errors.Wrap(err, "calculate checksum")
 	}
 
@@ -137,9 +320,40 @@ func (ds *DirectorySink) verifySegment(segmentPath, chksumPath string) error {
 			hex.EncodeToString(got),
 		)
 	}
+	return ds.verifySignature(segmentPath, digest.Sum(nil))
+}
+
+// verifySignature checks the signature of the named segment file against
+// digest, the SHA-512 digest of the segment file's contents, and the
+// segment's link in the hash chain, if it has one.
+//
+// If the sink was not created with the VerifySegments option, this method
+// does nothing.
+func (ds *DirectorySink) verifySignature(segmentPath string, digest []byte) error {
+	if ds.verifyKey == nil {
+		return nil
+	}
+	sig, err := ds.loadChecksum(ds.metaPath(segmentPath + ".SIGNATURE"))
+	if err != nil {
+		return errors.Wrap(err, "load signature")
+	}
+	link, err := ds.loadChecksum(ds.metaPath(segmentPath + ".CHAIN"))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "load hash chain")
+	}
+	if !ed25519.Verify(ds.verifyKey, signedMessage(digest, link), sig) {
+		return ErrBadSignature
+	}
 	return nil
 }
 
+// signedMessage returns the message signed for a segment: the SHA-512
+// digest of its contents, followed by its link in the hash chain, if the
+// segment was written by a sink created with the AppendOnly option.
+func signedMessage(digest, link []byte) []byte {
+	return append(append([]byte(nil), digest...), link...)
+}
+
 func (ds *DirectorySink) loadChecksum(name string) ([]byte, error) {
 	src, err := ioutil.ReadFile(name)
 	if err != nil {
@@ -154,9 +368,19 @@ func (ds *DirectorySink) loadChecksum(name string) ([]byte, error) {
 
 // parseOffsets parses a segment file's offset boundaries from its filename.
 func (ds *DirectorySink) parseOffsets(name string) (start, end Offset, err error) {
+	start, end, err = parseSegFileName(name)
+	if err != nil {
+		return ZeroOffset, ZeroOffset, errors.Wrap(err, filepath.Join(ds.dir, name))
+	}
+	return start, end, nil
+}
+
+// parseSegFileName parses a segment's offset boundaries from a file name in
+// the form produced by fmtSegFileName.
+func parseSegFileName(name string) (start, end Offset, err error) {
 	sep := strings.Index(name, "-")
 	if sep == -1 {
-		return ZeroOffset, ZeroOffset, errors.Errorf("no separator in filename: %s", filepath.Join(ds.dir, name))
+		return ZeroOffset, ZeroOffset, errors.New("no separator in filename")
 	}
 
 	start, err = ParseOffset(name[:sep])
@@ -176,15 +400,25 @@ func (ds *DirectorySink) parseOffsets(name string) (start, end Offset, err error
 func (ds *DirectorySink) reset() {
 	ds.segments = [][2]Offset{}
 	ds.segPaths = []string{}
+	ds.tombstones = nil
+	ds.ids = nil
+
+	// The segment files may have changed since they were cached.
+	ds.cacheMu.Lock()
+	ds.limits.releaseCache(len(ds.cacheOrder))
+	ds.cache, ds.cacheOrder = nil, nil
+	ds.cacheMu.Unlock()
 }
 
 // findFiles walks the sink's working directory, looking for segment files, and
-// checksum files.
+// checksum files. The i-th checksum file is that of the i-th segment file,
+// or "" if the segment file has no checksum file.
 //
 // This method does not descend into child directories.
 func (ds *DirectorySink) findFiles() (segments, checksums []string, err error) {
 	segments = []string{}
 	checksums = []string{}
+	found := make(map[string]bool)
 	if err := filepath.Walk(ds.dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return errors.Wrap(err, "walk dir")
@@ -202,7 +436,13 @@ func (ds *DirectorySink) findFiles() (segments, checksums []string, err error) {
 		if ok, err := filepath.Match("*.CHECKSUM", name); err != nil {
 			return errors.Wrap(err, "match checksum pattern")
 		} else if ok {
-			checksums = append(checksums, name)
+			found[name] = true
+			return nil
+		}
+
+		// Skip any other files that accompany a segment file.
+		switch filepath.Ext(name) {
+		case ".SIGNATURE", ".CHAIN", ".TOMBSTONE", ".BLOOM", ".INDEX", ".REWRITE", ".STATS", ".ID", ".BOOKMARK", ".tmp":
 			return nil
 		}
 
@@ -217,41 +457,192 @@ func (ds *DirectorySink) findFiles() (segments, checksums []string, err error) {
 	}); err != nil {
 		return nil, nil, err
 	}
+
+	if ds.metaDir != ds.dir {
+		entries, err := os.ReadDir(ds.metaDir)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read metadata dir")
+		}
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == ".CHECKSUM" {
+				found[e.Name()] = true
+			}
+		}
+	}
+
+	for _, name := range segments {
+		if found[name+".CHECKSUM"] {
+			checksums = append(checksums, name+".CHECKSUM")
+		} else {
+			checksums = append(checksums, "")
+		}
+	}
 	return segments, checksums, nil
 }
 
 // LoadSegment implements the SegmentLoader interface.
+//
+// The segment file is read without holding the sink's lock, so loading a
+// segment does not block, and is not blocked by, concurrent calls to
+// WriteSegment, or Truncate.
 func (ds *DirectorySink) LoadSegment(offset Offset) (*Segment, error) {
-	ds.mu.RLock()
-	defer ds.mu.RUnlock()
-
-	if offset.Equal(ZeroOffset) {
+	segs, err := ds.loadSegmentFiles(func() ([]string, error) {
 		if len(ds.segPaths) == 0 {
-			return nil, errors.New("no segments to load")
+			return nil, io.EOF
+		}
+		if offset.Equal(ZeroOffset) {
+			return ds.segPaths[:1], nil
+		}
+
+		// Offsets that fall between two segments load the newer of the two.
+		for i, offs := range ds.segments {
+			if offset.Within(offs[0], offs[1]) || offset.Before(offs[0]) {
+				return ds.segPaths[i : i+1], nil
+			}
 		}
-		return ds.loadSegment(ds.segPaths[0])
+		return nil, io.EOF
+	})
+	if err != nil {
+		return nil, err
 	}
+	return segs[0], nil
+}
 
-	for i, offs := range ds.segments {
-		if offset.Within(offs[0], offs[1]) {
-			return ds.loadSegment(ds.segPaths[i])
+// LoadSegments implements the RangeLoader interface. The segments to load
+// are found while holding the sink's lock once, so that they are consistent
+// with one another, even if the log is truncated at the same time.
+func (ds *DirectorySink) LoadSegments(from, to Offset) ([]*Segment, error) {
+	return ds.loadSegmentFiles(func() ([]string, error) {
+		var names []string
+		for i, offs := range ds.segments {
+			if offs[0].After(to) {
+				break
+			}
+			if offs[1].Before(from) {
+				continue
+			}
+			names = append(names, ds.segPaths[i])
+		}
+		return names, nil
+	})
+}
+
+// segmentRef holds what is needed to load a segment file without holding
+// ds.mu.
+type segmentRef struct {
+	name       string
+	id         SegmentID
+	tomb       Offset // Offset the segment is truncated at; see LogicalTruncation.
+	tombstoned bool
+}
+
+// loadSegmentFiles loads the segment files named by find, which is called
+// while holding a read lock on ds.mu. The files are read without holding
+// the lock, so that reading a large segment does not block writes to, or
+// truncation of, the sink, and so that readers are not starved by them.
+// Should one of the files be removed in the meantime, by a truncation,
+// find is called again.
+func (ds *DirectorySink) loadSegmentFiles(find func() ([]string, error)) ([]*Segment, error) {
+	for {
+		ds.mu.RLock()
+		names, err := find()
+		refs := make([]segmentRef, len(names))
+		for i, name := range names {
+			tomb, ok := ds.tombstones[name]
+			refs[i] = segmentRef{name: name, id: ds.ids[name], tomb: tomb, tombstoned: ok}
+		}
+		ds.mu.RUnlock()
+		if err != nil {
+			return nil, err
 		}
+
+		segs, removed, err := ds.loadSegmentRefs(refs)
+		if removed {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "load segment %s", refs[len(segs)].name)
+		}
+		return segs, nil
 	}
+}
 
-	return nil, io.EOF
+// loadSegmentRefs loads the segments referred to by refs, from the segment
+// cache if they are there, or else from their segment files, and drops any
+// data chunks removed by a tombstone. It reports whether a segment file was
+// not found because the sink has since removed it, along with the segments
+// loaded before it.
+func (ds *DirectorySink) loadSegmentRefs(refs []segmentRef) (segs []*Segment, removed bool, err error) {
+	for _, ref := range refs {
+		seg := ds.cachedSegment(ref.id)
+		if seg == nil {
+			seg, err = ds.readSegment(ref.name)
+			ds.mu.RLock()
+			_, known := ds.ids[ref.name]
+			if err == nil && known {
+				// A segment that has since been rewritten was
+				// removed from the cache, and must not be
+				// added back.
+				ds.cacheSegment(ref.id, seg)
+			}
+			ds.mu.RUnlock()
+			if err != nil {
+				return segs, errors.Is(err, os.ErrNotExist) && !known, err
+			}
+		}
+		if ref.tombstoned {
+			seg.Truncate(ref.tomb)
+		}
+		segs = append(segs, seg)
+	}
+	return segs, false, nil
 }
 
+// loadSegment loads the named segment, from the segment cache if it is
+// there (see CacheSegments), or else from its segment file, and drops any
+// data chunks removed by a tombstone. It must be called while holding
+// ds.mu; see loadSegmentFiles, to load a segment without it.
 func (ds *DirectorySink) loadSegment(name string) (*Segment, error) {
+	id := ds.ids[name]
+	seg := ds.cachedSegment(id)
+	if seg == nil {
+		var err error
+		if seg, err = ds.readSegment(name); err != nil {
+			return nil, err
+		}
+		ds.cacheSegment(id, seg)
+	}
+	if tomb, ok := ds.tombstones[name]; ok {
+		seg.Truncate(tomb)
+	}
+	return seg, nil
+}
+
+// readSegment reads, and verifies, the named segment file.
+func (ds *DirectorySink) readSegment(name string) (*Segment, error) {
+	ds.limits.acquireFile()
+	defer ds.limits.releaseFile()
 	f, err := os.Open(filepath.Join(ds.dir, name))
 	if err != nil {
 		return nil, errors.Wrap(err, "open segment file")
 	}
 	defer f.Close()
 
+	r, err := decompress(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "open segment file")
+	}
+	digest := sha512.New()
+	if ds.verifyKey != nil {
+		r = io.TeeReader(r, digest)
+	}
+
 	seg := new(Segment)
-	if _, err := seg.ReadFrom(f); err != nil {
+	if _, err := seg.ReadFrom(r); err != nil {
 		return nil, errors.Wrap(err, "load segment")
 	}
+	if err := ds.verifySignature(name, digest.Sum(nil)); err != nil {
+		return nil, errors.Wrapf(err, "verify segment %s", name)
+	}
 	return seg, nil
 }
 
@@ -260,16 +651,38 @@ func (ds *DirectorySink) loadSegment(name string) (*Segment, error) {
 // It will write each data segment out to a file, along with a second
 // file with a .CHECKSUM extension.
 func (ds *DirectorySink) WriteSegment(seg *Segment) error {
+	return ds.WriteSegmentContext(context.Background(), seg)
+}
+
+// WriteSegmentContext implements the ContextWriter interface.
+//
+// A write that is cancelled, or times out, before the segment's checksum
+// file has been written is abandoned, and the partially-written segment
+// file is removed; the segment can then be written again without leaving a
+// duplicate behind. A blocked system call (such as a write to a hung
+// network filesystem) cannot be interrupted, so the write is only
+// abandoned once it returns.
+func (ds *DirectorySink) WriteSegmentContext(ctx context.Context, seg *Segment) error {
 	start, end := seg.Limits()
 	if start == ZeroOffset && end == ZeroOffset {
 		return nil
 	}
-	if err := ds.writeSegment(seg); err != nil {
+	if ds.keyFn != nil || ds.indexFn != nil {
+		if err := checkKeyable(seg); err != nil {
+			return errors.Wrap(err, "write segment")
+		}
+	}
+	if err := ds.checkFreeSpace(seg); err != nil {
+		return err
+	}
+	id := newSegmentID()
+	if err := ds.writeSegment(ctx, seg, id); err != nil {
 		return err
 	}
 	ds.mu.Lock()
 	ds.segments = append(ds.segments, [2]Offset{start, end})
 	ds.segPaths = append(ds.segPaths, fmtSegFileName(seg))
+	ds.setSegmentID(fmtSegFileName(seg), id)
 	ds.mu.Unlock()
 	return nil
 }
@@ -279,30 +692,255 @@ func fmtSegFileName(seg *Segment) string {
 	return start.String() + "-" + end.String()
 }
 
-func (ds *DirectorySink) writeSegment(seg *Segment) error {
-	name := filepath.Join(ds.dir, fmtSegFileName(seg))
+// checkFreeSpace returns ErrDiskSpaceLow if writing seg would leave less
+// than the configured minimum amount of free space on the sink's filesystem.
+//
+// If a low-disk-space callback has been set with MinFreeSpace, it is called
+// before giving up, and the free space is checked again.
+func (ds *DirectorySink) checkFreeSpace(seg *Segment) error {
+	if ds.minFree == 0 {
+		return nil
+	}
+	size, err := seg.EncodedSize()
+	if err != nil {
+		return errors.Wrap(err, "calculate segment size")
+	}
+	need := ds.minFree + uint64(size+int64(ds.padding(size)))
+
+	free, err := diskFree(ds.dir)
+	if err != nil {
+		return errors.Wrap(err, "check free space")
+	}
+	if free >= need {
+		return nil
+	}
+
+	if ds.onLowDisk != nil {
+		if err := ds.onLowDisk(free); err != nil {
+			return errors.Wrap(err, "low disk space callback")
+		}
+		if free, err = diskFree(ds.dir); err != nil {
+			return errors.Wrap(err, "check free space")
+		}
+		if free >= need {
+			return nil
+		}
+	}
+	return ErrDiskSpaceLow
+}
+
+// writeSegment writes seg to its segment file, along with its accompanying
+// files, recording id as its SegmentID.
+func (ds *DirectorySink) writeSegment(ctx context.Context, seg *Segment, id SegmentID) (err error) {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "write segment")
+	}
+	base := fmtSegFileName(seg)
+	name, meta := filepath.Join(ds.dir, base), ds.metaPath(base)
+	ds.uncacheSegment(id)
+	ds.limits.acquireFile()
+	defer ds.limits.releaseFile()
 	f, err := os.Create(name)
 	if err != nil {
 		return errors.Wrap(err, "create segment file")
 	}
 	defer f.Close()
 
+	// Do not leave a partially-written segment behind.
+	defer func() {
+		if err != nil {
+			os.Remove(name)
+			os.Remove(meta + ".CHECKSUM")
+			os.Remove(meta + ".SIGNATURE")
+			os.Remove(meta + ".CHAIN")
+			os.Remove(meta + ".BLOOM")
+			os.Remove(meta + ".INDEX")
+			os.Remove(meta + ".STATS")
+			os.Remove(meta + ".ID")
+		}
+	}()
+
 	// Initialize the hash.Hash to be used for calculating a checksum.
 	chksum := ds.newChecksum()
+	digest := sha512.New()
 
-	mw := io.MultiWriter(f, chksum)
-	if _, err := seg.WriteTo(mw); err != nil {
+	mw := io.MultiWriter(f, chksum, digest)
+	size, err := seg.WriteTo(mw)
+	if err != nil {
 		return errors.Wrap(err, "write segment")
 	}
+	if n := ds.padding(size); n > 0 {
+		b, err := mw.Write(paddingRecord(n))
+		if size += int64(b); err != nil {
+			return errors.Wrap(err, "pad segment")
+		}
+	}
 
-	if err := ds.writeChecksum(name, chksum); err != nil {
+	// The segment is not valid until its checksum file has been written,
+	// so this is the last chance to abandon the write.
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "write segment")
+	}
+	if err := ds.writeChecksum(meta, chksum); err != nil {
 		return errors.Wrap(err, "write checksum")
 	}
 
+	// The segment's link in the hash chain is signed along with its
+	// contents, so that the chain cannot be recalculated without the
+	// signing key.
+	var link []byte
+	if ds.appendOnly {
+		ds.chainMu.Lock()
+		defer ds.chainMu.Unlock()
+		link = chainLink(ds.chain, digest.Sum(nil))
+	}
+
+	if ds.signKey != nil {
+		sig := ed25519.Sign(ds.signKey, signedMessage(digest.Sum(nil), link))
+		if err := ioutil.WriteFile(meta+".SIGNATURE", []byte(hex.EncodeToString(sig)), 0666); err != nil {
+			return errors.Wrap(err, "write signature")
+		}
+	}
+
+	if ds.keyFn != nil {
+		if err := ds.writeBloomFilter(base, seg); err != nil {
+			return err
+		}
+	}
+	if ds.indexFn != nil {
+		if err := ds.writeIndex(base, seg, true); err != nil {
+			return err
+		}
+	}
+	if err := ds.writeStats(segmentStats(base, id, seg, size)); err != nil {
+		return err
+	}
+	if err := ds.writeSegmentID(base, id); err != nil {
+		return err
+	}
+
+	if ds.appendOnly {
+		if err := ioutil.WriteFile(meta+".CHAIN", []byte(hex.EncodeToString(link)), 0666); err != nil {
+			return errors.Wrap(err, "write hash chain")
+		}
+		ds.chain = link
+	}
+
+	return nil
+}
+
+// padding returns the size of the padding record needed to align a segment
+// file of size bytes; see AlignSegments.
+func (ds *DirectorySink) padding(size int64) int {
+	if ds.align == 0 || size%ds.align == 0 {
+		return 0
+	}
+	return int(ds.align - size%ds.align)
+}
+
+// chainLink returns the link in a segment hash chain that follows prev, for
+// a segment whose contents have the SHA-512 digest digest.
+func chainLink(prev, digest []byte) []byte {
+	h := sha512.New()
+	h.Write(prev)
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+// VerifyChain walks every segment known to the sink, from oldest to newest,
+// and recalculates the hash chain written by a sink created with the
+// AppendOnly option. Each segment's link covers its own contents, and the
+// link of the segment before it, so modifying, removing, or inserting a
+// segment will break the chain.
+//
+// If the recalculated chain does not match the one stored alongside the
+// segments, an error whose cause is ErrChainBroken is returned.
+//
+// The links are stored alongside the segments, so on their own, they only
+// detect accidental damage. To detect deliberate tampering:
+//
+//   - combine AppendOnly with SignSegments, and verify with VerifySegments;
+//     each segment's signature covers its link in the chain, so the chain
+//     cannot be recalculated without the signing key. A segment whose
+//     signature does not match causes an error whose cause is
+//     ErrBadSignature.
+//   - record the head of the chain (see ChainHead) somewhere out of reach
+//     of the sink's directory, and check it with VerifyChainHead; otherwise
+//     removing the newest segments goes undetected.
+func (ds *DirectorySink) VerifyChain() error {
+	_, err := ds.verifyChain()
+	return err
+}
+
+// VerifyChainHead is like VerifyChain, but also checks that the head of the
+// recalculated chain is head, as previously returned by ChainHead. If it is
+// not, an error whose cause is ErrChainBroken is returned.
+func (ds *DirectorySink) VerifyChainHead(head []byte) error {
+	link, err := ds.verifyChain()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(link, head) {
+		return errors.Wrap(ErrChainBroken, "chain head does not match")
+	}
 	return nil
 }
 
+// ChainHead returns the most-recent link in the hash chain of a sink created
+// with the AppendOnly option, or nil if no segments have been chained.
+func (ds *DirectorySink) ChainHead() []byte {
+	ds.chainMu.Lock()
+	defer ds.chainMu.Unlock()
+	return append([]byte(nil), ds.chain...)
+}
+
+// verifyChain implements VerifyChain, and returns the head of the
+// recalculated chain.
+func (ds *DirectorySink) verifyChain() ([]byte, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	var link []byte
+	for _, name := range ds.segPaths {
+		ds.limits.acquireFile()
+		f, err := os.Open(filepath.Join(ds.dir, name))
+		if err != nil {
+			ds.limits.releaseFile()
+			return nil, errors.Wrap(err, "open segment file")
+		}
+		digest := sha512.New()
+		r, err := decompress(f)
+		if err == nil {
+			_, err = io.Copy(digest, r)
+		}
+		f.Close()
+		ds.limits.releaseFile()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read segment %s", name)
+		}
+
+		want, err := ds.loadChecksum(ds.metaPath(name + ".CHAIN"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "load hash chain for segment %s", name)
+		}
+		link = chainLink(link, digest.Sum(nil))
+		if !bytes.Equal(link, want) {
+			return nil, errors.Wrapf(ErrChainBroken, "segment %s", name)
+		}
+		if err := ds.verifySignature(name, digest.Sum(nil)); err != nil {
+			return nil, errors.Wrapf(err, "segment %s", name)
+		}
+	}
+	return link, nil
+}
+
 func (ds *DirectorySink) newChecksum() hash.Hash {
+	return newSegmentChecksum()
+}
+
+// newSegmentChecksum returns a hash.Hash for calculating the checksums held
+// in ".CHECKSUM" files.
+func newSegmentChecksum() hash.Hash {
 	return crc64.New(crc64.MakeTable(crc64.ISO))
 }
 
@@ -322,8 +960,37 @@ func (ds *DirectorySink) writeChecksum(segmentName string, chksum hash.Hash) err
 //
 // In this particular Sink implementation, Close does nothing, as a
 // DirectorySink does not hold any open file descriptors beyond those
-// when calling WriteSegment, or LoadSegment.
+// when calling WriteSegment, or LoadSegment. If the sink was created with
+// the ThrottleTruncation option, Close stops any background truncation;
+// files that were not yet deleted are skipped the next time the sink is
+// analyzed in this process.
 func (ds *DirectorySink) Close() error {
+	if ds.throttle != nil {
+		ds.throttle.close()
+	}
+	return nil
+}
+
+// Ping implements the HealthChecker interface.
+//
+// Ping checks that the sink's directory still exists, is writable, and that
+// the filesystem it is on has space available.
+func (ds *DirectorySink) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkDirPerms(ds.dir); err != nil {
+		return errors.Wrap(err, "ping")
+	}
+	if !diskFreeSupported {
+		return nil
+	}
+	free, err := diskFree(ds.dir)
+	if err != nil {
+		return errors.Wrap(err, "ping")
+	} else if free == 0 {
+		return errors.Errorf("ping: no space left on device holding %s", ds.dir)
+	}
 	return nil
 }
 
@@ -336,6 +1003,9 @@ func (ds *DirectorySink) Close() error {
 func (ds *DirectorySink) Offsets() (oldest, newest Offset) {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
+	if len(ds.segments) == 0 {
+		return ZeroOffset, ZeroOffset
+	}
 	lastSeg := len(ds.segments) - 1
 	return ds.segments[0][0], ds.segments[lastSeg][1]
 }
@@ -350,6 +1020,9 @@ func (ds *DirectorySink) NumSegments() int {
 
 // Truncate implements the Sink interface.
 //
+// If the sink was created with the AppendOnly option, Truncate returns
+// ErrAppendOnly.
+//
 // Truncate will delete any on-disk segment files, along with their checksum
 // files, if the last offset in the segment file is older than the given
 // offset.
@@ -357,75 +1030,285 @@ func (ds *DirectorySink) NumSegments() int {
 // Should the offset fall within the offsets of a segment file, the
 // segment file will be truncated, re-written to disk, and its checksum
 // re-calculated.
+//
+// If the sink was created with the ThrottleTruncation option, the files
+// are deleted, and rewritten, in the background. Otherwise, whole segment
+// files are deleted after the sink has forgotten them, without holding its
+// lock, so that readers are not blocked while they are deleted.
+//
+// Data chunks that have been pinned (see Pin) are not removed until they
+// are unpinned.
+//
+// If the sink was created with the OnBeforeTruncate option, and its
+// callback returns an error, nothing is removed, and the error is returned.
 func (ds *DirectorySink) Truncate(offset Offset) error {
+	if ds.appendOnly {
+		return ErrAppendOnly
+	}
+	offset = ds.pins.limit(offset)
+	if err := ds.beforeTruncate(offset); err != nil {
+		return err
+	}
+	if ds.throttle != nil {
+		return ds.truncateThrottled(offset)
+	}
+
 	ds.mu.Lock()
-	defer ds.mu.Unlock()
 
-	// Find segments whose most-recent offset is older than the offset
-	// passed to this function.
-	removed := 0
-	var err error
+	// Find segments whose most-recent offset is not newer than the offset
+	// passed to this function, and forget them; their files are deleted
+	// once the lock is released.
+	var removed []string
 	for i, offsets := range ds.segments {
-		// If the most-recent offset of the segment's boundiares is
-		// older than the given offset, mark it for removal.
-		if offsets[1].Before(offset) {
-			// If we encounter an error while deleting a segment
-			// file, keep the error, but break out of this loop,
-			// so that we fall through to remove any references to
-			// segments that we were able to delete.
-			if err = ds.deleteSegmentFile(ds.segPaths[i]); err != nil {
-				break
-			}
-			removed++
-		} else {
+		if offsets[1].After(offset) {
 			// Break early so as to not waste cycles iterating
 			// through the rest of the segments.
 			break
 		}
+		removed = append(removed, ds.segPaths[i])
+		ds.dropSegmentID(ds.segPaths[i])
 	}
+	ds.segments = ds.segments[len(removed):]
+	ds.segPaths = ds.segPaths[len(removed):]
+	err := ds.truncateFirst(offset)
+	ds.mu.Unlock()
 
-	// Drop the segment offsets and paths from the sink.
-	if removed > 0 {
-		ds.segments = ds.segments[removed:]
-		ds.segPaths = ds.segPaths[removed:]
+	if derr := ds.deleteSegmentFiles(removed); derr != nil {
+		return derr
 	}
+	return err
+}
 
-	// Check to see if there was an error left over from deleting segment
-	// files; return if there was.
-	if err != nil {
-		return errors.Wrap(err, "delete segment file")
+// deleteSegmentFiles deletes the named segment files, and their accompanying
+// files, which the sink has already forgotten, so that deleting them does
+// not block readers. If a file cannot be deleted, the rest are still
+// deleted, and the first error is returned; the segment file will be found
+// again the next time the sink is analyzed.
+func (ds *DirectorySink) deleteSegmentFiles(names []string) error {
+	var err error
+	for _, name := range names {
+		if derr := ds.deleteSegmentFile(name); derr != nil && err == nil {
+			err = errors.Wrap(derr, "delete segment file")
+		}
+	}
+	return err
+}
+
+// beforeTruncate calls the sink's OnBeforeTruncate callback, if any, with
+// the segments truncating at offset would remove data chunks from.
+func (ds *DirectorySink) beforeTruncate(offset Offset) error {
+	if ds.beforeTrunc == nil {
+		return nil
+	}
+	ds.mu.RLock()
+	var segs []SegmentStats
+	for i, offs := range ds.segments {
+		if offs[0].After(offset) {
+			break
+		}
+		st, err := ds.loadStats(ds.segPaths[i])
+		if err != nil {
+			ds.mu.RUnlock()
+			return errors.Wrapf(err, "segment %s", ds.segPaths[i])
+		}
+		st.ID = ds.ids[st.Name]
+		segs = append(segs, *st)
+	}
+	ds.mu.RUnlock()
+	if len(segs) == 0 {
+		return nil
+	}
+
+	// The callback is made without holding the lock, since it may take
+	// some time, such as waiting for the segments to be uploaded.
+	if err := ds.beforeTrunc(segs); err != nil {
+		return errors.Wrap(err, "before truncate")
 	}
+	return nil
+}
 
+// truncateFirst truncates the sink's first segment, if offset falls within
+// it, by rewriting the segment without the data chunks at, or before,
+// offset (or, with the LogicalTruncation option, by writing a tombstone).
+// It must be called while holding a write lock on ds.mu.
+func (ds *DirectorySink) truncateFirst(offset Offset) error {
 	// Of the remaining segments, see if our offset falls within the
 	// boundaries of the (new) first segment.
 	//
 	// If it does, then load the segment, truncate it, write it
 	// back out to disk, and adjust the values in the segments and
 	// segPaths slices.
-	if ds.segments[0][0].Before(offset) && ds.segments[0][1].After(offset) {
-		seg, err := ds.loadSegment(ds.segPaths[0])
-		if err != nil {
-			return errors.Wrap(err, "truncate segment")
+	if len(ds.segments) > 0 && !ds.segments[0][0].After(offset) && ds.segments[0][1].After(offset) {
+		if ds.logical {
+			return ds.tombstone(0, offset)
+		}
+		return ds.rewriteSegment(0, func(seg *Segment) { seg.Truncate(offset) })
+	}
+
+	return nil
+}
+
+// rewriteSegment loads the i-th segment, modifies it with fn, and writes it
+// back out to disk under its new name, and the same SegmentID, before
+// removing the original file.
+// If fn removes every chunk from the segment, the segment is removed
+// altogether. It must be called while holding a write lock on ds.mu.
+func (ds *DirectorySink) rewriteSegment(i int, fn func(*Segment)) error {
+	old := ds.segPaths[i]
+	id := ds.ids[old]
+	seg, err := ds.loadSegment(old)
+	if err != nil {
+		return errors.Wrap(err, "load segment")
+	}
+	fn(seg)
+
+	if seg.Chunks() == 0 {
+		if err := ds.deleteSegmentFile(old); err != nil {
+			return errors.Wrap(err, "delete segment file")
+		}
+		ds.dropSegmentID(old)
+		ds.segments = append(ds.segments[:i], ds.segments[i+1:]...)
+		ds.segPaths = append(ds.segPaths[:i], ds.segPaths[i+1:]...)
+		delete(ds.tombstones, old)
+		return nil
+	}
+
+	// The rewritten segment has new offsets, and therefore a new file
+	// name. Record the rewrite before writing it, so that GC can tell the
+	// original file is a stale copy, should the sink be interrupted before
+	// the original file is removed.
+	name := fmtSegFileName(seg)
+	marker := ds.metaPath(old + ".REWRITE")
+	if name != old {
+		if err := ioutil.WriteFile(marker, []byte(name), 0666); err != nil {
+			return errors.Wrap(err, "record rewrite")
+		}
+	}
+	if err := ds.writeSegment(context.Background(), seg, id); err != nil {
+		os.Remove(marker)
+		return errors.Wrap(err, "write segment")
+	}
+	if name != old {
+		if err := ds.deleteSegmentFile(old); err != nil {
+			return errors.Wrap(err, "delete original segment file")
+		}
+		ds.dropSegmentID(old)
+	}
+	start, end := seg.Limits()
+	ds.segments[i] = [2]Offset{start, end}
+	ds.segPaths[i] = name
+	ds.setSegmentID(name, id)
+	delete(ds.tombstones, old)
+	return nil
+}
+
+// TruncateAfter implements the TailTruncater interface.
+//
+// TruncateAfter deletes any on-disk segment files, along with their
+// accompanying files, if the first offset in the segment file is newer than
+// the given offset. Should the offset fall within the offsets of a segment
+// file, the segment file is truncated, and re-written to disk.
+//
+// If the sink was created with the AppendOnly option, TruncateAfter returns
+// ErrAppendOnly. If it was created with the ImmutableSegments option, and
+// the offset falls within a segment file, TruncateAfter returns
+// ErrImmutable.
+func (ds *DirectorySink) TruncateAfter(offset Offset) (err error) {
+	if ds.appendOnly {
+		return ErrAppendOnly
+	}
+	if ds.pins.pinnedAfter(offset) {
+		return ErrPinned
+	}
+
+	ds.mu.Lock()
+	var removed []string
+	defer func() {
+		ds.mu.Unlock()
+		if derr := ds.deleteSegmentFiles(removed); derr != nil && err == nil {
+			err = derr
 		}
-		seg.Truncate(offset)
-		if err := ds.writeSegment(seg); err != nil {
-			return errors.Wrap(err, "write truncated segment")
+	}()
+
+	if ds.immutable {
+		// Make sure no segment needs to be rewritten, before removing
+		// anything.
+		for _, offs := range ds.segments {
+			if !offs[0].After(offset) && offs[1].After(offset) {
+				return ErrImmutable
+			}
 		}
-		start, _ := seg.Limits()
-		ds.segments[0][0] = start
-		ds.segPaths[0] = fmtSegFileName(seg)
 	}
 
+	// Remove whole segments, newest first; their files are deleted once
+	// the lock is released.
+	for n := len(ds.segments); n > 0 && ds.segments[n-1][0].After(offset); n-- {
+		removed = append(removed, ds.segPaths[n-1])
+		ds.dropSegmentID(ds.segPaths[n-1])
+		ds.segments = ds.segments[:n-1]
+		ds.segPaths = ds.segPaths[:n-1]
+	}
+
+	// See if the offset falls within the (new) last segment.
+	n := len(ds.segments)
+	if n == 0 || !ds.segments[n-1][1].After(offset) {
+		return nil
+	}
+	if err := ds.rewriteSegment(n-1, func(seg *Segment) { seg.TruncateAfter(offset) }); err != nil {
+		return errors.Wrap(err, "truncate segment")
+	}
+	return nil
+}
+
+// Pin implements the Pinner interface.
+func (ds *DirectorySink) Pin(first, last Offset) {
+	ds.pins.pin(first, last)
+}
+
+// Unpin implements the Pinner interface.
+func (ds *DirectorySink) Unpin(first, last Offset) error {
+	if off, ok := ds.pins.unpin(first, last); ok {
+		return ds.Truncate(off)
+	}
 	return nil
 }
 
-func (ds *DirectorySink) deleteSegmentFile(name string) error {
-	name = filepath.Join(ds.dir, name)
-	if err := os.Remove(name); err != nil {
+// metaPath returns the path to name, a file accompanying a segment file, in
+// the sink's metadata directory (see MetadataDir).
+func (ds *DirectorySink) metaPath(name string) string {
+	return filepath.Join(ds.metaDir, name)
+}
+
+func (ds *DirectorySink) deleteSegmentFile(base string) error {
+	if err := os.Remove(filepath.Join(ds.dir, base)); err != nil {
 		return errors.Wrap(err, "rm")
 	}
+	name := ds.metaPath(base)
 	if err := os.Remove(name + ".CHECKSUM"); err != nil {
 		return errors.Wrap(err, "rm checksum")
 	}
+	if err := os.Remove(name + ".SIGNATURE"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm signature")
+	}
+	if err := os.Remove(name + ".TOMBSTONE"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm tombstone")
+	}
+	if err := os.Remove(name + ".BLOOM"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm bloom filter")
+	}
+	if err := os.Remove(name + ".INDEX"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm index")
+	}
+	if err := os.Remove(name + ".REWRITE"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm rewrite record")
+	}
+	if err := os.Remove(name + ".STATS"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm stats")
+	}
+	if err := os.Remove(name + ".ID"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "rm segment id")
+	}
+	ds.dropBloomFilter(filepath.Base(name))
+	ds.dropIndex(filepath.Base(name))
 	return nil
 }
@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"bytes"
+	"os"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SaveBookmark implements the Bookmarker interface. Each bookmark is stored
+// in a file named after it, with a ".BOOKMARK" extension, alongside the
+// sink's segment files (or in its metadata directory; see MetadataDir), so
+// that it is included in snapshots made with SnapshotTo.
+//
+// The bookmark file is replaced atomically, by writing it to a temporary
+// file, syncing it, and renaming it over the original.
+func (ds *DirectorySink) SaveBookmark(name string, offset Offset) error {
+	if !validBookmarkName(name) {
+		return errors.Errorf("invalid bookmark name %q", name)
+	}
+	path := ds.metaPath(name + ".BOOKMARK")
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, "create bookmark")
+	}
+	if _, err := f.Write(append(offset.AppendText(nil), '\n')); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "write bookmark")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "sync bookmark")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "close bookmark")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "write bookmark")
+	}
+	return nil
+}
+
+// LoadBookmark implements the Bookmarker interface.
+func (ds *DirectorySink) LoadBookmark(name string) (Offset, error) {
+	if !validBookmarkName(name) {
+		return ZeroOffset, errors.Errorf("invalid bookmark name %q", name)
+	}
+	p, err := os.ReadFile(ds.metaPath(name + ".BOOKMARK"))
+	if err != nil && os.IsNotExist(err) {
+		return ZeroOffset, nil
+	} else if err != nil {
+		return ZeroOffset, errors.Wrap(err, "read bookmark")
+	}
+	offset, err := ParseOffsetBytes(bytes.TrimSpace(p))
+	if err != nil {
+		return ZeroOffset, errors.Wrap(err, "parse bookmark")
+	}
+	return offset, nil
+}
@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// CacheSegments causes a *DirectorySink to keep up to n of the segments it
+// most recently loaded in memory, so that loading them again does not read,
+// and verify, their segment files. See the sink's Warmup method, and the
+// MaxCachedSegments field of ResourceLimits.
+func CacheSegments(n int) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if n <= 0 {
+			return errors.New("segment cache size must be positive")
+		}
+		ds.cacheSize = n
+		return nil
+	}
+}
+
+// Warmup implements the Warmer interface, by loading the newest n segments
+// into the sink's segment cache (see CacheSegments), so that a service
+// replaying the tail of the log at startup does not wait on cold reads. At
+// most as many segments as the cache holds are loaded. Warmup returns the
+// number of segments loaded.
+//
+// If the sink was not created with the CacheSegments option, Warmup returns
+// ErrNotSupported.
+func (ds *DirectorySink) Warmup(n int) (int, error) {
+	if ds.cacheSize == 0 {
+		return 0, ErrNotSupported
+	}
+	if n > ds.cacheSize {
+		n = ds.cacheSize
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if n > len(ds.segPaths) {
+		n = len(ds.segPaths)
+	}
+	// Load the oldest of them first, so that the newest are the last to
+	// be evicted.
+	for _, name := range ds.segPaths[len(ds.segPaths)-n:] {
+		if _, err := ds.loadSegment(name); err != nil {
+			return 0, errors.Wrapf(err, "warm up segment %s", name)
+		}
+	}
+	return n, nil
+}
+
+// cachedSegment returns a copy of the segment with the given ID from the
+// segment cache, or nil if it is not cached.
+func (ds *DirectorySink) cachedSegment(id SegmentID) *Segment {
+	ds.cacheMu.Lock()
+	defer ds.cacheMu.Unlock()
+	seg, ok := ds.cache[id]
+	if !ok {
+		return nil
+	}
+	ds.touchCached(id)
+	return seg.clone()
+}
+
+// cacheSegment adds a copy of the segment with the given ID to the segment
+// cache, if it is enabled, evicting the least-recently used segment if the
+// cache is full. Segments are cached by ID, rather than name, so that a
+// cached segment is found however its segment file is renamed; a segment
+// that is rewritten is removed from the cache (see uncacheSegment).
+func (ds *DirectorySink) cacheSegment(id SegmentID, seg *Segment) {
+	if ds.cacheSize == 0 || id == "" {
+		return
+	}
+	ds.cacheMu.Lock()
+	defer ds.cacheMu.Unlock()
+	if ds.cache == nil {
+		ds.cache = make(map[SegmentID]*Segment)
+	}
+	if _, ok := ds.cache[id]; ok {
+		ds.touchCached(id)
+	} else if ds.limits.reserveCache() {
+		ds.cacheOrder = append(ds.cacheOrder, id)
+	} else if len(ds.cacheOrder) > 0 {
+		// The shared limit has been reached; reuse the space held by
+		// the least-recently used segment.
+		delete(ds.cache, ds.cacheOrder[0])
+		ds.cacheOrder = append(ds.cacheOrder[1:], id)
+	} else {
+		return
+	}
+	ds.cache[id] = seg.clone()
+	for len(ds.cacheOrder) > ds.cacheSize {
+		delete(ds.cache, ds.cacheOrder[0])
+		ds.cacheOrder = ds.cacheOrder[1:]
+		ds.limits.releaseCache(1)
+	}
+}
+
+// touchCached marks the segment with the given ID as the most-recently used. It must
+// be called while holding ds.cacheMu.
+func (ds *DirectorySink) touchCached(id SegmentID) {
+	for i, n := range ds.cacheOrder {
+		if n == id {
+			ds.cacheOrder = append(append(ds.cacheOrder[:i:i], ds.cacheOrder[i+1:]...), id)
+			return
+		}
+	}
+}
+
+// uncacheSegment removes the segment with the given ID from the segment
+// cache, such as when its segment file is rewritten, or removed.
+func (ds *DirectorySink) uncacheSegment(id SegmentID) {
+	ds.cacheMu.Lock()
+	defer ds.cacheMu.Unlock()
+	if _, ok := ds.cache[id]; !ok {
+		return
+	}
+	delete(ds.cache, id)
+	ds.limits.releaseCache(1)
+	for i, n := range ds.cacheOrder {
+		if n == id {
+			ds.cacheOrder = append(ds.cacheOrder[:i:i], ds.cacheOrder[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// gzipMagic holds the first bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompress returns a reader of r's contents, decompressing them if they
+// are gzip-compressed. Segments are encoded as text, so a compressed
+// segment can never be mistaken for an uncompressed one.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if p, err := br.Peek(len(gzipMagic)); err != nil || !bytes.Equal(p, gzipMagic) {
+		return br, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "gzip")
+	}
+	return zr, nil
+}
+
+// CompressBefore implements the Compressor interface.
+//
+// CompressBefore gzip-compresses each segment file whose data chunks are
+// all older than offset, and that has not already been compressed,
+// replacing the segment file in place. It returns the number of segment
+// files compressed.
+//
+// Compressed segment files are decompressed as they are loaded. A
+// segment's checksum, signature (see SignSegments), and link in the hash
+// chain (see AppendOnly) cover its decompressed contents, so they remain
+// valid. The checksum is recalculated as the segment is compressed, and
+// again from the compressed segment file, which only replaces the original
+// if both match.
+//
+// If the sink was created with the ImmutableSegments option,
+// CompressBefore returns ErrImmutable.
+func (ds *DirectorySink) CompressBefore(offset Offset) (int, error) {
+	if ds.immutable {
+		return 0, ErrImmutable
+	}
+	ds.mu.RLock()
+	var names []string
+	for i, offs := range ds.segments {
+		if !offs[1].Before(offset) {
+			break
+		}
+		names = append(names, ds.segPaths[i])
+	}
+	ds.mu.RUnlock()
+
+	// Compress one segment at a time, so that the sink is not locked for
+	// any longer than it needs to be.
+	var n int
+	for _, name := range names {
+		ok, err := ds.compressSegment(name)
+		if err != nil {
+			return n, errors.Wrapf(err, "compress segment %s", name)
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// compressSegment compresses the named segment file, if it is still known
+// to the sink, and has not already been compressed. It reports whether the
+// segment file was compressed.
+func (ds *DirectorySink) compressSegment(name string) (ok bool, err error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// The segment may have been truncated since CompressBefore was called.
+	var found bool
+	for _, p := range ds.segPaths {
+		if p == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	path := filepath.Join(ds.dir, name)
+	ds.limits.acquireFile()
+	defer ds.limits.releaseFile()
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "open segment file")
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if p, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(p, gzipMagic) {
+		return false, nil
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, errors.Wrap(err, "create temp file")
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	chksum := ds.newChecksum()
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(io.MultiWriter(zw, chksum), br); err != nil {
+		return false, errors.Wrap(err, "compress")
+	}
+	if err := zw.Close(); err != nil {
+		return false, errors.Wrap(err, "compress")
+	}
+	if err := out.Sync(); err != nil {
+		return false, errors.Wrap(err, "sync")
+	}
+
+	want, err := ds.loadChecksum(ds.metaPath(name + ".CHECKSUM"))
+	if err != nil {
+		return false, errors.Wrap(err, "load checksum")
+	}
+	if got := chksum.Sum(nil); !bytes.Equal(got, want) {
+		return false, errors.New("checksum mismatch")
+	}
+
+	// Read back the compressed segment, and make sure it decompresses to
+	// the original, before replacing the original.
+	if err := ds.verifyCompressed(tmp, want); err != nil {
+		return false, errors.Wrap(err, "verify compressed segment")
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "stat compressed segment")
+	}
+	st, err := ds.readStats(name)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return false, errors.Wrap(err, "replace segment file")
+	}
+
+	// Without a ".STATS" file, the statistics are calculated from the
+	// compressed segment file when they are listed.
+	if st != nil {
+		st.setFileBytes(info.Size())
+		if err := ds.writeStats(st); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// verifyCompressed checks that the compressed segment file at path
+// decompresses to contents with the checksum want.
+func (ds *DirectorySink) verifyCompressed(path string, want []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	chksum := ds.newChecksum()
+	if _, err := io.Copy(chksum, r); err != nil {
+		return errors.Wrap(err, "decompress")
+	}
+	if got := chksum.Sum(nil); !bytes.Equal(got, want) {
+		return errors.Errorf("checksum mismatch (want=%x got=%x)", want, got)
+	}
+	return nil
+}
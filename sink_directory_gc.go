@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// segmentFileExts holds the extensions of the files that accompany a
+// segment file.
+var segmentFileExts = []string{".CHECKSUM", ".SIGNATURE", ".CHAIN", ".TOMBSTONE", ".BLOOM", ".INDEX", ".REWRITE", ".STATS", ".ID"}
+
+// GC removes files from the sink's directory (and its metadata directory;
+// see MetadataDir) that are no longer needed:
+//
+//   - files accompanying a segment file (checksums, signatures, etc.), where
+//     the segment file itself no longer exists;
+//   - temporary files left behind by an interrupted write;
+//   - copies of segment files from before they were truncated, left behind
+//     when the sink was interrupted part-way through rewriting a segment.
+//
+// A segment file is only considered to be a pre-truncation copy when the
+// sink recorded that it was being rewritten, and the rewritten segment file
+// was written in full. If the rewritten segment file was not written in
+// full, the record of the rewrite is removed, and the original is kept.
+//
+// GC returns the number of bytes reclaimed. Files that are waiting to be
+// deleted by a throttled truncation (see ThrottleTruncation) are left
+// alone. GC can be called before Analyze, to tidy up a directory that was
+// left in an inconsistent state.
+//
+// If the sink was created with the AppendOnly option, GC returns
+// ErrAppendOnly.
+func (ds *DirectorySink) GC() (int64, error) {
+	if ds.appendOnly {
+		return 0, ErrAppendOnly
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	dirs := []string{ds.dir}
+	if ds.metaDir != ds.dir {
+		dirs = append(dirs, ds.metaDir)
+	}
+
+	// Sort the directories' files into segment files, the files that
+	// accompany them, and temporary files. Segment files are only looked
+	// for in the sink's directory.
+	var (
+		segFiles  = make(map[string][2]Offset)
+		sidecars  []string
+		tempFiles []string
+	)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, errors.Wrap(err, "read dir")
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			name := e.Name()
+			switch ext := filepath.Ext(name); {
+			case ext == ".tmp":
+				tempFiles = append(tempFiles, filepath.Join(dir, name))
+			case isSegmentFileExt(ext):
+				sidecars = append(sidecars, filepath.Join(dir, name))
+			case dir == ds.dir:
+				if start, end, err := ds.parseOffsets(name); err == nil {
+					segFiles[name] = [2]Offset{start, end}
+				}
+			}
+		}
+	}
+
+	var reclaimed int64
+	remove := func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil && os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "stat")
+		}
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "rm")
+		}
+		reclaimed += info.Size()
+		return nil
+	}
+
+	for _, path := range tempFiles {
+		if err := remove(path); err != nil {
+			return reclaimed, errors.Wrap(err, "remove temp file")
+		}
+	}
+
+	stale, err := ds.staleSegmentFiles(segFiles)
+	if err != nil {
+		return reclaimed, err
+	}
+	for _, name := range stale {
+		for _, ext := range segmentFileExts {
+			if err := remove(ds.metaPath(name + ext)); err != nil {
+				return reclaimed, errors.Wrap(err, "remove stale segment file")
+			}
+		}
+		if err := remove(filepath.Join(ds.dir, name)); err != nil {
+			return reclaimed, errors.Wrap(err, "remove stale segment file")
+		}
+		ds.forgetSegment(name)
+		delete(segFiles, name)
+	}
+
+	for _, path := range sidecars {
+		name := filepath.Base(path)
+		seg := strings.TrimSuffix(name, filepath.Ext(name))
+		if _, ok := segFiles[seg]; ok || ds.awaitingTruncation(seg) {
+			continue
+		}
+		if err := remove(path); err != nil {
+			return reclaimed, errors.Wrap(err, "remove orphaned file")
+		}
+	}
+	return reclaimed, nil
+}
+
+// staleSegmentFiles returns the names of the segment files in segFiles that
+// are pre-truncation copies of another segment file, as recorded by
+// rewriteSegment. Records of rewrites that were not completed are removed.
+func (ds *DirectorySink) staleSegmentFiles(segFiles map[string][2]Offset) ([]string, error) {
+	names := make([]string, 0, len(segFiles))
+	for name := range segFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var stale []string
+	for _, name := range names {
+		if ds.awaitingTruncation(name) {
+			continue
+		}
+		marker := ds.metaPath(name + ".REWRITE")
+		p, err := ioutil.ReadFile(marker)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "read rewrite record")
+		}
+
+		// The rewritten segment file is only complete once its
+		// checksum file has been written.
+		target := string(p)
+		if _, ok := segFiles[target]; ok && target != name {
+			if _, err := os.Stat(ds.metaPath(target + ".CHECKSUM")); err == nil {
+				stale = append(stale, name)
+				continue
+			}
+		}
+		if err := os.Remove(marker); err != nil {
+			return nil, errors.Wrap(err, "remove incomplete rewrite record")
+		}
+	}
+	return stale, nil
+}
+
+// awaitingTruncation reports whether the named segment file is waiting to be
+// deleted by a throttled truncation.
+func (ds *DirectorySink) awaitingTruncation(name string) bool {
+	if ds.throttle == nil {
+		return false
+	}
+	_, end, err := ds.parseOffsets(name)
+	return err == nil && !end.After(ds.throttle.truncated())
+}
+
+// forgetSegment removes any state the sink holds for the named segment
+// file. It must be called while holding a write lock on ds.mu.
+func (ds *DirectorySink) forgetSegment(name string) {
+	for i, p := range ds.segPaths {
+		if p == name {
+			ds.segments = append(ds.segments[:i], ds.segments[i+1:]...)
+			ds.segPaths = append(ds.segPaths[:i], ds.segPaths[i+1:]...)
+			break
+		}
+	}
+	delete(ds.tombstones, name)
+	ds.dropBloomFilter(name)
+	ds.dropIndex(name)
+	ds.dropSegmentID(name)
+}
+
+func isSegmentFileExt(ext string) bool {
+	for _, e := range segmentFileExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
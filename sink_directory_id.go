@@ -0,0 +1,160 @@
+package wal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrSegmentNotFound is returned by a *DirectorySink's LoadSegmentByID, and
+// ReadChunkAt methods, when there is no segment with the given SegmentID.
+var ErrSegmentNotFound = errors.New("wal: segment not found")
+
+// SegmentID is the stable identifier of a segment file in a *DirectorySink.
+//
+// A segment file is named after the offsets of its first, and last, data
+// chunks, so it is renamed when it is rewritten (such as when it is
+// truncated); its SegmentID is assigned when it is first written, and is
+// kept across rewrites, so that a reference to a segment taken by one
+// goroutine is not invalidated by another truncating the log. Pins (see
+// Pin) are taken on offsets, rather than segment files, so are unaffected
+// by rewrites, too.
+//
+// SegmentIDs are ULIDs: 26-character strings that sort in the order they
+// were assigned, to the millisecond.
+type SegmentID string
+
+// ulidAlphabet is Crockford's base32 alphabet, used to encode ULIDs.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newSegmentID returns a new SegmentID, made from the current time, and 80
+// random bits.
+func newSegmentID() SegmentID {
+	var id [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	for i := 5; i >= 0; i-- {
+		id[i], ms = byte(ms), ms>>8
+	}
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(errors.Wrap(err, "generate segment id"))
+	}
+
+	// Encode the 128-bit ID, most-significant bits first, 5 bits to a
+	// character; the first character holds only the top 3 bits.
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var b [26]byte
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = ulidAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return SegmentID(b[:])
+}
+
+// parseSegmentID returns s as a SegmentID, or an error if it is not a ULID.
+func parseSegmentID(s string) (SegmentID, error) {
+	if len(s) != 26 || s[0] > '7' {
+		return "", errors.Errorf("malformed segment id %q", s)
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(ulidAlphabet, s[i]) == -1 {
+			return "", errors.Errorf("malformed segment id %q", s)
+		}
+	}
+	return SegmentID(s), nil
+}
+
+// writeSegmentID writes id to the ".ID" file accompanying the named segment
+// file. The file is replaced atomically, since it may be linked into a
+// snapshot (see SnapshotTo).
+func (ds *DirectorySink) writeSegmentID(name string, id SegmentID) error {
+	path := ds.metaPath(name + ".ID")
+	if err := os.WriteFile(path+".tmp", []byte(id), 0666); err != nil {
+		return errors.Wrap(err, "write segment id")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return errors.Wrap(err, "write segment id")
+	}
+	return nil
+}
+
+// loadSegmentID returns the ID of the named segment file, from its ".ID"
+// file. A segment written before segment IDs were assigned is assigned one,
+// and its ".ID" file written.
+func (ds *DirectorySink) loadSegmentID(name string) (SegmentID, error) {
+	p, err := os.ReadFile(ds.metaPath(name + ".ID"))
+	if err != nil && os.IsNotExist(err) {
+		id := newSegmentID()
+		return id, ds.writeSegmentID(name, id)
+	} else if err != nil {
+		return "", errors.Wrap(err, "read segment id")
+	}
+	return parseSegmentID(strings.TrimSpace(string(p)))
+}
+
+// setSegmentID records id as that of the named segment file. It must be
+// called while holding a write lock on ds.mu.
+func (ds *DirectorySink) setSegmentID(name string, id SegmentID) {
+	if ds.ids == nil {
+		ds.ids = make(map[string]SegmentID)
+	}
+	ds.ids[name] = id
+}
+
+// dropSegmentID forgets the ID of the named segment file, and removes the
+// segment from the segment cache, once its segment file has been removed.
+// It must be called while holding a write lock on ds.mu.
+func (ds *DirectorySink) dropSegmentID(name string) {
+	ds.uncacheSegment(ds.ids[name])
+	delete(ds.ids, name)
+}
+
+// segmentName returns the name of the segment file with the given ID. It
+// must be called while holding ds.mu.
+func (ds *DirectorySink) segmentName(id SegmentID) (string, bool) {
+	for _, name := range ds.segPaths {
+		if ds.ids[name] == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// SegmentID returns the ID of the segment holding the data chunk at offset,
+// which stays the same however the segment's file is renamed. Like
+// LoadSegment, an offset that falls between two segments returns the ID of
+// the newer of the two. If there is no such segment, SegmentID returns
+// io.EOF.
+func (ds *DirectorySink) SegmentID(offset Offset) (SegmentID, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	for i, offs := range ds.segments {
+		if offset.Within(offs[0], offs[1]) || offset.Before(offs[0]) {
+			return ds.ids[ds.segPaths[i]], nil
+		}
+	}
+	return "", io.EOF
+}
+
+// LoadSegmentByID loads the segment with the given ID, under whichever name
+// its segment file currently has. If the segment has been removed, such as
+// by truncating it altogether, LoadSegmentByID returns ErrSegmentNotFound.
+func (ds *DirectorySink) LoadSegmentByID(id SegmentID) (*Segment, error) {
+	segs, err := ds.loadSegmentFiles(func() ([]string, error) {
+		name, ok := ds.segmentName(id)
+		if !ok {
+			return nil, ErrSegmentNotFound
+		}
+		return []string{name}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return segs[0], nil
+}
@@ -0,0 +1,287 @@
+package wal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+var (
+	// ErrNoLeaseAvailable is returned by AcquireLease when every segment
+	// has either been completed by the consumer group, or is leased to
+	// another consumer.
+	ErrNoLeaseAvailable = errors.New("wal: no segments available to lease")
+
+	// ErrLeaseLost is returned when renewing, or completing, a lease that
+	// has expired and been taken over by another consumer.
+	ErrLeaseLost = errors.New("wal: lease lost")
+)
+
+// Lease is a claim, held by a consumer in a consumer group, to process the
+// data chunks in a single segment of a *DirectorySink.
+//
+// Leases allow several processes that share a WAL directory to divide the
+// work of reading the log between them, without an external coordinator.
+// Each process calls AcquireLease, reads the chunks between the lease's
+// Start and End offsets, and calls Complete. A lease that is not completed,
+// or renewed, before it expires may be acquired by another consumer.
+type Lease struct {
+	Group   string
+	Owner   string
+	Start   Offset
+	End     Offset
+	Expires time.Time
+
+	ds   *DirectorySink
+	base string // Path to the lease files, without the ".lease.<generation>" suffix.
+	gen  int    // Generation of the lease file held.
+}
+
+// Lease files live in a directory per consumer group, under the sink's
+// directory:
+//
+//	leases/<group>/<chunkOffset0>-<chunkOffsetN>.lease.<generation>
+//	leases/<group>/<chunkOffset0>-<chunkOffsetN>.done
+//
+// A ".lease" file holds the owner's name, and the lease's expiry time (in
+// nanoseconds since the Unix epoch), on separate lines; a released lease
+// has no owner. A ".done" file marks a segment as completed by the group.
+//
+// Lease files are never modified. Each change to a lease (acquiring,
+// renewing, or releasing it) writes a lease file with the next generation
+// number, which is linked into place, and so can only be created once: of
+// any consumers trying to change a lease at the same time, only one
+// succeeds, and the others find that the lease has changed under them.
+// Older generations are removed once they have been superseded.
+func (ds *DirectorySink) leaseDir(group string) string {
+	return filepath.Join(ds.dir, "leases", group)
+}
+
+// AcquireLease claims the oldest segment that has not been completed by
+// group, and is not leased to another consumer, on behalf of owner. The
+// lease expires after ttl.
+//
+// Segments written by other processes are only visible after calling the
+// sink's Analyze method.
+func (ds *DirectorySink) AcquireLease(group, owner string, ttl time.Duration) (*Lease, error) {
+	if group == "" || strings.ContainsAny(group, `/\`) || strings.HasPrefix(group, ".") {
+		return nil, errors.Errorf("invalid consumer group %q", group)
+	}
+	if owner == "" || strings.ContainsRune(owner, '\n') {
+		return nil, errors.Errorf("invalid lease owner %q", owner)
+	}
+
+	dir := ds.leaseDir(group)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create lease directory")
+	}
+
+	ds.mu.RLock()
+	segments := append([][2]Offset(nil), ds.segments...)
+	segPaths := append([]string(nil), ds.segPaths...)
+	ds.mu.RUnlock()
+
+	for i, seg := range segPaths {
+		base := filepath.Join(dir, seg)
+		if _, err := os.Stat(base + ".done"); err == nil {
+			continue
+		}
+
+		lease := &Lease{
+			Group:   group,
+			Owner:   owner,
+			Start:   segments[i][0],
+			End:     segments[i][1],
+			Expires: time.Now().Add(ttl),
+			ds:      ds,
+			base:    base,
+		}
+		if ok, err := lease.claim(); err != nil {
+			return nil, errors.Wrapf(err, "claim segment %s", seg)
+		} else if ok {
+			return lease, nil
+		}
+	}
+	return nil, ErrNoLeaseAvailable
+}
+
+// claim attempts to acquire the lease, if the segment has never been leased,
+// or its current lease has been released, or has expired. claim reports
+// whether the lease was acquired.
+func (l *Lease) claim() (bool, error) {
+	gen, owner, expires, err := currentLease(l.base)
+	if err != nil {
+		return false, err
+	}
+	if owner != "" && time.Now().Before(expires) {
+		return false, nil
+	}
+	if ok, err := l.swap(gen, l.encode()); err != nil || !ok {
+		return false, err
+	}
+	return true, nil
+}
+
+// swap replaces generation gen of the lease file with p, as generation
+// gen+1. It reports whether the lease file was replaced; if another
+// consumer has already replaced generation gen, it was not.
+func (l *Lease) swap(gen int, p []byte) (bool, error) {
+	// Write the new lease file in full, under a name no other consumer
+	// will use, before linking it into place; linking fails if the new
+	// generation already exists.
+	tmp, err := os.CreateTemp(filepath.Dir(l.base), filepath.Base(l.base)+".*.tmp")
+	if err != nil {
+		return false, errors.Wrap(err, "create lease")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(p)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "write lease")
+	}
+
+	if err := os.Link(tmp.Name(), leaseFileName(l.base, gen+1)); err != nil && os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "replace lease")
+	}
+	l.gen = gen + 1
+
+	// Remove the generations that have been superseded.
+	for g := gen; g > 0; g-- {
+		if err := os.Remove(leaseFileName(l.base, g)); err != nil {
+			break
+		}
+	}
+	return true, nil
+}
+
+func leaseFileName(base string, gen int) string {
+	return base + ".lease." + strconv.Itoa(gen)
+}
+
+// currentLease returns the generation, owner, and expiry time of the newest
+// lease file for the segment whose lease files start with base. If the
+// segment has never been leased, gen is zero.
+func currentLease(base string) (gen int, owner string, expires time.Time, err error) {
+	entries, err := os.ReadDir(filepath.Dir(base))
+	if err != nil {
+		return 0, "", time.Time{}, errors.Wrap(err, "find lease files")
+	}
+	prefix := filepath.Base(base) + ".lease."
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		if g, err := strconv.Atoi(strings.TrimPrefix(e.Name(), prefix)); err == nil && g > gen {
+			gen = g
+		}
+	}
+	if gen == 0 {
+		return 0, "", time.Time{}, nil
+	}
+	owner, expires, err = readLease(leaseFileName(base, gen))
+	if err != nil && os.IsNotExist(errors.Cause(err)) {
+		// Superseded while it was being read; report it as it was,
+		// so that an attempt to replace it fails.
+		return gen, "", time.Time{}, nil
+	}
+	return gen, owner, expires, err
+}
+
+func (l *Lease) encode() []byte {
+	return encodeLease(l.Owner, l.Expires)
+}
+
+func encodeLease(owner string, expires time.Time) []byte {
+	return []byte(owner + "\n" + strconv.FormatInt(expires.UnixNano(), 10) + "\n")
+}
+
+// readLease returns the owner, and expiry time, of the lease file name.
+func readLease(name string) (owner string, expires time.Time, err error) {
+	p, err := os.ReadFile(name)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "read lease")
+	}
+	lines := bytes.SplitN(bytes.TrimRight(p, "\n"), []byte("\n"), 2)
+	if len(lines) != 2 {
+		return "", time.Time{}, errors.Errorf("malformed lease file %s", name)
+	}
+	n, err := strconv.ParseInt(string(lines[1]), 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "parse lease expiry")
+	}
+	return string(lines[0]), time.Unix(0, n), nil
+}
+
+// replace replaces the lease file held by l with p. It returns ErrLeaseLost
+// if the lease file has been replaced by another consumer.
+func (l *Lease) replace(p []byte) error {
+	if ok, err := l.swap(l.gen, p); err != nil {
+		return err
+	} else if !ok {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Renew extends the lease, so that it expires ttl from now.
+func (l *Lease) Renew(ttl time.Duration) error {
+	expires := time.Now().Add(ttl)
+	if err := l.replace(encodeLease(l.Owner, expires)); err != nil {
+		return err
+	}
+	l.Expires = expires
+	return nil
+}
+
+// Complete marks the lease's segment as processed by the consumer group,
+// and releases the lease. A completed segment will not be leased to the
+// group again.
+func (l *Lease) Complete() error {
+	// Make sure the lease is still held, by replacing it with an
+	// identical one, before marking the segment done.
+	if err := l.replace(l.encode()); err != nil {
+		return err
+	}
+	if err := os.WriteFile(l.base+".done", l.encode(), 0666); err != nil {
+		return errors.Wrap(err, "mark segment done")
+	}
+	if err := l.Release(); err != nil && err != ErrLeaseLost {
+		return err
+	}
+	return nil
+}
+
+// Release gives up the lease, without marking its segment as processed, so
+// that another consumer may acquire it.
+func (l *Lease) Release() error {
+	return l.replace(encodeLease("", time.Unix(0, 0)))
+}
+
+// GroupProgress returns the offset up to which every segment has been
+// completed by group. If no segments have been completed, or the oldest
+// segment has not been completed, ZeroOffset is returned.
+func (ds *DirectorySink) GroupProgress(group string) (Offset, error) {
+	dir := ds.leaseDir(group)
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	progress := ZeroOffset
+	for i, seg := range ds.segPaths {
+		if _, err := os.Stat(filepath.Join(dir, seg+".done")); err != nil && os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return ZeroOffset, errors.Wrap(err, "check segment progress")
+		}
+		progress = ds.segments[i][1]
+	}
+	return progress, nil
+}
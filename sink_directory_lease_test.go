@@ -0,0 +1,143 @@
+package wal
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDirectorySinkLeases(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-leases"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		seg := NewSegment()
+		if _, err := seg.Write([]byte("hello, wal")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := s.AcquireLease("group", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.AcquireLease("group", "b", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Start == b.Start {
+		t.Fatalf("consumers leased the same segment: %v", a.Start)
+	}
+
+	if err := a.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if progress, err := s.GroupProgress("group"); err != nil {
+		t.Fatal(err)
+	} else if progress != a.End {
+		t.Errorf("wrong group progress: want=%v got=%v", a.End, progress)
+	}
+
+	// b's lease expires, and is taken over by c.
+	time.Sleep(5 * time.Millisecond)
+	c, err := s.AcquireLease("group", "c", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Start != b.Start {
+		t.Errorf("expired lease was not taken over: want=%v got=%v", b.Start, c.Start)
+	}
+	if err := b.Complete(); err != ErrLeaseLost {
+		t.Errorf("want %v, got %v", ErrLeaseLost, err)
+	}
+
+	// The last segment is still available; then there are none.
+	if _, err := s.AcquireLease("group", "d", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AcquireLease("group", "e", time.Minute); err != ErrNoLeaseAvailable {
+		t.Errorf("want %v, got %v", ErrNoLeaseAvailable, err)
+	}
+
+	// Other consumer groups are unaffected.
+	if _, err := s.AcquireLease("other", "a", time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	// Lease files do not confuse Analyze.
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NumSegments(); n != 3 {
+		t.Errorf("wrong number of segments: want=%d got=%d", 3, n)
+	}
+}
+
+func TestDirectorySinkLeaseContention(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-lease-contention"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteSegment(newSegmentOffsets(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := s.AcquireLease("group", "owner", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Several consumers race to take over the expired lease, while its
+	// owner tries to renew it; only one of them can succeed.
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acquired int
+	)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_, err := s.AcquireLease("group", name, time.Minute)
+			if err == ErrNoLeaseAvailable {
+				return
+			} else if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			acquired++
+			mu.Unlock()
+		}(name)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := owner.Renew(time.Minute)
+		if err == ErrLeaseLost {
+			return
+		} else if err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		acquired++
+		mu.Unlock()
+	}()
+	wg.Wait()
+
+	if acquired != 1 {
+		t.Errorf("lease held by %d consumers", acquired)
+	}
+}
@@ -0,0 +1,293 @@
+package wal
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// DirectoryOption is a functional configuration type that can be used to
+// configure the behaviour of a *DirectorySink.
+type DirectoryOption func(*DirectorySink) error
+
+// ErrDiskSpaceLow is returned by a *DirectorySink's WriteSegment method when
+// writing the segment would leave less free space than was configured with
+// the MinFreeSpace option.
+var ErrDiskSpaceLow = errors.New("wal: free disk space below watermark")
+
+// ErrBadSignature is returned when a segment's signature does not match its
+// contents, indicating the segment has been tampered with.
+var ErrBadSignature = errors.New("wal: segment signature mismatch")
+
+var (
+	// ErrAppendOnly is returned when attempting to truncate a
+	// *DirectorySink created with the AppendOnly option.
+	ErrAppendOnly = errors.New("wal: sink is append-only")
+
+	// ErrChainBroken is returned by VerifyChain when a segment does not
+	// match the hash chain.
+	ErrChainBroken = errors.New("wal: segment hash chain broken")
+
+	// ErrImmutable is returned when an operation would rewrite a segment
+	// file of a *DirectorySink created with the ImmutableSegments option.
+	ErrImmutable = errors.New("wal: segment files are immutable")
+)
+
+// MinFreeSpace causes a *DirectorySink to refuse to write a segment, by
+// returning ErrDiskSpaceLow, if doing so would leave fewer than n bytes
+// free on the filesystem holding the sink's directory.
+//
+// If onLow is non-nil, it is called with the number of free bytes before a
+// write is refused, giving the caller a chance to free up space, by calling
+// the sink's own Truncate method. The free space is checked again after
+// onLow returns.
+//
+// onLow is called from within WriteSegment, which a *Logger calls while
+// holding its lock; onLow must not call any of the Logger's methods (such
+// as Truncate), as doing so deadlocks.
+//
+// When built with the yawal_nodeps build tag, MinFreeSpace returns
+// ErrNotSupported on platforms other than Linux, macOS, and FreeBSD.
+func MinFreeSpace(n uint64, onLow func(free uint64) error) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if n == 0 {
+			return errors.New("minimum free space must be greater than zero")
+		}
+		if !diskFreeSupported {
+			return ErrNotSupported
+		}
+		ds.minFree = n
+		ds.onLowDisk = onLow
+		return nil
+	}
+}
+
+// OnBeforeTruncate causes a *DirectorySink to call fn before truncating the
+// log with its Truncate method, with the statistics of the segments that
+// data chunks are about to be removed from, oldest first (see
+// ListSegments). If fn returns an error, the truncation
+// is abandoned, and Truncate returns the error; for example, so that
+// retention does not delete segments an archiver has not yet shipped
+// elsewhere. The truncation can be retried once they have been.
+//
+// fn is called from within Truncate, which a *Logger calls while holding
+// its lock; fn must not call any of the Logger's methods, as doing so
+// deadlocks. It may call the sink's read-only methods, such as LoadSegment.
+func OnBeforeTruncate(fn func(segs []SegmentStats) error) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if fn == nil {
+			return errors.New("nil truncate callback")
+		}
+		ds.beforeTrunc = fn
+		return nil
+	}
+}
+
+// SignSegments causes a *DirectorySink to sign each segment it writes with
+// key. The Ed25519 signature of the SHA-512 digest of the segment file
+// (followed by the segment's link in the hash chain, if the sink was created
+// with the AppendOnly option) is written, hex-encoded, to a file alongside
+// the segment's checksum file.
+func SignSegments(key ed25519.PrivateKey) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if len(key) != ed25519.PrivateKeySize {
+			return errors.New("invalid ed25519 private key")
+		}
+		ds.signKey = key
+		return nil
+	}
+}
+
+// VerifySegments causes a *DirectorySink to verify the signature of each
+// segment, using key, when it is analyzed or loaded. A segment with a
+// missing, or invalid, signature will fail to load, with ErrBadSignature
+// returned for a signature that does not match.
+func VerifySegments(key ed25519.PublicKey) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid ed25519 public key")
+		}
+		ds.verifyKey = key
+		return nil
+	}
+}
+
+// AppendOnly puts a *DirectorySink into a strict, audit-friendly mode:
+//
+//   - Truncate always returns ErrAppendOnly.
+//   - Each segment written is chained to the segment before it with a
+//     rolling SHA-512 hash, which can be checked with VerifyChain.
+//
+// The sink's Analyze method must be called before writing any segments to
+// a directory holding an existing log, so that new segments are chained to
+// the existing ones. Combine AppendOnly with SignSegments, whose signatures
+// then cover each segment's link in the chain, to prevent the chain from
+// being recalculated by someone without the signing key; see VerifyChain.
+func AppendOnly() DirectoryOption {
+	return func(ds *DirectorySink) error {
+		ds.appendOnly = true
+		return nil
+	}
+}
+
+// ThrottleTruncation causes a *DirectorySink to truncate in the background,
+// so that large truncations do not starve other IO on the filesystem.
+//
+// Truncate removes the truncated segments from the sink immediately, so
+// they are no longer loaded, then returns. A background worker deletes their
+// files, at most files at a time, pausing for interval between batches,
+// before rewriting the segment the truncation offset falls within.
+//
+// If onProgress is non-nil, it is called from the worker after each batch,
+// and once more (with Done set) when the truncation is complete.
+func ThrottleTruncation(files int, interval time.Duration, onProgress func(TruncateProgress)) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if files < 1 {
+			return errors.New("files per interval must be at least 1")
+		}
+		if interval < 0 {
+			return errors.New("negative truncation interval")
+		}
+		if onProgress == nil {
+			onProgress = func(TruncateProgress) {}
+		}
+		ds.throttle = &truncThrottle{
+			files:      files,
+			interval:   interval,
+			onProgress: onProgress,
+			stop:       make(chan struct{}),
+		}
+		return nil
+	}
+}
+
+// LogicalTruncation causes a *DirectorySink to truncate a segment that an
+// offset falls within by writing a small tombstone file alongside it,
+// rather than rewriting the whole segment. Data chunks at, or before, the
+// tombstone's offset are dropped as the segment is loaded.
+//
+// The physical rewrite is deferred until the sink's Compact method is
+// called. Until then, the oldest offset reported by the sink's Offsets
+// method is the offset just after the truncation offset, which may not be
+// the offset of a data chunk.
+func LogicalTruncation() DirectoryOption {
+	return func(ds *DirectorySink) error {
+		ds.logical = true
+		return nil
+	}
+}
+
+// ImmutableSegments causes a *DirectorySink to never rewrite a segment file
+// once it has been written, so that tools such as rsync, or rclone, can
+// replicate the sink's directory incrementally, without copying rewritten
+// segment files again:
+//
+//   - Truncate removes whole segment files, and truncates the segment the
+//     offset falls within with a tombstone file, as with the
+//     LogicalTruncation option (which ImmutableSegments implies).
+//   - TruncateAfter removes whole segment files, and returns ErrImmutable,
+//     without removing anything, if the offset falls within a segment.
+//   - Compact, and CompressBefore, return ErrImmutable.
+//
+// Files accompanying a segment file, such as its tombstone, may still be
+// replaced.
+func ImmutableSegments() DirectoryOption {
+	return func(ds *DirectorySink) error {
+		ds.immutable = true
+		ds.logical = true
+		return nil
+	}
+}
+
+// MetadataDir causes a *DirectorySink to keep the files accompanying its
+// segment files (checksums, signatures, tombstones, indexes, etc.) in dir,
+// rather than alongside the segment files; for example, to keep them on a
+// fast, local disk, while the segment files live on a slower, archival
+// mount. dir is created if it does not exist.
+//
+// If the two directories diverge, such as after a crash part-way through
+// writing a segment, Analyze ignores accompanying files whose segment file
+// does not exist (GC removes them), and skips the newest segment file if
+// its checksum file does not exist, as it was not completely written. Any
+// other segment file without a checksum file is an error.
+func MetadataDir(dir string) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return errors.Wrap(err, "metadata dir")
+		}
+		ds.metaDir = dir
+		return nil
+	}
+}
+
+// AlignSegments causes a *DirectorySink to pad each segment file it writes
+// to a multiple of block bytes (such as 4KiB, or 1MiB), with a padding
+// record following its data chunks; for example, for storage that must be
+// written in whole blocks (such as tape, or files opened with O_DIRECT), or
+// that is billed by the block. Padding records are skipped when a segment
+// is loaded, or inspected; the segment's checksum, and signature, cover its
+// padding.
+//
+// Segment files compressed with CompressBefore are no longer aligned.
+func AlignSegments(block int64) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if block <= 0 {
+			return errors.New("block size must be positive")
+		}
+		ds.align = block
+		return nil
+	}
+}
+
+// DirectoryLimits causes a *DirectorySink to share the resource limits rl
+// with the other *DirectorySinks, and *Loggers, it is passed to. A
+// *DirectorySink is bound by rl's MaxOpenFiles, and MaxCachedSegments.
+func DirectoryLimits(rl *ResourceLimits) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if rl == nil {
+			return errors.New("nil resource limits")
+		}
+		ds.limits = rl
+		return nil
+	}
+}
+
+// BloomFilter causes a *DirectorySink to keep a Bloom filter over the keys
+// of the data chunks in each segment it writes, as extracted by keyFn. The
+// filters are written alongside the segment files, and are used by the
+// sink's MayContainKey method to check whether a key has been logged,
+// without reading every segment. Segments holding encrypted, compressed,
+// or batched data chunks cannot be written to the sink; see KeyFunc.
+func BloomFilter(keyFn KeyFunc) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if keyFn == nil {
+			return errors.New("nil key func")
+		}
+		ds.keyFn = keyFn
+		return nil
+	}
+}
+
+// IndexKeys causes a *DirectorySink to maintain an index of the keys of the
+// data chunks in each segment it writes, as extracted by keyFn, mapping
+// each key to the offsets of the data chunks holding it, and where they are
+// in the segment file. The indexes are written alongside the segment files,
+// and are used by the sink's LookupKey, and LookupRecords methods.
+//
+// Segments without an index, such as those written before the sink was
+// created with IndexKeys, are indexed when the sink is analyzed. Segments
+// holding encrypted, compressed, or batched data chunks cannot be written
+// to the sink, and such data chunks in existing segments are not indexed;
+// see KeyFunc.
+func IndexKeys(keyFn KeyFunc) DirectoryOption {
+	return func(ds *DirectorySink) error {
+		if keyFn == nil {
+			return errors.New("nil key func")
+		}
+		ds.indexFn = keyFn
+		return nil
+	}
+}
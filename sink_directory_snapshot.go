@@ -0,0 +1,109 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SnapshotTo creates a point-in-time snapshot of the sink's segment files,
+// along with their accompanying files (checksums, signatures, etc.), and
+// bookmarks (see SaveBookmark), in dir, so that a backup tool can copy dir
+// without capturing a segment file that is only partially written, or
+// part-way through being truncated.
+//
+// dir is created if it does not exist, and must be on the same filesystem
+// as the sink's directory for the snapshot to be made with hard links;
+// otherwise, the files are copied. Hard-linked files share their contents
+// with the sink's files, but the sink never modifies a segment file in
+// place, so the snapshot is not changed by later writes, or truncations.
+//
+// The sink's lock is held while the snapshot is made, which blocks writes,
+// and truncations, until it completes; copying files holds it for longer.
+// SnapshotTo returns the number of segments in the snapshot.
+//
+// The accompanying files are placed alongside the segment files in dir,
+// even if the sink keeps them in a separate directory (see MetadataDir).
+func (ds *DirectorySink) SnapshotTo(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, errors.Wrap(err, "mkdir all")
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	for _, name := range ds.segPaths {
+		if err := snapshotFile(filepath.Join(ds.dir, name), filepath.Join(dir, name)); err != nil {
+			return 0, errors.Wrapf(err, "snapshot segment %s", name)
+		}
+		for _, ext := range segmentFileExts {
+			if ext == ".REWRITE" {
+				// The snapshot holds only the current segment
+				// files, so there is no rewrite to record.
+				continue
+			}
+			src := ds.metaPath(name + ext)
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := snapshotFile(src, filepath.Join(dir, name+ext)); err != nil {
+				return 0, errors.Wrapf(err, "snapshot segment %s", name)
+			}
+		}
+	}
+
+	// Bookmarks are replaced, rather than modified, by SaveBookmark, so
+	// they can be linked, too.
+	marks, err := filepath.Glob(ds.metaPath("*.BOOKMARK"))
+	if err != nil {
+		return 0, errors.Wrap(err, "find bookmarks")
+	}
+	for _, src := range marks {
+		if err := snapshotFile(src, filepath.Join(dir, filepath.Base(src))); err != nil {
+			return 0, errors.Wrapf(err, "snapshot bookmark %s", filepath.Base(src))
+		}
+	}
+	return len(ds.segPaths), nil
+}
+
+// snapshotFile hard links src to dst, falling back to copying src when it
+// cannot be linked (such as when dst is on a different filesystem).
+func snapshotFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	} else if os.IsExist(err) {
+		return errors.Wrap(err, "link")
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst, which must not exist, and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "copy")
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "sync")
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return errors.Wrap(err, "close")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SegmentStats describes the data chunks in a segment file, as recorded in
+// a ".STATS" file when the segment was written, so that they can be listed
+// without decoding the segment file itself.
+type SegmentStats struct {
+	Name         string    `json:"name"`
+	ID           SegmentID `json:"id"`
+	First        Offset    `json:"first"`
+	Last         Offset    `json:"last"`
+	Chunks       int       `json:"chunks"`
+	MinChunk     int       `json:"min_chunk"`         // Size of the smallest data chunk's data, in bytes.
+	MaxChunk     int       `json:"max_chunk"`         // Size of the largest data chunk's data, in bytes.
+	PayloadBytes int64     `json:"payload_bytes"`     // Total size of the data chunks' data, in bytes.
+	FileBytes    int64     `json:"file_bytes"`        // Size of the segment file, in bytes.
+	Ratio        float64   `json:"compression_ratio"` // PayloadBytes / FileBytes.
+}
+
+// segmentStats returns the statistics of seg, written to the segment file
+// name, of size bytes, with the given ID.
+func segmentStats(name string, id SegmentID, seg *Segment, size int64) *SegmentStats {
+	st := &SegmentStats{
+		Name:   name,
+		ID:     id,
+		Chunks: seg.Chunks(),
+	}
+	st.First, st.Last = seg.Limits()
+	for i := 0; i < st.Chunks; i++ {
+		n := len(seg.chunkAt(i).Data())
+		if i == 0 || n < st.MinChunk {
+			st.MinChunk = n
+		}
+		if n > st.MaxChunk {
+			st.MaxChunk = n
+		}
+		st.PayloadBytes += int64(n)
+	}
+	st.setFileBytes(size)
+	return st
+}
+
+// setFileBytes sets the size of the segment file, and the compression
+// ratio that follows from it.
+func (st *SegmentStats) setFileBytes(size int64) {
+	st.FileBytes = size
+	st.Ratio = 0
+	if size > 0 {
+		st.Ratio = float64(st.PayloadBytes) / float64(size)
+	}
+}
+
+// writeStats writes st to the ".STATS" file accompanying its segment file.
+// The file is replaced atomically, since it may be linked into a snapshot
+// (see SnapshotTo).
+func (ds *DirectorySink) writeStats(st *SegmentStats) error {
+	p, err := json.Marshal(st)
+	if err != nil {
+		return errors.Wrap(err, "marshal stats")
+	}
+	path := ds.metaPath(st.Name + ".STATS")
+	if err := os.WriteFile(path+".tmp", p, 0666); err != nil {
+		return errors.Wrap(err, "write stats")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return errors.Wrap(err, "write stats")
+	}
+	return nil
+}
+
+// readStats reads the ".STATS" file accompanying the named segment file.
+// It returns nil if there is none, for example because the segment was
+// written before statistics were recorded.
+func (ds *DirectorySink) readStats(name string) (*SegmentStats, error) {
+	p, err := os.ReadFile(ds.metaPath(name + ".STATS"))
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read stats")
+	}
+	st := &SegmentStats{}
+	if err := json.Unmarshal(p, st); err != nil {
+		return nil, errors.Wrap(err, "parse stats")
+	}
+	return st, nil
+}
+
+// loadStats loads the statistics of the named segment file, calculating
+// them from the segment file if there is no ".STATS" file. It must be
+// called while holding ds.mu.
+func (ds *DirectorySink) loadStats(name string) (*SegmentStats, error) {
+	if st, err := ds.readStats(name); err != nil || st != nil {
+		return st, err
+	}
+
+	info, err := os.Stat(filepath.Join(ds.dir, name))
+	if err != nil {
+		return nil, errors.Wrap(err, "stat segment file")
+	}
+	seg, err := ds.readSegment(name)
+	if err != nil {
+		return nil, err
+	}
+	return segmentStats(name, ds.ids[name], seg, info.Size()), nil
+}
+
+// ListSegments returns the statistics of each segment file known to the
+// sink, oldest first, as recorded when each segment was written (and
+// updated when it is compressed; see CompressBefore). They describe every
+// data chunk written to the segment file, including those since removed by
+// a tombstone (see Truncate).
+func (ds *DirectorySink) ListSegments() ([]SegmentStats, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	stats := make([]SegmentStats, 0, len(ds.segPaths))
+	for _, name := range ds.segPaths {
+		st, err := ds.loadStats(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "segment %s", name)
+		}
+		// Segments written before segment IDs were assigned have
+		// statistics without one.
+		st.ID = ds.ids[name]
+		stats = append(stats, *st)
+	}
+	return stats, nil
+}
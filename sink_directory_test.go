@@ -2,11 +2,22 @@ package wal
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
 )
 
 func fmtTempDir(prefix string) string {
@@ -75,6 +86,12 @@ func TestDirectorySink(t *testing.T) {
 			}
 		})
 
+		t.Run("Ping", func(t *testing.T) {
+			if err := s.Ping(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+
 		if err := s.Close(); err != nil {
 			t.Error("error closing sink:", err)
 		}
@@ -222,3 +239,1458 @@ func TestDirectorySinkMulti(t *testing.T) {
 		}
 	})
 }
+
+func TestDirectorySinkMinFreeSpace(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-minfree"
+	defer os.RemoveAll(tempdir)
+
+	var called bool
+	s, err := NewDirectorySink(tempdir, MinFreeSpace(1<<62, func(free uint64) error {
+		called = true
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg := NewSegment()
+	if _, err := seg.Write([]byte("hello, wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteSegment(seg); err != ErrDiskSpaceLow {
+		t.Errorf("want %v, got %v", ErrDiskSpaceLow, err)
+	}
+	if !called {
+		t.Error("low disk space callback was not called")
+	}
+	if n := s.NumSegments(); n != 0 {
+		t.Errorf("wrong number of segments: want=%d got=%d", 0, n)
+	}
+}
+
+func TestDirectorySinkMinFreeSpaceTruncate(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-minfree-truncate"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offs := range [][]Offset{{1, 2}, {3, 4}} {
+		if err := s.WriteSegment(newSegmentOffsets(offs...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncating the sink from within the callback must not deadlock.
+	var truncated *DirectorySink
+	s, err = NewDirectorySink(tempdir, MinFreeSpace(1<<62, func(free uint64) error {
+		return truncated.Truncate(Offset(2))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	truncated = s
+
+	done := make(chan error, 1)
+	go func() { done <- s.WriteSegment(newSegmentOffsets(5, 6)) }()
+	select {
+	case err := <-done:
+		if err != ErrDiskSpaceLow {
+			t.Errorf("want %v, got %v", ErrDiskSpaceLow, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write deadlocked")
+	}
+	if first, _ := s.Offsets(); first != Offset(3) {
+		t.Errorf("wrong first offset: want=%v got=%v", Offset(3), first)
+	}
+}
+
+func TestDirectorySinkSignedSegments(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-signed"
+	defer os.RemoveAll(tempdir)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDirectorySink(tempdir, SignSegments(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := NewSegment()
+	if _, err := seg.Write([]byte("hello, wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteSegment(seg); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		s, err := NewDirectorySink(tempdir, VerifySegments(pub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Analyze(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.LoadSegment(ZeroOffset); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewDirectorySink(tempdir, VerifySegments(other))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Analyze(); errors.Cause(err) != ErrBadSignature {
+			t.Errorf("want %v, got %v", ErrBadSignature, err)
+		}
+	})
+}
+
+func TestDirectorySinkAppendOnly(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-appendonly"
+	defer os.RemoveAll(tempdir)
+
+	writeSegment := func(s *DirectorySink) {
+		seg := NewSegment()
+		if _, err := seg.Write([]byte("hello, wal")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewDirectorySink(tempdir, AppendOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		writeSegment(s)
+	}
+	if err := s.Truncate(NewOffset()); err != ErrAppendOnly {
+		t.Errorf("want %v, got %v", ErrAppendOnly, err)
+	}
+	if _, err := s.GC(); err != ErrAppendOnly {
+		t.Errorf("GC: want %v, got %v", ErrAppendOnly, err)
+	}
+
+	// Re-open the sink, and continue the chain.
+	s, err = NewDirectorySink(tempdir, AppendOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	writeSegment(s)
+	if err := s.VerifyChain(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tamper with one of the segments.
+	name := filepath.Join(tempdir, s.segPaths[1])
+	if err := os.WriteFile(name, []byte("tampered\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyChain(); errors.Cause(err) != ErrChainBroken {
+		t.Errorf("want %v, got %v", ErrChainBroken, err)
+	}
+}
+
+func TestDirectorySinkAppendOnlySigned(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-appendonly-signed"
+	defer os.RemoveAll(tempdir)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDirectorySink(tempdir, AppendOnly(), SignSegments(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := s.ChainHead()
+
+	open := func() *DirectorySink {
+		t.Helper()
+		s, err := NewDirectorySink(tempdir, AppendOnly(), VerifySegments(pub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Analyze(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if err := open().VerifyChainHead(head); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the newest segment leaves a valid chain, but one that no
+	// longer ends at the recorded head.
+	for _, ext := range []string{"", ".CHECKSUM", ".SIGNATURE", ".CHAIN"} {
+		if err := os.Remove(filepath.Join(tempdir, "41-42"+ext)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s = open()
+	if err := s.VerifyChain(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyChainHead(head); errors.Cause(err) != ErrChainBroken {
+		t.Errorf("want %v, got %v", ErrChainBroken, err)
+	}
+
+	// Removing a segment, and recalculating the chain over the remaining
+	// segments, invalidates their signatures.
+	for _, ext := range []string{"", ".CHECKSUM", ".SIGNATURE", ".CHAIN"} {
+		if err := os.Remove(filepath.Join(tempdir, "21-22"+ext)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var link []byte
+	for _, name := range []string{"11-12", "31-32"} {
+		p, err := os.ReadFile(filepath.Join(tempdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha512.Sum512(p)
+		link = chainLink(link, digest[:])
+		if err := os.WriteFile(filepath.Join(tempdir, name+".CHAIN"), []byte(hex.EncodeToString(link)), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = NewDirectorySink(tempdir, AppendOnly(), VerifySegments(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); errors.Cause(err) != ErrBadSignature {
+		t.Errorf("want %v, got %v", ErrBadSignature, err)
+	}
+}
+
+func TestDirectorySinkThrottleTruncation(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-throttle"
+	defer os.RemoveAll(tempdir)
+
+	progress := make(chan TruncateProgress, 16)
+	s, err := NewDirectorySink(tempdir, ThrottleTruncation(2, time.Millisecond, func(p TruncateProgress) {
+		progress <- p
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncate part-way through the fourth segment.
+	if err := s.Truncate(31); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments after truncate: want=2 got=%d", n)
+	}
+
+	var last TruncateProgress
+	for !last.Done {
+		select {
+		case last = <-progress:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for truncation")
+		}
+	}
+	if last.Err != nil {
+		t.Fatal(last.Err)
+	}
+	if last.Deleted != 3 || last.Total != 3 {
+		t.Errorf("wrong progress: %+v", last)
+	}
+
+	// Re-analyzing the directory finds only the remaining segments.
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if first, last := s.Offsets(); first != 32 || last != 42 {
+		t.Errorf("wrong offsets after truncate: want=32,42 got=%v,%v", first, last)
+	}
+}
+
+func TestDirectorySinkTruncateAfter(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-truncateafter"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncate part-way through the second segment.
+	if err := s.TruncateAfter(11); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NumSegments(); n != 2 {
+		t.Errorf("wrong number of segments: want=2 got=%d", n)
+	}
+
+	// Re-analyzing the directory finds only the remaining segments.
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if first, last := s.Offsets(); first != 1 || last != 11 {
+		t.Errorf("wrong offsets after truncate: want=1,11 got=%v,%v", first, last)
+	}
+}
+
+func TestDirectorySinkLogicalTruncation(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-logical"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir, LogicalTruncation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2), Offset(i*10+3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readAll := func(s *DirectorySink) []Offset {
+		var got []Offset
+		r := NewReader(s)
+		for r.Next() {
+			got = append(got, r.Offset())
+		}
+		if err := r.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	want := []Offset{3, 11, 12, 13}
+	check := func(name string, got []Offset) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: wrong offsets: want=%v got=%v", name, want, got)
+		}
+	}
+
+	if err := s.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, "1-3")); err != nil {
+		t.Errorf("segment file was rewritten: %v", err)
+	}
+	check("truncated", readAll(s))
+
+	// The tombstone survives re-analyzing the directory.
+	s, err = NewDirectorySink(tempdir, LogicalTruncation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	check("analyzed", readAll(s))
+
+	if n, err := s.Compact(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("wrong number of segments compacted: want=1 got=%d", n)
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, "3-3")); err != nil {
+		t.Errorf("segment was not rewritten: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, "1-3.TOMBSTONE")); !os.IsNotExist(err) {
+		t.Errorf("tombstone was not removed: %v", err)
+	}
+	check("compacted", readAll(s))
+}
+
+func TestDirectorySinkBloomFilter(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-bloom"
+	defer os.RemoveAll(tempdir)
+
+	// Each data chunk's key is everything before the first ":".
+	keyFn := func(data []byte) []byte {
+		if i := bytes.IndexByte(data, ':'); i != -1 {
+			return data[:i]
+		}
+		return nil
+	}
+
+	s, err := NewDirectorySink(tempdir, BloomFilter(keyFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		seg := NewSegment()
+		for j := 0; j < 10; j++ {
+			if _, err := fmt.Fprintf(seg, "txn-%d-%d:payload", i, j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(s *DirectorySink) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 10; j++ {
+				if key := fmt.Sprintf("txn-%d-%d", i, j); !s.MayContainKey([]byte(key)) {
+					t.Errorf("false negative for key %q", key)
+				}
+			}
+		}
+		var positives int
+		for i := 0; i < 1000; i++ {
+			if s.MayContainKey([]byte(fmt.Sprintf("missing-%d", i))) {
+				positives++
+			}
+		}
+		if positives > 50 {
+			t.Errorf("too many false positives: %d/1000", positives)
+		}
+	}
+	check(s)
+
+	// The filters are loaded when the directory is analyzed.
+	s, err = NewDirectorySink(tempdir, BloomFilter(keyFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+}
+
+func TestDirectorySinkIndexKeys(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-index"
+	defer os.RemoveAll(tempdir)
+
+	keyFn := func(data []byte) []byte {
+		if i := bytes.IndexByte(data, ':'); i != -1 {
+			return data[:i]
+		}
+		return nil
+	}
+
+	// Write the first segment without an index.
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []Offset
+	for i := 0; i < 3; i++ {
+		seg := NewSegment()
+		for _, data := range []string{"a:1", "b:2", "no key"} {
+			if _, err := seg.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+			if data == "a:1" {
+				_, off := seg.Limits()
+				want = append(want, off)
+			}
+		}
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if s, err = NewDirectorySink(tempdir, IndexKeys(keyFn)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Analyze(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	got, err := s.LookupKey([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("wrong offsets for key: want=%v got=%v", want, got)
+	}
+	if got, err := s.LookupKey([]byte("missing")); err != nil || len(got) != 0 {
+		t.Errorf("unexpected result for missing key: %v, %v", got, err)
+	}
+
+	// The data chunk at each offset holds the key.
+	r := NewReaderOffset(s, got[1])
+	if !r.Next() || string(r.Data()) != "a:1" {
+		t.Errorf("wrong data at indexed offset: %q", r.Data())
+	}
+
+	// Truncated data chunks are no longer returned.
+	if err := s.Truncate(want[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.LookupKey([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(got) != fmt.Sprint(want[1:]) {
+		t.Errorf("wrong offsets after truncate: want=%v got=%v", want[1:], got)
+	}
+}
+
+func TestDirectorySinkLookupRecords(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-readat"
+	defer os.RemoveAll(tempdir)
+
+	keyFn := func(data []byte) []byte {
+		if i := bytes.IndexByte(data, ':'); i != -1 {
+			return data[:i]
+		}
+		return nil
+	}
+	s, err := NewDirectorySink(tempdir, IndexKeys(keyFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sep := range []byte{0, '|'} {
+		seg := NewSegment()
+		seg.sep = sep
+		for _, data := range []string{"no key", "a:" + strconv.Itoa(i), "b:" + strconv.Itoa(i)} {
+			if _, err := seg.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first segment file is compressed, so it must be loaded as a
+	// whole.
+	if n, err := s.CompressBefore(s.segments[1][0]); err != nil || n != 1 {
+		t.Fatalf("compress first segment: n=%d err=%v", n, err)
+	}
+
+	// Damage the first data chunk of the second segment file, so that it
+	// cannot be loaded as a whole.
+	path := filepath.Join(tempdir, s.segPaths[1])
+	p, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(p, []byte(base64.RawStdEncoding.EncodeToString([]byte("no key"))))
+	p[i] = '!'
+	if err := os.WriteFile(path, p, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := s.LookupRecords([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || string(recs[0].Data) != "b:0" || string(recs[1].Data) != "b:1" {
+		t.Errorf("wrong records: %q", recs)
+	}
+	if want, _ := s.LookupKey([]byte("b")); len(recs) == 2 && (recs[0].Offset != want[0] || recs[1].Offset != want[1]) {
+		t.Errorf("wrong offsets: want=%v got=%v", want, recs)
+	}
+}
+
+func TestDirectorySinkIndexKeysNotKeyable(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-index-keyable"
+	defer os.RemoveAll(tempdir)
+
+	keyFn := func(data []byte) []byte { return data }
+	s, err := NewDirectorySink(tempdir, IndexKeys(keyFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A *Logger whose stored data is not the record written is rejected.
+	for name, opt := range map[string]Option{
+		"encrypt":  EncryptRecords(newTestAEAD(t)),
+		"compress": CompressRecords(16),
+		"batch":    BatchRecords(time.Second, 10),
+	} {
+		if _, err := New(s, opt); !errors.Is(err, ErrNotKeyable) {
+			t.Errorf("%s: want %v, got %v", name, ErrNotKeyable, err)
+		}
+	}
+
+	// As is a segment holding such a data chunk, written by other means.
+	seg := NewSegment()
+	seg.addChunks(newChunkHeader([]byte("key"), NewOffset(), chunkAttrs{attrDeflate: "1"}.encode()))
+	if err := s.WriteSegment(seg); !errors.Is(err, ErrNotKeyable) {
+		t.Errorf("want %v, got %v", ErrNotKeyable, err)
+	}
+	if n := s.NumSegments(); n != 0 {
+		t.Errorf("want no segments, got %d", n)
+	}
+}
+
+func TestDirectorySinkLookupRecordsVerified(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-readat-verified"
+	defer os.RemoveAll(tempdir)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFn := func(data []byte) []byte {
+		if i := bytes.IndexByte(data, ':'); i != -1 {
+			return data[:i]
+		}
+		return nil
+	}
+	s, err := NewDirectorySink(tempdir, SignSegments(priv), VerifySegments(pub), IndexKeys(keyFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := NewSegment()
+	for _, data := range []string{"a:0", "b:0"} {
+		if _, err := seg.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteSegment(seg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the data of the indexed data chunk, from "b:0" to "b:1".
+	path := filepath.Join(tempdir, s.segPaths[0])
+	p, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawStdEncoding
+	p = bytes.Replace(p, []byte(enc.EncodeToString([]byte("b:0"))), []byte(enc.EncodeToString([]byte("b:1"))), 1)
+	if err := os.WriteFile(path, p, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if recs, err := s.LookupRecords([]byte("b")); errors.Cause(err) != ErrBadSignature {
+		t.Errorf("want %v, got %q, %v", ErrBadSignature, recs, err)
+	}
+}
+
+func TestDirectorySinkGC(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-gc"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A segment, along with copies of it from before it was truncated at
+	// either end, as if the sink had been interrupted while rewriting it.
+	for _, seg := range []*Segment{
+		newSegmentOffsets(11, 12, 13, 14),
+		newSegmentOffsets(12, 13, 14),
+		newSegmentOffsets(12, 13),
+		newSegmentOffsets(21, 22),
+	} {
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Records of the rewrites, along with orphaned checksum, and
+	// temporary, files.
+	for name, data := range map[string]string{
+		"11-14.REWRITE":       "12-14",
+		"12-14.REWRITE":       "12-13",
+		"15-16.CHECKSUM":      "0123456789abcdef",
+		"12-13.TOMBSTONE.tmp": "12",
+	} {
+		if err := os.WriteFile(filepath.Join(tempdir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want int64
+	for _, name := range []string{"11-14", "11-14.CHECKSUM", "11-14.ID", "11-14.REWRITE", "11-14.STATS", "12-14", "12-14.CHECKSUM", "12-14.ID", "12-14.REWRITE", "12-14.STATS", "15-16.CHECKSUM", "12-13.TOMBSTONE.tmp"} {
+		fi, err := os.Stat(filepath.Join(tempdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += fi.Size()
+	}
+
+	// The orphaned checksum file would cause Analyze to fail, so collect
+	// the garbage first.
+	got, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("wrong number of bytes reclaimed: want=%d got=%d", want, got)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if first, last := s.Offsets(); s.NumSegments() != 2 || first != 12 || last != 22 {
+		t.Errorf("wrong segments after GC: want=2 (12,22) got=%d (%v,%v)", s.NumSegments(), first, last)
+	}
+
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := "12-13,12-13.CHECKSUM,12-13.ID,12-13.STATS,21-22,21-22.CHECKSUM,21-22.ID,21-22.STATS"; strings.Join(names, ",") != want {
+		t.Errorf("wrong files after GC: want=%s got=%v", want, names)
+	}
+
+	// Nothing more to collect.
+	if n, err := s.GC(); err != nil || n != 0 {
+		t.Errorf("second GC: reclaimed=%d err=%v", n, err)
+	}
+}
+
+func TestDirectorySinkGCSharedBoundaries(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-gcbounds"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Segments sharing boundary offsets, as found in older logs, are not
+	// copies of one another.
+	for _, seg := range []*Segment{
+		newSegmentOffsets(10, 20),
+		newSegmentOffsets(20, 25, 30),
+		newSegmentOffsets(30),
+	} {
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A rewrite that was interrupted before the rewritten segment file
+	// was written.
+	if err := os.WriteFile(filepath.Join(tempdir, "20-30.REWRITE"), []byte("25-30"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := "10-20,10-20.CHECKSUM,10-20.ID,10-20.STATS,20-30,20-30.CHECKSUM,20-30.ID,20-30.STATS,30-30,30-30.CHECKSUM,30-30.ID,30-30.STATS"; strings.Join(names, ",") != want {
+		t.Errorf("wrong files after GC: want=%s got=%v", want, names)
+	}
+}
+
+func TestDirectorySinkAnalyzeContext(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-analyzectx"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []AnalyzeProgress
+	if err := s.AnalyzeContext(context.Background(), func(p AnalyzeProgress) {
+		seen = append(seen, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 3 {
+		t.Fatalf("wrong number of progress reports: want=3 got=%d", len(seen))
+	}
+	if want := (AnalyzeProgress{Scanned: 2, Total: 3, File: "31-32"}); seen[2] != want {
+		t.Errorf("wrong progress: want=%+v got=%+v", want, seen[2])
+	}
+
+	// Cancel part-way through.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = s.AnalyzeContext(ctx, func(p AnalyzeProgress) {
+		if p.Scanned == 1 {
+			cancel()
+		}
+	})
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("wrong error: want=%v got=%v", context.Canceled, err)
+	}
+	if n := s.NumSegments(); n != 0 {
+		t.Errorf("cancelled analysis left %d segments", n)
+	}
+}
+
+func TestDirectorySinkWriteSegmentContext(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-writectx"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.WriteSegmentContext(ctx, newSegmentOffsets(1, 2)); errors.Cause(err) != context.Canceled {
+		t.Errorf("wrong error: want=%v got=%v", context.Canceled, err)
+	}
+	if entries, err := os.ReadDir(tempdir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("abandoned write left %d files behind", len(entries))
+	}
+	if n := s.NumSegments(); n != 0 {
+		t.Errorf("wrong number of segments: want=0 got=%d", n)
+	}
+}
+
+func TestDirectorySinkSnapshotTo(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-snapshot"
+	defer os.RemoveAll(tempdir)
+	snapdir := tempdir + "-copy"
+	defer os.RemoveAll(snapdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := s.SnapshotTo(snapdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("wrong number of segments in snapshot: want=3 got=%d", n)
+	}
+
+	// Changes to the sink after the snapshot do not affect it.
+	if err := s.WriteSegment(newSegmentOffsets(31, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Truncate(11); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := NewDirectorySink(snapdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if first, last := snap.Offsets(); first != 1 || last != 22 {
+		t.Errorf("wrong snapshot offsets: want=1,22 got=%v,%v", first, last)
+	}
+	if n := snap.NumSegments(); n != 3 {
+		t.Errorf("wrong number of snapshot segments: want=3 got=%d", n)
+	}
+
+	// A second snapshot into the same directory would overwrite the first.
+	if _, err := s.SnapshotTo(snapdir); err == nil {
+		t.Error("expected an error snapshotting over an existing snapshot")
+	}
+}
+
+func TestDirectorySinkImmutableSegments(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-immutable"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir, ImmutableSegments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2), Offset(i*10+3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat := func(name string) os.FileInfo {
+		fi, err := os.Stat(filepath.Join(tempdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	before := []os.FileInfo{stat("1-3"), stat("11-13")}
+
+	if err := s.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TruncateAfter(12); err != ErrImmutable {
+		t.Errorf("want %v, got %v", ErrImmutable, err)
+	}
+	if err := s.TruncateAfter(13); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Compact(); err != ErrImmutable {
+		t.Errorf("want %v, got %v", ErrImmutable, err)
+	}
+	if _, err := s.CompressBefore(NewOffset()); err != ErrImmutable {
+		t.Errorf("want %v, got %v", ErrImmutable, err)
+	}
+
+	// The remaining segment files were never rewritten.
+	for i, name := range []string{"1-3", "11-13"} {
+		if !os.SameFile(before[i], stat(name)) {
+			t.Errorf("segment file %s was rewritten", name)
+		}
+	}
+	if first, last := s.Offsets(); first != 3 || last != 13 {
+		t.Errorf("wrong offsets: want=3,13 got=%v,%v", first, last)
+	}
+}
+
+func TestDirectorySinkMetadataDir(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-metadir"
+	defer os.RemoveAll(tempdir)
+	dataDir, metaDir := filepath.Join(tempdir, "data"), filepath.Join(tempdir, "meta")
+
+	s, err := NewDirectorySink(dataDir, MetadataDir(metaDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2), Offset(i*10+3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"1-3", "11-13", "21-23"} {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err != nil {
+			t.Errorf("segment file: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(metaDir, name+".CHECKSUM")); err != nil {
+			t.Errorf("checksum file: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, name+".CHECKSUM")); !os.IsNotExist(err) {
+			t.Errorf("checksum file %s written alongside segment file", name)
+		}
+	}
+
+	// Diverge the directories: the newest segment file's checksum is
+	// lost, and a checksum file for a segment that no longer exists is
+	// left behind.
+	if err := os.Remove(filepath.Join(metaDir, "21-23.CHECKSUM")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(metaDir, "31-33.CHECKSUM"), []byte("00"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewDirectorySink(dataDir, MetadataDir(metaDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if first, last := s.Offsets(); first != 1 || last != 13 {
+		t.Errorf("wrong offsets: want=1,13 got=%v,%v", first, last)
+	}
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(metaDir, "31-33.CHECKSUM")); !os.IsNotExist(err) {
+		t.Error("orphaned checksum file not removed")
+	}
+
+	// Any other missing checksum file is an error.
+	if err := os.Remove(filepath.Join(metaDir, "1-3.CHECKSUM")); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewDirectorySink(dataDir, MetadataDir(metaDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err == nil {
+		t.Error("expected error analyzing segment without checksum file")
+	}
+}
+
+func TestDirectorySinkCacheSegments(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-cache"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Warmup(1); err != ErrNotSupported {
+		t.Errorf("want %v, got %v", ErrNotSupported, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2), Offset(i*10+3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = NewDirectorySink(tempdir, CacheSegments(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Warmup(5); err != nil || n != 2 {
+		t.Fatalf("warmup: want 2 segments, got %d (%v)", n, err)
+	}
+
+	// Cached segments are loaded without reading their segment files.
+	if err := os.Rename(filepath.Join(tempdir, "21-23"), filepath.Join(tempdir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	seg, err := s.LoadSegment(21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.Truncate(22) // Must not modify the cached segment.
+	if seg, err = s.LoadSegment(21); err != nil {
+		t.Fatal(err)
+	} else if seg.Chunks() != 3 {
+		t.Errorf("wrong number of chunks in cached segment: want=3 got=%d", seg.Chunks())
+	}
+	if _, err := s.LoadSegment(1); err != nil {
+		t.Fatal(err) // 1-3 was not warmed up, but is still on disk.
+	}
+	if err := os.Rename(filepath.Join(tempdir, "moved"), filepath.Join(tempdir, "21-23")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncating drops replaced segments from the cache.
+	if err := s.Truncate(12); err != nil {
+		t.Fatal(err)
+	}
+	if seg, err := s.LoadSegment(12); err != nil {
+		t.Fatal(err)
+	} else if first, _ := seg.Limits(); first != 13 {
+		t.Errorf("wrong first offset after truncation: want=13 got=%v", first)
+	}
+}
+
+func TestDirectorySinkVerify(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-verify"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+1), Offset(i*10+2), Offset(i*10+3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var list bytes.Buffer
+	if err := s.WriteSegmentList(&list); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempdir, SegmentListName), list.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Verify(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK || len(report.Segments) != 4 {
+		t.Fatalf("want a clean report of 4 segments, got %+v", report)
+	}
+	if seg := report.Segments[1]; seg.Name != "11-13" || seg.Records != 3 || seg.First != 11 || seg.Last != 13 {
+		t.Errorf("wrong segment report: %+v", seg)
+	}
+
+	// Corrupt a segment file, remove a checksum file, and a listed
+	// segment file.
+	p, err := os.ReadFile(filepath.Join(tempdir, "1-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempdir, "1-3"), bytes.Replace(p, []byte("2:"), []byte("9:"), 1), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tempdir, "11-13.CHECKSUM")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tempdir, "31-33")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = s.Verify(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK {
+		t.Fatal("want problems to be reported")
+	}
+	if n := len(report.Segments[0].Problems); n != 2 {
+		// A checksum mismatch, and offsets out of order.
+		t.Errorf("want 2 problems with 1-3, got %q", report.Segments[0].Problems)
+	}
+	if n := len(report.Segments[1].Problems); n != 1 {
+		t.Errorf("want 1 problem with 11-13, got %q", report.Segments[1].Problems)
+	}
+	if len(report.Problems) != 1 {
+		t.Errorf("want 1 problem with the segment list, got %q", report.Problems)
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDirectorySinkListSegments(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-stats"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recs := range [][]string{{"a", "bbb", "cc"}, {strings.Repeat("d", 1000)}} {
+		seg := NewSegment()
+		for _, rec := range recs {
+			if _, err := seg.Write([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.WriteSegment(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := s.ListSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("want 2 segments, got %d", len(stats))
+	}
+	st := stats[0]
+	if st.Chunks != 3 || st.MinChunk != 1 || st.MaxChunk != 3 || st.PayloadBytes != 6 {
+		t.Errorf("wrong stats: %+v", st)
+	}
+	fi, err := os.Stat(filepath.Join(tempdir, st.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.FileBytes != fi.Size() || st.Ratio != 6/float64(fi.Size()) {
+		t.Errorf("wrong file size, or ratio: %+v", st)
+	}
+
+	// Compressing a segment updates its file size, and compression ratio.
+	before := stats[1]
+	if _, err := s.CompressBefore(NewOffset()); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = s.ListSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if after := stats[1]; after.FileBytes >= before.FileBytes || after.Ratio <= 1 || after.PayloadBytes != 1000 {
+		t.Errorf("wrong stats after compression: before=%+v after=%+v", before, after)
+	}
+
+	// Without a stats file, they are calculated from the segment file.
+	if err := os.Remove(filepath.Join(tempdir, stats[1].Name+".STATS")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ListSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[1] != stats[1] {
+		t.Errorf("wrong calculated stats: want=%+v got=%+v", stats[1], got[1])
+	}
+}
+
+func TestDirectorySinkSegmentIDs(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-ids"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir, CacheSegments(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12), Offset(i*10+13))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := s.SegmentID(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSegmentID(string(id)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadSegmentByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncating part-way through the first segment renames its file, but
+	// keeps its ID; the segment is not loaded from the cache as it was.
+	if err := s.Truncate(11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tempdir, "12-13.ID")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.SegmentID(12); err != nil || got != id {
+		t.Errorf("wrong segment id after rewrite: want=%s got=%s (%v)", id, got, err)
+	}
+	seg, err := s.LoadSegmentByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, last := seg.Limits(); first != 12 || last != 13 {
+		t.Errorf("wrong segment loaded by id: want=12,13 got=%v,%v", first, last)
+	}
+
+	// The IDs are kept when the directory is analyzed again, and listed
+	// in the segment list.
+	stats, err := s.ListSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	var list bytes.Buffer
+	if err := s.WriteSegmentList(&list); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(list.String()), "\n")
+	for i, st := range stats {
+		if got, err := s.SegmentID(st.First); err != nil || got != st.ID {
+			t.Errorf("wrong id for segment %s: want=%s got=%s (%v)", st.Name, st.ID, got, err)
+		}
+		if want := st.Name + " " + st.First.String() + " " + string(st.ID); lines[i] != want {
+			t.Errorf("wrong segment list line: want=%q got=%q", want, lines[i])
+		}
+	}
+
+	// Once the segment is removed, it cannot be loaded by its ID.
+	if err := s.Truncate(13); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadSegmentByID(id); err != ErrSegmentNotFound {
+		t.Errorf("want ErrSegmentNotFound, got %v", err)
+	}
+}
+
+func TestDirectorySinkOnBeforeTruncate(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-beforetrunc"
+	defer os.RemoveAll(tempdir)
+
+	archived := false
+	var got []string
+	s, err := NewDirectorySink(tempdir, OnBeforeTruncate(func(segs []SegmentStats) error {
+		got = got[:0]
+		for _, st := range segs {
+			got = append(got, st.Name)
+		}
+		if !archived {
+			return errors.New("not archived")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12), Offset(i*10+13))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The truncation is vetoed, until the segments have been archived.
+	if err := s.Truncate(22); err == nil {
+		t.Fatal("truncation was not vetoed")
+	}
+	if want := "11-13,21-23"; strings.Join(got, ",") != want {
+		t.Errorf("wrong segments passed to callback: want=%s got=%v", want, got)
+	}
+	if first, _ := s.Offsets(); s.NumSegments() != 3 || first != 11 {
+		t.Errorf("vetoed truncation removed data chunks: %d segments, first=%v", s.NumSegments(), first)
+	}
+
+	archived = true
+	if err := s.Truncate(22); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := s.Offsets(); s.NumSegments() != 2 || first != 23 {
+		t.Errorf("wrong segments after truncation: %d segments, first=%v", s.NumSegments(), first)
+	}
+}
+
+func TestDirectorySinkConcurrentLoad(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-concurrent"
+	defer os.RemoveAll(tempdir)
+
+	s, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers load the oldest segment, as it is truncated, and rewritten,
+	// out from under them, and should always find a whole segment.
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			var err error
+			defer func() { errs <- err }()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var seg *Segment
+				seg, err = s.LoadSegment(ZeroOffset)
+				if err == io.EOF {
+					err = nil
+					continue
+				} else if err != nil {
+					return
+				}
+				if seg.Chunks() == 0 {
+					err = errors.New("loaded an empty segment")
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		off := Offset(1000 + i*10)
+		if err := s.WriteSegment(newSegmentOffsets(off+1, off+2, off+3)); err != nil {
+			t.Fatal(err)
+		}
+		if i > 1 {
+			// Remove one segment, and rewrite the next.
+			if err := s.Truncate(off - 18); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A segment file removed by the sink is looked up again, but one
+	// removed from under the sink is reported.
+	segs, removed, err := s.loadSegmentRefs([]segmentRef{{name: "1001-1003"}})
+	if !removed || len(segs) != 0 {
+		t.Errorf("removed segment file not reported as removed: %v", err)
+	}
+	name := s.segPaths[0]
+	if err := os.Remove(filepath.Join(tempdir, name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadSegment(ZeroOffset); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %v, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestDirectorySinkAlignSegments(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-align"
+	defer os.RemoveAll(tempdir)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDirectorySink(tempdir, AlignSegments(4096), SignSegments(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12), Offset(i*10+13))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each segment file is padded to the block size, but loads, and
+	// verifies, as it would without its padding.
+	for _, name := range s.segPaths {
+		info, err := os.Stat(filepath.Join(tempdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size()%4096 != 0 {
+			t.Errorf("segment file %s is %d bytes, not block-aligned", name, info.Size())
+		}
+		f, err := os.Open(filepath.Join(tempdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seginfo, _, err := InspectSegment(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seginfo.Records != 3 || seginfo.Size != info.Size() {
+			t.Errorf("wrong segment info for %s: %+v", name, seginfo)
+		}
+	}
+	s, err = NewDirectorySink(tempdir, VerifySegments(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	var got []Offset
+	r := NewReader(s)
+	for r.Next() {
+		got = append(got, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[11 12 13 21 22 23 31 32 33]"; fmt.Sprint(got) != want {
+		t.Errorf("wrong offsets: want=%s got=%v", want, got)
+	}
+}
@@ -0,0 +1,160 @@
+package wal
+
+import (
+	"sync"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// TruncateProgress reports the progress of a throttled truncation (see the
+// ThrottleTruncation option).
+type TruncateProgress struct {
+	Offset  Offset // The offset passed to Truncate.
+	Deleted int    // Segment files deleted so far.
+	Total   int    // Segment files to delete.
+	Done    bool   // Whether the truncation has finished.
+	Err     error  // Set if the truncation failed; Done is also set.
+}
+
+// truncThrottle holds the state of a *DirectorySink's background truncation
+// worker.
+type truncThrottle struct {
+	files      int
+	interval   time.Duration
+	onProgress func(TruncateProgress)
+
+	mu      sync.Mutex
+	floor   Offset // Segments ending at, or before, floor have been truncated.
+	jobs    []truncJob
+	running bool
+	stop    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// truncJob is a truncation waiting to be carried out by the worker.
+type truncJob struct {
+	offset Offset
+	files  []string // Segment files to delete.
+}
+
+// truncated returns the offset that every segment file ending at, or
+// before, has been (or is waiting to be) truncated.
+func (t *truncThrottle) truncated() Offset {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.floor
+}
+
+func (t *truncThrottle) close() {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	close(t.stop)
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// truncateThrottled removes the segments ending at, or before, offset from
+// the sink, and queues their files for deletion by the background worker.
+func (ds *DirectorySink) truncateThrottled(offset Offset) error {
+	t := ds.throttle
+
+	ds.mu.Lock()
+	var n int
+	for n < len(ds.segments) && !ds.segments[n][1].After(offset) {
+		n++
+	}
+	job := truncJob{
+		offset: offset,
+		files:  append([]string(nil), ds.segPaths[:n]...),
+	}
+	for _, name := range ds.segPaths[:n] {
+		ds.dropSegmentID(name)
+	}
+	ds.segments = ds.segments[n:]
+	ds.segPaths = ds.segPaths[n:]
+	ds.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return errors.New("truncate: sink closed")
+	}
+	if offset.After(t.floor) {
+		t.floor = offset
+	}
+	t.jobs = append(t.jobs, job)
+	if !t.running {
+		t.running = true
+		t.wg.Add(1)
+		go ds.truncateWorker()
+	}
+	return nil
+}
+
+// truncateWorker carries out queued truncations, until there are none left,
+// or the sink is closed.
+func (ds *DirectorySink) truncateWorker() {
+	t := ds.throttle
+	defer t.wg.Done()
+	for {
+		t.mu.Lock()
+		if len(t.jobs) == 0 {
+			t.running = false
+			t.mu.Unlock()
+			return
+		}
+		job := t.jobs[0]
+		t.jobs = t.jobs[1:]
+		t.mu.Unlock()
+
+		if !ds.runTruncJob(job) {
+			return
+		}
+	}
+}
+
+// runTruncJob deletes a job's files, in batches, then truncates the sink's
+// first segment. It returns false if the sink was closed part-way through.
+func (ds *DirectorySink) runTruncJob(job truncJob) bool {
+	t := ds.throttle
+	progress := TruncateProgress{Offset: job.offset, Total: len(job.files)}
+	finish := func(err error) {
+		progress.Done = true
+		progress.Err = err
+		t.onProgress(progress)
+	}
+
+	for len(job.files) > 0 {
+		n := t.files
+		if n > len(job.files) {
+			n = len(job.files)
+		}
+		for _, name := range job.files[:n] {
+			if err := ds.deleteSegmentFile(name); err != nil {
+				finish(errors.Wrap(err, "delete segment file"))
+				return true
+			}
+			progress.Deleted++
+		}
+		job.files = job.files[n:]
+		t.onProgress(progress)
+
+		select {
+		case <-time.After(t.interval):
+		case <-t.stop:
+			return false
+		}
+	}
+
+	ds.mu.Lock()
+	err := ds.truncateFirst(job.offset)
+	ds.mu.Unlock()
+	finish(err)
+	return true
+}
@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// tombstone logically truncates the i-th segment at offset, by writing a
+// tombstone file alongside it. Data chunks in the segment at, or before,
+// offset are dropped when the segment is loaded. It must be called while
+// holding a write lock on ds.mu.
+func (ds *DirectorySink) tombstone(i int, offset Offset) error {
+	name := ds.metaPath(ds.segPaths[i] + ".TOMBSTONE")
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(offset.String()), 0666); err != nil {
+		return errors.Wrap(err, "write tombstone")
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "write tombstone")
+	}
+	ds.setTombstone(ds.segPaths[i], offset)
+	ds.segments[i][0] = offset + 1
+	return nil
+}
+
+func (ds *DirectorySink) setTombstone(name string, offset Offset) {
+	if ds.tombstones == nil {
+		ds.tombstones = make(map[string]Offset)
+	}
+	ds.tombstones[name] = offset
+}
+
+// readTombstone returns the offset the named segment was logically truncated
+// at. ok is false if the segment has no tombstone.
+func (ds *DirectorySink) readTombstone(name string) (offset Offset, ok bool, err error) {
+	p, err := os.ReadFile(ds.metaPath(name + ".TOMBSTONE"))
+	if err != nil && os.IsNotExist(err) {
+		return ZeroOffset, false, nil
+	} else if err != nil {
+		return ZeroOffset, false, errors.Wrap(err, "read tombstone")
+	}
+	n, err := strconv.ParseInt(string(bytes.TrimSpace(p)), 10, 64)
+	if err != nil {
+		return ZeroOffset, false, errors.Wrap(err, "parse tombstone")
+	}
+	return Offset(n), true, nil
+}
+
+// Compact physically rewrites any segments that have been logically
+// truncated (see the LogicalTruncation option), dropping the truncated data
+// chunks, and their tombstone files. It returns the number of segments
+// rewritten.
+//
+// If the sink was created with the ImmutableSegments option, Compact
+// returns ErrImmutable.
+func (ds *DirectorySink) Compact() (int, error) {
+	if ds.immutable {
+		return 0, ErrImmutable
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	var n int
+	for i := 0; i < len(ds.segPaths); i++ {
+		if _, ok := ds.tombstones[ds.segPaths[i]]; !ok {
+			continue
+		}
+		// The tombstone is applied as the segment is loaded, so there
+		// is nothing more to do to the segment itself.
+		before := len(ds.segPaths)
+		if err := ds.rewriteSegment(i, func(*Segment) {}); err != nil {
+			return n, errors.Wrap(err, "compact segment")
+		}
+		if len(ds.segPaths) < before {
+			i-- // The segment was empty, and has been removed.
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// VerifyReport describes the integrity of the files in a DirectorySink's
+// directory, as checked by its Verify method. It is intended to be encoded
+// as JSON, for collecting the results of integrity audits across many
+// hosts.
+type VerifyReport struct {
+	Dir      string          `json:"dir"`
+	OK       bool            `json:"ok"`                 // Whether no problems were found.
+	Segments []SegmentReport `json:"segments"`           // Each segment file, oldest first.
+	Problems []string        `json:"problems,omitempty"` // Problems spanning segment files, such as overlapping offsets.
+}
+
+// SegmentReport describes the integrity of a single segment file, as part
+// of a VerifyReport.
+type SegmentReport struct {
+	Name     string   `json:"name"`
+	Records  int      `json:"records"`
+	First    Offset   `json:"first"`
+	Last     Offset   `json:"last"`
+	Checksum string   `json:"checksum,omitempty"` // The hex-encoded checksum of the segment file's contents.
+	Problems []string `json:"problems,omitempty"` // Problems found in the segment file.
+}
+
+// Verify checks the integrity of every segment file in the sink's
+// directory, using up to workers goroutines at once. Unlike Analyze, which
+// stops at the first problem, Verify carries on, and reports every problem
+// it finds. It checks that:
+//
+//   - each segment file has a checksum file, and matches it;
+//   - every record in each segment file can be decoded;
+//   - offsets strictly increase, within, and across segment files, and
+//     match the segment file's name;
+//   - the segment list written by WriteSegmentList, if there is one,
+//     only lists segment files that exist.
+//
+// Verify does not need Analyze to have been called, and does not change
+// the sink's state. It returns an error if the directory cannot be read,
+// or ctx is done before every segment file has been checked.
+func (ds *DirectorySink) Verify(ctx context.Context, workers int) (*VerifyReport, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	names, chksums, err := ds.findFiles()
+	if err != nil {
+		return nil, errors.Wrap(err, "find files")
+	}
+
+	report := &VerifyReport{
+		Dir:      ds.dir,
+		Segments: make([]SegmentReport, len(names)),
+	}
+	var (
+		wg   sync.WaitGroup
+		work = make(chan int)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				report.Segments[i] = ds.verifySegmentFile(names[i], chksums[i])
+			}
+		}()
+	}
+dispatch:
+	for i := range names {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "verify")
+	}
+
+	for i := 1; i < len(report.Segments); i++ {
+		prev, seg := report.Segments[i-1], report.Segments[i]
+		if prev.Records > 0 && seg.Records > 0 && !seg.First.After(prev.Last) {
+			report.Problems = append(report.Problems,
+				"segment "+seg.Name+" overlaps segment "+prev.Name)
+		}
+	}
+	report.Problems = append(report.Problems, ds.verifySegmentList(names)...)
+
+	report.OK = len(report.Problems) == 0
+	for _, seg := range report.Segments {
+		report.OK = report.OK && len(seg.Problems) == 0
+	}
+	return report, nil
+}
+
+// verifySegmentFile checks the integrity of the named segment file, against
+// the named checksum file ("" if there is none).
+func (ds *DirectorySink) verifySegmentFile(name, chksum string) SegmentReport {
+	rep := SegmentReport{Name: name}
+	problem := func(err error) {
+		rep.Problems = append(rep.Problems, err.Error())
+	}
+
+	ds.limits.acquireFile()
+	defer ds.limits.releaseFile()
+	f, err := os.Open(filepath.Join(ds.dir, name))
+	if err != nil {
+		problem(errors.Wrap(err, "open segment file"))
+		return rep
+	}
+	defer f.Close()
+	info, records, err := InspectSegment(f)
+	rep.Records, rep.First, rep.Last = len(records), info.First, info.Last
+	if err != nil {
+		problem(err)
+	} else {
+		var sum [8]byte
+		binary.BigEndian.PutUint64(sum[:], info.Checksum)
+		rep.Checksum = hex.EncodeToString(sum[:])
+	}
+
+	if chksum == "" {
+		problem(errors.New("no checksum file"))
+	} else if want, err := ds.loadChecksum(ds.metaPath(chksum)); err != nil {
+		problem(err)
+	} else if rep.Checksum != "" && rep.Checksum != hex.EncodeToString(want) {
+		problem(errors.Errorf("checksum mismatch (want=%x got=%s)", want, rep.Checksum))
+	}
+
+	for i := 1; i < len(records); i++ {
+		if !records[i].Offset.After(records[i-1].Offset) {
+			problem(errors.Errorf("record %d: offset %v does not follow %v", i, records[i].Offset, records[i-1].Offset))
+		}
+	}
+	if start, end, err := parseSegFileName(name); err != nil {
+		problem(err)
+	} else if len(records) > 0 && (rep.First != start || rep.Last != end) {
+		problem(errors.Errorf("records span %v-%v, not %s", rep.First, rep.Last, name))
+	}
+	return rep
+}
+
+// verifySegmentList checks that every segment file in the segment list
+// written by WriteSegmentList, if there is one, is one of names.
+func (ds *DirectorySink) verifySegmentList(names []string) []string {
+	p, err := os.ReadFile(filepath.Join(ds.dir, SegmentListName))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return []string{errors.Wrap(err, "read segment list").Error()}
+	}
+	_, listed, _, err := parseSegmentList(p)
+	if err != nil {
+		return []string{errors.Wrap(err, "parse segment list").Error()}
+	}
+
+	exists := make(map[string]bool, len(names))
+	for _, name := range names {
+		exists[name] = true
+	}
+	var problems []string
+	for _, name := range listed {
+		if !exists[name] {
+			problems = append(problems, "segment list: segment "+name+" does not exist")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,501 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// SegmentListName is the name of the file listing the segment files in a
+// directory published for an HTTPSink (see DirectorySink's
+// PublishSegmentList method).
+const SegmentListName = "SEGMENTS"
+
+// ErrSegmentListTorn is returned when a segment list written by
+// PublishSegmentList does not match its header, such as when it was read
+// while it was being replaced by a writer that does not rename it into
+// place, or its download was cut short.
+var ErrSegmentListTorn = errors.New("wal: segment list torn")
+
+// segmentListMagic starts the header line of a segment list written by
+// PublishSegmentList.
+const segmentListMagic = "#yawal-segments"
+
+// segmentListRetryDelay is how long an HTTPSink waits before fetching a
+// torn segment list again.
+const segmentListRetryDelay = 100 * time.Millisecond
+
+// httpMaxAttempts is the number of times an HTTPSink requests a file,
+// resuming where the previous attempt left off, before giving up.
+const httpMaxAttempts = 3
+
+// HTTPSink is a read-only Sink that loads segments from a directory written
+// by a DirectorySink, and published on a static HTTP(S) server, or CDN, so
+// that an archived log can be replayed without first copying it, or so that
+// a log being written by one process can be read by others.
+//
+// As a static server cannot be relied upon to list a directory's contents,
+// the published directory must hold a segment list, named SegmentListName,
+// written by the DirectorySink's PublishSegmentList (or WriteSegmentList)
+// method. Each segment file is verified against its ".CHECKSUM" file as it
+// is loaded; segment files compressed with CompressBefore are decompressed.
+//
+// Calling Analyze again picks up a newer segment list. A list that is torn
+// is fetched again, and one with an older generation than the list already
+// loaded (such as a stale copy cached by a CDN) is ignored.
+//
+// Segment files are downloaded with range requests, so that a download that
+// is cut off part-way through is resumed, rather than restarted, provided
+// the server sends an ETag, or Last-Modified header.
+//
+// WriteSegment and Truncate return ErrNotSupported.
+type HTTPSink struct {
+	base   *url.URL
+	client *http.Client
+
+	mu       sync.RWMutex
+	segments [][2]Offset
+	segPaths []string
+	gen      uint64 // Generation of the segment list loaded.
+}
+
+// NewHTTPSink returns an *HTTPSink that loads segments from the directory
+// at baseURL, using client. If client is nil, http.DefaultClient is used.
+//
+// baseURL may also be a "file" URL, such as "file:///mnt/shared/wal/", for
+// reading a directory on shared storage, in which case the files are read
+// with http.NewFileTransport, unless a client is given.
+//
+// As with NewDirectorySink, call the returned sink's Analyze method to load
+// the segment list, before using it.
+func NewHTTPSink(baseURL string, client *http.Client) (*HTTPSink, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse base url")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" && base.Scheme != "file" {
+		return nil, errors.Errorf("unsupported url scheme %q", base.Scheme)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	if client == nil && base.Scheme == "file" {
+		client = &http.Client{Transport: http.NewFileTransport(http.Dir("/"))}
+	} else if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSink{
+		base:   base,
+		client: client,
+	}, nil
+}
+
+// Analyze implements the Analyzer interface, by loading the segment list.
+func (s *HTTPSink) Analyze() error {
+	var (
+		segments [][2]Offset
+		names    []string
+		gen      uint64
+	)
+	for attempt := 1; ; attempt++ {
+		p, err := s.fetch(context.Background(), SegmentListName)
+		if err != nil {
+			return errors.Wrap(err, "load segment list")
+		}
+		segments, names, gen, err = parseSegmentList(p)
+		if err == nil {
+			break
+		} else if !errors.Is(err, ErrSegmentListTorn) || attempt == httpMaxAttempts {
+			return errors.Wrap(err, "parse segment list")
+		}
+		time.Sleep(segmentListRetryDelay)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen < s.gen {
+		return nil
+	}
+	s.segments, s.segPaths, s.gen = segments, names, gen
+	return nil
+}
+
+// Generation returns the generation of the segment list loaded by Analyze,
+// as assigned by PublishSegmentList; it is zero for a list written by
+// WriteSegmentList.
+func (s *HTTPSink) Generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gen
+}
+
+// LoadSegment implements the SegmentLoader interface.
+func (s *HTTPSink) LoadSegment(offset Offset) (*Segment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.segPaths) == 0 {
+		return nil, io.EOF
+	}
+	if offset.Equal(ZeroOffset) {
+		return s.loadSegment(s.segPaths[0], s.segments[0][0])
+	}
+
+	// Offsets that fall between two segments load the newer of the two.
+	for i, offs := range s.segments {
+		if offset.Within(offs[0], offs[1]) || offset.Before(offs[0]) {
+			return s.loadSegment(s.segPaths[i], offs[0])
+		}
+	}
+	return nil, io.EOF
+}
+
+// loadSegment downloads, and verifies the named segment file. Any data
+// chunks before first, which have been truncated, are discarded.
+func (s *HTTPSink) loadSegment(name string, first Offset) (*Segment, error) {
+	ctx := context.Background()
+	src, err := s.fetch(ctx, name+".CHECKSUM")
+	if err != nil {
+		return nil, errors.Wrapf(err, "load checksum for segment %s", name)
+	}
+	want := make([]byte, hex.DecodedLen(len(src)))
+	if _, err := hex.Decode(want, src); err != nil {
+		return nil, errors.Wrapf(err, "decode checksum for segment %s", name)
+	}
+
+	p, err := s.fetch(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load segment %s", name)
+	}
+	r, err := decompress(bytes.NewReader(p))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load segment %s", name)
+	}
+	chksum := newSegmentChecksum()
+	seg := new(Segment)
+	if _, err := seg.ReadFrom(io.TeeReader(r, chksum)); err != nil {
+		return nil, errors.Wrapf(err, "load segment %s", name)
+	}
+	if got := chksum.Sum(nil); !bytes.Equal(got, want) {
+		return nil, errors.Errorf("segment %s: checksum mismatch (want=%x got=%x)", name, want, got)
+	}
+	seg.Truncate(first - 1)
+	return seg, nil
+}
+
+// fetch downloads the named file. If the response body is cut off, the
+// rest of the file is requested with a range request, conditional on the
+// file not having changed since.
+func (s *HTTPSink) fetch(ctx context.Context, name string) ([]byte, error) {
+	u := s.base.ResolveReference(&url.URL{Path: name})
+
+	var (
+		buf       bytes.Buffer
+		validator string // ETag, or Last-Modified header of the file.
+		err       error
+	)
+	for attempt := 0; attempt < httpMaxAttempts; attempt++ {
+		req, rerr := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if rerr != nil {
+			return nil, errors.Wrap(rerr, "new request")
+		}
+		// Ask for the file as-is, so that ranges are over the bytes
+		// stored on the server.
+		req.Header.Set("Accept-Encoding", "identity")
+		if buf.Len() > 0 {
+			if validator == "" {
+				// The file could have changed; start over.
+				buf.Reset()
+			} else {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", buf.Len()))
+				req.Header.Set("If-Range", validator)
+			}
+		}
+
+		var resp *http.Response
+		if resp, err = s.client.Do(req); err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.Wrap(err, "get")
+			}
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			// A full response; either this is the first attempt, or the
+			// file has changed since the last one.
+			buf.Reset()
+			validator = resp.Header.Get("ETag")
+			if validator == "" || strings.HasPrefix(validator, "W/") {
+				validator = resp.Header.Get("Last-Modified")
+			}
+
+		case http.StatusPartialContent:
+			var start int
+			if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != buf.Len() {
+				resp.Body.Close()
+				return nil, errors.Errorf("get %s: unexpected content range %q", u, resp.Header.Get("Content-Range"))
+			}
+
+		default:
+			resp.Body.Close()
+			return nil, errors.Errorf("get %s: %s", u, resp.Status)
+		}
+
+		_, err = io.Copy(&buf, resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, errors.Wrapf(err, "get %s: giving up after %d attempts", u, httpMaxAttempts)
+}
+
+// WriteSegment implements the SegmentWriter interface. It always returns
+// ErrNotSupported, as an HTTPSink is read-only.
+func (s *HTTPSink) WriteSegment(*Segment) error {
+	return ErrNotSupported
+}
+
+// Offsets implements the Sink interface.
+func (s *HTTPSink) Offsets() (first, last Offset) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.segments) == 0 {
+		return ZeroOffset, ZeroOffset
+	}
+	return s.segments[0][0], s.segments[len(s.segments)-1][1]
+}
+
+// NumSegments implements the Sink interface.
+func (s *HTTPSink) NumSegments() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.segments)
+}
+
+// Truncate implements the Sink interface. It always returns
+// ErrNotSupported, as an HTTPSink is read-only.
+func (s *HTTPSink) Truncate(Offset) error {
+	return ErrNotSupported
+}
+
+// Ping implements the HealthChecker interface, by requesting the segment
+// list.
+func (s *HTTPSink) Ping(ctx context.Context) error {
+	if _, err := s.fetch(ctx, SegmentListName); err != nil {
+		return errors.Wrap(err, "ping")
+	}
+	return nil
+}
+
+// Close implements the io.Closer interface. It does nothing.
+func (s *HTTPSink) Close() error {
+	return nil
+}
+
+// WriteSegmentList writes the list of segment files known to the sink to
+// w, for publishing the sink's directory for an HTTPSink. The list should
+// be written to a file named SegmentListName, in the sink's directory; use
+// PublishSegmentList to do so safely while other processes are reading it.
+//
+// Each line of the list holds the name of a segment file, followed by the
+// offset of its first data chunk that has not been truncated, and its
+// SegmentID, separated by spaces. Lists written before segment IDs were
+// assigned, without the third field, can still be read.
+func (ds *DirectorySink) WriteSegmentList(w io.Writer) error {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.writeSegmentList(w)
+}
+
+// writeSegmentList implements WriteSegmentList. It must be called while
+// holding ds.mu.
+func (ds *DirectorySink) writeSegmentList(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i, name := range ds.segPaths {
+		fmt.Fprintf(bw, "%s %s %s\n", name, ds.segments[i][0], ds.ids[name])
+	}
+	if err := bw.Flush(); err != nil {
+		return errors.Wrap(err, "write segment list")
+	}
+	return nil
+}
+
+// PublishSegmentList writes the list of segment files known to the sink
+// (see WriteSegmentList) to the file named SegmentListName, in the sink's
+// directory, so that the sink can be written by one process, while others
+// read it with an HTTPSink, or from shared storage, and returns the list's
+// generation.
+//
+// The list is written to a temporary file, synced, and renamed into place,
+// so a reader sees either the previous list, or the new one. Its first line
+// is a header holding its generation, one greater than that of the list it
+// replaces, along with its number of segments, and its CRC-32 (IEEE)
+// checksum:
+//
+//	#yawal-segments <generation> <segments> <checksum>
+//
+// so that a reader can tell a torn list (see ErrSegmentListTorn), which it
+// should read again, and a stale one, which it should ignore.
+//
+// The sink reads the generation of the existing list when it first
+// publishes one, and keeps track of it from then on. If the existing list's
+// header cannot be read, PublishSegmentList returns an error, rather than
+// start again from the first generation, whose lists readers would ignore.
+//
+// Publish the list after each write, or truncation, that readers should
+// see; readers must be able to load the segment files it lists, so segment
+// files removed by a truncation should not be deleted until readers have
+// loaded the list that replaces them (see LogicalTruncation).
+func (ds *DirectorySink) PublishSegmentList() (uint64, error) {
+	ds.listMu.Lock()
+	defer ds.listMu.Unlock()
+
+	// Hold ds.mu, so that GC cannot remove the temporary file.
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	path := filepath.Join(ds.dir, SegmentListName)
+	if ds.listGen == 0 {
+		gen, err := readSegmentListGen(path)
+		if err != nil {
+			return 0, err
+		}
+		ds.listGen = gen
+	}
+	gen := ds.listGen + 1
+
+	var body bytes.Buffer
+	if err := ds.writeSegmentList(&body); err != nil {
+		return 0, err
+	}
+	header := fmt.Sprintf("%s %d %d %08x\n", segmentListMagic, gen, bytes.Count(body.Bytes(), []byte("\n")), crc32.ChecksumIEEE(body.Bytes()))
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, errors.Wrap(err, "create segment list")
+	}
+	if _, err := io.WriteString(f, header); err == nil {
+		_, err = body.WriteTo(f)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "write segment list")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "sync segment list")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "close segment list")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "write segment list")
+	}
+	ds.listGen = gen
+	return gen, nil
+}
+
+// readSegmentListGen returns the generation of the segment list at path,
+// which is zero if there is none, or it was written by WriteSegmentList.
+// Readers ignore lists older than one they have loaded, so rather than
+// start again from zero, it returns an error if the list's header cannot
+// be read.
+func readSegmentListGen(path string) (uint64, error) {
+	p, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "read segment list")
+	}
+	if !bytes.HasPrefix(p, []byte("#")) {
+		return 0, nil
+	}
+	gen, _, _, _, ok := parseSegmentListHeader(p)
+	if !ok {
+		return 0, errors.Wrap(ErrSegmentListTorn, "read segment list generation")
+	}
+	return gen, nil
+}
+
+// parseSegmentListHeader parses the header line of a segment list written
+// by PublishSegmentList, and returns the rest of the list. ok is false if
+// p has no header.
+func parseSegmentListHeader(p []byte) (gen uint64, count int, sum uint32, body []byte, ok bool) {
+	if !bytes.HasPrefix(p, []byte(segmentListMagic+" ")) {
+		return 0, 0, 0, p, false
+	}
+	line, body, _ := bytes.Cut(p, []byte("\n"))
+	if _, err := fmt.Sscanf(string(line), segmentListMagic+" %d %d %x", &gen, &count, &sum); err != nil {
+		return 0, 0, 0, body, false
+	}
+	return gen, count, sum, body, true
+}
+
+// parseSegmentList parses a segment list written by PublishSegmentList, or
+// WriteSegmentList, and returns its generation, which is zero for a list
+// without a header. It returns ErrSegmentListTorn if the list does not
+// match its header.
+func parseSegmentList(p []byte) (segments [][2]Offset, names []string, gen uint64, err error) {
+	if bytes.HasPrefix(p, []byte("#")) {
+		g, count, sum, body, ok := parseSegmentListHeader(p)
+		if !ok || crc32.ChecksumIEEE(body) != sum || bytes.Count(body, []byte("\n")) != count {
+			return nil, nil, 0, ErrSegmentListTorn
+		}
+		p, gen = body, g
+	}
+	sc := bufio.NewScanner(bytes.NewReader(p))
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, nil, 0, errors.Errorf("line %d: malformed", n)
+		}
+		if len(fields) == 3 {
+			if _, err := parseSegmentID(fields[2]); err != nil {
+				return nil, nil, 0, errors.Wrapf(err, "line %d", n)
+			}
+		}
+		start, end, err := parseSegFileName(fields[0])
+		if err != nil {
+			return nil, nil, 0, errors.Wrapf(err, "line %d", n)
+		}
+		first, err := ParseOffset(fields[1])
+		if err != nil {
+			return nil, nil, 0, errors.Wrapf(err, "line %d", n)
+		}
+		if first.Before(start) || first.After(end) {
+			return nil, nil, 0, errors.Errorf("line %d: first offset %v is outside segment %s", n, first, fields[0])
+		}
+		if len(segments) > 0 && !start.After(segments[len(segments)-1][1]) {
+			return nil, nil, 0, errors.Errorf("line %d: segment %s is out of order", n, fields[0])
+		}
+		segments = append(segments, [2]Offset{first, end})
+		names = append(names, fields[0])
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, 0, err
+	}
+	return segments, names, gen, nil
+}
@@ -0,0 +1,227 @@
+package wal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestHTTPSink(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-http"
+	defer os.RemoveAll(tempdir)
+
+	ds, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ds.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12), Offset(i*10+13))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Truncate(12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CompressBefore(20); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(tempdir, SegmentListName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.WriteSegmentList(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut off the first response for each segment file part-way through,
+	// so that it has to be resumed.
+	var (
+		mu      sync.Mutex
+		cut     = make(map[string]bool)
+		resumed int
+	)
+	files := http.FileServer(http.Dir(tempdir))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Base(r.URL.Path)
+		mu.Lock()
+		first := !cut[name]
+		cut[name] = true
+		if r.Header.Get("Range") != "" {
+			resumed++
+		}
+		mu.Unlock()
+		if _, _, err := parseSegFileName(name); err != nil || !first || filepath.Ext(name) != "" {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		path := filepath.Join(tempdir, name)
+		p, err := os.ReadFile(path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(p)))
+		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		w.Write(p[:len(p)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	sink, err := NewHTTPSink(srv.URL+"/wal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.base.Path = "/"
+	if err := sink.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if first, last := sink.Offsets(); sink.NumSegments() != 3 || first != 13 || last != 33 {
+		t.Errorf("wrong segments: want=3 (13,33) got=%d (%v,%v)", sink.NumSegments(), first, last)
+	}
+
+	r := NewReader(sink)
+	var got []Offset
+	for r.Next() {
+		got = append(got, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Offset{13, 21, 22, 23, 31, 32, 33}
+	if len(got) != len(want) {
+		t.Fatalf("wrong offsets: want=%v got=%v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("wrong offsets: want=%v got=%v", want, got)
+		}
+	}
+	if resumed != 3 {
+		t.Errorf("wrong number of resumed downloads: want=3 got=%d", resumed)
+	}
+
+	if err := sink.WriteSegment(newSegmentOffsets(41)); err != ErrNotSupported {
+		t.Errorf("wrong error writing segment: want=%v got=%v", ErrNotSupported, err)
+	}
+}
+
+func TestPublishSegmentList(t *testing.T) {
+	tempdir := fmtTempDir("gca-wal") + "-publish"
+	defer os.RemoveAll(tempdir)
+
+	ds, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(want uint64) []byte {
+		t.Helper()
+		if gen, err := ds.PublishSegmentList(); err != nil {
+			t.Fatal(err)
+		} else if gen != want {
+			t.Fatalf("wrong generation: want=%d got=%d", want, gen)
+		}
+		p, err := os.ReadFile(filepath.Join(tempdir, SegmentListName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// A reader in another process, reading from shared storage.
+	reader, err := NewHTTPSink("file://"+tempdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stale []byte
+	for i := 0; i < 2; i++ {
+		if err := ds.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12))); err != nil {
+			t.Fatal(err)
+		}
+		if p := publish(uint64(i + 1)); i == 0 {
+			stale = p
+		}
+		if err := reader.Analyze(); err != nil {
+			t.Fatal(err)
+		}
+		if gen, n := reader.Generation(), reader.NumSegments(); gen != uint64(i+1) || n != i+1 {
+			t.Errorf("reader loaded generation %d, with %d segments; want %d, with %d", gen, n, i+1, i+1)
+		}
+	}
+
+	// A reader served a torn list tries again; one served a stale list
+	// keeps the newer one it has.
+	if err := ds.WriteSegment(newSegmentOffsets(31, 32)); err != nil {
+		t.Fatal(err)
+	}
+	current := publish(3)
+	var (
+		mu    sync.Mutex
+		serve [][]byte
+	)
+	files := http.FileServer(http.Dir(tempdir))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if filepath.Base(r.URL.Path) != SegmentListName || len(serve) == 0 {
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Write(serve[0])
+		serve = serve[1:]
+	}))
+	defer srv.Close()
+	reader, err = NewHTTPSink(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve = [][]byte{current[:len(current)-10], current}
+	if err := reader.Analyze(); err != nil {
+		t.Fatalf("torn list: %v", err)
+	}
+	serve = [][]byte{stale}
+	if err := reader.Analyze(); err != nil {
+		t.Fatalf("stale list: %v", err)
+	}
+	if gen, n := reader.Generation(), reader.NumSegments(); gen != 3 || n != 3 {
+		t.Errorf("reader loaded generation %d, with %d segments; want 3, with 3", gen, n)
+	}
+
+	serve = [][]byte{current[:10], current[:10], current[:10]}
+	if err := reader.Analyze(); !errors.Is(err, ErrSegmentListTorn) {
+		t.Errorf("want %v, got %v", ErrSegmentListTorn, err)
+	}
+
+	// The sink keeps track of the generation, even if the published list
+	// is damaged; a new sink will not start again from the first.
+	path := filepath.Join(tempdir, SegmentListName)
+	if err := os.WriteFile(path, current[:10], 0666); err != nil {
+		t.Fatal(err)
+	}
+	publish(4)
+	if err := os.WriteFile(path, current[:10], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err = NewDirectorySink(tempdir); err != nil {
+		t.Fatal(err)
+	}
+	if gen, err := ds.PublishSegmentList(); !errors.Is(err, ErrSegmentListTorn) {
+		t.Errorf("want %v, got generation %d, %v", ErrSegmentListTorn, gen, err)
+	}
+}
@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"context"
 	"io"
 	"sync"
 )
@@ -9,6 +10,8 @@ import (
 type MemorySink struct {
 	mu       sync.RWMutex
 	segments []*Segment
+	pins     pinSet
+	marks    map[string]Offset // Bookmarks; see SaveBookmark.
 }
 
 // NewMemorySink returns a Sink implementation that stores segments in memory.
@@ -26,6 +29,9 @@ func (s *MemorySink) LoadSegment(offset Offset) (*Segment, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	if len(s.segments) == 0 {
+		return nil, io.EOF
+	}
 	if offset.Equal(ZeroOffset) {
 		return s.segments[0], nil
 	}
@@ -39,6 +45,24 @@ func (s *MemorySink) LoadSegment(offset Offset) (*Segment, error) {
 	return nil, io.EOF
 }
 
+// LoadSegments implements the RangeLoader interface.
+func (s *MemorySink) LoadSegments(from, to Offset) ([]*Segment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var segs []*Segment
+	for _, seg := range s.segments {
+		a, b := seg.Limits()
+		if a.After(to) {
+			break
+		}
+		if !b.Before(from) {
+			segs = append(segs, seg)
+		}
+	}
+	return segs, nil
+}
+
 func (s *MemorySink) WriteSegment(seg *Segment) error {
 	first, last := seg.Limits()
 	if first.Equal(ZeroOffset) && last.Equal(ZeroOffset) {
@@ -54,6 +78,9 @@ func (s *MemorySink) WriteSegment(seg *Segment) error {
 func (s *MemorySink) Offsets() (first, last Offset) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	if len(s.segments) == 0 {
+		return ZeroOffset, ZeroOffset
+	}
 	first, _ = s.segments[0].Limits()
 	_, last = s.segments[len(s.segments)-1].Limits()
 	return first, last
@@ -66,6 +93,8 @@ func (s *MemorySink) NumSegments() int {
 }
 
 func (s *MemorySink) Truncate(offset Offset) error {
+	offset = s.pins.limit(offset)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -73,7 +102,7 @@ func (s *MemorySink) Truncate(offset Offset) error {
 	removed := 0
 	for _, seg := range s.segments {
 		_, end := seg.Limits()
-		if end.Before(offset) {
+		if !end.After(offset) {
 			removed++
 		} else {
 			break
@@ -83,14 +112,84 @@ func (s *MemorySink) Truncate(offset Offset) error {
 		s.segments = s.segments[removed:]
 	}
 
-	// See if we need to truncate the first segment.
-	if offset.Within(s.segments[0].Limits()) {
-		s.segments[0].Truncate(offset)
+	// See if we need to truncate the first segment. The segment may be
+	// in use by a Reader, so truncate a copy of it.
+	if len(s.segments) > 0 && offset.Within(s.segments[0].Limits()) {
+		seg := s.segments[0].clone()
+		seg.Truncate(offset)
+		s.segments[0] = seg
+	}
+
+	return nil
+}
+
+// TruncateAfter implements the TailTruncater interface.
+func (s *MemorySink) TruncateAfter(offset Offset) error {
+	if s.pins.pinnedAfter(offset) {
+		return ErrPinned
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Remove whole segments, newest first.
+	for len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		if start, _ := last.Limits(); !start.After(offset) {
+			break
+		}
+		s.segments = s.segments[:len(s.segments)-1]
+	}
+
+	// See if we need to truncate the last segment. As with Truncate, the
+	// segment may be in use by a Reader, so truncate a copy of it.
+	if n := len(s.segments); n > 0 {
+		if _, end := s.segments[n-1].Limits(); end.After(offset) {
+			seg := s.segments[n-1].clone()
+			seg.TruncateAfter(offset)
+			s.segments[n-1] = seg
+		}
 	}
+	return nil
+}
+
+// Pin implements the Pinner interface.
+func (s *MemorySink) Pin(first, last Offset) {
+	s.pins.pin(first, last)
+}
 
+// Unpin implements the Pinner interface.
+func (s *MemorySink) Unpin(first, last Offset) error {
+	if off, ok := s.pins.unpin(first, last); ok {
+		return s.Truncate(off)
+	}
 	return nil
 }
 
+// SaveBookmark implements the Bookmarker interface.
+func (s *MemorySink) SaveBookmark(name string, offset Offset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.marks == nil {
+		s.marks = make(map[string]Offset)
+	}
+	s.marks[name] = offset
+	return nil
+}
+
+// LoadBookmark implements the Bookmarker interface.
+func (s *MemorySink) LoadBookmark(name string) (Offset, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.marks[name], nil
+}
+
+// Ping implements the HealthChecker interface. A *MemorySink is always
+// healthy.
+func (s *MemorySink) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
 func (s *MemorySink) Close() error {
 	return nil
 }
@@ -2,6 +2,8 @@ package wal
 
 import (
 	"math/rand"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -165,3 +167,78 @@ func TestMemorySink(t *testing.T) {
 		t.Logf("removed=%d truncated=%d", removed, truncated)
 	})
 }
+
+func TestMemorySinkTruncateAfterLoaded(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(newSegmentOffsets(1, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A segment loaded before the sink is truncated must be left intact.
+	seg, err := sink.LoadSegment(ZeroOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.TruncateAfter(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, last := seg.Limits(); last != 3 {
+		t.Errorf("loaded segment was truncated: want last=%v got=%v", Offset(3), last)
+	}
+	if _, last := sink.Offsets(); last != 1 {
+		t.Errorf("wrong last offset: want=%v got=%v", Offset(1), last)
+	}
+}
+
+func TestLoadSegments(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempdir := fmtTempDir("gca-wal") + "-loadsegments"
+	defer os.RemoveAll(tempdir)
+	dir, err := NewDirectorySink(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sink := range []Sink{mem, dir} {
+		for i := 0; i < 4; i++ {
+			if err := sink.WriteSegment(newSegmentOffsets(Offset(i*10+11), Offset(i*10+12))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for name, sink := range map[string]Sink{
+		"memory":    mem,
+		"directory": dir,
+		"fallback":  struct{ Sink }{mem}, // Hides the RangeLoader implementation.
+	} {
+		for _, tt := range []struct {
+			from, to Offset
+			want     string
+		}{
+			{ZeroOffset, 100, "11,21,31,41"},
+			{12, 31, "11,21,31"},
+			{13, 20, ""},
+			{15, 25, "21"},
+			{50, 60, ""},
+		} {
+			segs, err := LoadSegments(sink, tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			var got []string
+			for _, seg := range segs {
+				first, _ := seg.Limits()
+				got = append(got, first.String())
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("%s: wrong segments from %v to %v: want=%s got=%v", name, tt.from, tt.to, tt.want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ShadowSink is a Sink that duplicates every write to a second, "shadow"
+// Sink, and compares segments loaded from the primary Sink against those in
+// the shadow Sink in the background.
+//
+// A ShadowSink is intended for validating a migration to a new Sink before
+// cutting over to it: the primary Sink remains the source of truth, and
+// errors from the shadow Sink are never returned to the caller. Instead,
+// they are counted, and can be retrieved with the Stats method.
+type ShadowSink struct {
+	primary      Sink
+	shadow       Sink
+	onDivergence func(Offset, error)
+	repair       bool // Copy divergent segments to the shadow Sink; see ReadRepair.
+
+	// writeMu is held while writing segments, so that a repair does not
+	// interleave with new segments.
+	writeMu sync.Mutex
+
+	compare chan Offset
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu    sync.Mutex
+	stats ShadowStats
+}
+
+// ShadowStats holds counters describing how a ShadowSink's shadow Sink has
+// behaved, compared to its primary Sink.
+type ShadowStats struct {
+	Writes       uint64 // Segments written to the shadow Sink.
+	WriteErrors  uint64 // Failed writes to, and truncations of, the shadow Sink.
+	Compared     uint64 // Segments compared between the Sinks.
+	Mismatches   uint64 // Compared segments that differed.
+	ReadErrors   uint64 // Segments that could not be loaded from the shadow Sink.
+	Skipped      uint64 // Segments that were not compared, because the comparison queue was full.
+	Repairs      uint64 // Divergent segments copied to the shadow Sink; see ReadRepair.
+	RepairErrors uint64 // Divergent segments that could not be copied to the shadow Sink.
+}
+
+// ShadowOption is a functional configuration type that can be used to
+// configure the behaviour of a *ShadowSink.
+type ShadowOption func(*ShadowSink) error
+
+// ReadRepair causes a *ShadowSink to repair its shadow Sink when a segment
+// loaded from the primary Sink is found to be missing from, corrupt in, or
+// different in, the shadow Sink, keeping the two converged without a
+// separate repair job.
+//
+// The repair is made in the background, after the divergence is reported:
+// the shadow Sink is truncated to just before the segment (see
+// TailTruncater), and the segment, along with every newer segment in the
+// primary Sink, is written to it again. The shadow Sink must implement
+// TailTruncater, or the repair fails, and is counted in the sink's
+// RepairErrors.
+func ReadRepair() ShadowOption {
+	return func(s *ShadowSink) error {
+		s.repair = true
+		return nil
+	}
+}
+
+// NewShadowSink returns a *ShadowSink that writes to primary, and shadow,
+// and reads from primary.
+//
+// onDivergence, if non-nil, is called from a background goroutine whenever
+// a segment loaded from primary cannot be loaded from, or does not match
+// the corresponding segment in, shadow.
+func NewShadowSink(primary, shadow Sink, onDivergence func(Offset, error), options ...ShadowOption) (*ShadowSink, error) {
+	if primary == nil || shadow == nil {
+		return nil, errors.New("nil sink")
+	}
+	if onDivergence == nil {
+		onDivergence = func(Offset, error) {}
+	}
+	s := &ShadowSink{
+		primary:      primary,
+		shadow:       shadow,
+		onDivergence: onDivergence,
+		compare:      make(chan Offset, 64),
+		done:         make(chan struct{}),
+	}
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, errors.Wrap(err, "applying option")
+		}
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Stats returns the current divergence counters.
+func (s *ShadowSink) Stats() ShadowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *ShadowSink) count(fn func(*ShadowStats)) {
+	s.mu.Lock()
+	fn(&s.stats)
+	s.mu.Unlock()
+}
+
+// Analyze implements the Analyzer interface, by analyzing both Sinks.
+func (s *ShadowSink) Analyze() error {
+	if err := s.primary.Analyze(); err != nil {
+		return err
+	}
+	if err := s.shadow.Analyze(); err != nil {
+		s.count(func(st *ShadowStats) { st.ReadErrors++ })
+	}
+	return nil
+}
+
+// LoadSegment implements the SegmentLoader interface, by loading the
+// segment from the primary Sink. The segment is queued for comparison with
+// the shadow Sink.
+func (s *ShadowSink) LoadSegment(offset Offset) (*Segment, error) {
+	seg, err := s.primary.LoadSegment(offset)
+	if err != nil {
+		return seg, err
+	}
+	select {
+	case s.compare <- offset:
+	default:
+		s.count(func(st *ShadowStats) { st.Skipped++ })
+	}
+	return seg, nil
+}
+
+// WriteSegment implements the SegmentWriter interface. The segment is
+// written to the primary Sink, and then to the shadow Sink.
+func (s *ShadowSink) WriteSegment(seg *Segment) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.primary.WriteSegment(seg); err != nil {
+		return err
+	}
+	err := s.shadow.WriteSegment(seg)
+	s.count(func(st *ShadowStats) {
+		st.Writes++
+		if err != nil {
+			st.WriteErrors++
+		}
+	})
+	return nil
+}
+
+// Offsets implements the Sink interface, by returning the primary Sink's
+// offsets.
+func (s *ShadowSink) Offsets() (first, last Offset) {
+	return s.primary.Offsets()
+}
+
+// NumSegments implements the Sink interface, by returning the number of
+// segments in the primary Sink.
+func (s *ShadowSink) NumSegments() int {
+	return s.primary.NumSegments()
+}
+
+// Truncate implements the Sink interface, by truncating both Sinks.
+func (s *ShadowSink) Truncate(offset Offset) error {
+	if err := s.primary.Truncate(offset); err != nil {
+		return err
+	}
+	if err := s.shadow.Truncate(offset); err != nil {
+		s.count(func(st *ShadowStats) { st.WriteErrors++ })
+	}
+	return nil
+}
+
+// TruncateAfter implements the TailTruncater interface, by truncating both
+// Sinks. It returns ErrNotSupported if the primary Sink does not implement
+// TailTruncater.
+func (s *ShadowSink) TruncateAfter(offset Offset) error {
+	if err := truncateAfter(s.primary, offset); err != nil {
+		return err
+	}
+	if err := truncateAfter(s.shadow, offset); err != nil {
+		s.count(func(st *ShadowStats) { st.WriteErrors++ })
+	}
+	return nil
+}
+
+// Ping implements the HealthChecker interface, by checking the primary
+// Sink, if it implements HealthChecker.
+func (s *ShadowSink) Ping(ctx context.Context) error {
+	if hc, ok := s.primary.(HealthChecker); ok {
+		return hc.Ping(ctx)
+	}
+	return ctx.Err()
+}
+
+// Close stops comparing segments, and closes both Sinks. Only an error from
+// closing the primary Sink is returned.
+func (s *ShadowSink) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	s.wg.Wait()
+
+	s.shadow.Close()
+	return s.primary.Close()
+}
+
+// run compares queued segments until the sink is closed.
+func (s *ShadowSink) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case off := <-s.compare:
+			s.compareSegment(off)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *ShadowSink) compareSegment(off Offset) {
+	want, err := encodeSegment(s.primary, off)
+	if err != nil {
+		// The segment may have been truncated since it was loaded.
+		return
+	}
+	got, err := encodeSegment(s.shadow, off)
+	if err != nil {
+		s.count(func(st *ShadowStats) { st.ReadErrors++ })
+		s.onDivergence(off, errors.Wrap(err, "load shadow segment"))
+		s.repairFrom(off)
+		return
+	}
+
+	equal := bytes.Equal(want, got)
+	s.count(func(st *ShadowStats) {
+		st.Compared++
+		if !equal {
+			st.Mismatches++
+		}
+	})
+	if !equal {
+		s.onDivergence(off, errors.New("shadow segment does not match primary segment"))
+		s.repairFrom(off)
+	}
+}
+
+// repairFrom copies the segment containing off, and every newer segment,
+// from the primary Sink to the shadow Sink, replacing whatever the shadow
+// Sink holds from the start of that segment on, if the sink was created
+// with the ReadRepair option.
+func (s *ShadowSink) repairFrom(off Offset) {
+	if !s.repair {
+		return
+	}
+	err := s.copyFrom(off)
+	s.count(func(st *ShadowStats) {
+		if err != nil {
+			st.RepairErrors++
+		} else {
+			st.Repairs++
+		}
+	})
+}
+
+func (s *ShadowSink) copyFrom(off Offset) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	seg, err := s.primary.LoadSegment(off)
+	if err != nil {
+		return errors.Wrap(err, "load primary segment")
+	}
+	first, _ := seg.Limits()
+	if err := truncateAfter(s.shadow, first-1); err != nil {
+		return errors.Wrap(err, "truncate shadow sink")
+	}
+	for {
+		if err := s.shadow.WriteSegment(seg); err != nil {
+			return errors.Wrap(err, "write shadow segment")
+		}
+		_, last := seg.Limits()
+		if seg, err = s.primary.LoadSegment(last + 1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "load primary segment")
+		}
+	}
+}
+
+// encodeSegment loads the segment containing off from loader, and returns
+// its encoded form.
+func encodeSegment(loader SegmentLoader, off Offset) ([]byte, error) {
+	seg, err := loader.LoadSegment(off)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := seg.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
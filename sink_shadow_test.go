@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShadowSink(t *testing.T) {
+	primary, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diverged := make(chan Offset, 1)
+	sink, err := NewShadowSink(primary, shadow, func(off Offset, err error) {
+		diverged <- off
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	write := func(s SegmentWriter, offsets ...Offset) {
+		if err := s.WriteSegment(newSegmentOffsets(offsets...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(sink, 1, 2, 3)
+	write(primary, 4, 5) // Only written to the primary sink.
+
+	if shadow.NumSegments() != 1 {
+		t.Fatalf("segment was not written to shadow sink")
+	}
+
+	for _, off := range []Offset{1, 4} {
+		if _, err := sink.LoadSegment(off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case off := <-diverged:
+		if off != 4 {
+			t.Errorf("wrong divergent offset: want=%v got=%v", 4, off)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("divergence was not reported")
+	}
+
+	// Wait for both comparisons to be counted.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		st := sink.Stats()
+		if st.Compared+st.ReadErrors == 2 {
+			if st.Compared != 1 || st.Mismatches != 0 || st.ReadErrors != 1 {
+				t.Errorf("unexpected stats: %+v", st)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("comparisons not counted: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShadowSinkReadRepair(t *testing.T) {
+	primary, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewShadowSink(primary, shadow, nil, ReadRepair())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	write := func(s SegmentWriter, offsets ...Offset) {
+		if err := s.WriteSegment(newSegmentOffsets(offsets...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(sink, 1, 2, 3)
+	write(primary, 4, 5) // Missing from the shadow sink.
+	write(sink, 6, 7)
+
+	if _, err := sink.LoadSegment(4); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		st := sink.Stats()
+		if st.Repairs+st.RepairErrors > 0 {
+			if st.Repairs != 1 || st.RepairErrors != 0 || st.Mismatches != 1 {
+				t.Errorf("unexpected stats: %+v", st)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("segment was not repaired: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The shadow sink now matches the primary sink.
+	if n := shadow.NumSegments(); n != 3 {
+		t.Errorf("wrong number of shadow segments: want=3 got=%d", n)
+	}
+	for _, off := range []Offset{1, 4, 6} {
+		want, err := encodeSegment(primary, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := encodeSegment(shadow, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("shadow segment at %v differs: want=%q got=%q", off, want, got)
+		}
+	}
+}
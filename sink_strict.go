@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"context"
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// OffsetOrderError is returned by a *StrictSink's WriteSegment method when
+// a segment's offsets do not all follow those already written. Use
+// errors.As to check for an *OffsetOrderError.
+type OffsetOrderError struct {
+	First, Last Offset // The offsets of the segment's oldest, and newest, data chunks.
+	Newest      Offset // The newest offset already written.
+}
+
+func (e *OffsetOrderError) Error() string {
+	return "wal: segment offsets " + e.First.String() + "-" + e.Last.String() +
+		" are not after the newest offset written, " + e.Newest.String()
+}
+
+// StrictSink is a Sink that wraps another, rejecting any segment whose
+// offsets do not all follow those already written to it, rather than
+// storing overlapping, or out-of-order, history; for example, when two
+// *Loggers are mistakenly configured to write to the same directory:
+//
+//	sink, err := wal.NewStrictSink(dirSink)
+//	...
+//	logger, err := wal.New(sink)
+//
+// Writes are serialized, so that two segments cannot both pass the check
+// at once. The newest offset written is remembered across Truncate, which
+// may remove every segment, but not across TruncateAfter, which deliberately
+// rolls back the log's newest data chunks; segments written after a call to
+// TruncateAfter must follow its offset.
+type StrictSink struct {
+	sink Sink
+
+	mu   sync.Mutex
+	last Offset // The newest offset written, or rolled back to.
+}
+
+// NewStrictSink returns a *StrictSink wrapping sink. Segments written must
+// follow the offsets sink already holds, including those it finds when it
+// is analyzed.
+func NewStrictSink(sink Sink) (*StrictSink, error) {
+	if sink == nil {
+		return nil, errors.New("nil sink")
+	}
+	_, last := sink.Offsets()
+	return &StrictSink{sink: sink, last: last}, nil
+}
+
+// check returns an *OffsetOrderError if seg's offsets do not all follow
+// those already written. It must be called while holding s.mu.
+func (s *StrictSink) check(seg *Segment) error {
+	first, last := seg.Limits()
+	newest := s.last
+	if _, l := s.sink.Offsets(); l.After(newest) {
+		newest = l
+	}
+	if !first.After(newest) {
+		return &OffsetOrderError{First: first, Last: last, Newest: newest}
+	}
+	return nil
+}
+
+// WriteSegment implements the SegmentWriter interface. It returns an
+// *OffsetOrderError, without writing seg, if seg's offsets do not all
+// follow those already written. Empty segments are passed on to the
+// underlying Sink.
+func (s *StrictSink) WriteSegment(seg *Segment) error {
+	return s.WriteSegmentContext(context.Background(), seg)
+}
+
+// WriteSegmentContext implements the ContextWriter interface, passing ctx
+// on to the underlying Sink, if it implements ContextWriter.
+func (s *StrictSink) WriteSegmentContext(ctx context.Context, seg *Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seg.Chunks() == 0 {
+		return s.write(ctx, seg)
+	}
+	if err := s.check(seg); err != nil {
+		return err
+	}
+	if err := s.write(ctx, seg); err != nil {
+		return err
+	}
+	_, s.last = seg.Limits()
+	return nil
+}
+
+// write writes seg to the underlying Sink.
+func (s *StrictSink) write(ctx context.Context, seg *Segment) error {
+	if cw, ok := s.sink.(ContextWriter); ok {
+		return cw.WriteSegmentContext(ctx, seg)
+	}
+	return s.sink.WriteSegment(seg)
+}
+
+// Analyze implements the Analyzer interface, by analyzing the underlying
+// Sink.
+func (s *StrictSink) Analyze() error {
+	return s.sink.Analyze()
+}
+
+// LoadSegment implements the SegmentLoader interface.
+func (s *StrictSink) LoadSegment(offset Offset) (*Segment, error) {
+	return s.sink.LoadSegment(offset)
+}
+
+// Offsets implements the Sink interface.
+func (s *StrictSink) Offsets() (first, last Offset) {
+	return s.sink.Offsets()
+}
+
+// NumSegments implements the Sink interface.
+func (s *StrictSink) NumSegments() int {
+	return s.sink.NumSegments()
+}
+
+// Truncate implements the Sink interface.
+func (s *StrictSink) Truncate(offset Offset) error {
+	return s.sink.Truncate(offset)
+}
+
+// TruncateAfter implements the TailTruncater interface. Segments written
+// afterwards must follow offset. It returns ErrNotSupported if the
+// underlying Sink does not implement TailTruncater.
+func (s *StrictSink) TruncateAfter(offset Offset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := truncateAfter(s.sink, offset); err != nil {
+		return err
+	}
+	if offset.Before(s.last) {
+		s.last = offset
+	}
+	return nil
+}
+
+// Ping implements the HealthChecker interface, by checking the underlying
+// Sink, if it implements HealthChecker.
+func (s *StrictSink) Ping(ctx context.Context) error {
+	if hc, ok := s.sink.(HealthChecker); ok {
+		return hc.Ping(ctx)
+	}
+	return ctx.Err()
+}
+
+// Close implements the io.Closer interface, by closing the underlying Sink.
+func (s *StrictSink) Close() error {
+	return s.sink.Close()
+}
@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"testing"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestStrictSink(t *testing.T) {
+	mem, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.WriteSegment(newSegmentOffsets(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewStrictSink(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.WriteSegment(newSegmentOffsets(3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	// Empty segments, as written by a Logger flushing while idle, are
+	// always accepted.
+	if err := sink.WriteSegment(NewSegment()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seg := range []*Segment{
+		newSegmentOffsets(4, 5), // Overlaps the newest segment.
+		newSegmentOffsets(0, 1), // Older than every segment.
+	} {
+		err := sink.WriteSegment(seg)
+		var oerr *OffsetOrderError
+		if !errors.As(err, &oerr) {
+			t.Fatalf("want an *OffsetOrderError, got %v", err)
+		}
+		if oerr.Newest != 4 {
+			t.Errorf("wrong newest offset: want=4 got=%v", oerr.Newest)
+		}
+	}
+	if n := mem.NumSegments(); n != 2 {
+		t.Errorf("rejected segments were written: %d segments", n)
+	}
+
+	// Truncating every segment does not allow older offsets to be
+	// written again...
+	if err := sink.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(newSegmentOffsets(4)); err == nil {
+		t.Error("segment written after truncation, at an old offset")
+	}
+
+	// ...but rolling back the tail of the log does.
+	if err := sink.TruncateAfter(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(newSegmentOffsets(3)); err != nil {
+		t.Errorf("write after TruncateAfter: %v", err)
+	}
+}
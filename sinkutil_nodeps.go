@@ -0,0 +1,32 @@
+//go:build yawal_nodeps
+
+package wal
+
+import (
+	"os"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// checkDirPerms checks to see if name exists, is a directory, and that we
+// have write permissions to it, by creating, and removing, a file in it,
+// since the standard library cannot check permissions directly.
+func checkDirPerms(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("%s is not a directory", name)
+	}
+
+	f, err := os.CreateTemp(name, ".yawalwrchk")
+	if err != nil {
+		return errors.Wrap(err, "check write permissions")
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return errors.Wrap(err, "check write permissions")
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build yawal_nodeps && !(linux || darwin || freebsd)
+
+package wal
+
+// diskFreeSupported reports whether diskFree can be used on this platform.
+// Without golang.org/x/sys, the free space on a filesystem can only be found
+// on platforms whose syscall package provides Statfs.
+const diskFreeSupported = false
+
+// diskFree returns ErrNotSupported.
+func diskFree(name string) (uint64, error) {
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,22 @@
+//go:build yawal_nodeps && (linux || darwin || freebsd)
+
+package wal
+
+import (
+	"syscall"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// diskFreeSupported reports whether diskFree can be used on this platform.
+const diskFreeSupported = true
+
+// diskFree returns the number of bytes available to an unprivileged user,
+// on the filesystem holding name.
+func diskFree(name string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(name, &st); err != nil {
+		return 0, errors.Wrap(err, "statfs")
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -1,11 +1,12 @@
-// +build !windows
+//go:build !windows && !yawal_nodeps
+// +build !windows,!yawal_nodeps
 
 package wal
 
 import (
 	"os"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
 	"golang.org/x/sys/unix"
 )
 
@@ -32,3 +33,16 @@ func checkDirPerms(name string) error {
 
 	return nil
 }
+
+// diskFreeSupported reports whether diskFree can be used on this platform.
+const diskFreeSupported = true
+
+// diskFree returns the number of bytes available to an unprivileged user,
+// on the filesystem holding name.
+func diskFree(name string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(name, &st); err != nil {
+		return 0, errors.Wrap(err, "statfs")
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
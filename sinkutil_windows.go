@@ -1,4 +1,5 @@
-// +build windows
+//go:build windows && !yawal_nodeps
+// +build windows,!yawal_nodeps
 
 package wal
 
@@ -6,7 +7,8 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/pkg/errors"
+	"go.nesv.ca/yawal/internal/errors"
+	"golang.org/x/sys/windows"
 )
 
 func checkDirPerms(name string) error {
@@ -21,9 +23,28 @@ func checkDirPerms(name string) error {
 
 	// Attempt to write a file, and remove it before returning.
 	testFile := filepath.Join(name, "yawalwrchk")
-	if err := os.Create(testFile); err != nil {
+	f, err := os.Create(testFile)
+	if err != nil {
 		return errors.Wrap(err, "no write perms?")
 	}
+	f.Close()
 	os.Remove(testFile)
 	return nil
 }
+
+// diskFreeSupported reports whether diskFree can be used on this platform.
+const diskFreeSupported = true
+
+// diskFree returns the number of bytes available to the current user, on
+// the volume holding name.
+func diskFree(name string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, errors.Wrap(err, "convert path")
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, errors.Wrap(err, "get disk free space")
+	}
+	return free, nil
+}
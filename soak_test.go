@@ -0,0 +1,245 @@
+//go:build soak
+
+package wal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// The soak test is opt-in, since it runs for minutes:
+//
+//	go test -tags=soak -run TestSoak -timeout 30m -soak.duration=10m
+var (
+	soakDuration = flag.Duration("soak.duration", 2*time.Minute, "How long to run the soak test for.")
+	soakCycle    = flag.Duration("soak.cycle", 5*time.Second, "How long to run between crashes.")
+	soakWriters  = flag.Int("soak.writers", 4, "Number of concurrent writers.")
+	soakReaders  = flag.Int("soak.readers", 2, "Number of concurrent readers.")
+)
+
+// soakState holds what the soak test knows about the records written to
+// the log, across crashes.
+type soakState struct {
+	mu        sync.Mutex
+	appended  map[Offset]string // Records appended, whether or not they were acknowledged.
+	acked     map[Offset]string // Records appended, and flushed, which must not be lost.
+	truncated Offset            // Records at, or before, this offset may have been truncated.
+	last      Offset            // Newest offset appended.
+	crashed   Offset            // Newest offset appended before the last crash.
+}
+
+// ack records that the given records, appended by a writer before it
+// flushed the log, have been acknowledged.
+func (st *soakState) ack(recs map[Offset]string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for off, data := range recs {
+		// Records may have been truncated while they were being
+		// flushed.
+		if off.After(st.truncated) {
+			st.acked[off] = data
+		}
+	}
+}
+
+// watermark returns an offset to truncate the log at, that leaves keep
+// acknowledged records after it, and records that records at, or before,
+// it may be lost. It returns false if there is nothing to truncate.
+func (st *soakState) watermark(keep int) (Offset, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.acked) <= keep {
+		return ZeroOffset, false
+	}
+	offs := make([]Offset, 0, len(st.acked))
+	for off := range st.acked {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i].Before(offs[j]) })
+	w := offs[len(offs)-keep-1]
+
+	// Mark the records as truncated before truncating them, so that the
+	// checks never expect them to be there.
+	st.truncated = w
+	for off := range st.acked {
+		if !off.After(w) {
+			delete(st.acked, off)
+		}
+	}
+	for off := range st.appended {
+		if !off.After(w) {
+			delete(st.appended, off)
+		}
+	}
+	return w, true
+}
+
+// check reads the whole of sink, and checks the soak test's invariants: no
+// acknowledged record is lost, or corrupted; no record is read twice, or
+// that was never written; and offsets only increase.
+func (st *soakState) check(sink Sink) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	seen := make(map[string]Offset)
+	var prev Offset
+	r := NewReader(sink)
+	for r.Next() {
+		off, data := r.Offset(), string(r.Data())
+		if !off.After(prev) {
+			return errors.Errorf("offset %v is not after %v", off, prev)
+		}
+		prev = off
+		if dup, ok := seen[data]; ok {
+			return errors.Errorf("record %q read at both %v, and %v", data, dup, off)
+		}
+		seen[data] = off
+		if !off.After(st.truncated) {
+			continue
+		}
+		want, ok := st.appended[off]
+		if !ok {
+			return errors.Errorf("record %q at %v was never appended", data, off)
+		} else if want != data {
+			return errors.Errorf("record at %v is corrupt: want=%q got=%q", off, want, data)
+		}
+	}
+	if err := r.Error(); err != nil {
+		return errors.Wrap(err, "read log")
+	}
+	for off, data := range st.acked {
+		if got, ok := seen[data]; !ok || got != off {
+			return errors.Errorf("acknowledged record %q at %v was lost", data, off)
+		}
+	}
+	return nil
+}
+
+// TestSoak runs writers, readers, and truncation against a DirectorySink,
+// crashing the *Logger (abandoning it without closing, or flushing, it), and
+// recovering the log from the directory every cycle, checking the soak
+// test's invariants as it goes.
+func TestSoak(t *testing.T) {
+	dir := fmtTempDir("gca-wal") + "-soak"
+	defer os.RemoveAll(dir)
+
+	st := &soakState{
+		appended: make(map[Offset]string),
+		acked:    make(map[Offset]string),
+	}
+	deadline := time.Now().Add(*soakDuration)
+	for cycle := 0; time.Now().Before(deadline); cycle++ {
+		sink, err := NewDirectorySink(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Analyze(); err != nil {
+			t.Fatalf("cycle %d: recover: %v", cycle, err)
+		}
+		if err := st.check(sink); err != nil {
+			t.Fatalf("cycle %d: after recovery: %v", cycle, err)
+		}
+		logger, err := New(sink, SegmentSize(4096))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runSoakCycle(cycle, logger, sink, st); err != nil {
+			t.Fatalf("cycle %d: %v", cycle, err)
+		}
+		t.Logf("cycle %d: %d segments, %d acknowledged records", cycle, sink.NumSegments(), len(st.acked))
+	}
+}
+
+// runSoakCycle runs the soak test's writers, readers, and truncation against
+// logger until the cycle ends, then abandons it.
+func runSoakCycle(cycle int, logger *Logger, sink Sink, st *soakState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *soakCycle)
+	defer cancel()
+	g := NewGroup(ctx)
+
+	for w := 0; w < *soakWriters; w++ {
+		w := w
+		g.Go(fmt.Sprintf("writer %d", w), func(ctx context.Context) error {
+			unacked := make(map[Offset]string)
+			for seq := 0; ctx.Err() == nil; seq++ {
+				data := fmt.Sprintf("c%d-w%d-%d", cycle, w, seq)
+				off, err := logger.Append([]byte(data))
+				if err != nil {
+					return errors.Wrap(err, "append")
+				}
+				st.mu.Lock()
+				if !off.After(st.crashed) {
+					st.mu.Unlock()
+					return errors.Errorf("offset %v is not after %v, from before the crash", off, st.crashed)
+				}
+				st.appended[off] = data
+				if off.After(st.last) {
+					st.last = off
+				}
+				st.mu.Unlock()
+				unacked[off] = data
+
+				if seq%50 == 49 {
+					if err := logger.Flush(); err != nil {
+						return errors.Wrap(err, "flush")
+					}
+					st.ack(unacked)
+					unacked = make(map[Offset]string)
+				}
+			}
+			return nil
+		})
+	}
+
+	for i := 0; i < *soakReaders; i++ {
+		g.Go(fmt.Sprintf("reader %d", i), func(ctx context.Context) error {
+			for ctx.Err() == nil {
+				var prev Offset
+				r := NewReader(sink)
+				for r.Next() {
+					if !r.Offset().After(prev) {
+						return errors.Errorf("offset %v is not after %v", r.Offset(), prev)
+					}
+					prev = r.Offset()
+				}
+				if err := r.Error(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	g.Go("truncate", func(ctx context.Context) error {
+		for ctx.Err() == nil {
+			time.Sleep(100 * time.Millisecond)
+			if w, ok := st.watermark(5000); ok {
+				if err := logger.Truncate(w); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	// The cycle ends when its context times out, or when any of the
+	// goroutines fails, which cancels the rest.
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// Crash: abandon the logger, without flushing it. Records that were
+	// never flushed may be lost; everything acknowledged must survive.
+	st.mu.Lock()
+	st.crashed = st.last
+	st.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,57 @@
+package wal
+
+import "time"
+
+// Stats holds a point-in-time summary of the state of a *Logger, as
+// returned by its Stats method.
+type Stats struct {
+	Segments int    // Segments held by the Sink.
+	First    Offset // Offset of the oldest data chunk in the Sink.
+	Last     Offset // Offset of the newest data chunk in the Sink.
+
+	ActiveChunks int    // Data chunks in the active segment.
+	ActiveSize   int64  // Bytes used in the active segment.
+	SegmentSize  uint64 // Maximum size of a segment, in bytes.
+	Pending      int    // Segments waiting to be written to the Sink.
+
+	Flushes     uint64    // Successful flushes.
+	FlushErrors uint64    // Failed flushes.
+	LastFlush   time.Time // When the *Logger was last flushed successfully.
+	LastError   error     // The error from the most-recent failed flush, if any.
+
+	Written      uint64 // Segments holding data chunks written to the Sink.
+	WrittenBytes int64  // Bytes of data chunks written to the Sink.
+
+	FinalizeErrors    uint64 // Errors returned by the segment finalize func; see OnSegmentFinalize.
+	LastFinalizeError error  // The most-recent of them, if any.
+
+	Closed bool
+}
+
+// Stats returns a summary of the *Logger's current state, for use in
+// monitoring, and debugging.
+func (l *Logger) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	active := l.seg.Stats()
+	st := Stats{
+		Segments:     l.sink.NumSegments(),
+		ActiveChunks: active.Chunks,
+		ActiveSize:   active.Size,
+		SegmentSize:  l.segSize,
+		Pending:      len(l.pending),
+		Flushes:      l.flushes,
+		FlushErrors:  l.flushErrors,
+		LastFlush:    l.lastFlush,
+		LastError:    l.lastErr,
+		Written:      l.written,
+		WrittenBytes: l.writtenBytes,
+		Closed:       l.closed,
+
+		FinalizeErrors:    l.finalizeErrs,
+		LastFinalizeError: l.lastFinalize,
+	}
+	st.First, st.Last = l.sink.Offsets()
+	return st
+}
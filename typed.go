@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Codec defines the interface of a type that can encode values of type T
+// into data chunks, and decode them again.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(p []byte) (T, error)
+}
+
+// JSONCodec is a Codec that encodes values with the encoding/json package.
+type JSONCodec[T any] struct{}
+
+// Encode implements the Codec interface.
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode implements the Codec interface.
+func (JSONCodec[T]) Decode(p []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(p, &v)
+	return v, err
+}
+
+// ErrCodecMismatch is passed to a MigrationCodec's OnMismatch function
+// when a value does not survive a round trip through the new codec.
+var ErrCodecMismatch = errors.New("wal: codec round trip mismatch")
+
+// MigrationCodec is a Codec for migrating a log from one encoding of T to
+// another. Values are encoded, and decoded, with New; as a safety net, each
+// encoded value is also decoded again, and both it and the original value
+// are re-encoded with Old, and compared. Any difference is reported to
+// OnMismatch, but does not fail the write.
+//
+// Once no mismatches are reported, MigrationCodec can be replaced with New.
+type MigrationCodec[T any] struct {
+	New, Old Codec[T]
+
+	// OnMismatch, if non-nil, is called with each value that does not
+	// survive the round trip, and an error wrapping ErrCodecMismatch (or
+	// the error returned by either codec).
+	OnMismatch func(v T, err error)
+}
+
+// Encode implements the Codec interface.
+func (c MigrationCodec[T]) Encode(v T) ([]byte, error) {
+	p, err := c.New.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.verify(v, p); err != nil && c.OnMismatch != nil {
+		c.OnMismatch(v, err)
+	}
+	return p, nil
+}
+
+// verify decodes p, which is v encoded with c.New, and checks that it
+// re-encodes with c.Old to the same bytes as v.
+func (c MigrationCodec[T]) verify(v T, p []byte) error {
+	got, err := c.New.Decode(p)
+	if err != nil {
+		return errors.Wrap(err, "decode with new codec")
+	}
+	want, err := c.Old.Encode(v)
+	if err != nil {
+		return errors.Wrap(err, "encode with old codec")
+	}
+	q, err := c.Old.Encode(got)
+	if err != nil {
+		return errors.Wrap(err, "re-encode with old codec")
+	}
+	if !bytes.Equal(q, want) {
+		return errors.Wrapf(ErrCodecMismatch, "want=%q got=%q", want, q)
+	}
+	return nil
+}
+
+// Decode implements the Codec interface.
+func (c MigrationCodec[T]) Decode(p []byte) (T, error) {
+	return c.New.Decode(p)
+}
+
+// Typed wraps a *Logger, so that values of type T can be written to, and
+// replayed from, a write-ahead log without handling raw []byte.
+//
+// Example:
+//
+//	type Event struct {
+//		Name string
+//	}
+//
+//	events := wal.NewTyped[Event](logger, wal.JSONCodec[Event]{})
+//	if _, err := events.Append(Event{Name: "created"}); err != nil {
+//		...
+//	}
+//
+type Typed[T any] struct {
+	logger  *Logger
+	codec   Codec[T]
+	schemas SchemaResolver[T]
+}
+
+// NewTyped returns a *Typed that writes values of type T to logger, using
+// codec to convert them to, and from, data chunks.
+func NewTyped[T any](logger *Logger, codec Codec[T]) *Typed[T] {
+	return &Typed[T]{
+		logger: logger,
+		codec:  codec,
+	}
+}
+
+// SchemaResolver defines the interface of a type that maps schema IDs to
+// the codecs used to encode, and decode, values of type T. It allows the
+// encoding of T to change over time, while still being able to replay
+// values written with older schemas.
+type SchemaResolver[T any] interface {
+	// Current returns the ID, and codec, of the schema new values are
+	// encoded with.
+	Current() (id uint32, codec Codec[T])
+
+	// Resolve returns the codec for the schema identified by id.
+	// Data chunks written without a schema ID are resolved with an id
+	// of 0.
+	Resolve(id uint32) (Codec[T], error)
+}
+
+// NewTypedSchema returns a *Typed that writes values of type T to logger.
+//
+// Each value is encoded with the current schema of schemas, and the
+// schema's ID is stored in the data chunk alongside the value. When
+// replaying, the stored ID is resolved back to a codec with schemas.
+func NewTypedSchema[T any](logger *Logger, schemas SchemaResolver[T]) *Typed[T] {
+	return &Typed[T]{
+		logger:  logger,
+		schemas: schemas,
+	}
+}
+
+// Append encodes v, and writes it to the underlying *Logger. It returns the
+// offset of the new data chunk.
+func (t *Typed[T]) Append(v T) (Offset, error) {
+	codec, attrs := t.codec, chunkAttrs(nil)
+	if t.schemas != nil {
+		var id uint32
+		id, codec = t.schemas.Current()
+		attrs = chunkAttrs{attrSchema: strconv.FormatUint(uint64(id), 10)}
+	}
+
+	p, err := codec.Encode(v)
+	if err != nil {
+		return ZeroOffset, errors.Wrap(err, "encode")
+	}
+	return t.logger.write(p, attrs)
+}
+
+// decoder returns the codec to decode the current data chunk of r with.
+func (t *Typed[T]) decoder(r *Reader) (Codec[T], error) {
+	if t.schemas == nil {
+		return t.codec, nil
+	}
+
+	var id uint64
+	if s, ok := r.attrs()[attrSchema]; ok {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse schema id")
+		}
+		id = n
+	}
+	codec, err := t.schemas.Resolve(uint32(id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve schema %d", id)
+	}
+	return codec, nil
+}
+
+// Replay calls fn with each decoded value, and its offset, in the order they
+// were written. Only values that have been written to the *Logger's Sink
+// are replayed; call the *Logger's Flush method beforehand to include the
+// active segment.
+//
+// Replay stops, and returns the error, if fn returns a non-nil error, or if
+// a data chunk cannot be decoded.
+func (t *Typed[T]) Replay(fn func(Offset, T) error) error {
+	return t.ReplayFrom(ZeroOffset, fn)
+}
+
+// ReplayFrom is like Replay, but starts at offset.
+func (t *Typed[T]) ReplayFrom(offset Offset, fn func(Offset, T) error) error {
+	r := t.logger.NewReaderOffset(offset)
+	for r.Next() {
+		codec, err := t.decoder(r)
+		if err != nil {
+			return errors.Wrapf(err, "chunk at offset %v", r.Offset())
+		}
+		v, err := codec.Decode(r.Data())
+		if err != nil {
+			return errors.Wrapf(err, "decode chunk at offset %v", r.Offset())
+		}
+		if err := fn(r.Offset(), v); err != nil {
+			return err
+		}
+	}
+	return r.Error()
+}
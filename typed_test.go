@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTyped(t *testing.T) {
+	type event struct {
+		Name string
+		N    int
+	}
+
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := NewTyped[event](logger, JSONCodec[event]{})
+
+	offsets := make([]Offset, 10)
+	for i := range offsets {
+		off, err := events.Append(event{Name: "test", N: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets[i] = off
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var i int
+	if err := events.Replay(func(off Offset, e event) error {
+		if off != offsets[i] {
+			t.Errorf("wrong offset: want=%v got=%v", offsets[i], off)
+		}
+		if e.N != i {
+			t.Errorf("wrong event: want=%d got=%d", i, e.N)
+		}
+		i++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(offsets) {
+		t.Errorf("wrong number of events: want=%d got=%d", len(offsets), i)
+	}
+}
+
+// upperCodec is a Codec for strings, that stores them upper-cased.
+type upperCodec struct{}
+
+func (upperCodec) Encode(v string) ([]byte, error) { return []byte(strings.ToUpper(v)), nil }
+func (upperCodec) Decode(p []byte) (string, error) { return strings.ToLower(string(p)), nil }
+
+// testSchemas is a SchemaResolver where schema 1 is JSON, and schema 2 is
+// upperCodec.
+type testSchemas struct {
+	current uint32
+}
+
+func (s *testSchemas) Current() (uint32, Codec[string]) {
+	c, _ := s.Resolve(s.current)
+	return s.current, c
+}
+
+func (s *testSchemas) Resolve(id uint32) (Codec[string], error) {
+	switch id {
+	case 1:
+		return JSONCodec[string]{}, nil
+	case 2:
+		return upperCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown schema %d", id)
+}
+
+func TestTypedSchema(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schemas := &testSchemas{current: 1}
+	words := NewTypedSchema[string](logger, schemas)
+	if _, err := words.Append("hello"); err != nil {
+		t.Fatal(err)
+	}
+	schemas.current = 2
+	if _, err := words.Append("world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	if err := words.Replay(func(_ Offset, s string) error {
+		got = append(got, s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hello", "world"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("want=%q got=%q", want, got)
+	}
+}
+
+func TestMigrationCodec(t *testing.T) {
+	var mismatched []string
+	codec := MigrationCodec[string]{
+		New: upperCodec{},
+		Old: JSONCodec[string]{},
+		OnMismatch: func(v string, err error) {
+			if !errors.Is(err, ErrCodecMismatch) {
+				t.Errorf("want %v, got %v", ErrCodecMismatch, err)
+			}
+			mismatched = append(mismatched, v)
+		},
+	}
+
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := NewTyped[string](logger, codec)
+
+	// upperCodec loses the case of mixed-case strings.
+	for _, v := range []string{"hello", "Hello", "wal", "WAL"} {
+		if _, err := values.Append(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"Hello", "WAL"}; fmt.Sprint(mismatched) != fmt.Sprint(want) {
+		t.Errorf("wrong mismatches: want=%q got=%q", want, mismatched)
+	}
+
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := values.Replay(func(_ Offset, v string) error {
+		got = append(got, v)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hello", "hello", "wal", "wal"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("wrong values: want=%q got=%q", want, got)
+	}
+}
@@ -0,0 +1,162 @@
+package wal
+
+import (
+	"io"
+	"sync"
+
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrReadOnly is returned when attempting to modify a read-only View.
+var ErrReadOnly = errors.New("wal: view is read-only")
+
+// View is an immutable, consistent view of a *Logger's log, as it was when
+// the View was created with the Logger's Snapshot method.
+//
+// Readers created from a View see every data chunk that had been written to
+// the *Logger at the time of the snapshot, including those that had not yet
+// been written to its Sink, and nothing written since. If the Sink
+// implements the Pinner interface, the data chunks in the View are
+// protected from truncation until the View is closed.
+type View struct {
+	sink   Sink
+	first  Offset     // Oldest offset in the sink, at the time of the snapshot.
+	last   Offset     // Newest offset in the sink, at the time of the snapshot.
+	mem    []*Segment // Copies of the segments not yet written to the sink.
+	nsegs  int        // Segments in the sink, at the time of the snapshot.
+	pinned bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Snapshot returns a View of the data chunks written to the *Logger so far.
+// Writes to the *Logger are blocked while the snapshot is taken. The View
+// must be closed, so that any data chunks it protects from truncation can
+// be removed.
+func (l *Logger) Snapshot() (*View, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrLoggerClosed
+	}
+
+	v := NewView(l.sink)
+	if err := l.closeBatch(); err != nil {
+		return nil, err
+	}
+	for _, seg := range l.pending {
+		v.mem = append(v.mem, seg.clone())
+	}
+	if l.seg.Chunks() > 0 {
+		v.mem = append(v.mem, l.seg.clone())
+	}
+	return v, nil
+}
+
+// NewView returns a read-only View of the data chunks in sink, for reading a
+// log without a *Logger; for example, one that New refuses to write to,
+// because it was created by a newer version of this package (see
+// FormatVersionError). If sink implements the Pinner interface, the data
+// chunks in the View are protected from truncation until it is closed.
+func NewView(sink Sink) *View {
+	v := &View{sink: sink}
+	if v.nsegs = sink.NumSegments(); v.nsegs > 0 {
+		v.first, v.last = sink.Offsets()
+		if p, ok := sink.(Pinner); ok {
+			p.Pin(v.first, v.last)
+			v.pinned = true
+		}
+	}
+	return v
+}
+
+// Offsets returns the offsets of the first (oldest), and last (newest) data
+// chunks in the View.
+func (v *View) Offsets() (first, last Offset) {
+	return v.oldest(), v.newest()
+}
+
+// NewReader returns a new *Reader that reads the data chunks in the View,
+// from the earliest-known offset.
+func (v *View) NewReader() *Reader {
+	return NewReader(viewSink{v})
+}
+
+// NewReaderOffset returns a new *Reader that reads the data chunks in the
+// View, starting at offset.
+func (v *View) NewReaderOffset(offset Offset) *Reader {
+	return NewReaderOffset(viewSink{v}, offset)
+}
+
+// Close releases the View, allowing the data chunks in it to be truncated.
+// Readers created from the View must not be used after it is closed.
+func (v *View) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	if v.pinned {
+		if err := v.sink.(Pinner).Unpin(v.first, v.last); err != nil {
+			return errors.Wrap(err, "unpin")
+		}
+	}
+	return nil
+}
+
+func (v *View) oldest() Offset {
+	if v.nsegs > 0 {
+		return v.first
+	}
+	if len(v.mem) > 0 {
+		first, _ := v.mem[0].Limits()
+		return first
+	}
+	return ZeroOffset
+}
+
+func (v *View) newest() Offset {
+	if n := len(v.mem); n > 0 {
+		_, last := v.mem[n-1].Limits()
+		return last
+	}
+	return v.last
+}
+
+// loadSegment loads the segment containing, or following, offset, without
+// returning anything written after the snapshot was taken.
+func (v *View) loadSegment(offset Offset) (*Segment, error) {
+	if v.nsegs > 0 && !offset.After(v.last) {
+		seg, err := v.sink.LoadSegment(offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == nil {
+			if start, _ := seg.Limits(); !start.After(v.last) {
+				return seg, nil
+			}
+		}
+	}
+	for _, seg := range v.mem {
+		if _, end := seg.Limits(); !offset.After(end) {
+			return seg, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// viewSink adapts a View to the Sink interface, so that it can be read with
+// a *Reader. Any attempt to modify it returns ErrReadOnly.
+type viewSink struct {
+	v *View
+}
+
+func (s viewSink) Analyze() error                              { return nil }
+func (s viewSink) LoadSegment(offset Offset) (*Segment, error) { return s.v.loadSegment(offset) }
+func (s viewSink) WriteSegment(*Segment) error                 { return ErrReadOnly }
+func (s viewSink) Offsets() (first, last Offset)               { return s.v.Offsets() }
+func (s viewSink) NumSegments() int                            { return s.v.nsegs + len(s.v.mem) }
+func (s viewSink) Truncate(Offset) error                       { return ErrReadOnly }
+func (s viewSink) Close() error                                { return nil }
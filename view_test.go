@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoggerSnapshot(t *testing.T) {
+	sink, err := NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []Offset
+	for i := 0; i < 3; i++ {
+		off, err := logger.Append([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, off)
+		if i == 1 {
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	view, err := logger.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes, and truncations, after the snapshot are not seen by the
+	// view.
+	after, err := logger.Append([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Truncate(want[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Offset
+	r := view.NewReader()
+	for r.Next() {
+		if string(r.Data()) != "before" {
+			t.Errorf("read unexpected data %q", r.Data())
+		}
+		got = append(got, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("wrong offsets in view: want=%v got=%v", want, got)
+	}
+	if first, last := view.Offsets(); first != want[0] || last != want[2] {
+		t.Errorf("wrong view offsets: want=%v,%v got=%v,%v", want[0], want[2], first, last)
+	}
+
+	// The truncation is carried out once the view is closed.
+	if first, _ := logger.Offsets(); first != want[0] {
+		t.Errorf("pinned data was truncated: first offset=%v", first)
+	}
+	if err := view.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := logger.Offsets(); first != after {
+		t.Errorf("wrong first offset after closing view: want=%v got=%v", after, first)
+	}
+}
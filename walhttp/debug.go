@@ -0,0 +1,174 @@
+// Package walhttp provides HTTP handlers for inspecting a write-ahead log
+// from within a running service.
+package walhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/walutil"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 1000
+)
+
+// stats is the JSON form of wal.Stats.
+type stats struct {
+	Segments     int        `json:"segments"`
+	First        wal.Offset `json:"first"`
+	Last         wal.Offset `json:"last"`
+	ActiveChunks int        `json:"active_chunks"`
+	ActiveSize   int64      `json:"active_size"`
+	SegmentSize  uint64     `json:"segment_size"`
+	Fill         float64    `json:"fill"` // ActiveSize / SegmentSize.
+	Pending      int        `json:"pending"`
+	Flushes      uint64     `json:"flushes"`
+	FlushErrors  uint64     `json:"flush_errors"`
+	LastFlush    *time.Time `json:"last_flush,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Closed       bool       `json:"closed"`
+}
+
+// records is the response to a request for a page of records.
+type records struct {
+	Records []walutil.JSONRecord `json:"records"`
+	Next    wal.Offset           `json:"next"` // Pass as "from" to get the next page.
+}
+
+// DebugHandler returns an http.Handler that serves information about
+// logger, as JSON. It is intended to be mounted under a path such as
+// /debug/wal:
+//
+//	http.Handle("/debug/wal/", walhttp.DebugHandler(logger))
+//
+// A request for any path ending in "/records" returns a page of records,
+// oldest first. The "limit" query parameter sets the number of records in
+// the page (default 20, at most 1000), and the "from" query parameter sets
+// the offset to start from; without it, the most-recent records are
+// returned. Any other path returns the logger's statistics (see
+// wal.Logger's Stats method).
+//
+// Records are only read from the logger's Sink; records in the active
+// segment are not shown until it has been flushed.
+func DebugHandler(logger *wal.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		var v interface{}
+		if strings.HasSuffix(r.URL.Path, "/records") {
+			page, err := readRecords(logger, r)
+			if _, ok := err.(errInvalid); ok {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			v = page
+		} else {
+			v = newStats(logger.Stats())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	})
+}
+
+func newStats(st wal.Stats) stats {
+	s := stats{
+		Segments:     st.Segments,
+		First:        st.First,
+		Last:         st.Last,
+		ActiveChunks: st.ActiveChunks,
+		ActiveSize:   st.ActiveSize,
+		SegmentSize:  st.SegmentSize,
+		Pending:      st.Pending,
+		Flushes:      st.Flushes,
+		FlushErrors:  st.FlushErrors,
+		Closed:       st.Closed,
+	}
+	if st.SegmentSize > 0 {
+		s.Fill = float64(st.ActiveSize) / float64(st.SegmentSize)
+	}
+	if !st.LastFlush.IsZero() {
+		s.LastFlush = &st.LastFlush
+	}
+	if st.LastError != nil {
+		s.LastError = st.LastError.Error()
+	}
+	return s
+}
+
+func readRecords(logger *wal.Logger, r *http.Request) (*records, error) {
+	q := r.URL.Query()
+	limit := defaultLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, errInvalid("limit")
+		}
+		if n > maxLimit {
+			n = maxLimit
+		}
+		limit = n
+	}
+
+	page := &records{Records: []walutil.JSONRecord{}}
+	add := func(rd *wal.Reader) {
+		page.Records = append(page.Records, walutil.JSONRecord{
+			Offset: rd.Offset(),
+			Time:   walutil.TimeOf(rd.Offset()).UTC(),
+			Data:   append([]byte(nil), rd.Data()...),
+			Meta:   rd.Attrs(),
+		})
+	}
+
+	var rd *wal.Reader
+	if s := q.Get("from"); s != "" {
+		from, err := wal.ParseOffset(s)
+		if err != nil {
+			return nil, errInvalid("from")
+		}
+		rd = logger.NewReaderOffset(from)
+		for len(page.Records) < limit && rd.Next() {
+			add(rd)
+		}
+	} else {
+		// Keep the most-recent records.
+		rd = logger.NewReader()
+		for rd.Next() {
+			if len(page.Records) == limit {
+				page.Records = page.Records[1:]
+			}
+			add(rd)
+		}
+	}
+	if err := rd.Error(); err != nil {
+		return nil, err
+	}
+
+	if n := len(page.Records); n > 0 {
+		page.Next = page.Records[n-1].Offset + 1
+	} else if from := q.Get("from"); from != "" {
+		page.Next, _ = wal.ParseOffset(from)
+	}
+	return page, nil
+}
+
+type errInvalid string
+
+func (e errInvalid) Error() string {
+	return "invalid " + string(e) + " parameter"
+}
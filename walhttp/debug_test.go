@@ -0,0 +1,93 @@
+package walhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestDebugHandler(t *testing.T) {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []wal.Offset
+	for i := 0; i < 5; i++ {
+		off, err := logger.Append([]byte("record " + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Append([]byte("active")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.StripPrefix("/debug/wal", DebugHandler(logger)))
+	defer srv.Close()
+
+	get := func(path string, v interface{}) int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/debug/wal" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var st stats
+	if code := get("/", &st); code != http.StatusOK {
+		t.Fatalf("wrong status: %d", code)
+	}
+	if st.Segments != 1 || st.First != offsets[0] || st.Last != offsets[4] {
+		t.Errorf("wrong stats: %+v", st)
+	}
+	if st.ActiveChunks != 1 || st.Flushes != 1 || st.LastFlush == nil || st.Fill <= 0 {
+		t.Errorf("wrong stats: %+v", st)
+	}
+
+	// The most-recent records.
+	var page records
+	if code := get("/records?limit=2", &page); code != http.StatusOK {
+		t.Fatalf("wrong status: %d", code)
+	}
+	if len(page.Records) != 2 || page.Records[0].Offset != offsets[3] || string(page.Records[1].Data) != "record 4" {
+		t.Errorf("wrong records: %+v", page.Records)
+	}
+
+	// Paging from the start of the log.
+	page = records{}
+	if code := get("/records?limit=3&from=0", &page); code != http.StatusOK {
+		t.Fatalf("wrong status: %d", code)
+	}
+	if len(page.Records) != 3 || page.Next != offsets[2]+1 {
+		t.Errorf("wrong first page: %+v", page)
+	}
+	next := page.Next
+	page = records{}
+	get("/records?limit=3&from="+next.String(), &page)
+	if len(page.Records) != 2 || page.Records[0].Offset != offsets[3] {
+		t.Errorf("wrong second page: %+v", page)
+	}
+
+	if code := get("/records?limit=x", nil); code != http.StatusBadRequest {
+		t.Errorf("wrong status for invalid limit: %d", code)
+	}
+}
@@ -0,0 +1,169 @@
+package waltest
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrInjected is the error returned by a *ChaosSink's methods when it
+// injects a failure.
+var ErrInjected = errors.New("waltest: injected sink error")
+
+// ChaosOptions configures the failures injected by a *ChaosSink. The zero
+// value injects nothing.
+type ChaosOptions struct {
+	// Latency is added to each call to the Sink's methods, along with up
+	// to Jitter more, chosen at random.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// The rates, between 0 and 1, at which calls to the Sink's methods
+	// fail with ErrInjected, rather than being passed to the wrapped
+	// Sink.
+	WriteErrorRate    float64 // WriteSegment.
+	LoadErrorRate     float64 // LoadSegment.
+	TruncateErrorRate float64 // Truncate, and TruncateAfter.
+
+	// Seed seeds the random numbers used to pick latencies and failures,
+	// so that a failing test can be reproduced.
+	Seed int64
+}
+
+// ChaosSink is a wal.Sink that wraps another, adding latency to, and
+// injecting errors into, calls to its methods; for example, to test how
+// an application handles a slow, or failing, disk, without writing a
+// custom Sink:
+//
+//	sink := waltest.NewChaosSink(memSink, waltest.ChaosOptions{
+//		Latency:        time.Millisecond,
+//		WriteErrorRate: 0.1,
+//	})
+//	logger, err := wal.New(sink)
+//
+// A failed call has no effect on the wrapped Sink.
+type ChaosSink struct {
+	sink wal.Sink
+	opts ChaosOptions
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	injected int
+}
+
+// NewChaosSink returns a *ChaosSink wrapping sink.
+func NewChaosSink(sink wal.Sink, opts ChaosOptions) *ChaosSink {
+	return &ChaosSink{
+		sink: sink,
+		opts: opts,
+		rand: rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// Injected returns the number of failures the sink has injected.
+func (s *ChaosSink) Injected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.injected
+}
+
+// chaos sleeps for the sink's latency, and returns ErrInjected with
+// probability rate.
+func (s *ChaosSink) chaos(rate float64) error {
+	s.mu.Lock()
+	delay := s.opts.Latency
+	if s.opts.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.opts.Jitter)))
+	}
+	fail := rate > 0 && s.rand.Float64() < rate
+	if fail {
+		s.injected++
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if fail {
+		return ErrInjected
+	}
+	return nil
+}
+
+// Analyze implements the wal.Analyzer interface.
+func (s *ChaosSink) Analyze() error {
+	if err := s.chaos(0); err != nil {
+		return err
+	}
+	return s.sink.Analyze()
+}
+
+// LoadSegment implements the wal.SegmentLoader interface.
+func (s *ChaosSink) LoadSegment(offset wal.Offset) (*wal.Segment, error) {
+	if err := s.chaos(s.opts.LoadErrorRate); err != nil {
+		return nil, err
+	}
+	return s.sink.LoadSegment(offset)
+}
+
+// WriteSegment implements the wal.SegmentWriter interface.
+func (s *ChaosSink) WriteSegment(seg *wal.Segment) error {
+	if err := s.chaos(s.opts.WriteErrorRate); err != nil {
+		return err
+	}
+	return s.sink.WriteSegment(seg)
+}
+
+// Offsets implements the wal.Sink interface.
+func (s *ChaosSink) Offsets() (first, last wal.Offset) {
+	return s.sink.Offsets()
+}
+
+// NumSegments implements the wal.Sink interface.
+func (s *ChaosSink) NumSegments() int {
+	return s.sink.NumSegments()
+}
+
+// Truncate implements the wal.Sink interface.
+func (s *ChaosSink) Truncate(offset wal.Offset) error {
+	if err := s.chaos(s.opts.TruncateErrorRate); err != nil {
+		return err
+	}
+	return s.sink.Truncate(offset)
+}
+
+// TruncateAfter implements the wal.TailTruncater interface. It returns
+// wal.ErrNotSupported if the wrapped Sink does not implement
+// wal.TailTruncater.
+func (s *ChaosSink) TruncateAfter(offset wal.Offset) error {
+	tt, ok := s.sink.(wal.TailTruncater)
+	if !ok {
+		return wal.ErrNotSupported
+	}
+	if err := s.chaos(s.opts.TruncateErrorRate); err != nil {
+		return err
+	}
+	return tt.TruncateAfter(offset)
+}
+
+// Ping implements the wal.HealthChecker interface. It fails with the
+// sink's write error rate, since a Sink that cannot store segments is not
+// healthy.
+func (s *ChaosSink) Ping(ctx context.Context) error {
+	if err := s.chaos(s.opts.WriteErrorRate); err != nil {
+		return err
+	}
+	if hc, ok := s.sink.(wal.HealthChecker); ok {
+		return hc.Ping(ctx)
+	}
+	return ctx.Err()
+}
+
+// Close implements the io.Closer interface, by closing the wrapped Sink.
+func (s *ChaosSink) Close() error {
+	return s.sink.Close()
+}
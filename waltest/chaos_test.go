@@ -0,0 +1,58 @@
+package waltest
+
+import (
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestChaosSink(t *testing.T) {
+	mem, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewChaosSink(mem, ChaosOptions{
+		Latency:        time.Millisecond,
+		WriteErrorRate: 0.5,
+		LoadErrorRate:  1,
+		Seed:           1,
+	})
+
+	start := time.Now()
+	var failed int
+	for i := 0; i < 50; i++ {
+		seg := wal.NewSegment()
+		if _, err := seg.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.WriteSegment(seg); errors.Is(err, ErrInjected) {
+			failed++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("latency was not added: 50 writes took %v", elapsed)
+	}
+	if failed == 0 || failed == 50 {
+		t.Errorf("wrong number of failed writes at a rate of 0.5: %d of 50", failed)
+	}
+	if n := mem.NumSegments(); n != 50-failed {
+		t.Errorf("failed writes reached the wrapped sink: want=%d got=%d segments", 50-failed, n)
+	}
+	if n := sink.Injected(); n != failed {
+		t.Errorf("wrong number of injected failures: want=%d got=%d", failed, n)
+	}
+
+	if _, err := sink.LoadSegment(wal.ZeroOffset); err != ErrInjected {
+		t.Errorf("want %v, got %v", ErrInjected, err)
+	}
+	if err := sink.TruncateAfter(wal.ZeroOffset); err != nil {
+		t.Errorf("truncate after: %v", err)
+	}
+	if n := mem.NumSegments(); n != 0 {
+		t.Errorf("wrong number of segments after truncation: want=0 got=%d", n)
+	}
+}
@@ -0,0 +1,95 @@
+// Package waltest provides helpers for testing applications that write to a
+// write-ahead log.
+package waltest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Update causes AssertGolden to write golden files, rather than compare
+// against them. Tests can set it from a flag:
+//
+//	func init() {
+//		flag.BoolVar(&waltest.Update, "update", false, "update golden files")
+//	}
+var Update bool
+
+// Record returns the data chunks in sink, oldest first, in a canonical form
+// that is the same every time a program writes the same data chunks, for
+// comparing with a "golden" file.
+//
+// Offsets depend on the clock, so each data chunk's offset is replaced with
+// its position in the log (starting at 1); and the data chunks are
+// recorded without regard to the segments they were written in. Each data
+// chunk is recorded on its own line, in the same form as a segment file:
+//
+//	<position>[;<key>=<value>...]:<data>
+//
+// where the data is base64-encoded, and attributes are sorted by key.
+// Attributes that cannot be reproduced, such as the ID of the key an
+// encrypted data chunk was encrypted with, are recorded as-is; record
+// encrypted logs with a *wal.Reader's Decrypt method (see RecordReader).
+//
+// Only segments written to sink are recorded; flush the *wal.Logger first.
+func Record(sink wal.Sink) ([]byte, error) {
+	return RecordReader(wal.NewReader(sink))
+}
+
+// RecordReader is like Record, but records the data chunks read by r.
+func RecordReader(r *wal.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := base64.RawStdEncoding
+	for n := 1; r.Next(); n++ {
+		buf.WriteString(strconv.Itoa(n))
+		attrs := r.Attrs()
+		keys := make([]string, 0, len(attrs))
+		for k := range attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteByte(';')
+			buf.WriteString(url.QueryEscape(k) + "=" + url.QueryEscape(attrs[k]))
+		}
+		buf.WriteByte(':')
+		buf.WriteString(enc.EncodeToString(r.Data()))
+		buf.WriteByte('\n')
+	}
+	if err := r.Error(); err != nil {
+		return nil, errors.Wrap(err, "record")
+	}
+	return buf.Bytes(), nil
+}
+
+// AssertGolden records the data chunks in sink (see Record), and fails t if
+// they differ from the contents of the golden file at path. If Update is
+// true, the golden file is written instead.
+func AssertGolden(t testing.TB, sink wal.Sink, path string) {
+	t.Helper()
+	got, err := Record(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Update {
+		if err := os.WriteFile(path, got, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("log does not match golden file %s:\nwant:\n%s\ngot:\n%s", path, want, got)
+	}
+}
@@ -0,0 +1,59 @@
+package waltest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestRecord(t *testing.T) {
+	write := func(segSize uint64) wal.Sink {
+		sink, err := wal.NewMemorySink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger, err := wal.New(sink, wal.SegmentSize(segSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"one", "two", "three"} {
+			if _, err := logger.Append([]byte(s)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := logger.AppendTTL([]byte("four"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return sink
+	}
+
+	// The same data chunks are recorded the same way, regardless of when,
+	// or in how many segments, they were written.
+	a, err := Record(write(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Record(write(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1:b25l\n2:dHdv\n3:dGhyZWU\n4;ttl=3600000000000:Zm91cg\n"
+	if string(a) != want {
+		t.Errorf("wrong recording:\nwant:\n%s\ngot:\n%s", want, a)
+	}
+	if string(b) != want {
+		t.Errorf("wrong recording with small segments:\nwant:\n%s\ngot:\n%s", want, b)
+	}
+
+	golden := filepath.Join(t.TempDir(), "log.golden")
+	if err := os.WriteFile(golden, []byte(want), 0666); err != nil {
+		t.Fatal(err)
+	}
+	AssertGolden(t, write(1024), golden)
+}
@@ -0,0 +1,282 @@
+package walutil
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Message is a data chunk delivered to a subscriber of a *Broker.
+type Message struct {
+	Offset wal.Offset
+	Data   []byte
+}
+
+// Broker provides in-process publish/subscribe on top of a *wal.Logger,
+// turning the write-ahead log into a lightweight, durable queue.
+//
+// Each subscriber has a name, and a cursor holding the offset of the last
+// message delivered to it. Cursors are persisted to files in a directory,
+// so a subscriber picks up where it left off when it subscribes again,
+// including after a restart.
+//
+//	broker, err := walutil.NewBroker(logger, "/var/lib/app/cursors", func(err error) {
+//		log.Println("broker:", err)
+//	})
+//	if err != nil {
+//		...
+//	}
+//	defer broker.Close()
+//
+//	msgs, err := broker.Subscribe("indexer")
+//	if err != nil {
+//		...
+//	}
+//	for msg := range msgs {
+//		...
+//	}
+//
+type Broker struct {
+	logger        *wal.Logger
+	dir           string
+	onError       func(error)
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	dirty  bool          // Messages have been published since the last flush.
+	notify chan struct{} // Closed, and replaced, when published messages are flushed.
+	subs   map[string]bool
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// ErrBrokerClosed is returned when calling methods on a *Broker after its
+// Close method has been called.
+var ErrBrokerClosed = errors.New("walutil: broker closed")
+
+// DefaultBrokerFlushInterval is how often a *Broker flushes its logger, by
+// default.
+const DefaultBrokerFlushInterval = 100 * time.Millisecond
+
+// BrokerOption configures a *Broker.
+type BrokerOption func(*Broker) error
+
+// BrokerFlushInterval sets how often a *Broker flushes its logger, making
+// published messages durable, and delivering them to subscribers. The
+// default is DefaultBrokerFlushInterval.
+//
+// Messages published between flushes are written to the same segment,
+// rather than one segment each; a longer interval writes fewer, larger
+// segments, at the cost of latency.
+func BrokerFlushInterval(d time.Duration) BrokerOption {
+	return func(b *Broker) error {
+		if d <= 0 {
+			return errors.New("flush interval must be positive")
+		}
+		b.flushInterval = d
+		return nil
+	}
+}
+
+// NewBroker returns a *Broker that publishes messages to logger, and
+// persists subscriber cursors to files in dir. If dir does not exist, it is
+// created.
+//
+// Errors encountered while delivering messages to subscribers, or flushing
+// the logger, are passed to onError, which may be nil.
+func NewBroker(logger *wal.Logger, dir string, onError func(error), options ...BrokerOption) (*Broker, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create cursor directory")
+	}
+	if onError == nil {
+		onError = func(error) {}
+	}
+	b := &Broker{
+		logger:        logger,
+		dir:           dir,
+		onError:       onError,
+		flushInterval: DefaultBrokerFlushInterval,
+		notify:        make(chan struct{}),
+		subs:          make(map[string]bool),
+		done:          make(chan struct{}),
+	}
+	for _, option := range options {
+		if err := option(b); err != nil {
+			return nil, errors.Wrap(err, "applying option")
+		}
+	}
+	b.wg.Add(1)
+	go b.flushEvery(b.flushInterval)
+	return b, nil
+}
+
+// Publish writes p to the *Broker's logger.
+//
+// The message is made durable, and delivered to subscribers, the next time
+// the *Broker flushes its logger (see BrokerFlushInterval); call Flush to
+// do so before then.
+func (b *Broker) Publish(p []byte) (wal.Offset, error) {
+	off, err := b.logger.Append(p)
+	if err != nil {
+		return wal.ZeroOffset, errors.Wrap(err, "publish")
+	}
+
+	b.mu.Lock()
+	b.dirty = true
+	b.mu.Unlock()
+	return off, nil
+}
+
+// Flush flushes the *Broker's logger, if any messages have been published
+// since it was last flushed, and notifies subscribers of them.
+func (b *Broker) Flush() error {
+	b.mu.Lock()
+	dirty := b.dirty
+	b.dirty = false
+	b.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	if err := b.logger.Flush(); err != nil {
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+		return errors.Wrap(err, "flush")
+	}
+
+	b.mu.Lock()
+	close(b.notify)
+	b.notify = make(chan struct{})
+	b.mu.Unlock()
+	return nil
+}
+
+// flushEvery calls Flush every interval, until the *Broker is closed.
+func (b *Broker) flushEvery(interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				b.onError(err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Subscribe returns a channel that receives every message published after
+// the subscriber's persisted cursor. A subscriber that has never subscribed
+// before receives every message in the log.
+//
+// A message is considered delivered, and the subscriber's cursor advanced,
+// once it has been received from the channel. The channel is closed when
+// the *Broker is closed.
+//
+// Only one subscription may be active for each name.
+func (b *Broker) Subscribe(name string) (<-chan Message, error) {
+	if !validCursorName(name) {
+		return nil, errors.Errorf("invalid subscriber name %q", name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	if b.subs[name] {
+		return nil, errors.Errorf("subscriber %q already subscribed", name)
+	}
+
+	cursor, err := loadCursor(b.cursorPath(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load cursor for %q", name)
+	}
+
+	ch := make(chan Message)
+	b.subs[name] = true
+	b.wg.Add(1)
+	go b.deliver(name, cursor, ch)
+	return ch, nil
+}
+
+func (b *Broker) cursorPath(name string) string {
+	return filepath.Join(b.dir, name+".cursor")
+}
+
+// wait returns a channel that will be closed when the next messages are
+// published, and flushed.
+func (b *Broker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.notify
+}
+
+// deliver sends messages after cursor to ch, until the *Broker is closed.
+func (b *Broker) deliver(name string, cursor wal.Offset, ch chan<- Message) {
+	defer b.wg.Done()
+	defer close(ch)
+
+	for {
+		// Grab the notification channel before reading, so a message
+		// published while reading is not missed.
+		wait := b.wait()
+
+		start := wal.ZeroOffset
+		if cursor != wal.ZeroOffset {
+			start = cursor + 1
+		}
+		r := b.logger.NewReaderOffset(start)
+		for r.Next() {
+			msg := Message{
+				Offset: r.Offset(),
+				Data:   append([]byte(nil), r.Data()...),
+			}
+			select {
+			case ch <- msg:
+			case <-b.done:
+				return
+			}
+
+			cursor = msg.Offset
+			if err := saveCursor(b.cursorPath(name), cursor); err != nil {
+				b.onError(errors.Wrapf(err, "save cursor for %q", name))
+			}
+		}
+		if err := r.Error(); err != nil {
+			b.onError(errors.Wrapf(err, "read messages for %q", name))
+		}
+
+		select {
+		case <-wait:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Close stops delivering messages to all subscribers, and closes their
+// channels, then flushes any messages published since the last flush. It
+// does not close the *Broker's logger.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return b.Flush()
+}
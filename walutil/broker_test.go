@@ -0,0 +1,115 @@
+package walutil
+
+import (
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func newTestLogger(t *testing.T) *wal.Logger {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+func receive(t *testing.T, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return Message{}
+}
+
+func TestBroker(t *testing.T) {
+	logger := newTestLogger(t)
+	dir := t.TempDir()
+
+	broker, err := NewBroker(logger, dir, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b"} {
+		if _, err := broker.Publish([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := broker.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b"} {
+		if got := string(receive(t, msgs).Data); got != want {
+			t.Errorf("want=%q got=%q", want, got)
+		}
+	}
+
+	// Messages published after subscribing are delivered.
+	if _, err := broker.Publish([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(receive(t, msgs).Data); got != "c" {
+		t.Errorf("want=%q got=%q", "c", got)
+	}
+	if err := broker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new broker resumes from the persisted cursor.
+	broker, err = NewBroker(logger, dir, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	if _, err := broker.Publish([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = broker.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(receive(t, msgs).Data); got != "d" {
+		t.Errorf("want=%q got=%q", "d", got)
+	}
+}
+
+func TestBrokerBatchesSegments(t *testing.T) {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker, err := NewBroker(logger, t.TempDir(), func(err error) { t.Error(err) }, BrokerFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := broker.Publish([]byte("message")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sink.NumSegments(); n != 0 {
+		t.Errorf("segments written before flush: %d", n)
+	}
+	if err := broker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sink.NumSegments(); n != 1 {
+		t.Errorf("wrong number of segments: want=1 got=%d", n)
+	}
+}
@@ -0,0 +1,107 @@
+package walutil
+
+import (
+	"context"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrSnapshotRequired is returned by CatchUp when a follower cannot catch
+// up by replaying the leader's log alone, and no Snapshot func was given.
+var ErrSnapshotRequired = errors.New("walutil: follower is behind the leader's log; snapshot required")
+
+// ErrSnapshotStale is returned by CatchUp when the snapshot installed by
+// opts.Snapshot is older than the oldest data chunk held by the leader, so
+// that the data chunks between the two cannot be applied.
+var ErrSnapshotStale = errors.New("walutil: snapshot is older than the leader's log")
+
+// CatchUpOptions configures CatchUp.
+type CatchUpOptions struct {
+	// Snapshot installs a compacted snapshot of the leader's state on
+	// the follower, such as one fetched from the leader, or from object
+	// storage, and returns the offset of the newest data chunk it covers.
+	// It must cover every data chunk up to, and including, the oldest held
+	// by the leader.
+	Snapshot func(ctx context.Context) (wal.Offset, error)
+
+	// Apply is called with each data chunk the follower has not yet
+	// applied, oldest first. If it returns an error, CatchUp stops, and
+	// returns it.
+	Apply func(off wal.Offset, data []byte) error
+
+	// Follow causes CatchUp to keep applying data chunks as they are
+	// written to the leader, checking every PollInterval (by default,
+	// every 250ms), until ctx is done.
+	Follow       bool
+	PollInterval time.Duration
+}
+
+// CatchUp brings a follower up to date with the log held by leader, such as
+// a *wal.HTTPSink reading a leader's segment files, and returns the offset
+// of the newest data chunk the follower has applied, which it should
+// persist (for example, with SaveCursor), and pass as from when it next
+// catches up.
+//
+// from is the offset of the newest data chunk the follower has already
+// applied, or wal.ZeroOffset for a new follower. A new follower, or one
+// whose position is older than the oldest data chunk held by leader (which
+// may have been truncated past it), first installs a snapshot with
+// opts.Snapshot, rather than replaying the entire log; if opts.Snapshot is
+// nil, CatchUp returns ErrSnapshotRequired for a follower that is behind
+// the leader's log, and replays the entire log for a new one. If the
+// snapshot is older than the oldest data chunk held by leader, CatchUp
+// returns ErrSnapshotStale, along with the snapshot's offset. Data chunks
+// after the follower's position are then passed to opts.Apply.
+//
+// A Sink does not record where it was truncated, so a follower whose
+// position is older than the leader's oldest data chunk is taken to be
+// behind, even if it applied every data chunk that was truncated.
+//
+// If the returned error is non-nil, the returned offset is still that of
+// the newest data chunk applied, so that the follower can resume from it.
+func CatchUp(ctx context.Context, leader wal.Sink, from wal.Offset, opts CatchUpOptions) (wal.Offset, error) {
+	if opts.Apply == nil {
+		return from, errors.New("nil apply func")
+	}
+
+	first, _ := leader.Offsets()
+	behind := !from.Equal(wal.ZeroOffset) && from.Before(first)
+	switch {
+	case opts.Snapshot != nil && (from.Equal(wal.ZeroOffset) || behind):
+		off, err := opts.Snapshot(ctx)
+		if err != nil {
+			return from, errors.Wrap(err, "snapshot")
+		}
+		from = off
+		if !off.Equal(wal.ZeroOffset) && off.Before(first) {
+			return from, ErrSnapshotStale
+		}
+	case behind:
+		return from, ErrSnapshotRequired
+	}
+
+	r := wal.NewReaderOffset(leader, from)
+	if opts.Follow {
+		interval := opts.PollInterval
+		if interval <= 0 {
+			interval = tailPollInterval
+		}
+		r.Follow(ctx, interval)
+	}
+	for r.Next() {
+		off := r.Offset()
+		if !off.After(from) {
+			continue
+		}
+		if err := opts.Apply(off, r.Data()); err != nil {
+			return from, errors.Wrapf(err, "apply %v", off)
+		}
+		from = off
+	}
+	if err := r.Error(); err != nil {
+		return from, errors.Wrap(err, "read leader")
+	}
+	return from, nil
+}
@@ -0,0 +1,121 @@
+package walutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestCatchUp(t *testing.T) {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offs []wal.Offset
+	appendRecord := func() {
+		off, err := logger.Append([]byte{byte('a' + len(offs))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, off)
+	}
+	for i := 0; i < 6; i++ {
+		appendRecord()
+	}
+	// The leader compacts the first three records into a snapshot.
+	if err := logger.Truncate(offs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot is the index of the newest record covered by the snapshot
+	// installed, or -1, for none.
+	catchUp := func(from wal.Offset, snapshot int) (string, wal.Offset, error) {
+		var (
+			applied string
+			opts    = CatchUpOptions{
+				Apply: func(off wal.Offset, data []byte) error {
+					applied += string(data)
+					return nil
+				},
+			}
+		)
+		if snapshot >= 0 {
+			opts.Snapshot = func(ctx context.Context) (wal.Offset, error) {
+				applied += "[" + "abcdef"[:snapshot+1] + "]"
+				return offs[snapshot], nil
+			}
+		}
+		last, err := CatchUp(context.Background(), sink, from, opts)
+		return applied, last, err
+	}
+
+	for _, tt := range []struct {
+		name     string
+		from     wal.Offset
+		snapshot int
+		want     string
+		err      error
+	}{
+		{"new", wal.ZeroOffset, 3, "[abcd]ef", nil},
+		{"behind", offs[0], 3, "[abcd]ef", nil},
+		{"behind without snapshot", offs[0], -1, "", ErrSnapshotRequired},
+		{"stale snapshot", offs[0], 1, "[ab]", ErrSnapshotStale},
+		{"current", offs[4], 3, "f", nil},
+	} {
+		applied, last, err := catchUp(tt.from, tt.snapshot)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: want error %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if tt.err == ErrSnapshotStale && last != offs[tt.snapshot] {
+			t.Errorf("%s: want the snapshot's offset %v, got %v", tt.name, offs[tt.snapshot], last)
+		}
+		if applied != tt.want {
+			t.Errorf("%s: want %q applied, got %q", tt.name, tt.want, applied)
+		}
+		if want := offs[5]; err == nil && last != want {
+			t.Errorf("%s: want last offset %v, got %v", tt.name, want, last)
+		}
+	}
+
+	// A following follower applies records as they are written.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan wal.Offset, 1)
+	done := make(chan error, 1)
+	from := offs[5]
+	go func() {
+		_, err := CatchUp(ctx, sink, from, CatchUpOptions{
+			Apply: func(off wal.Offset, data []byte) error {
+				applied <- off
+				return nil
+			},
+			Follow:       true,
+			PollInterval: time.Millisecond,
+		})
+		done <- err
+	}()
+	appendRecord()
+	select {
+	case off := <-applied:
+		if off != offs[6] {
+			t.Errorf("follower applied %v, want %v", off, offs[6])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower did not apply the new record")
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("follow: want %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,33 @@
+package walutil
+
+import (
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// CompressOlderThan compresses the segments in sink whose data chunks are
+// all older than age, and returns the number of segments compressed.
+// Compressing cold segments shrinks the log's history, while the segments
+// still being written to, and read from, stay uncompressed.
+//
+// sink must implement the wal.Compressor interface (as a *wal.DirectorySink
+// does); otherwise, wal.ErrNotSupported is returned.
+func CompressOlderThan(sink wal.Sink, age time.Duration) (int, error) {
+	return compressBefore(sink, wal.NewOffsetTime(time.Now().Add(-age)))
+}
+
+// compressBefore compresses the segments in sink whose data chunks are all
+// older than cutoff.
+func compressBefore(sink wal.Sink, cutoff wal.Offset) (int, error) {
+	c, ok := sink.(wal.Compressor)
+	if !ok {
+		return 0, wal.ErrNotSupported
+	}
+	n, err := c.CompressBefore(cutoff)
+	if err != nil {
+		return n, errors.Wrap(err, "compress older than")
+	}
+	return n, nil
+}
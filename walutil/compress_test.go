@@ -0,0 +1,76 @@
+package walutil
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestCompressOlderThan(t *testing.T) {
+	sink, err := wal.NewDirectorySink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []wal.Offset
+	for i := 0; i < 4; i++ {
+		off, err := logger.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// None of the segments are an hour old.
+	if n, err := CompressOlderThan(sink, time.Hour); err != nil || n != 0 {
+		t.Errorf("recent segments compressed: n=%d err=%v", n, err)
+	}
+
+	// Use a fixed cutoff, rather than an age, so that the result does not
+	// depend on how long the test takes to run.
+	n, err := compressBefore(sink, offsets[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("wrong number of segments compressed: want=3 got=%d", n)
+	}
+	if n, err := compressBefore(sink, offsets[3]); err != nil || n != 0 {
+		t.Errorf("segments compressed twice: n=%d err=%v", n, err)
+	}
+
+	// Compressed segments still pass verification, and read back as they
+	// were written.
+	if err := sink.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	r := wal.NewReader(sink)
+	var i int
+	for ; r.Next(); i++ {
+		if want := fmt.Sprintf("record %d", i); string(r.Data()) != want {
+			t.Errorf("wrong data: want=%q got=%q", want, r.Data())
+		}
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if i != 4 {
+		t.Errorf("wrong number of records: want=4 got=%d", i)
+	}
+
+	mem, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompressOlderThan(mem, 0); err != wal.ErrNotSupported {
+		t.Errorf("wrong error: want=%v got=%v", wal.ErrNotSupported, err)
+	}
+}
@@ -0,0 +1,140 @@
+package walutil
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrCursorCorrupt is returned by LoadCursor when a cursor file's checksum
+// does not match its contents.
+var ErrCursorCorrupt = errors.New("walutil: cursor file corrupt")
+
+// Cursor is a consumer's position in a log, as persisted by SaveCursor.
+type Cursor struct {
+	// Offset is the offset of the last data chunk the consumer
+	// processed.
+	Offset wal.Offset
+
+	// Generation is incremented each time the cursor is saved, so that
+	// a consumer can tell when another consumer has saved the cursor
+	// since it was loaded.
+	Generation uint64
+}
+
+// LoadCursor reads a cursor from the file name, written by SaveCursor. If
+// the file does not exist, the zero Cursor is returned.
+//
+// A cursor file holds the cursor's offset, its generation, and a CRC-32
+// checksum of the two, on a single line:
+//
+//	<offset> <generation> <checksum>
+//
+// Files holding only an offset are read with a generation of zero. If the
+// checksum does not match, LoadCursor returns ErrCursorCorrupt.
+func LoadCursor(name string) (Cursor, error) {
+	p, err := os.ReadFile(name)
+	if err != nil && os.IsNotExist(err) {
+		return Cursor{}, nil
+	} else if err != nil {
+		return Cursor{}, errors.Wrap(err, "read cursor")
+	}
+
+	fields := strings.Fields(string(p))
+	switch len(fields) {
+	case 1:
+		offset, err := wal.ParseOffset(fields[0])
+		if err != nil {
+			return Cursor{}, ErrCursorCorrupt
+		}
+		return Cursor{Offset: offset}, nil
+
+	case 3:
+		body := fields[0] + " " + fields[1]
+		if fields[2] != cursorChecksum(body) {
+			return Cursor{}, ErrCursorCorrupt
+		}
+		offset, err := wal.ParseOffset(fields[0])
+		if err != nil {
+			return Cursor{}, ErrCursorCorrupt
+		}
+		gen, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return Cursor{}, ErrCursorCorrupt
+		}
+		return Cursor{Offset: offset, Generation: gen}, nil
+	}
+	return Cursor{}, ErrCursorCorrupt
+}
+
+// SaveCursor atomically writes offset to the cursor file name, by writing it
+// to a temporary file in the same directory, syncing it, and renaming it
+// over the original; a crash leaves either the previous cursor, or the new
+// one, in place. The cursor's generation is one greater than that of the
+// cursor being replaced (or one, if there was none, or it was corrupt).
+// SaveCursor returns the saved cursor.
+func SaveCursor(name string, offset wal.Offset) (Cursor, error) {
+	prev, err := LoadCursor(name)
+	if err != nil && err != ErrCursorCorrupt {
+		return Cursor{}, err
+	}
+	c := Cursor{Offset: offset, Generation: prev.Generation + 1}
+
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return Cursor{}, errors.Wrap(err, "create temporary cursor file")
+	}
+	defer os.Remove(f.Name())
+
+	body := fmt.Sprintf("%s %d", c.Offset, c.Generation)
+	if _, err := f.WriteString(body + " " + cursorChecksum(body) + "\n"); err != nil {
+		f.Close()
+		return Cursor{}, errors.Wrap(err, "write cursor")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return Cursor{}, errors.Wrap(err, "sync cursor")
+	}
+	if err := f.Close(); err != nil {
+		return Cursor{}, errors.Wrap(err, "close cursor")
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return Cursor{}, errors.Wrap(err, "rename cursor")
+	}
+	return c, nil
+}
+
+// cursorChecksum returns the hex-encoded CRC-32 (IEEE) checksum of body.
+func cursorChecksum(body string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body)))
+}
+
+// loadCursor reads an offset from the file name. If the file does not
+// exist, wal.ZeroOffset is returned.
+func loadCursor(name string) (wal.Offset, error) {
+	c, err := LoadCursor(name)
+	if err != nil {
+		return wal.ZeroOffset, err
+	}
+	return c.Offset, nil
+}
+
+// saveCursor atomically writes offset to the file name (see SaveCursor).
+func saveCursor(name string, offset wal.Offset) error {
+	_, err := SaveCursor(name, offset)
+	return err
+}
+
+// validCursorName reports whether name can be used as the name of a
+// persisted cursor.
+func validCursorName(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,60 @@
+package walutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestCursor(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "consumer")
+
+	c, err := LoadCursor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != (Cursor{}) {
+		t.Errorf("wrong cursor before saving: %+v", c)
+	}
+
+	for i, off := range []wal.Offset{10, 20} {
+		saved, err := SaveCursor(name, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Cursor{Offset: off, Generation: uint64(i + 1)}
+		if saved != want {
+			t.Errorf("wrong saved cursor: want=%+v got=%+v", want, saved)
+		}
+		if c, err = LoadCursor(name); err != nil {
+			t.Fatal(err)
+		} else if c != want {
+			t.Errorf("wrong loaded cursor: want=%+v got=%+v", want, c)
+		}
+	}
+
+	// A cursor file holding only an offset is still read.
+	if err := os.WriteFile(name, []byte("30\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := LoadCursor(name); err != nil {
+		t.Fatal(err)
+	} else if c != (Cursor{Offset: 30}) {
+		t.Errorf("wrong cursor from offset-only file: %+v", c)
+	}
+
+	// A cursor file whose contents do not match its checksum is corrupt.
+	if err := os.WriteFile(name, []byte("40 3 00000000\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCursor(name); err != ErrCursorCorrupt {
+		t.Errorf("want %v, got %v", ErrCursorCorrupt, err)
+	}
+	if c, err := SaveCursor(name, 50); err != nil {
+		t.Fatal(err)
+	} else if c != (Cursor{Offset: 50, Generation: 1}) {
+		t.Errorf("wrong cursor saved over a corrupt one: %+v", c)
+	}
+}
@@ -0,0 +1,65 @@
+package walutil
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// DiffReport describes the differences between two logs, as returned by
+// Diff. Each list of offsets is oldest first.
+type DiffReport struct {
+	Compared   int          // Number of offsets found in both logs.
+	Missing    []wal.Offset // Offsets of data chunks in the first log, but not the second.
+	Extra      []wal.Offset // Offsets of data chunks in the second log, but not the first.
+	Mismatched []wal.Offset // Offsets of data chunks in both logs, with different data.
+}
+
+// Equal reports whether the two logs hold the same data chunks.
+func (d DiffReport) Equal() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mismatched) == 0
+}
+
+func (d DiffReport) String() string {
+	return fmt.Sprintf("compared=%d missing=%d extra=%d mismatched=%d", d.Compared, len(d.Missing), len(d.Extra), len(d.Mismatched))
+}
+
+// Diff compares the data chunks in a, and b, by offset, and by a hash of
+// their data, and reports those that are missing from b, those that b holds
+// in addition to a, and those whose data differs; for example, to check
+// that a replica, or a migrated copy, of a log matches the original.
+//
+// Both logs are read once, oldest first, in step with one another, so Diff
+// does not hold either log in memory.
+func Diff(a, b wal.Sink) (DiffReport, error) {
+	var d DiffReport
+	ra, rb := wal.NewReader(a), wal.NewReader(b)
+	okA, okB := ra.Next(), rb.Next()
+	for okA || okB {
+		switch {
+		case okA && (!okB || ra.Offset().Before(rb.Offset())):
+			d.Missing = append(d.Missing, ra.Offset())
+			okA = ra.Next()
+
+		case okB && (!okA || rb.Offset().Before(ra.Offset())):
+			d.Extra = append(d.Extra, rb.Offset())
+			okB = rb.Next()
+
+		default:
+			d.Compared++
+			if sha256.Sum256(ra.Data()) != sha256.Sum256(rb.Data()) {
+				d.Mismatched = append(d.Mismatched, ra.Offset())
+			}
+			okA, okB = ra.Next(), rb.Next()
+		}
+	}
+	if err := ra.Error(); err != nil {
+		return d, errors.Wrap(err, "read first log")
+	}
+	if err := rb.Error(); err != nil {
+		return d, errors.Wrap(err, "read second log")
+	}
+	return d, nil
+}
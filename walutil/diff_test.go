@@ -0,0 +1,59 @@
+package walutil
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	wal "go.nesv.ca/yawal"
+)
+
+// newDiffSink returns a sink holding a single segment, with a data chunk at
+// each of the given offsets, holding the corresponding data.
+func newDiffSink(t *testing.T, offsets []int, data string) *wal.MemorySink {
+	t.Helper()
+	var text strings.Builder
+	for i, off := range offsets {
+		fmt.Fprintf(&text, "%d:%s\n", off, base64.RawStdEncoding.EncodeToString([]byte{data[i]}))
+	}
+	seg := wal.NewSegment()
+	if _, err := seg.ReadFrom(strings.NewReader(text.String())); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteSegment(seg); err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestDiff(t *testing.T) {
+	a := newDiffSink(t, []int{1, 2, 3, 5, 6}, "abcef")
+	b := newDiffSink(t, []int{2, 3, 4, 5, 7}, "bCdef")
+
+	d, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Equal() {
+		t.Error("logs reported equal")
+	}
+	want := DiffReport{
+		Compared:   3,
+		Missing:    []wal.Offset{1, 6},
+		Extra:      []wal.Offset{4, 7},
+		Mismatched: []wal.Offset{3},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("wrong report: want=%+v got=%+v", want, d)
+	}
+
+	if d, err := Diff(a, a); err != nil || !d.Equal() || d.Compared != 5 {
+		t.Errorf("log differs from itself: %v (%v)", d, err)
+	}
+}
@@ -1,8 +1,11 @@
 package walutil
 
 import (
+	"context"
 	"time"
 
+	"go.nesv.ca/yawal/internal/errors"
+
 	wal "go.nesv.ca/yawal"
 )
 
@@ -12,7 +15,10 @@ import (
 //
 // If the non-nil error returned from logger.Flush() is wal.ErrLoggerClosed,
 // this function will exit. It is recommended to call this function in its own
-// goroutine.
+// goroutine; since it cannot be stopped, it cannot be run in a *wal.Group.
+//
+// FlushUntilClosed, which can be stopped, and flushes logger a final time
+// when it is, is preferred in new code.
 //
 //	logger, err := wal.NewLogger(NewDirectorySink("/tmp/wal.d"))
 //	if err != nil {
@@ -40,3 +46,105 @@ func FlushInterval(logger *wal.Logger, d time.Duration, onError func(error)) {
 		<-timer.C
 	}
 }
+
+// FlushIntervalMin is like FlushInterval, but only flushes logger once its
+// active segment holds at least minChunks data chunks. This stops a quiet
+// logger from filling its Sink with segments holding a single data chunk,
+// while a busy logger is still flushed every d.
+//
+// Data chunks written to a quiet logger are not flushed until minChunks
+// have been written, the active segment fills up, or logger is closed, so
+// minChunks should be chosen with care.
+func FlushIntervalMin(logger *wal.Logger, d time.Duration, minChunks int, onError func(error)) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for range ticker.C {
+		st := logger.Stats()
+		if st.Closed {
+			return
+		}
+		if st.ActiveChunks < minChunks {
+			continue
+		}
+		if err := logger.Flush(); err == wal.ErrLoggerClosed {
+			return
+		} else if err != nil {
+			onError(err)
+		}
+	}
+}
+
+// FlushOptions configures FlushUntilClosed.
+type FlushOptions struct {
+	// Interval is how often the *wal.Logger is flushed. It must be
+	// positive.
+	Interval time.Duration
+
+	// OnError, if non-nil, is called with the error from each failed
+	// periodic flush.
+	OnError func(error)
+
+	// OnFlush, if non-nil, is called after each flush, including the
+	// final one, with how long it took, and its error, if any; for
+	// example, to record flush latencies and failures as metrics.
+	OnFlush func(took time.Duration, err error)
+}
+
+// FlushUntilClosed flushes logger every opts.Interval, until ctx is done, or
+// logger is closed, covering both periodic durability and a clean shutdown:
+// once ctx is done, logger is flushed a final time, and FlushUntilClosed
+// returns that flush's error (nil if it succeeded, or logger had already
+// been closed). If logger is closed first, FlushUntilClosed returns nil.
+//
+// Run FlushUntilClosed in a *wal.Group, whose Close method stops it, and
+// waits for the final flush, before closing logger:
+//
+//	g := wal.NewGroup(ctx)
+//	g.Own(logger)
+//	g.Go("flush", func(ctx context.Context) error {
+//		return walutil.FlushUntilClosed(ctx, logger, walutil.FlushOptions{
+//			Interval: 10 * time.Second,
+//			OnError: func(err error) {
+//				log.Println("error flushing wal:", err)
+//			},
+//		})
+//	})
+//	...
+//	if err := g.Close(); err != nil {
+//		log.Println("wal shutdown:", err)
+//	}
+func FlushUntilClosed(ctx context.Context, logger *wal.Logger, opts FlushOptions) error {
+	if opts.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	flush := func() error {
+		start := time.Now()
+		err := logger.Flush()
+		if err == wal.ErrLoggerClosed {
+			return err
+		}
+		if opts.OnFlush != nil {
+			opts.OnFlush(time.Since(start), err)
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := flush(); err != nil && err != wal.ErrLoggerClosed {
+				return errors.Wrap(err, "final flush")
+			}
+			return nil
+		case <-ticker.C:
+			if err := flush(); err == wal.ErrLoggerClosed {
+				return nil
+			} else if err != nil && opts.OnError != nil {
+				opts.OnError(err)
+			}
+		}
+	}
+}
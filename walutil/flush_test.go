@@ -0,0 +1,84 @@
+package walutil
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlushIntervalMin(t *testing.T) {
+	logger := newTestLogger(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		FlushIntervalMin(logger, 5*time.Millisecond, 2, func(err error) {
+			t.Error(err)
+		})
+	}()
+
+	if _, err := logger.Append([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := logger.Stats().Segments; n != 0 {
+		t.Fatalf("flushed before minimum number of chunks written: %d segments", n)
+	}
+
+	if _, err := logger.Append([]byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for logger.Stats().Segments == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("not flushed after minimum number of chunks written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("FlushIntervalMin did not return after logger was closed")
+	}
+}
+
+func TestFlushUntilClosed(t *testing.T) {
+	logger := newTestLogger(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var flushes int
+	done := make(chan error, 1)
+	go func() {
+		done <- FlushUntilClosed(ctx, logger, FlushOptions{
+			Interval: time.Hour,
+			OnFlush: func(_ time.Duration, err error) {
+				if err != nil {
+					t.Error(err)
+				}
+				flushes++
+			},
+		})
+	}()
+
+	if _, err := logger.Append([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := logger.Stats().Segments; n != 1 || flushes != 1 {
+		t.Errorf("not flushed on cancellation: %d segments, %d flushes", n, flushes)
+	}
+
+	// A closed logger stops the flushes.
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err := FlushUntilClosed(context.Background(), logger, FlushOptions{Interval: time.Millisecond})
+	if err != nil {
+		t.Errorf("want nil error once logger is closed, got %v", err)
+	}
+}
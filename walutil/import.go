@@ -0,0 +1,117 @@
+package walutil
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ImportLines writes each record read from r, split from one another by
+// split, to logger, and returns the number of records written; for example,
+// to migrate an existing log file into a write-ahead log. A nil split
+// reads newline-delimited records (see bufio.ScanLines); ScanLengthPrefixed
+// reads length-prefixed ones. Empty records are skipped.
+//
+// If offsetFn is nil, the records are given offsets by logger, as they are
+// written, and logger is flushed once they have all been written.
+// Otherwise, offsetFn is called with each record to synthesize its offset,
+// such as from a timestamp in the record; the offsets must increase from
+// one record to the next, and be newer than any already written to logger.
+// The records are written to logger's Sink in segments of
+// wal.DefaultSegmentSize bytes, with logger's ImportSegment method.
+//
+// If an error occurs part-way through, the records already written are
+// kept, and the number of them is returned along with the error.
+func ImportLines(r io.Reader, logger *wal.Logger, split bufio.SplitFunc, offsetFn func(rec []byte) (wal.Offset, error)) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, int(wal.DefaultSegmentSize))
+	if split != nil {
+		sc.Split(split)
+	}
+
+	if offsetFn == nil {
+		var n int
+		for sc.Scan() {
+			if len(sc.Bytes()) == 0 {
+				continue
+			}
+			if _, err := logger.Append(sc.Bytes()); err != nil {
+				return n, errors.Wrapf(err, "record %d", n+1)
+			}
+			n++
+		}
+		if err := sc.Err(); err != nil {
+			return n, errors.Wrap(err, "read records")
+		}
+		if err := logger.Flush(); err != nil {
+			return n, err
+		}
+		return n, nil
+	}
+
+	// Records are counted once the segment holding them is written.
+	var n, built int
+	b := wal.NewSegmentBuilder(wal.DefaultSegmentSize)
+	write := func() error {
+		seg, _, err := b.Finish()
+		if err != nil {
+			return err
+		}
+		if err := logger.ImportSegment(seg); err != nil {
+			return err
+		}
+		n, built = n+built, 0
+		return nil
+	}
+	for sc.Scan() {
+		rec := sc.Bytes()
+		if len(rec) == 0 {
+			continue
+		}
+		off, err := offsetFn(rec)
+		if err != nil {
+			return n, errors.Wrapf(err, "record %d: offset", n+built+1)
+		}
+		err = b.Append(off, rec, nil)
+		if errors.Is(err, wal.ErrNotEnoughSpace) && b.Chunks() > 0 {
+			if err := write(); err != nil {
+				return n, errors.Wrap(err, "write records")
+			}
+			err = b.Append(off, rec, nil)
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "record %d", n+built+1)
+		}
+		built++
+	}
+	if err := sc.Err(); err != nil {
+		return n, errors.Wrap(err, "read records")
+	}
+	if err := write(); err != nil {
+		return n, errors.Wrap(err, "write records")
+	}
+	return n, nil
+}
+
+// ScanLengthPrefixed is a bufio.SplitFunc, for ImportLines, that reads
+// records each prefixed with their length, in bytes, as a 4-byte, big-endian,
+// unsigned integer.
+func ScanLengthPrefixed(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) < 4 {
+		if atEOF && len(data) > 0 {
+			return 0, nil, errors.New("truncated record length")
+		}
+		return 0, nil, nil
+	}
+	n := int(binary.BigEndian.Uint32(data))
+	if len(data) < 4+n {
+		if atEOF {
+			return 0, nil, errors.New("truncated record")
+		}
+		return 0, nil, nil
+	}
+	return 4 + n, data[4 : 4+n], nil
+}
@@ -0,0 +1,89 @@
+package walutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func readAll(t *testing.T, logger *wal.Logger) []string {
+	t.Helper()
+	r := logger.NewReader()
+	var got []string
+	for r.Next() {
+		got = append(got, string(r.Data()))
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestImportLines(t *testing.T) {
+	logger := newTestLogger(t)
+	defer logger.Close()
+	n, err := ImportLines(strings.NewReader("one\ntwo\n\nthree\n"), logger, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("wrong number of records: want=3 got=%d", n)
+	}
+	if got, want := fmt.Sprint(readAll(t, logger)), "[one two three]"; got != want {
+		t.Errorf("wrong records: want=%s got=%s", want, got)
+	}
+}
+
+func TestImportLinesOffsets(t *testing.T) {
+	logger := newTestLogger(t)
+	defer logger.Close()
+
+	// Records are length-prefixed, each starting with the number of
+	// seconds after base at which it was written.
+	base := time.Now().Add(time.Hour)
+	var buf bytes.Buffer
+	for _, rec := range []string{"1 one", "2 two", "4 four"} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(rec)))
+		buf.WriteString(rec)
+	}
+	offsetFn := func(rec []byte) (wal.Offset, error) {
+		secs, err := strconv.Atoi(string(bytes.Fields(rec)[0]))
+		if err != nil {
+			return wal.ZeroOffset, err
+		}
+		return wal.NewOffsetTime(base.Add(time.Duration(secs) * time.Second)), nil
+	}
+	n, err := ImportLines(&buf, logger, ScanLengthPrefixed, offsetFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("wrong number of records: want=3 got=%d", n)
+	}
+
+	// Records appended afterwards follow on from those imported.
+	off, err := logger.Append([]byte("five"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wal.NewOffsetTime(base.Add(4 * time.Second)); !off.After(want) {
+		t.Errorf("appended offset %v is not after the imported %v", off, want)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(readAll(t, logger)), "[1 one 2 two 4 four five]"; got != want {
+		t.Errorf("wrong records: want=%s got=%s", want, got)
+	}
+
+	// Importing records older than those written fails.
+	if _, err := ImportLines(strings.NewReader("3 three\n"), logger, nil, offsetFn); err == nil {
+		t.Error("imported a record older than those written")
+	}
+}
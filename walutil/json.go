@@ -0,0 +1,110 @@
+package walutil
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// JSONRecord is the form each data chunk takes when exported by ExportJSON.
+type JSONRecord struct {
+	Offset wal.Offset        `json:"offset"`
+	Time   time.Time         `json:"time"`
+	Data   []byte            `json:"data,omitempty"` // Base64-encoded, when marshalled.
+	Raw    *string           `json:"raw,omitempty"`  // Set instead of Data, with ExportOptions.Raw.
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+// ExportOptions configures ExportJSON.
+type ExportOptions struct {
+	// From is the offset to start exporting from. The zero value exports
+	// the whole log.
+	From wal.Offset
+
+	// Raw causes payloads that are valid UTF-8 to be written as-is, in
+	// a record's "raw" field, rather than base64-encoded in its "data"
+	// field. Payloads that are not valid UTF-8 are always base64-encoded.
+	Raw bool
+}
+
+// ExportJSON writes every data chunk in sink to w, as newline-delimited JSON
+// (one JSONRecord per line), oldest first. It returns the number of records
+// written.
+func ExportJSON(sink wal.Sink, w io.Writer, opts ExportOptions) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var n int
+	r := wal.NewReaderOffset(sink, opts.From)
+	for r.Next() {
+		rec := JSONRecord{
+			Offset: r.Offset(),
+			Time:   TimeOf(r.Offset()).UTC(),
+			Meta:   r.Attrs(),
+		}
+		if p := r.Data(); opts.Raw && utf8.Valid(p) {
+			s := string(p)
+			rec.Raw = &s
+		} else {
+			rec.Data = p
+		}
+		if err := enc.Encode(rec); err != nil {
+			return n, errors.Wrapf(err, "export record %v", r.Offset())
+		}
+		n++
+	}
+	if err := r.Error(); err != nil {
+		return n, errors.Wrap(err, "export")
+	}
+	if err := bw.Flush(); err != nil {
+		return n, errors.Wrap(err, "export")
+	}
+	return n, nil
+}
+
+// ImportJSON reads records, in the form written by ExportJSON, from r, and
+// appends their payloads to logger. It returns the number of records
+// imported.
+//
+// Records are assigned new offsets as they are appended. A record's "ttl"
+// attribute is preserved (relative to its new offset); other attributes are
+// not.
+func ImportJSON(logger *wal.Logger, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+
+	var n int
+	for {
+		var rec JSONRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, errors.Wrapf(err, "decode record %d", n)
+		}
+
+		p := rec.Data
+		if rec.Raw != nil {
+			p = []byte(*rec.Raw)
+		}
+
+		var err error
+		if ttl, ok := rec.Meta["ttl"]; ok {
+			var d int64
+			if d, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+				return n, errors.Wrapf(err, "parse ttl of record %v", rec.Offset)
+			}
+			_, err = logger.AppendTTL(p, time.Duration(d))
+		} else {
+			_, err = logger.Append(p)
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "import record %v", rec.Offset)
+		}
+		n++
+	}
+}
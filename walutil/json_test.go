@@ -0,0 +1,76 @@
+package walutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestExportImportJSON(t *testing.T) {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.AppendTTL([]byte{0xff, 0x00}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportJSON(sink, &buf, ExportOptions{Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("wrong number of records exported: want=2 got=%d", n)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of lines: want=2 got=%d", len(lines))
+	}
+	if !strings.Contains(lines[0], `"raw":"hello"`) {
+		t.Errorf("expected raw payload: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"data":"/wA="`) || !strings.Contains(lines[1], `"ttl":"3600000000000"`) {
+		t.Errorf("expected base64 payload with ttl: %s", lines[1])
+	}
+
+	imported := newTestLogger(t)
+	if n, err := ImportJSON(imported, &buf); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("wrong number of records imported: want=2 got=%d", n)
+	}
+	if err := imported.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := imported.NewReader()
+	var got [][]byte
+	for r.Next() {
+		got = append(got, append([]byte(nil), r.Data()...))
+		if len(got) == 2 {
+			if _, ok := r.Expiry(); !ok {
+				t.Error("expected imported record to keep its ttl")
+			}
+		}
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[0]) != "hello" || !bytes.Equal(got[1], []byte{0xff, 0x00}) {
+		t.Errorf("wrong records imported: %q", got)
+	}
+}
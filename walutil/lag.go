@@ -0,0 +1,65 @@
+package walutil
+
+import (
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// LagStats describes how far a reader is behind the newest data chunk in a
+// Sink, as returned by Lag.
+type LagStats struct {
+	Offsets int64         // The difference between the newest offset, and the reader's.
+	Time    time.Duration // Offsets, as the time between the data chunks being written.
+
+	// Bytes is the approximate size of the data chunks the reader has yet
+	// to read, or -1 if the Sink does not implement wal.SegmentLister. The
+	// data chunks in the segment the reader is part-way through are
+	// assumed to be the same size, and spread evenly over its offsets.
+	Bytes int64
+}
+
+// Lag returns how far a reader, that has read up to, and including, the data
+// chunk at readerOffset, is behind the newest data chunk in sink; for
+// example, to export a consumer's lag as a metric. A reader that has not read
+// any data chunks still in sink is behind by the whole log.
+func Lag(sink wal.Sink, readerOffset wal.Offset) (LagStats, error) {
+	lag := LagStats{Bytes: -1}
+	first, last := sink.Offsets()
+	if sink.NumSegments() == 0 || !last.After(readerOffset) {
+		if _, ok := sink.(wal.SegmentLister); ok {
+			lag.Bytes = 0
+		}
+		return lag, nil
+	}
+	off := readerOffset
+	if off.Before(first) {
+		off = first
+	}
+	lag.Offsets = int64(last - off)
+	lag.Time = Between(off, last)
+
+	lister, ok := sink.(wal.SegmentLister)
+	if !ok {
+		return lag, nil
+	}
+	stats, err := lister.ListSegments()
+	if err != nil {
+		return lag, errors.Wrap(err, "list segments")
+	}
+	lag.Bytes = 0
+	for _, st := range stats {
+		switch {
+		case !st.Last.After(readerOffset):
+			// Already read.
+		case readerOffset.Before(st.First):
+			lag.Bytes += st.PayloadBytes
+		default:
+			// The reader has read at least the first data chunk.
+			unread := float64(st.Chunks-1) * float64(st.Last-readerOffset) / float64(st.Last-st.First)
+			lag.Bytes += int64(unread * float64(st.PayloadBytes) / float64(st.Chunks))
+		}
+	}
+	return lag, nil
+}
@@ -0,0 +1,74 @@
+package walutil
+
+import (
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestLag(t *testing.T) {
+	sink, err := wal.NewDirectorySink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two segments, of two 10-byte data chunks each.
+	var offsets []wal.Offset
+	for i := 0; i < 4; i++ {
+		off, err := logger.Append([]byte("0123456789"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		if i%2 == 1 {
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		reader wal.Offset
+		from   wal.Offset
+		bytes  int64
+	}{
+		{"nothing read", wal.ZeroOffset, offsets[0], 40},
+		{"first segment read", offsets[1], offsets[1], 20},
+		{"everything read", offsets[3], offsets[3], 0},
+	} {
+		lag, err := Lag(sink, tc.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(offsets[3] - tc.from); lag.Offsets != want || lag.Time != time.Duration(want) {
+			t.Errorf("%s: want lag of %d, got %+v", tc.name, want, lag)
+		}
+		if lag.Bytes != tc.bytes {
+			t.Errorf("%s: want %d bytes behind, got %d", tc.name, tc.bytes, lag.Bytes)
+		}
+	}
+
+	// Part-way through a segment.
+	lag, err := Lag(sink, offsets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Bytes != 30 {
+		t.Errorf("want 30 bytes behind, got %d", lag.Bytes)
+	}
+
+	// Without segment statistics, the byte lag is unknown.
+	mem, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag, err := Lag(mem, wal.ZeroOffset); err != nil || lag.Bytes != -1 {
+		t.Errorf("want unknown byte lag, got %+v (err=%v)", lag, err)
+	}
+}
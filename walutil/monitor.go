@@ -0,0 +1,167 @@
+package walutil
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Metric identifies a quantity checked by Monitor.
+type Metric int
+
+const (
+	// SegmentRate is the number of segments written to the Sink per
+	// second.
+	SegmentRate Metric = iota
+
+	// ByteRate is the number of bytes of data chunks written to the Sink
+	// per second.
+	ByteRate
+
+	// TruncationLag is the age of the oldest data chunk in the Sink, in
+	// seconds; it grows when the log is not being truncated.
+	TruncationLag
+
+	// ReaderLag is how far the slowest reader is behind the newest data
+	// chunk in the Sink, in seconds.
+	ReaderLag
+)
+
+func (m Metric) String() string {
+	switch m {
+	case SegmentRate:
+		return "segment-rate"
+	case ByteRate:
+		return "byte-rate"
+	case TruncationLag:
+		return "truncation-lag"
+	case ReaderLag:
+		return "reader-lag"
+	}
+	return "unknown"
+}
+
+// Alert is passed to MonitorOptions.OnAlert when a metric exceeds its
+// threshold.
+type Alert struct {
+	Metric    Metric
+	Value     float64 // The metric's value.
+	Threshold float64 // The threshold it exceeded.
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("%s %.2f exceeds threshold %.2f", a.Metric, a.Value, a.Threshold)
+}
+
+// MonitorOptions configures Monitor. A threshold of zero disables the check
+// for its metric.
+type MonitorOptions struct {
+	// Interval is how often the metrics are checked. Rates are averaged
+	// over the interval. It must be positive.
+	Interval time.Duration
+
+	SegmentRate   float64       // Segments written per second.
+	ByteRate      float64       // Bytes of data chunks written per second.
+	TruncationLag time.Duration // Age of the oldest data chunk.
+	ReaderLag     time.Duration // How far ReaderOffset is behind the newest data chunk.
+
+	// ReaderOffset returns the offset of the last data chunk read by the
+	// slowest reader, such as one saved with SaveCursor. It is required
+	// if ReaderLag is set.
+	ReaderOffset func() wal.Offset
+
+	// OnAlert is called, from Monitor's goroutine, for each metric that
+	// exceeds its threshold when the metrics are checked. It is called
+	// on every check, for as long as the metric stays over its threshold.
+	OnAlert func(Alert)
+}
+
+// Monitor checks logger's metrics every opts.Interval, and calls
+// opts.OnAlert for each one that exceeds its threshold, so that an
+// application can alert when its write-ahead log is growing faster than it
+// is being consumed. It blocks until ctx is done, returning ctx's error, or
+// logger is closed, returning nil.
+//
+// Run Monitor in a *wal.Group, alongside the application's other background
+// goroutines; the context error it returns when the group is closed is not
+// reported:
+//
+//	g.Go("monitor", func(ctx context.Context) error {
+//		return walutil.Monitor(ctx, logger, walutil.MonitorOptions{
+//			Interval:      time.Minute,
+//			TruncationLag: 24 * time.Hour,
+//			OnAlert: func(a walutil.Alert) {
+//				log.Println("wal:", a)
+//			},
+//		})
+//	})
+func Monitor(ctx context.Context, logger *wal.Logger, opts MonitorOptions) error {
+	if opts.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if opts.OnAlert == nil {
+		return errors.New("nil alert function")
+	}
+	if opts.ReaderLag > 0 && opts.ReaderOffset == nil {
+		return errors.New("reader lag threshold set without a reader offset function")
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	m := &monitor{opts: opts, prev: logger.Stats(), at: time.Now()}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			st := logger.Stats()
+			if st.Closed {
+				return nil
+			}
+			m.check(st, now)
+		}
+	}
+}
+
+// monitor holds the state of a call to Monitor between checks.
+type monitor struct {
+	opts MonitorOptions
+	prev wal.Stats // The *Logger's statistics at the last check.
+	at   time.Time // When the last check was made.
+}
+
+// check compares the metrics derived from st, taken at now, to their
+// thresholds.
+func (m *monitor) check(st wal.Stats, now time.Time) {
+	if elapsed := now.Sub(m.at).Seconds(); elapsed > 0 {
+		m.alert(SegmentRate, float64(st.Written-m.prev.Written)/elapsed, m.opts.SegmentRate)
+		m.alert(ByteRate, float64(st.WrittenBytes-m.prev.WrittenBytes)/elapsed, m.opts.ByteRate)
+	}
+	m.prev, m.at = st, now
+
+	if st.Segments == 0 {
+		return
+	}
+	if m.opts.TruncationLag > 0 {
+		m.alert(TruncationLag, now.Sub(TimeOf(st.First)).Seconds(), m.opts.TruncationLag.Seconds())
+	}
+	if m.opts.ReaderLag > 0 {
+		// A reader that has not read anything is behind by the whole
+		// log.
+		off := m.opts.ReaderOffset()
+		if off.Before(st.First) {
+			off = st.First
+		}
+		m.alert(ReaderLag, Between(off, st.Last).Seconds(), m.opts.ReaderLag.Seconds())
+	}
+}
+
+// alert calls the alert function if threshold is set, and value exceeds it.
+func (m *monitor) alert(metric Metric, value, threshold float64) {
+	if threshold > 0 && value > threshold {
+		m.opts.OnAlert(Alert{Metric: metric, Value: value, Threshold: threshold})
+	}
+}
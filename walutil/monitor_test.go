@@ -0,0 +1,104 @@
+package walutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func TestMonitorCheck(t *testing.T) {
+	now := time.Now()
+	var alerts []Alert
+	m := &monitor{
+		opts: MonitorOptions{
+			SegmentRate:   1,
+			ByteRate:      1000,
+			TruncationLag: time.Hour,
+			ReaderLag:     time.Minute,
+			ReaderOffset:  func() wal.Offset { return OffsetAt(now.Add(-2 * time.Minute)) },
+			OnAlert:       func(a Alert) { alerts = append(alerts, a) },
+		},
+		at: now,
+	}
+
+	// 20 segments, and 10KB, written in 10 seconds, with data chunks
+	// from the last 30 minutes in the sink.
+	now = now.Add(10 * time.Second)
+	m.check(wal.Stats{
+		Segments:     20,
+		First:        OffsetAt(now.Add(-30 * time.Minute)),
+		Last:         OffsetAt(now),
+		Written:      20,
+		WrittenBytes: 10000,
+	}, now)
+
+	want := map[Metric]float64{SegmentRate: 2, ReaderLag: 120}
+	if len(alerts) != len(want) {
+		t.Fatalf("want %d alerts, got %v", len(want), alerts)
+	}
+	for _, a := range alerts {
+		if v, ok := want[a.Metric]; !ok || v != a.Value {
+			t.Errorf("unexpected alert: %v", a)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	logger := newTestLogger(t)
+	if _, err := logger.Append([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if st := logger.Stats(); st.Written != 1 || st.WrittenBytes == 0 {
+		t.Errorf("want 1 segment written, got %d (%d bytes)", st.Written, st.WrittenBytes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alerts := make(chan Alert, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- Monitor(ctx, logger, MonitorOptions{
+			Interval:      5 * time.Millisecond,
+			TruncationLag: time.Nanosecond,
+			OnAlert: func(a Alert) {
+				select {
+				case alerts <- a:
+				default:
+				}
+			},
+		})
+	}()
+
+	select {
+	case a := <-alerts:
+		if a.Metric != TruncationLag {
+			t.Errorf("wrong alert: %v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no alert")
+	}
+
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Monitor did not return after logger was closed")
+	}
+
+	if err := Monitor(ctx, logger, MonitorOptions{Interval: time.Second, ReaderLag: time.Second, OnAlert: func(Alert) {}}); err == nil {
+		t.Error("want error for reader lag without a reader offset function")
+	}
+}
@@ -0,0 +1,48 @@
+package walutil
+
+import (
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+// OffsetAt returns the offset of a data chunk written at time t.
+func OffsetAt(t time.Time) wal.Offset {
+	return wal.NewOffsetTime(t)
+}
+
+// TimeOf returns the time at which the data chunk at offset o was written.
+func TimeOf(o wal.Offset) time.Time {
+	return time.Unix(0, int64(o))
+}
+
+// OffsetRangeForDay returns the first, and last possible offsets for the
+// calendar day containing date, in date's location. The returned offsets
+// can be passed to a wal.Offset's Within method.
+func OffsetRangeForDay(date time.Time) (first, last wal.Offset) {
+	y, m, d := date.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, date.Location())
+	end := start.AddDate(0, 0, 1)
+	return OffsetAt(start), OffsetAt(end) - 1
+}
+
+// HumanizeOffset formats o as an RFC 3339 timestamp, in UTC, with
+// nanosecond precision. For example:
+//
+//	2017-01-01T00:00:00.123456789Z
+//
+func HumanizeOffset(o wal.Offset) string {
+	return TimeOf(o).UTC().Format(time.RFC3339Nano)
+}
+
+// AddDuration returns the offset that is d after o. A negative d returns an
+// offset before o.
+func AddDuration(o wal.Offset, d time.Duration) wal.Offset {
+	return o + wal.Offset(d)
+}
+
+// Between returns the amount of time elapsed between the offsets a, and b.
+// If b is before a, the returned duration is negative.
+func Between(a, b wal.Offset) time.Duration {
+	return time.Duration(b - a)
+}
@@ -0,0 +1,24 @@
+package walutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOffsetRangeForDay(t *testing.T) {
+	date := time.Date(2017, time.January, 1, 13, 37, 0, 0, time.UTC)
+	first, last := OffsetRangeForDay(date)
+
+	if got, want := HumanizeOffset(first), "2017-01-01T00:00:00Z"; got != want {
+		t.Errorf("wrong first offset: want=%s got=%s", want, got)
+	}
+	if got, want := HumanizeOffset(last), "2017-01-01T23:59:59.999999999Z"; got != want {
+		t.Errorf("wrong last offset: want=%s got=%s", want, got)
+	}
+	if !OffsetAt(date).Within(first, last) {
+		t.Errorf("offset for %v is not within %v..%v", date, first, last)
+	}
+	if d := Between(first, last+1); d != 24*time.Hour {
+		t.Errorf("wrong duration between offsets: want=%v got=%v", 24*time.Hour, d)
+	}
+}
@@ -0,0 +1,316 @@
+package walutil
+
+import (
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// QueueOptions configures a consumer created with a *Broker's Consume
+// method.
+type QueueOptions struct {
+	// VisibilityTimeout is how long a delivered message may go without
+	// being acknowledged, before it is delivered again.
+	// The default is 30 seconds.
+	VisibilityTimeout time.Duration
+
+	// MaxAttempts is the number of times a message is delivered before
+	// it is given up on, and written to DeadLetter. Zero means messages
+	// are redelivered until they are acknowledged.
+	MaxAttempts int
+
+	// DeadLetter is the logger that messages are written to after
+	// MaxAttempts unsuccessful deliveries. If nil, such messages are
+	// dropped.
+	DeadLetter *wal.Logger
+
+	// Prefetch is the maximum number of messages read from the log, and
+	// waiting to be delivered, at any one time. The default is 64.
+	Prefetch int
+}
+
+// Delivery is a message delivered by a *Broker's Consume method. Each
+// Delivery must be acknowledged with Ack, or rejected with Nack.
+type Delivery struct {
+	Message
+	Attempt int // The delivery attempt, starting at 1.
+
+	c *consumer
+}
+
+// Ack acknowledges the message as processed. It will not be delivered
+// again.
+func (d *Delivery) Ack() error {
+	return d.c.settle(d.Offset, true)
+}
+
+// Nack rejects the message, causing it to be redelivered (or written to the
+// dead-letter log, if it has reached the maximum number of attempts).
+func (d *Delivery) Nack() error {
+	return d.c.settle(d.Offset, false)
+}
+
+type settlement struct {
+	off wal.Offset
+	ack bool
+}
+
+// consumer holds the state of a subscriber created with Consume.
+//
+// All fields, other than settled, are owned by the consumer's run
+// goroutine.
+type consumer struct {
+	b       *Broker
+	name    string
+	opts    QueueOptions
+	ch      chan *Delivery
+	settled chan settlement
+
+	cursor   wal.Offset               // Offset all messages up to, and including, have been settled.
+	read     wal.Offset               // Offset of the last message read from the log.
+	ready    []*queued                // Messages waiting to be delivered.
+	inflight map[wal.Offset]*queued   // Messages delivered, but not settled.
+	expires  map[wal.Offset]time.Time // When each in-flight message becomes visible again.
+}
+
+// queued holds a message waiting to be delivered, or settled.
+type queued struct {
+	Message
+	attempts     int
+	deadLettered bool // Written to the dead-letter log, but not yet flushed.
+}
+
+// Consume is like Subscribe, but provides at-least-once delivery: each
+// Delivery must be acknowledged, and a message that is not acknowledged
+// within opts.VisibilityTimeout, or is rejected, is delivered again.
+//
+// The subscriber's persisted cursor only advances past a message once it,
+// and every message before it, has been acknowledged (or dead-lettered).
+// Messages that were delivered, but not acknowledged, before a restart are
+// delivered again, with their attempt counts reset.
+func (b *Broker) Consume(name string, opts QueueOptions) (<-chan *Delivery, error) {
+	if !validCursorName(name) {
+		return nil, errors.Errorf("invalid subscriber name %q", name)
+	}
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 30 * time.Second
+	}
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = 64
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	if b.subs[name] {
+		return nil, errors.Errorf("subscriber %q already subscribed", name)
+	}
+
+	cursor, err := loadCursor(b.cursorPath(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load cursor for %q", name)
+	}
+
+	c := &consumer{
+		b:        b,
+		name:     name,
+		opts:     opts,
+		ch:       make(chan *Delivery),
+		settled:  make(chan settlement),
+		cursor:   cursor,
+		read:     cursor,
+		inflight: make(map[wal.Offset]*queued),
+		expires:  make(map[wal.Offset]time.Time),
+	}
+	b.subs[name] = true
+	b.wg.Add(1)
+	go c.run()
+	return c.ch, nil
+}
+
+// settle passes an acknowledgement, or rejection, to the consumer's run
+// goroutine.
+func (c *consumer) settle(off wal.Offset, ack bool) error {
+	select {
+	case c.settled <- settlement{off: off, ack: ack}:
+		return nil
+	case <-c.b.done:
+		return ErrBrokerClosed
+	}
+}
+
+func (c *consumer) run() {
+	defer c.b.wg.Done()
+	defer close(c.ch)
+
+	tick := c.opts.VisibilityTimeout / 4
+	if tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var (
+		r         *wal.Reader
+		exhausted bool
+		wait      = c.b.wait()
+	)
+	for {
+		// Read more messages from the log, if there is room for them.
+		if !exhausted && len(c.ready) < c.opts.Prefetch {
+			if r == nil {
+				r = c.b.logger.NewReaderOffset(c.read + 1)
+			}
+			for len(c.ready) < c.opts.Prefetch && r.Next() {
+				c.read = r.Offset()
+				c.ready = append(c.ready, &queued{
+					Message: Message{
+						Offset: r.Offset(),
+						Data:   append([]byte(nil), r.Data()...),
+					},
+				})
+			}
+			if len(c.ready) < c.opts.Prefetch {
+				exhausted = true
+			}
+			if err := r.Error(); err != nil {
+				c.b.onError(errors.Wrapf(err, "read messages for %q", c.name))
+				r = nil
+			}
+		}
+
+		var (
+			out  chan<- *Delivery
+			next *Delivery
+		)
+		if len(c.ready) > 0 {
+			q := c.ready[0]
+			out = c.ch
+			next = &Delivery{Message: q.Message, Attempt: q.attempts + 1, c: c}
+		}
+
+		select {
+		case out <- next:
+			q := c.ready[0]
+			c.ready = c.ready[1:]
+			q.attempts++
+			c.inflight[q.Offset] = q
+			c.expires[q.Offset] = time.Now().Add(c.opts.VisibilityTimeout)
+
+		case s := <-c.settled:
+			c.handle(s)
+
+		case now := <-ticker.C:
+			for off, t := range c.expires {
+				if now.After(t) {
+					c.retry(c.inflight[off])
+				}
+			}
+
+		case <-wait:
+			exhausted = false
+			wait = c.b.wait()
+
+		case <-c.b.done:
+			return
+		}
+	}
+}
+
+// handle processes an acknowledgement, or rejection, of a message.
+func (c *consumer) handle(s settlement) {
+	q, ok := c.inflight[s.off]
+	if !ok {
+		// The message has already been settled, or timed out and is
+		// waiting to be delivered again; an acknowledgement still
+		// counts.
+		if s.ack {
+			for i := range c.ready {
+				if c.ready[i].Offset == s.off {
+					c.ready = append(c.ready[:i], c.ready[i+1:]...)
+					c.commit()
+					break
+				}
+			}
+		}
+		return
+	}
+
+	if s.ack {
+		c.remove(q)
+		return
+	}
+	c.retry(q)
+}
+
+// retry makes an in-flight message available for delivery again, or
+// dead-letters it if it has been delivered the maximum number of times.
+func (c *consumer) retry(d *queued) {
+	if c.opts.MaxAttempts > 0 && d.attempts >= c.opts.MaxAttempts {
+		if c.opts.DeadLetter != nil {
+			// The message must be durable in the dead-letter log
+			// before the cursor moves past it.
+			if err := c.deadLetter(d); err != nil {
+				// Keep the message, rather than lose it.
+				c.b.onError(errors.Wrapf(err, "dead-letter message %v for %q", d.Offset, c.name))
+				delete(c.expires, d.Offset)
+				delete(c.inflight, d.Offset)
+				c.ready = append(c.ready, d)
+				return
+			}
+		}
+		c.remove(d)
+		return
+	}
+
+	delete(c.expires, d.Offset)
+	delete(c.inflight, d.Offset)
+	c.ready = append(c.ready, d)
+}
+
+// deadLetter writes d to the dead-letter log, and flushes it. If the flush
+// fails, d is not written again on the next attempt; only the flush is
+// retried.
+func (c *consumer) deadLetter(d *queued) error {
+	if !d.deadLettered {
+		if _, err := c.opts.DeadLetter.Write(d.Data); err != nil {
+			return err
+		}
+		d.deadLettered = true
+	}
+	return c.opts.DeadLetter.Flush()
+}
+
+// remove settles an in-flight message for good, and advances the cursor.
+func (c *consumer) remove(d *queued) {
+	delete(c.expires, d.Offset)
+	delete(c.inflight, d.Offset)
+	c.commit()
+}
+
+// commit advances the persisted cursor to just before the oldest message
+// that has not been settled.
+func (c *consumer) commit() {
+	cursor := c.read
+	for off := range c.inflight {
+		if off-1 < cursor {
+			cursor = off - 1
+		}
+	}
+	for _, d := range c.ready {
+		if d.Offset-1 < cursor {
+			cursor = d.Offset - 1
+		}
+	}
+	if cursor <= c.cursor {
+		return
+	}
+
+	c.cursor = cursor
+	if err := saveCursor(c.b.cursorPath(c.name), cursor); err != nil {
+		c.b.onError(errors.Wrapf(err, "save cursor for %q", c.name))
+	}
+}
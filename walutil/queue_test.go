@@ -0,0 +1,85 @@
+package walutil
+
+import (
+	"testing"
+	"time"
+)
+
+func receiveDelivery(t *testing.T, ch <-chan *Delivery) *Delivery {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	return nil
+}
+
+func TestBrokerConsume(t *testing.T) {
+	logger := newTestLogger(t)
+	deadLetter := newTestLogger(t)
+	dir := t.TempDir()
+
+	broker, err := NewBroker(logger, dir, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := broker.Publish([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveries, err := broker.Consume("worker", QueueOptions{
+		VisibilityTimeout: 50 * time.Millisecond,
+		MaxAttempts:       2,
+		DeadLetter:        deadLetter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Acknowledge "a", reject "b", and let "c" time out.
+	seen := map[string]int{}
+	for len(seen) < 3 || seen["b"] < 2 || seen["c"] < 2 {
+		d := receiveDelivery(t, deliveries)
+		seen[string(d.Data)] = d.Attempt
+		switch string(d.Data) {
+		case "a":
+			if err := d.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		case "b":
+			if err := d.Nack(); err != nil {
+				t.Fatal(err)
+			}
+		case "c":
+			if d.Attempt == 2 {
+				if err := d.Ack(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if seen["a"] != 1 {
+		t.Errorf("acknowledged message delivered %d times", seen["a"])
+	}
+
+	// "b" should end up in the dead-letter log, flushed to its sink.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := deadLetter.NewReader()
+		if r.Next() {
+			if got := string(r.Data()); got != "b" {
+				t.Errorf("wrong dead-lettered message: want=%q got=%q", "b", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
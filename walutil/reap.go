@@ -0,0 +1,41 @@
+package walutil
+
+import (
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Reap removes expired data chunks from the start of logger's log, by
+// truncating the log up to, and including, the newest chunk in the longest
+// run of expired chunks. It returns the offset the log was truncated at,
+// or wal.ZeroOffset if there was nothing to remove.
+//
+// Data chunks written with a TTL (see the wal.Logger's AppendTTL method)
+// expire once their TTL has passed. Data chunks written without a TTL never
+// expire, so reaping stops at the first such chunk.
+//
+// Only data chunks that have been written to logger's Sink are considered.
+func Reap(logger *wal.Logger) (wal.Offset, error) {
+	now := wal.NewOffset()
+	last := wal.ZeroOffset
+
+	r := logger.NewReader()
+	for r.Next() {
+		exp, ok := r.Expiry()
+		if !ok || exp.After(now) {
+			break
+		}
+		last = r.Offset()
+	}
+	if err := r.Error(); err != nil {
+		return wal.ZeroOffset, errors.Wrap(err, "reap")
+	}
+
+	if last == wal.ZeroOffset {
+		return wal.ZeroOffset, nil
+	}
+	if err := logger.Truncate(last); err != nil {
+		return wal.ZeroOffset, errors.Wrap(err, "reap")
+	}
+	return last, nil
+}
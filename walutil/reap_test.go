@@ -0,0 +1,52 @@
+package walutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	logger := newTestLogger(t)
+
+	for i := 0; i < 3; i++ {
+		if _, err := logger.AppendTTL([]byte("ephemeral"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keep, err := logger.Append([]byte("durable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.AppendTTL([]byte("ephemeral"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if _, err := Reap(logger); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := logger.Offsets(); first != keep {
+		t.Errorf("wrong first offset after reaping: want=%v got=%v", keep, first)
+	}
+
+	// Expired chunks after the durable one are skipped by readers that
+	// ask for it.
+	r := logger.NewReader()
+	r.SkipExpired()
+	var n int
+	for r.Next() {
+		if got := string(r.Data()); got != "durable" {
+			t.Errorf("read unexpected chunk %q", got)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("wrong number of chunks: want=%d got=%d", 1, n)
+	}
+}
@@ -0,0 +1,110 @@
+package walutil
+
+import (
+	"crypto/sha256"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// Tier is one of the Sinks a log is kept in, along with how long its data
+// chunks are kept there; see ApplyRetention.
+type Tier struct {
+	Name   string        // Identifies the tier in errors.
+	Sink   wal.Sink      // Holds the tier's data chunks.
+	MaxAge time.Duration // How long data chunks are kept in Sink; zero keeps them forever.
+}
+
+// ApplyRetention truncates each of tiers, hottest first (such as a
+// DirectorySink on a local disk, followed by one on an archival mount),
+// removing the data chunks older than the tier's MaxAge, and returns the
+// offset each tier was truncated at, or wal.ZeroOffset if nothing was
+// removed from it.
+//
+// Data chunks are copied from one tier to the next by the application (for
+// example, with a wal.ShadowSink); ApplyRetention only removes a data chunk
+// from a tier once it has verified that the next tier holds a copy of it,
+// with the same data, so that nothing is lost if the copy has fallen
+// behind, or failed. Verification stops at the first data
+// chunk that has not been copied, and the tier is truncated no further.
+// The coldest tier's data chunks are removed once they are old enough.
+func ApplyRetention(tiers ...Tier) ([]wal.Offset, error) {
+	return applyRetention(time.Now(), tiers)
+}
+
+// applyRetention implements ApplyRetention, with now as the current time.
+func applyRetention(now time.Time, tiers []Tier) ([]wal.Offset, error) {
+	truncated := make([]wal.Offset, len(tiers))
+	for i, tier := range tiers {
+		if tier.MaxAge <= 0 {
+			continue
+		}
+		cutoff := wal.NewOffsetTime(now.Add(-tier.MaxAge))
+		var (
+			off wal.Offset
+			err error
+		)
+		if i == len(tiers)-1 {
+			off, err = newestBefore(tier.Sink, cutoff)
+		} else {
+			off, err = copiedBefore(tier.Sink, tiers[i+1].Sink, cutoff)
+		}
+		if err != nil {
+			return truncated, errors.Wrapf(err, "tier %s", tier.Name)
+		}
+		if off == wal.ZeroOffset {
+			continue
+		}
+		if err := tier.Sink.Truncate(off); err != nil {
+			return truncated, errors.Wrapf(err, "tier %s: truncate", tier.Name)
+		}
+		truncated[i] = off
+	}
+	return truncated, nil
+}
+
+// newestBefore returns the offset of the newest data chunk in sink that is
+// older than cutoff, or wal.ZeroOffset if there is none.
+func newestBefore(sink wal.Sink, cutoff wal.Offset) (wal.Offset, error) {
+	var last wal.Offset
+	r := wal.NewReader(sink)
+	for r.Next() && r.Offset().Before(cutoff) {
+		last = r.Offset()
+	}
+	if err := r.Error(); err != nil {
+		return wal.ZeroOffset, errors.Wrap(err, "read")
+	}
+	return last, nil
+}
+
+// copiedBefore is like newestBefore, but stops at the first data chunk in
+// sink that next does not hold a copy of.
+func copiedBefore(sink, next wal.Sink, cutoff wal.Offset) (wal.Offset, error) {
+	var last wal.Offset
+	r := wal.NewReader(sink)
+	if !r.Next() || !r.Offset().Before(cutoff) {
+		return wal.ZeroOffset, errors.Wrap(r.Error(), "read")
+	}
+	rn := wal.NewReaderOffset(next, r.Offset())
+	okN := rn.Next()
+	for {
+		for okN && rn.Offset().Before(r.Offset()) {
+			okN = rn.Next()
+		}
+		if !okN || rn.Offset() != r.Offset() || sha256.Sum256(rn.Data()) != sha256.Sum256(r.Data()) {
+			break
+		}
+		last = r.Offset()
+		if !r.Next() || !r.Offset().Before(cutoff) {
+			break
+		}
+	}
+	if err := r.Error(); err != nil {
+		return wal.ZeroOffset, errors.Wrap(err, "read")
+	}
+	if err := rn.Error(); err != nil {
+		return wal.ZeroOffset, errors.Wrap(err, "read next tier")
+	}
+	return last, nil
+}
@@ -0,0 +1,62 @@
+package walutil
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+func offsets(t *testing.T, sink wal.Sink) []wal.Offset {
+	t.Helper()
+	var offs []wal.Offset
+	r := wal.NewReader(sink)
+	for r.Next() {
+		offs = append(offs, r.Offset())
+	}
+	if err := r.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return offs
+}
+
+func TestApplyRetention(t *testing.T) {
+	// The archive is missing the data chunk at 4, and holds different
+	// data at 6, so the local tier cannot be truncated past 3.
+	local := newDiffSink(t, []int{1, 2, 3, 4, 5, 6, 7}, "abcdefg")
+	archive := newDiffSink(t, []int{1, 2, 3, 5, 6}, "abceX")
+
+	now := time.Unix(0, 10)
+	tiers := []Tier{
+		{Name: "local", Sink: local, MaxAge: 4},     // Keeps 6, and newer.
+		{Name: "archive", Sink: archive, MaxAge: 8}, // Keeps 2, and newer.
+	}
+	got, err := applyRetention(now, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[3 1]"; fmt.Sprint(got) != want {
+		t.Errorf("wrong truncation offsets: want=%s got=%v", want, got)
+	}
+	if want := "[4 5 6 7]"; fmt.Sprint(offsets(t, local)) != want {
+		t.Errorf("wrong local offsets: want=%s got=%v", want, offsets(t, local))
+	}
+	if want := "[2 3 5 6]"; fmt.Sprint(offsets(t, archive)) != want {
+		t.Errorf("wrong archive offsets: want=%s got=%v", want, offsets(t, archive))
+	}
+
+	// Once the archive has caught up, the local tier is truncated as far
+	// as its MaxAge allows. A tier without a MaxAge is never truncated.
+	caughtUp := newDiffSink(t, []int{4, 5, 6, 7}, "defg")
+	tiers[1] = Tier{Name: "archive", Sink: caughtUp}
+	if got, err = applyRetention(now, tiers); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[5 0]"; fmt.Sprint(got) != want {
+		t.Errorf("wrong truncation offsets: want=%s got=%v", want, got)
+	}
+	if want := "[6 7]"; fmt.Sprint(offsets(t, local)) != want {
+		t.Errorf("wrong local offsets: want=%s got=%v", want, offsets(t, local))
+	}
+}
@@ -0,0 +1,107 @@
+package walutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// FormatFunc writes a single data chunk to w, for Tail.
+type FormatFunc func(w io.Writer, o wal.Offset, data []byte) error
+
+// FormatLine is a FormatFunc that writes a data chunk's offset, as formatted
+// by HumanizeOffset, and its data (quoted, if it is not printable), on a
+// single line:
+//
+//	2017-01-01T00:00:00.123456789Z hello, wal
+//
+func FormatLine(w io.Writer, o wal.Offset, data []byte) error {
+	if isPrintable(data) {
+		_, err := fmt.Fprintf(w, "%s %s\n", HumanizeOffset(o), data)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %q\n", HumanizeOffset(o), data)
+	return err
+}
+
+func isPrintable(p []byte) bool {
+	if !utf8.Valid(p) {
+		return false
+	}
+	for _, r := range string(p) {
+		if unicode.IsControl(r) && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// tailPollInterval is how often Tail checks for new data chunks, when
+// following a sink.
+const tailPollInterval = 250 * time.Millisecond
+
+// Tail writes the last n data chunks in sink to w, oldest first, using
+// format (or FormatLine, if format is nil). If n is zero, or negative, every
+// data chunk is written.
+//
+// If follow is true, Tail continues to write data chunks as they are added
+// to sink, until ctx is done. Segments written to a DirectorySink by another
+// process are only seen after the sink's Analyze method is called.
+//
+// Finding the last n data chunks requires reading the whole log.
+func Tail(ctx context.Context, sink wal.Sink, n int, follow bool, w io.Writer, format FormatFunc) error {
+	if format == nil {
+		format = FormatLine
+	}
+
+	type record struct {
+		off  wal.Offset
+		data []byte
+	}
+	var (
+		r    = wal.NewReader(sink)
+		last []record
+	)
+	for r.Next() {
+		if n > 0 && len(last) == n {
+			copy(last, last[1:])
+			last = last[:n-1]
+		}
+		last = append(last, record{r.Offset(), append([]byte(nil), r.Data()...)})
+	}
+	if err := r.Error(); err != nil {
+		return errors.Wrap(err, "tail")
+	}
+	for _, rec := range last {
+		if err := format(w, rec.off, rec.data); err != nil {
+			return errors.Wrap(err, "tail")
+		}
+	}
+	if !follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		for r.Next() {
+			if err := format(w, r.Offset(), r.Data()); err != nil {
+				return errors.Wrap(err, "tail")
+			}
+		}
+		if err := r.Error(); err != nil {
+			return errors.Wrap(err, "tail")
+		}
+	}
+}
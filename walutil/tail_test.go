@@ -0,0 +1,108 @@
+package walutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	wal "go.nesv.ca/yawal"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTail(t *testing.T) {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := fmt.Fprintf(logger, "record %d", i); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	format := func(w io.Writer, o wal.Offset, data []byte) error {
+		_, err := fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := Tail(context.Background(), sink, 2, false, &buf, format); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "record 3\nrecord 4\n"; got != want {
+		t.Errorf("wrong output: want=%q got=%q", want, got)
+	}
+
+	// Follow the log, until new records show up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() { done <- Tail(ctx, sink, 1, true, &out, format) }()
+
+	waitFor := func(s string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), s) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out following log; output: %q", out.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("record 4")
+
+	if _, err := logger.Write([]byte("record 5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("record 5")
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if got, want := out.String(), "record 4\nrecord 5\n"; got != want {
+		t.Errorf("wrong output: want=%q got=%q", want, got)
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	var buf bytes.Buffer
+	if err := FormatLine(&buf, 0, []byte{0x00, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "1970-01-01T00:00:00Z \"\\x00x\"\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,42 @@
+package walutil
+
+import (
+	"bytes"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+// ErrReplayMismatch is returned by VerifyReplay when the digest of the
+// replayed state does not match the expected digest.
+var ErrReplayMismatch = errors.New("walutil: replayed state does not match digest")
+
+// VerifyReplay replays every data chunk in sink, oldest first, by calling
+// apply with each one, then calls digest to compute a digest of the
+// resulting state, and compares it to want. It returns the computed
+// digest, along with an error wrapping ErrReplayMismatch if it differs
+// from want.
+//
+// VerifyReplay is intended for tests, and CI jobs, that check that a state
+// machine materializes the same state from a recorded log every time. Pass
+// a nil want to compute the digest of a new recording.
+func VerifyReplay(sink wal.Sink, apply func(offset wal.Offset, data []byte) error, digest func() ([]byte, error), want []byte) ([]byte, error) {
+	r := wal.NewReader(sink)
+	for r.Next() {
+		if err := apply(r.Offset(), r.Data()); err != nil {
+			return nil, errors.Wrapf(err, "apply record %v", r.Offset())
+		}
+	}
+	if err := r.Error(); err != nil {
+		return nil, errors.Wrap(err, "replay")
+	}
+
+	got, err := digest()
+	if err != nil {
+		return nil, errors.Wrap(err, "digest")
+	}
+	if want != nil && !bytes.Equal(got, want) {
+		return got, errors.Wrapf(ErrReplayMismatch, "want=%x got=%x", want, got)
+	}
+	return got, nil
+}
@@ -0,0 +1,57 @@
+package walutil
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	wal "go.nesv.ca/yawal"
+	"go.nesv.ca/yawal/internal/errors"
+)
+
+func TestVerifyReplay(t *testing.T) {
+	sink, err := wal.NewMemorySink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := wal.New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := logger.Append([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state is the concatenation of every record.
+	replay := func(want []byte) ([]byte, error) {
+		var state strings.Builder
+		return VerifyReplay(sink, func(_ wal.Offset, p []byte) error {
+			state.Write(p)
+			return nil
+		}, func() ([]byte, error) {
+			sum := sha256.Sum256([]byte(state.String()))
+			return sum[:], nil
+		}, want)
+	}
+
+	golden, err := replay(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256([]byte("abc")); string(golden) != string(want[:]) {
+		t.Fatalf("wrong digest: want=%x got=%x", want, golden)
+	}
+	if _, err := replay(golden); err != nil {
+		t.Fatal(err)
+	}
+
+	other := sha256.Sum256([]byte("abd"))
+	if _, err := replay(other[:]); errors.Cause(err) != ErrReplayMismatch {
+		t.Errorf("want %v, got %v", ErrReplayMismatch, err)
+	}
+}